@@ -37,6 +37,7 @@
 package adminport
 
 import (
+	"crypto/tls"
 	"fmt"
 	base "github.com/couchbase/goxdcr/base"
 	"github.com/couchbase/goxdcr/log"
@@ -80,12 +81,23 @@ func NewHTTPServer(name, connAddr, urlPrefix string, reqch chan<- Request, handl
 	return s
 }
 
+// NewHTTPSServer creates an instance of admin-server that serves over tls,
+// with the specified tls config. Start() will actually start the server.
+func NewHTTPSServer(name, connAddr, urlPrefix string, reqch chan<- Request, handler RequestHandler, tlsConfig *tls.Config) Server {
+	s := NewHTTPServer(name, connAddr, urlPrefix, reqch, handler).(*httpServer)
+	s.srv.TLSConfig = tlsConfig
+	return s
+}
+
 // Start is part of Server interface.
 func (s *httpServer) Start() (err error) {
 
 	if s.lis, err = net.Listen("tcp", s.srv.Addr); err != nil {
 		return err
 	}
+	if s.srv.TLSConfig != nil {
+		s.lis = tls.NewListener(s.lis, s.srv.TLSConfig)
+	}
 
 	// Server routine
 	go func() {
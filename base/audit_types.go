@@ -40,7 +40,8 @@ type RemoteClusterRefEvent struct {
 
 type CreateReplicationEvent struct {
 	GenericReplicationEvent
-	FilterExpression string `json:"filter_expression,omitempty"`
+	FilterExpression    string `json:"filter_expression,omitempty"`
+	DocFilterExpression string `json:"doc_filter_expression,omitempty"`
 }
 
 type UpdateDefaultReplicationSettingsEvent struct {
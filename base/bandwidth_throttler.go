@@ -0,0 +1,138 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"sync"
+	"time"
+)
+
+/************************************
+/* struct BandwidthThrottler
+*************************************/
+
+// BandwidthThrottler limits the rate at which bytes are written to network.
+// A throttler can be shared by multiple writers, e.g., all outgoing nozzles of a replication,
+// in which case the limit applies to the total number of bytes written by all of them.
+// The rate is limited by both the limit of the writers themselves and the share of a global bandwidth budget
+// that has been allocated to the writers, whichever is lower
+type BandwidthThrottler struct {
+	// limit in bytes per second. 0 means no limit
+	limit int
+	// share of global bandwidth budget in bytes per second. 0 means that there is no global budget
+	share int
+	// the time when the bytes that have been reserved so far can all be written without exceeding limit
+	next time.Time
+	// closed, and replaced, when limit or share is changed, so that writers waiting under the old limit
+	// make their reservations again under the new one
+	changed_ch chan bool
+	lock       sync.Mutex
+}
+
+func NewBandwidthThrottler(limit int) *BandwidthThrottler {
+	return &BandwidthThrottler{limit: limit,
+		changed_ch: make(chan bool)}
+}
+
+func (throttler *BandwidthThrottler) Limit() int {
+	throttler.lock.Lock()
+	defer throttler.lock.Unlock()
+	return throttler.limit
+}
+
+func (throttler *BandwidthThrottler) SetLimit(limit int) {
+	throttler.lock.Lock()
+	defer throttler.lock.Unlock()
+	if throttler.limit != limit {
+		throttler.limit = limit
+		throttler.resetReservations()
+	}
+}
+
+func (throttler *BandwidthThrottler) Share() int {
+	throttler.lock.Lock()
+	defer throttler.lock.Unlock()
+	return throttler.share
+}
+
+func (throttler *BandwidthThrottler) SetShare(share int) {
+	throttler.lock.Lock()
+	defer throttler.lock.Unlock()
+	if throttler.share != share {
+		throttler.share = share
+		throttler.resetReservations()
+	}
+}
+
+// reservations made under the old limit do not delay writes under the new limit, including the writes
+// that are waiting at this point. always called with lock held
+func (throttler *BandwidthThrottler) resetReservations() {
+	throttler.next = time.Time{}
+	close(throttler.changed_ch)
+	throttler.changed_ch = make(chan bool)
+}
+
+// returns the lower of limit and share. 0 means no limit. always called with lock held
+func (throttler *BandwidthThrottler) effectiveLimit() int {
+	if throttler.limit <= 0 {
+		return throttler.share
+	}
+	if throttler.share <= 0 || throttler.limit < throttler.share {
+		return throttler.limit
+	}
+	return throttler.share
+}
+
+// reserves numOfBytes for writing. returns the time to wait before the bytes can be written,
+// and the channel that is closed when the reservation is dropped because of a change of limit
+func (throttler *BandwidthThrottler) reserve(numOfBytes int) (time.Duration, chan bool) {
+	throttler.lock.Lock()
+	defer throttler.lock.Unlock()
+
+	limit := throttler.effectiveLimit()
+	if limit <= 0 || numOfBytes <= 0 {
+		return 0, nil
+	}
+
+	now := time.Now()
+	// unused bandwidth in the past does not accumulate, to avoid bursts after idle periods
+	if throttler.next.Before(now) {
+		throttler.next = now
+	}
+	wait := throttler.next.Sub(now)
+	throttler.next = throttler.next.Add(time.Duration(int64(numOfBytes) * int64(time.Second) / int64(limit)))
+	return wait, throttler.changed_ch
+}
+
+// Wait blocks until numOfBytes can be written without exceeding limit, or until fin_ch is closed.
+// when limit or share is changed while waiting, the wait is re-computed under the new limit.
+// returns the time spent waiting
+func (throttler *BandwidthThrottler) Wait(numOfBytes int, fin_ch chan bool) time.Duration {
+	wait, changed_ch := throttler.reserve(numOfBytes)
+	if wait <= 0 {
+		return 0
+	}
+
+	start_time := time.Now()
+	for wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			wait = 0
+		case <-changed_ch:
+			timer.Stop()
+			wait, changed_ch = throttler.reserve(numOfBytes)
+		case <-fin_ch:
+			timer.Stop()
+			wait = 0
+		}
+	}
+	return time.Since(start_time)
+}
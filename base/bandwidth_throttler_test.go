@@ -0,0 +1,119 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBandwidthThrottlerEffectiveLimit(t *testing.T) {
+	tests := []struct {
+		limit    int
+		share    int
+		expected int
+	}{
+		{0, 0, 0},
+		{100, 0, 100},
+		{0, 200, 200},
+		{100, 200, 100},
+		{300, 200, 200},
+	}
+	for _, test := range tests {
+		throttler := NewBandwidthThrottler(test.limit)
+		throttler.SetShare(test.share)
+		if limit := throttler.effectiveLimit(); limit != test.expected {
+			t.Errorf("expected effective limit %v with limit %v and share %v, got %v", test.expected, test.limit, test.share, limit)
+		}
+	}
+}
+
+func TestBandwidthThrottlerReserve(t *testing.T) {
+	throttler := NewBandwidthThrottler(0)
+	if wait, _ := throttler.reserve(1000); wait != 0 {
+		t.Errorf("expected no wait without limit, got %v", wait)
+	}
+
+	throttler.SetLimit(1000)
+	if wait, _ := throttler.reserve(0); wait != 0 {
+		t.Errorf("expected no wait for 0 bytes, got %v", wait)
+	}
+	// the first write goes through, and the next one waits for the bytes of the first one to be written at 1000 bytes/s
+	if wait, _ := throttler.reserve(500); wait != 0 {
+		t.Errorf("expected no wait for first write, got %v", wait)
+	}
+	if wait, _ := throttler.reserve(500); wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("expected wait of about 500ms for second write, got %v", wait)
+	}
+
+	// reservations made under the old limit are dropped
+	throttler.SetLimit(2000)
+	if wait, _ := throttler.reserve(500); wait != 0 {
+		t.Errorf("expected no wait after limit change, got %v", wait)
+	}
+}
+
+func TestBandwidthThrottlerWaitStopsOnFinch(t *testing.T) {
+	throttler := NewBandwidthThrottler(1)
+	throttler.reserve(3600)
+
+	fin_ch := make(chan bool)
+	close(fin_ch)
+	if waited := throttler.Wait(1, fin_ch); waited > time.Second {
+		t.Errorf("expected Wait to return once fin_ch is closed, waited %v", waited)
+	}
+}
+
+// writers waiting under a low limit are released when the limit is raised or removed
+func TestBandwidthThrottlerLimitUpdatedWhileWaiting(t *testing.T) {
+	for _, newLimit := range []int{0, 1000000} {
+		throttler := NewBandwidthThrottler(1)
+		// makes the next write wait for an hour under the current limit
+		throttler.reserve(3600)
+
+		done_ch := make(chan time.Duration)
+		go func() {
+			done_ch <- throttler.Wait(100, make(chan bool))
+		}()
+
+		// let the writer start waiting
+		time.Sleep(50 * time.Millisecond)
+		throttler.SetLimit(newLimit)
+
+		select {
+		case waited := <-done_ch:
+			if waited > 5*time.Second {
+				t.Errorf("expected writer to be released after limit was changed to %v, waited %v", newLimit, waited)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("writer is still waiting after limit was changed to %v", newLimit)
+		}
+	}
+}
+
+func TestBandwidthThrottlerShareUpdatedWhileWaiting(t *testing.T) {
+	throttler := NewBandwidthThrottler(0)
+	throttler.SetShare(1)
+	throttler.reserve(3600)
+
+	done_ch := make(chan time.Duration)
+	go func() {
+		done_ch <- throttler.Wait(100, make(chan bool))
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	throttler.SetShare(1000000)
+
+	select {
+	case <-done_ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("writer is still waiting after share was raised")
+	}
+}
@@ -33,6 +33,7 @@ var NodesSelfPath = "/nodes/self"
 var SSLPortsPath = "/nodes/self/xdcrSSLPorts"
 var NodeServicesPath = "/pools/default/nodeServices"
 var BPath = "/pools/default/b/"
+var DefaultPoolTasksPath = "/pools/default/tasks"
 
 // constants for CAPI nozzle
 var RevsDiffPath = "/_revs_diff"
@@ -106,8 +107,10 @@ var ShortHttpTimeout = 20 * time.Second
 type XDCROutgoingNozzleType int
 
 const (
-	Xmem XDCROutgoingNozzleType = iota
-	Capi XDCROutgoingNozzleType = iota
+	Xmem    XDCROutgoingNozzleType = iota
+	Capi    XDCROutgoingNozzleType = iota
+	File    XDCROutgoingNozzleType = iota
+	Webhook XDCROutgoingNozzleType = iota
 )
 
 const (
@@ -115,6 +118,7 @@ const (
 	CHECKPOINT_MGR_SVC         string = "CheckpointManager"
 	STATISTICS_MGR_SVC         string = "StatisticsManager"
 	TOPOLOGY_CHANGE_DETECT_SVC string = "TopologyChangeDetectSvc"
+	CONFLICT_LOGGER_SVC        string = "ConflictLogger"
 )
 
 // supervisor related constants
@@ -238,8 +242,10 @@ const (
 	ReplicationDocPauseRequested       = "pause_requested"
 	ReplicationDocPauseRequestedOutput = "pauseRequested"
 
-	ReplicationDocTypeXmem = "xdc-xmem"
-	ReplicationDocTypeCapi = "xdc"
+	ReplicationDocTypeXmem    = "xdc-xmem"
+	ReplicationDocTypeCapi    = "xdc"
+	ReplicationDocTypeFile    = "xdc-file"
+	ReplicationDocTypeWebhook = "xdc-webhook"
 )
 
 // constant used in replication info to ensure compatibility with erlang xdcr
@@ -267,14 +273,33 @@ var EventChanSize = 10000
 // number of async listeners [for an event type]
 var MaxNumberOfAsyncListeners = 4
 
+// the number of conflict records that can be waiting to be written to conflict log destination.
+// records beyond it are dropped from the destination, but are still kept as recent records
+var ConflictLogQueueSize = 10000
+
+// the number of the most recent conflict records that are kept in memory for each replication
+var ConflictLogRecentRecordsSize = 1000
+
+// prefix of the keys of conflict records written to conflict log bucket
+var ConflictLogDocKeyPrefix = "_xdcr_conflict"
+
+// the maximum number of documents that can be kept in the dead-letter queue of each replication
+var DeadLetterQueueMaxCount = 10000
+
+// the maximum total size, in bytes, of the documents kept in the dead-letter queue of each replication.
+// documents beyond it are still recorded, but without their bodies, and cannot be re-driven
+var DeadLetterQueueMaxSize = 100 * 1024 * 1024
+
 // names of async component event listeners
 const (
-	DataReceivedEventListener    = "DataReceivedEventListener"
-	DataProcessedEventListener   = "DataProcessedEventListener"
-	DataFilteredEventListener    = "DataFilteredEventListener"
-	DataSentEventListener        = "DataSentEventListener"
-	DataFailedCREventListener    = "DataFailedCREventListener"
-	GetMetaReceivedEventListener = "GetMetaReceivedEventListener"
+	DataReceivedEventListener     = "DataReceivedEventListener"
+	DataProcessedEventListener    = "DataProcessedEventListener"
+	DataFilteredEventListener     = "DataFilteredEventListener"
+	DataSentEventListener         = "DataSentEventListener"
+	DataFailedCREventListener     = "DataFailedCREventListener"
+	GetMetaReceivedEventListener  = "GetMetaReceivedEventListener"
+	DataDeduplicatedEventListener = "DataDeduplicatedEventListener"
+	DataDeadLetteredEventListener = "DataDeadLetteredEventListener"
 )
 
 const (
@@ -310,6 +335,7 @@ const (
 	PermissionBucketXDCRReadSuffix    = "].xdcr!read"
 	PermissionBucketXDCRWriteSuffix   = "].xdcr!write"
 	PermissionBucketXDCRExecuteSuffix = "].xdcr!execute"
+	PermissionBucketDataReadSuffix    = "].data.docs!read"
 	PermissionXDCRInternalRead        = "cluster.admin.internal.xdcr!read"
 	PermissionXDCRInternalWrite       = "cluster.admin.internal.xdcr!write"
 )
@@ -326,9 +352,21 @@ var UnexpectedEOF = "unexpected EOF"
 // flag for memcached to enable lww to lww bucket replication
 var FORCE_ACCEPT_WITH_META_OPS uint32 = 0x02
 
+// flag for memcached to write a document without resolving conflicts with the existing version on target
+var SKIP_CONFLICT_RESOLUTION_FLAG uint32 = 0x08
+
 // read/write timeout for helo command to memcached
 var HELOTimeout time.Duration = time.Duration(120) * time.Second
 
+// features that can be requested through helo command to memcached
+const (
+	HELOFeatureTCPNoDelay uint16 = 0x03
+	HELOFeatureSnappy     uint16 = 0x0a
+)
+
+// datatype flag for document bodies that have been compressed with snappy
+const SnappyDataType uint8 = 0x02
+
 // minimum versions where various features are supported
 var VersionForSSLOverMemSupport = []int{3, 0}
 var VersionForSANInCertificateSupport = []int{4, 0}
@@ -338,6 +376,23 @@ var VersionForRBACSupport = []int{5, 0}
 var GoxdcrUserAgentPrefix = "couchbase-goxdcr"
 var GoxdcrUserAgent = ""
 
+// root directory under which file replications export mutations and replay nozzles read them. it is set by admin
+// through the archiveRootDir command line option. export and replay directories of replications need to be under it,
+// and file export and replay are not available when it is not set
+var ArchiveRootDir = ""
+
+// modes of replication cycle check. cycles are looked for among the replications of the local cluster
+// and of the remote clusters that the local cluster has references to, i.e., the clusters it knows.
+// cycles through clusters that the local cluster does not know, e.g., A -> B -> C -> A when A knows only B, are not found
+const (
+	// replication cycles are not checked
+	KnownClustersCycleCheckModeOff = 0
+	// a warning is logged when a new replication creates a replication cycle
+	KnownClustersCycleCheckModeWarn = 1
+	// creation of a replication that creates a replication cycle is refused
+	KnownClustersCycleCheckModeRefuse = 2
+)
+
 // --------------- Constants that are configurable -----------------
 
 // timeout for checkpointing attempt before pipeline is stopped - to put an upper bound on the delay of pipeline stop/restart
@@ -369,10 +424,18 @@ var CapiDataChanSizeMultiplier = 1
 // interval for refreshing remote cluster references
 var RefreshRemoteClusterRefInterval = 15 * time.Second
 
+// what to do when a new replication creates a replication cycle through known clusters that is longer than
+// a simple bidirectional pair
+var KnownClustersCycleCheckMode = KnownClustersCycleCheckModeWarn
+
+// the time budget for querying known remote clusters for their replications in replication cycle check.
+// remote clusters that do not respond in time are left out of the check
+var CycleCheckRemoteQueryTimeout = 5 * time.Second
+
 func InitConstants(topologyChangeCheckInterval time.Duration, maxTopologyChangeCountBeforeRestart,
 	maxTopologyStableCountBeforeRestart, maxWorkersForCheckpointing int,
 	timeoutCheckpointBeforeStop time.Duration, capiDataChanSizeMultiplier int,
-	refreshRemoteClusterRefInterval time.Duration, clusterVersion string) {
+	refreshRemoteClusterRefInterval time.Duration, knownClustersCycleCheckMode int, clusterVersion string) {
 	TopologyChangeCheckInterval = topologyChangeCheckInterval
 	MaxTopologyChangeCountBeforeRestart = maxTopologyChangeCountBeforeRestart
 	MaxTopologyStableCountBeforeRestart = maxTopologyStableCountBeforeRestart
@@ -380,6 +443,7 @@ func InitConstants(topologyChangeCheckInterval time.Duration, maxTopologyChangeC
 	TimeoutCheckpointBeforeStop = timeoutCheckpointBeforeStop
 	CapiDataChanSizeMultiplier = capiDataChanSizeMultiplier
 	RefreshRemoteClusterRefInterval = refreshRemoteClusterRefInterval
+	KnownClustersCycleCheckMode = knownClustersCycleCheckMode
 	if len(clusterVersion) > 0 {
 		GoxdcrUserAgent = GoxdcrUserAgentPrefix + KeyPartsDelimiter + clusterVersion
 	} else {
@@ -0,0 +1,193 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"github.com/couchbase/gomemcached"
+	"sync"
+	"time"
+)
+
+// a document that has been rejected by target with a permanent error
+type DeadLetter struct {
+	Id  uint64 `json:"id"`
+	Key string `json:"key"`
+	// source vbucket and seqno of the document
+	VBucket uint16 `json:"vb"`
+	Seqno   uint64 `json:"seqno"`
+	// the error status returned by target
+	Status string `json:"status"`
+	// when the document was rejected
+	Time time.Time `json:"time"`
+	// size of the request sent to target
+	Size int `json:"size"`
+	// whether the request is kept, and hence the document can be re-driven
+	Redrivable bool `json:"redrivable"`
+
+	req *gomemcached.MCRequest
+}
+
+// returns a copy of the request that was rejected, or nil when the request is not kept
+func (letter *DeadLetter) Request() *gomemcached.MCRequest {
+	if letter.req == nil {
+		return nil
+	}
+	return copyMCRequest(letter.req)
+}
+
+/************************************
+/* struct DeadLetterQueue
+*************************************/
+
+// DeadLetterQueue keeps the documents of a replication that target has rejected permanently,
+// e.g., for being too big, so that replication can move on and the documents can be looked at, re-driven
+// or discarded later. The queue is shared by the outgoing nozzles of the replication.
+// Documents are kept in memory only and are lost when goxdcr restarts
+type DeadLetterQueue struct {
+	letters  []*DeadLetter
+	next_id  uint64
+	size     int
+	maxCount int
+	maxSize  int
+	lock     sync.RWMutex
+}
+
+func NewDeadLetterQueue(maxCount, maxSize int) *DeadLetterQueue {
+	return &DeadLetterQueue{letters: make([]*DeadLetter, 0),
+		next_id:  1,
+		maxCount: maxCount,
+		maxSize:  maxSize,
+	}
+}
+
+// adds a rejected request to the queue, along with the source vbucket and seqno of the document.
+// the request is copied, except for its body, which is never modified after the request is constructed and can be shared.
+// when the queue is full, the oldest document is dropped to make room and is returned
+func (queue *DeadLetterQueue) Add(req *gomemcached.MCRequest, vbno uint16, seqno uint64, status gomemcached.Status) (*DeadLetter, *DeadLetter) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	var dropped *DeadLetter
+	if len(queue.letters) >= queue.maxCount && len(queue.letters) > 0 {
+		dropped = queue.letters[0]
+		queue.letters = queue.letters[1:]
+		if dropped.req != nil {
+			queue.size -= dropped.Size
+		}
+	}
+
+	letter := &DeadLetter{Id: queue.next_id,
+		Key:     string(req.Key),
+		VBucket: vbno,
+		Seqno:   seqno,
+		Status:  status.String(),
+		Time:    time.Now(),
+		Size:    req.Size(),
+	}
+	queue.next_id++
+	// documents beyond the size limit are recorded without their requests
+	if queue.size+letter.Size <= queue.maxSize {
+		letter.req = copyMCRequest(req)
+		letter.Redrivable = true
+		queue.size += letter.Size
+	}
+	queue.letters = append(queue.letters, letter)
+	return letter, dropped
+}
+
+// returns the documents in the queue, the oldest first
+func (queue *DeadLetterQueue) List() []*DeadLetter {
+	queue.lock.RLock()
+	defer queue.lock.RUnlock()
+
+	letters := make([]*DeadLetter, len(queue.letters))
+	copy(letters, queue.letters)
+	return letters
+}
+
+func (queue *DeadLetterQueue) Count() int {
+	queue.lock.RLock()
+	defer queue.lock.RUnlock()
+	return len(queue.letters)
+}
+
+// removes the documents with the specified ids from the queue and returns them. empty ids means all documents
+func (queue *DeadLetterQueue) Remove(ids []uint64) []*DeadLetter {
+	return queue.remove(ids, false)
+}
+
+// removes the re-drivable documents with the specified ids from the queue and returns them.
+// empty ids means all re-drivable documents
+func (queue *DeadLetterQueue) RemoveRedrivable(ids []uint64) []*DeadLetter {
+	return queue.remove(ids, true)
+}
+
+func (queue *DeadLetterQueue) remove(ids []uint64, redrivableOnly bool) []*DeadLetter {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	id_map := make(map[uint64]bool)
+	for _, id := range ids {
+		id_map[id] = true
+	}
+
+	removed := make([]*DeadLetter, 0)
+	kept := make([]*DeadLetter, 0, len(queue.letters))
+	for _, letter := range queue.letters {
+		if (len(ids) == 0 || id_map[letter.Id]) && (!redrivableOnly || letter.Redrivable) {
+			removed = append(removed, letter)
+			if letter.req != nil {
+				queue.size -= letter.Size
+			}
+		} else {
+			kept = append(kept, letter)
+		}
+	}
+	queue.letters = kept
+	return removed
+}
+
+// puts back documents that have been removed from the queue, e.g., when they could not be re-driven.
+// the documents are expected to be in the order of their ids, as returned by Remove and RemoveRedrivable
+func (queue *DeadLetterQueue) Restore(letters []*DeadLetter) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	// merge by ids so that the queue stays in the order in which documents were added
+	merged := make([]*DeadLetter, 0, len(queue.letters)+len(letters))
+	i, j := 0, 0
+	for i < len(queue.letters) || j < len(letters) {
+		if j >= len(letters) || (i < len(queue.letters) && queue.letters[i].Id < letters[j].Id) {
+			merged = append(merged, queue.letters[i])
+			i++
+		} else {
+			merged = append(merged, letters[j])
+			if letters[j].req != nil {
+				queue.size += letters[j].Size
+			}
+			j++
+		}
+	}
+	queue.letters = merged
+}
+
+func copyMCRequest(req *gomemcached.MCRequest) *gomemcached.MCRequest {
+	newReq := &gomemcached.MCRequest{Opcode: req.Opcode,
+		Cas:      req.Cas,
+		VBucket:  req.VBucket,
+		DataType: req.DataType,
+		Body:     req.Body,
+	}
+	newReq.Key = make([]byte, len(req.Key))
+	copy(newReq.Key, req.Key)
+	newReq.Extras = make([]byte, len(req.Extras))
+	copy(newReq.Extras, req.Extras)
+	return newReq
+}
@@ -49,6 +49,7 @@ func (pool *MCRequestPool) Put(req *WrappedMCRequest) {
 func (pool *MCRequestPool) cleanReq(req *WrappedMCRequest) *WrappedMCRequest {
 	req.Req = pool.cleanMCReq(req.Req)
 	req.Seqno = 0
+	req.SrcVBucket = 0
 	return req
 }
 
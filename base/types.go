@@ -86,6 +86,9 @@ type WrappedMCRequest struct {
 	Req        *gomemcached.MCRequest
 	Start_time time.Time
 	UniqueKey  string
+	// vbucket of the document on source, which Seqno belongs to. it is different from Req.VBucket,
+	// the vbucket of the document on target, when the document key has been rewritten
+	SrcVBucket uint16
 }
 
 func (req *WrappedMCRequest) ConstructUniqueKey() {
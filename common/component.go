@@ -44,6 +44,10 @@ const (
 	StatsUpdate ComponentEventType = iota
 	//received snapshot marker from dcp
 	SnapshotMarkerReceived ComponentEventType = iota
+	// data is not sent since a newer version of the same document is in the same batch
+	DataDeduplicated ComponentEventType = iota
+	// data is rejected by target with a permanent error and is moved to dead-letter queue
+	DataDeadLettered ComponentEventType = iota
 )
 
 type Event struct {
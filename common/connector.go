@@ -25,4 +25,6 @@ type Connector interface {
 	//add a node to its existing set of downstream nodes
 	AddDownStream (partId string, part Part) error
 	
+	//update settings of the connector at runtime, e.g., the filter expressions on routers
+	UpdateSettings (settings map[string]interface{}) error
 }
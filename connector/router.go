@@ -87,6 +87,11 @@ func (router *Router) AddDownStream(partId string, part common.Part) error {
 	return nil
 }
 
+// generic router has no settings that can be updated at runtime
+func (router *Router) UpdateSettings(settings map[string]interface{}) error {
+	return nil
+}
+
 // set or replace routing call back function.
 // this may be allowed when router is still running
 func (router *Router) SetRoutingCallBackFunc(routing_callback *Routing_Callback_Func) {
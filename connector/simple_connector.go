@@ -61,3 +61,8 @@ func (con *SimpleConnector) AddDownStream(partId string, part common.Part) error
 	return nil
 
 }
+
+// simple connector has no settings that can be updated at runtime
+func (con *SimpleConnector) UpdateSettings(settings map[string]interface{}) error {
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/couchbase/goxdcr/capi_utils"
 	"github.com/couchbase/goxdcr/common"
 	component "github.com/couchbase/goxdcr/component"
+	"github.com/couchbase/goxdcr/connector"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/metadata"
 	"github.com/couchbase/goxdcr/parts"
@@ -15,6 +16,7 @@ import (
 	"github.com/couchbase/goxdcr/pipeline_manager"
 	"github.com/couchbase/goxdcr/pipeline_svc"
 	"github.com/couchbase/goxdcr/pipeline_utils"
+	"github.com/couchbase/goxdcr/processor"
 	"github.com/couchbase/goxdcr/service_def"
 	"github.com/couchbase/goxdcr/service_impl"
 	"github.com/couchbase/goxdcr/simple_utils"
@@ -26,10 +28,14 @@ import (
 )
 
 const (
-	PART_NAME_DELIMITER     = "_"
-	DCP_NOZZLE_NAME_PREFIX  = "dcp"
-	XMEM_NOZZLE_NAME_PREFIX = "xmem"
-	CAPI_NOZZLE_NAME_PREFIX = "capi"
+	PART_NAME_DELIMITER        = "_"
+	DCP_NOZZLE_NAME_PREFIX     = "dcp"
+	REPLAY_NOZZLE_NAME_PREFIX  = "replay"
+	XMEM_NOZZLE_NAME_PREFIX    = "xmem"
+	CAPI_NOZZLE_NAME_PREFIX    = "capi"
+	FILE_NOZZLE_NAME_PREFIX    = "file"
+	WEBHOOK_NOZZLE_NAME_PREFIX = "webhook"
+	PROCESSOR_NAME_PREFIX      = "processor"
 )
 
 // errors
@@ -109,29 +115,33 @@ func (xdcrf *XDCRFactory) NewPipeline(topic string, progress_recorder common.Pip
 		return nil, err
 	}
 
-	username, password, certificate, sanInCertificate, err := targetClusterRef.MyCredentials()
-	if err != nil {
-		return nil, err
-	}
-	connStr, err := targetClusterRef.MyConnectionStr()
-	if err != nil {
-		return nil, err
-	}
-
-	targetBucketInfo, err := utils.GetBucketInfo(connStr, spec.TargetBucketName, username, password, certificate, sanInCertificate, xdcrf.logger)
-	if err != nil {
-		return nil, err
-	}
-
-	conflictResolutionType, err := utils.GetConflictResolutionTypeFromBucketInfo(spec.TargetBucketName, targetBucketInfo)
-	if err != nil {
-		return nil, err
-	}
-
 	// sourceCRMode is the conflict resolution mode to use when resolving conflicts for big documents at source side
 	// sourceCRMode is LWW if and only if target bucket is LWW enabled, so as to ensure that source side conflict
 	// resolution and target side conflict resolution yield consistent results
-	sourceCRMode := simple_utils.GetCRModeFromConflictResolutionTypeSetting(conflictResolutionType)
+	sourceCRMode := base.CRMode_RevId
+	var targetBucketInfo map[string]interface{}
+	// file and webhook replications do not write to target bucket and do not need to contact it
+	if spec.Settings.HasTargetBucket() {
+		username, password, certificate, sanInCertificate, err := targetClusterRef.MyCredentials()
+		if err != nil {
+			return nil, err
+		}
+		connStr, err := targetClusterRef.MyConnectionStr()
+		if err != nil {
+			return nil, err
+		}
+
+		targetBucketInfo, err = utils.GetBucketInfo(connStr, spec.TargetBucketName, username, password, certificate, sanInCertificate, xdcrf.logger)
+		if err != nil {
+			return nil, err
+		}
+
+		conflictResolutionType, err := utils.GetConflictResolutionTypeFromBucketInfo(spec.TargetBucketName, targetBucketInfo)
+		if err != nil {
+			return nil, err
+		}
+		sourceCRMode = simple_utils.GetCRModeFromConflictResolutionTypeSetting(conflictResolutionType)
+	}
 
 	xdcrf.logger.Infof("%v sourceCRMode=%v\n", topic, sourceCRMode)
 
@@ -154,26 +164,66 @@ func (xdcrf *XDCRFactory) NewPipeline(topic string, progress_recorder common.Pip
 	}
 	progress_recorder(fmt.Sprintf("%v target nozzles have been constructed", len(outNozzles)))
 
+	// outgoing nozzles share a throttler so that the bandwidth limit applies to the replication as a whole.
+	// the throttler is owned by pipeline manager, which also allocates to it a share of the global bandwidth budget
+	xdcrf.setBandwidthThrottler(outNozzles, pipeline_manager.BandwidthThrottler(topic, spec.Settings.BandwidthLimit))
+
+	err = xdcrf.setConflictResolver(outNozzles, spec, sourceCRMode)
+	if err != nil {
+		xdcrf.logger.Errorf("Error setting conflict resolver for %v. err=%v\n", topic, err)
+		return nil, err
+	}
+
+	// the dead-letter queue is owned by pipeline manager so that dead-lettered docs survive pipeline restarts
+	xdcrf.setDeadLetterQueue(outNozzles, pipeline_manager.DeadLetterQueue(topic))
+
 	// TODO construct queue parts. This will affect vbMap in router. may need an additional outNozzle -> downStreamPart/queue map in constructRouter
 
+	// insert processor parts between routers and outgoing nozzles if processors have been specified
+	processorParts, vbPartMap, err := xdcrf.constructProcessorParts(spec, outNozzles, vbNozzleMap, logger_ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(processorParts) > 0 {
+		progress_recorder(fmt.Sprintf("%v processor parts have been constructed", len(processorParts)))
+	}
+
+	// docs whose keys are rewritten may belong to any vbucket on target. routers need to know the number of
+	// target vbuckets to find them, and every router may route to every outgoing nozzle
+	keyTransformed := len(spec.Settings.KeyTransformRules) > 0
+	targetNumVBuckets := numOfVBuckets(target_kv_vb_map)
+
 	// connect parts
 	for _, sourceNozzle := range sourceNozzles {
-		vblist := sourceNozzle.(*parts.DcpNozzle).GetVBList()
-		downStreamParts := make(map[string]common.Part)
+		vblist := sourceNozzle.(parts.SourceNozzle).GetVBList()
+		targetNozzleIds := make(map[string]bool)
 		for _, vb := range vblist {
 			targetNozzleId, ok := vbNozzleMap[vb]
 			if !ok {
 				return nil, fmt.Errorf("Error constructing pipeline %v since there is no target nozzle for vb=%v", topic, vb)
 			}
+			targetNozzleIds[targetNozzleId] = true
+		}
+		if keyTransformed && targetNumVBuckets > 0 {
+			for targetNozzleId := range outNozzles {
+				targetNozzleIds[targetNozzleId] = true
+			}
+		}
 
+		downStreamParts := make(map[string]common.Part)
+		for targetNozzleId := range targetNozzleIds {
 			outNozzle, ok := outNozzles[targetNozzleId]
 			if !ok {
-				panic(fmt.Sprintf("%v There is no corresponding target nozzle for vb=%v, targetNozzleId=%v", topic, vb, targetNozzleId))
+				panic(fmt.Sprintf("%v There is no corresponding target nozzle for targetNozzleId=%v", topic, targetNozzleId))
+			}
+			if processorPart, ok := processorParts[targetNozzleId]; ok {
+				downStreamParts[processorPart.Id()] = processorPart
+			} else {
+				downStreamParts[targetNozzleId] = outNozzle
 			}
-			downStreamParts[targetNozzleId] = outNozzle
 		}
 
-		router, err := xdcrf.constructRouter(sourceNozzle.Id(), spec, downStreamParts, vbNozzleMap, sourceCRMode, logger_ctx)
+		router, err := xdcrf.constructRouter(sourceNozzle.Id(), spec, downStreamParts, vbPartMap, targetNumVBuckets, sourceCRMode, logger_ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -186,6 +236,7 @@ func (xdcrf *XDCRFactory) NewPipeline(topic string, progress_recorder common.Pip
 
 	xdcrf.registerAsyncListenersOnSources(pipeline, logger_ctx)
 	xdcrf.registerAsyncListenersOnTargets(pipeline, logger_ctx)
+	xdcrf.registerAsyncListenersOnProcessors(pipeline, processorParts, logger_ctx)
 
 	// initialize component event listener map in pipeline
 	pp.GetAllAsyncComponentEventListeners(pipeline)
@@ -271,12 +322,44 @@ func (xdcrf *XDCRFactory) registerAsyncListenersOnTargets(pipeline common.Pipeli
 		get_meta_received_event_listener := component.NewDefaultAsyncComponentEventListenerImpl(
 			pipeline_utils.GetElementIdFromNameAndIndex(pipeline, base.GetMetaReceivedEventListener, i),
 			pipeline.Topic(), logger_ctx)
+		data_deduplicated_event_listener := component.NewDefaultAsyncComponentEventListenerImpl(
+			pipeline_utils.GetElementIdFromNameAndIndex(pipeline, base.DataDeduplicatedEventListener, i),
+			pipeline.Topic(), logger_ctx)
+		data_dead_lettered_event_listener := component.NewDefaultAsyncComponentEventListenerImpl(
+			pipeline_utils.GetElementIdFromNameAndIndex(pipeline, base.DataDeadLetteredEventListener, i),
+			pipeline.Topic(), logger_ctx)
 
 		for index := load_distribution[i][0]; index < load_distribution[i][1]; index++ {
 			out_nozzle := targets[index]
 			out_nozzle.RegisterComponentEventListener(common.DataSent, data_sent_event_listener)
 			out_nozzle.RegisterComponentEventListener(common.DataFailedCRSource, data_failed_cr_event_listener)
 			out_nozzle.RegisterComponentEventListener(common.GetMetaReceived, get_meta_received_event_listener)
+			out_nozzle.RegisterComponentEventListener(common.DataDeduplicated, data_deduplicated_event_listener)
+			out_nozzle.RegisterComponentEventListener(common.DataDeadLettered, data_dead_lettered_event_listener)
+		}
+	}
+}
+
+// construct and register async componet event listeners on processor parts.
+// processor parts report dropped data through DataFiltered events, the same way as routers
+func (xdcrf *XDCRFactory) registerAsyncListenersOnProcessors(pipeline common.Pipeline, processorParts map[string]*parts.ProcessorPart, logger_ctx *log.LoggerContext) {
+	processorList := make([]*parts.ProcessorPart, 0, len(processorParts))
+	for _, processorPart := range processorParts {
+		processorList = append(processorList, processorPart)
+	}
+	num_of_processors := len(processorList)
+	num_of_listeners := min(num_of_processors, base.MaxNumberOfAsyncListeners)
+	load_distribution := simple_utils.BalanceLoad(num_of_listeners, num_of_processors)
+	xdcrf.logger.Infof("topic=%v, num_of_processors=%v, num_of_listeners=%v, load_distribution=%v\n", pipeline.Topic(), num_of_processors, num_of_listeners, load_distribution)
+
+	for i := 0; i < num_of_listeners; i++ {
+		// the indexes of the listeners start after those of the DataFiltered listeners on routers to keep listener ids unique
+		data_filtered_event_listener := component.NewDefaultAsyncComponentEventListenerImpl(
+			pipeline_utils.GetElementIdFromNameAndIndex(pipeline, base.DataFilteredEventListener, base.MaxNumberOfAsyncListeners+i),
+			pipeline.Topic(), logger_ctx)
+
+		for index := load_distribution[i][0]; index < load_distribution[i][1]; index++ {
+			processorList[index].RegisterComponentEventListener(common.DataFiltered, data_filtered_event_listener)
 		}
 	}
 }
@@ -297,6 +380,15 @@ func (xdcrf *XDCRFactory) constructSourceNozzles(spec *metadata.ReplicationSpeci
 		return nil, nil, err
 	}
 
+	// replay directory is re-resolved here, since archive root directory may have changed since it was validated
+	var replayDir string
+	if len(spec.Settings.ReplayDir) > 0 {
+		replayDir, err = metadata.ResolveArchiveDir(spec.Settings.ReplayDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%v invalid replay directory %v. err=%v", spec.Id, spec.Settings.ReplayDir, err)
+		}
+	}
+
 	for kvaddr, vbnos := range kv_vb_map {
 
 		numOfVbs := len(vbnos)
@@ -317,6 +409,17 @@ func (xdcrf *XDCRFactory) constructSourceNozzles(spec *metadata.ReplicationSpeci
 				vbList = append(vbList, vbnos[index])
 			}
 
+			if len(replayDir) > 0 {
+				// replay nozzles read the archive files of the vbs, instead of streaming from dcp
+				// partIds of the replay nozzles look like "replay_$topic_$kvaddr_1"
+				id := xdcrf.partId(REPLAY_NOZZLE_NAME_PREFIX, spec.Id, kvaddr, i)
+				replayNozzle := parts.NewReplayNozzle(id, replayDir, spec.Settings.ReplayFormat,
+					uint64(spec.Settings.ReplayStartSeqno), uint64(spec.Settings.ReplayEndSeqno), vbList, logger_ctx)
+				sourceNozzles[replayNozzle.Id()] = replayNozzle
+				xdcrf.logger.Debugf("Constructed source nozzle %v with vbList = %v \n", replayNozzle.Id(), vbList)
+				continue
+			}
+
 			// construct dcpNozzles
 			// partIds of the dcpNozzle nodes look like "dcpNozzle_$kvaddr_1"
 			id := xdcrf.partId(DCP_NOZZLE_NAME_PREFIX, spec.Id, kvaddr, i)
@@ -336,6 +439,15 @@ func (xdcrf *XDCRFactory) partId(prefix string, topic string, kvaddr string, ind
 	return prefix + PART_NAME_DELIMITER + topic + PART_NAME_DELIMITER + kvaddr + PART_NAME_DELIMITER + strconv.Itoa(index)
 }
 
+// returns the total number of vbuckets in a kv vb map, which is 0 for a nil map
+func numOfVBuckets(kv_vb_map map[string][]uint16) uint16 {
+	var count uint16
+	for _, vbList := range kv_vb_map {
+		count += uint16(len(vbList))
+	}
+	return count
+}
+
 func (xdcrf *XDCRFactory) filterVBList(targetkvVBList []uint16, kv_vb_map map[string][]uint16) []uint16 {
 	ret := []uint16{}
 	for _, vb := range targetkvVBList {
@@ -354,6 +466,12 @@ func (xdcrf *XDCRFactory) filterVBList(targetkvVBList []uint16, kv_vb_map map[st
 func (xdcrf *XDCRFactory) constructOutgoingNozzles(spec *metadata.ReplicationSpecification, kv_vb_map map[string][]uint16,
 	sourceCRMode base.ConflictResolutionMode, targetBucketInfo map[string]interface{},
 	targetClusterRef *metadata.RemoteClusterReference, logger_ctx *log.LoggerContext) (map[string]common.Nozzle, map[uint16]string, map[string][]uint16, string, error) {
+	if spec.Settings.RepType == metadata.ReplicationTypeFile {
+		return xdcrf.constructFileNozzles(spec, kv_vb_map, logger_ctx)
+	} else if spec.Settings.RepType == metadata.ReplicationTypeWebhook {
+		return xdcrf.constructWebhookNozzles(spec, kv_vb_map, logger_ctx)
+	}
+
 	outNozzles := make(map[string]common.Nozzle)
 	vbNozzleMap := make(map[uint16]string)
 
@@ -399,7 +517,12 @@ func (xdcrf *XDCRFactory) constructOutgoingNozzles(spec *metadata.ReplicationSpe
 			}
 		}
 
-		relevantVBs := xdcrf.filterVBList(kvVBList, kv_vb_map)
+		// docs whose keys are rewritten may belong to target vbuckets that are not local source vbuckets.
+		// all target vbuckets need outgoing nozzles in that case
+		relevantVBs := kvVBList
+		if len(spec.Settings.KeyTransformRules) == 0 {
+			relevantVBs = xdcrf.filterVBList(kvVBList, kv_vb_map)
+		}
 
 		xdcrf.logger.Debugf("kvaddr = %v; kvVbList=%v, relevantVBs=-%v\n", kvaddr, kvVBList, relevantVBs)
 
@@ -445,17 +568,187 @@ func (xdcrf *XDCRFactory) constructOutgoingNozzles(spec *metadata.ReplicationSpe
 	return outNozzles, vbNozzleMap, kvVBMap, bucketPwd, nil
 }
 
+// file nozzles are constructed per source kv node, since each of them exports a subset of the vbuckets on the local node.
+// there is no target bucket involved, hence the returned target kv vb map and target bucket password are empty
+func (xdcrf *XDCRFactory) constructFileNozzles(spec *metadata.ReplicationSpecification, kv_vb_map map[string][]uint16,
+	logger_ctx *log.LoggerContext) (map[string]common.Nozzle, map[uint16]string, map[string][]uint16, string, error) {
+	outNozzles := make(map[string]common.Nozzle)
+	vbNozzleMap := make(map[uint16]string)
+
+	if len(spec.Settings.ExportDir) == 0 {
+		return nil, nil, nil, "", fmt.Errorf("%v export directory has not been specified for file replication", spec.Id)
+	}
+
+	exportDir, err := metadata.ResolveArchiveDir(spec.Settings.ExportDir)
+	if err != nil {
+		return nil, nil, nil, "", fmt.Errorf("%v invalid export directory %v. err=%v", spec.Id, spec.Settings.ExportDir, err)
+	}
+
+	archiveDir := parts.ArchiveDirForReplication(exportDir, spec.Id)
+	maxTargetNozzlePerNode := spec.Settings.TargetNozzlePerNode
+
+	for kvaddr, vbList := range kv_vb_map {
+		numOfVbs := len(vbList)
+		numOfOutNozzles := min(numOfVbs, maxTargetNozzlePerNode)
+		load_distribution := simple_utils.BalanceLoad(numOfOutNozzles, numOfVbs)
+		xdcrf.logger.Infof("topic=%v, numOfOutNozzles=%v, numOfVbs=%v, load_distribution=%v\n", spec.Id, numOfOutNozzles, numOfVbs, load_distribution)
+
+		for i := 0; i < numOfOutNozzles; i++ {
+			nozzleVBList := make([]uint16, 0)
+			for index := load_distribution[i][0]; index < load_distribution[i][1]; index++ {
+				nozzleVBList = append(nozzleVBList, vbList[index])
+			}
+
+			// partIds of the file nozzles look like "file_$topic_$kvaddr_1"
+			fileNozzle_Id := xdcrf.partId(FILE_NOZZLE_NAME_PREFIX, spec.Id, kvaddr, i)
+			outNozzle := parts.NewFileNozzle(fileNozzle_Id, spec.Id, archiveDir, nozzleVBList, pipeline_manager.RecycleMCRequestObj, logger_ctx)
+			outNozzles[outNozzle.Id()] = outNozzle
+
+			for _, vbno := range nozzleVBList {
+				vbNozzleMap[vbno] = outNozzle.Id()
+			}
+		}
+	}
+
+	xdcrf.logger.Infof("Constructed %v file nozzles exporting to %v\n", len(outNozzles), archiveDir)
+	return outNozzles, vbNozzleMap, nil, "", nil
+}
+
+// webhook nozzles, like file nozzles, are constructed per source kv node and have no target bucket.
+// each vbucket is handled by a single webhook nozzle, which posts its mutations in seqno order
+func (xdcrf *XDCRFactory) constructWebhookNozzles(spec *metadata.ReplicationSpecification, kv_vb_map map[string][]uint16,
+	logger_ctx *log.LoggerContext) (map[string]common.Nozzle, map[uint16]string, map[string][]uint16, string, error) {
+	outNozzles := make(map[string]common.Nozzle)
+	vbNozzleMap := make(map[uint16]string)
+
+	if len(spec.Settings.WebhookURL) == 0 {
+		return nil, nil, nil, "", fmt.Errorf("%v webhook url has not been specified for webhook replication", spec.Id)
+	}
+
+	maxTargetNozzlePerNode := spec.Settings.TargetNozzlePerNode
+
+	for kvaddr, vbList := range kv_vb_map {
+		numOfVbs := len(vbList)
+		numOfOutNozzles := min(numOfVbs, maxTargetNozzlePerNode)
+		load_distribution := simple_utils.BalanceLoad(numOfOutNozzles, numOfVbs)
+		xdcrf.logger.Infof("topic=%v, numOfOutNozzles=%v, numOfVbs=%v, load_distribution=%v\n", spec.Id, numOfOutNozzles, numOfVbs, load_distribution)
+
+		for i := 0; i < numOfOutNozzles; i++ {
+			// partIds of the webhook nozzles look like "webhook_$topic_$kvaddr_1"
+			webhookNozzle_Id := xdcrf.partId(WEBHOOK_NOZZLE_NAME_PREFIX, spec.Id, kvaddr, i)
+			outNozzle := parts.NewWebhookNozzle(webhookNozzle_Id, spec.Id, spec.Settings.WebhookURL, spec.Settings.WebhookAuthHeader, pipeline_manager.RecycleMCRequestObj, logger_ctx)
+			outNozzles[outNozzle.Id()] = outNozzle
+
+			for index := load_distribution[i][0]; index < load_distribution[i][1]; index++ {
+				vbNozzleMap[vbList[index]] = outNozzle.Id()
+			}
+		}
+	}
+
+	xdcrf.logger.Infof("Constructed %v webhook nozzles posting to %v\n", len(outNozzles), spec.Settings.WebhookURL)
+	return outNozzles, vbNozzleMap, nil, "", nil
+}
+
 func (xdcrf *XDCRFactory) constructRouter(id string, spec *metadata.ReplicationSpecification,
 	downStreamParts map[string]common.Part,
 	vbNozzleMap map[uint16]string,
+	targetNumVBuckets uint16,
 	sourceCRMode base.ConflictResolutionMode,
 	logger_ctx *log.LoggerContext) (*parts.Router, error) {
 	routerId := "Router" + PART_NAME_DELIMITER + id
-	router, err := parts.NewRouter(routerId, spec.Id, spec.Settings.FilterExpression, downStreamParts, vbNozzleMap, sourceCRMode, logger_ctx, pipeline_manager.NewMCRequestObj)
+	router, err := parts.NewRouter(routerId, spec.Id, spec.Settings.FilterExpression, spec.Settings.DocFilterExpression, downStreamParts, vbNozzleMap, targetNumVBuckets, sourceCRMode, logger_ctx, pipeline_manager.NewMCRequestObj)
+	if err != nil {
+		return nil, err
+	}
+	// settings that can also be changed on a running router, e.g., handling of deletions and expirations
+	err = router.UpdateSettings(spec.Settings.ToMap())
 	xdcrf.logger.Infof("Constructed router %v", routerId)
 	return router, err
 }
 
+func (xdcrf *XDCRFactory) setBandwidthThrottler(outNozzles map[string]common.Nozzle, throttler *base.BandwidthThrottler) {
+	for _, outNozzle := range outNozzles {
+		switch nozzle := outNozzle.(type) {
+		case *parts.XmemNozzle:
+			nozzle.SetBandwidthThrottler(throttler)
+		case *parts.CapiNozzle:
+			nozzle.SetBandwidthThrottler(throttler)
+		case *parts.WebhookNozzle:
+			nozzle.SetBandwidthThrottler(throttler)
+		}
+	}
+}
+
+// dead-letter queue is supported by xmem nozzles only. capi nozzles keep repairing connections on permanent errors
+func (xdcrf *XDCRFactory) setDeadLetterQueue(outNozzles map[string]common.Nozzle, queue *base.DeadLetterQueue) {
+	for _, outNozzle := range outNozzles {
+		if xmemNozzle, ok := outNozzle.(*parts.XmemNozzle); ok {
+			xmemNozzle.SetDeadLetterQueue(queue)
+		}
+	}
+}
+
+// sets on the outgoing nozzles the conflict resolver specified by the replication settings.
+// the resolver is stateless and is shared by the outgoing nozzles
+func (xdcrf *XDCRFactory) setConflictResolver(outNozzles map[string]common.Nozzle, spec *metadata.ReplicationSpecification,
+	sourceCRMode base.ConflictResolutionMode) error {
+	resolver, err := parts.NewConflictResolver(spec.Settings.ConflictResolver, spec.Settings.ConflictResolverField, sourceCRMode)
+	if err != nil {
+		return err
+	}
+	for _, outNozzle := range outNozzles {
+		switch nozzle := outNozzle.(type) {
+		case *parts.XmemNozzle:
+			nozzle.SetConflictResolver(resolver)
+		case *parts.CapiNozzle:
+			err = nozzle.SetConflictResolver(resolver)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// constructs a processor part for each outgoing nozzle when processors have been specified for the replication.
+// returns a map of outgoing nozzle id -> processor part, and the vb -> part map for routers, in which
+// processor parts replace the outgoing nozzles they forward to.
+// returns an empty map and the original vbNozzleMap when no processors have been specified
+func (xdcrf *XDCRFactory) constructProcessorParts(spec *metadata.ReplicationSpecification,
+	outNozzles map[string]common.Nozzle,
+	vbNozzleMap map[uint16]string,
+	logger_ctx *log.LoggerContext) (map[string]*parts.ProcessorPart, map[uint16]string, error) {
+	processorParts := make(map[string]*parts.ProcessorPart)
+
+	processorTypes, err := processor.ParseProcessorTypes(spec.Settings.Processors)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(processorTypes) == 0 {
+		return processorParts, vbNozzleMap, nil
+	}
+
+	for outNozzleId, outNozzle := range outNozzles {
+		// partIds of the processor parts look like "processor_$outNozzleId"
+		processorPartId := PROCESSOR_NAME_PREFIX + PART_NAME_DELIMITER + outNozzleId
+		processorPart := parts.NewProcessorPart(processorPartId, spec.Id, processorTypes, pipeline_manager.RecycleMCRequestObj, logger_ctx)
+		processorPart.SetConnector(connector.NewSimpleConnector(processorPartId, outNozzle, logger_ctx))
+		processorParts[outNozzleId] = processorPart
+	}
+
+	vbPartMap := make(map[uint16]string)
+	for vbno, outNozzleId := range vbNozzleMap {
+		processorPart, ok := processorParts[outNozzleId]
+		if !ok {
+			return nil, nil, fmt.Errorf("Error constructing processor parts for %v since there is no target nozzle with id %v", spec.Id, outNozzleId)
+		}
+		vbPartMap[vbno] = processorPart.Id()
+	}
+
+	xdcrf.logger.Infof("Constructed %v processor parts with processors %v\n", len(processorParts), processorTypes)
+	return processorParts, vbPartMap, nil
+}
+
 func (xdcrf *XDCRFactory) getOutNozzleType(targetClusterRef *metadata.RemoteClusterReference, spec *metadata.ReplicationSpecification) (base.XDCROutgoingNozzleType, error) {
 	switch spec.Settings.RepType {
 	case metadata.ReplicationTypeXmem:
@@ -471,6 +764,10 @@ func (xdcrf *XDCRFactory) getOutNozzleType(targetClusterRef *metadata.RemoteClus
 		}
 	case metadata.ReplicationTypeCapi:
 		return base.Capi, nil
+	case metadata.ReplicationTypeFile:
+		return base.File, nil
+	case metadata.ReplicationTypeWebhook:
+		return base.Webhook, nil
 	default:
 		// should never get here
 		return -1, errors.New(fmt.Sprintf("Invalid replication type %v", spec.Settings.RepType))
@@ -532,9 +829,21 @@ func (xdcrf *XDCRFactory) ConstructSettingsForPart(pipeline common.Pipeline, par
 	} else if _, ok := part.(*parts.DcpNozzle); ok {
 		xdcrf.logger.Debugf("Construct settings for DcpNozzle %s", part.Id())
 		return xdcrf.constructSettingsForDcpNozzle(pipeline, part.(*parts.DcpNozzle), settings)
+	} else if _, ok := part.(*parts.ReplayNozzle); ok {
+		xdcrf.logger.Debugf("Construct settings for ReplayNozzle %s", part.Id())
+		return xdcrf.constructSettingsForReplayNozzle(pipeline, settings), nil
 	} else if _, ok := part.(*parts.CapiNozzle); ok {
 		xdcrf.logger.Debugf("Construct settings for CapiNozzle %s", part.Id())
 		return xdcrf.constructSettingsForCapiNozzle(pipeline, settings)
+	} else if _, ok := part.(*parts.FileNozzle); ok {
+		xdcrf.logger.Debugf("Construct settings for FileNozzle %s", part.Id())
+		return xdcrf.constructSettingsForFileNozzle(pipeline, settings), nil
+	} else if _, ok := part.(*parts.WebhookNozzle); ok {
+		xdcrf.logger.Debugf("Construct settings for WebhookNozzle %s", part.Id())
+		return xdcrf.constructSettingsForWebhookNozzle(pipeline, settings), nil
+	} else if _, ok := part.(*parts.ProcessorPart); ok {
+		xdcrf.logger.Debugf("Construct settings for ProcessorPart %s", part.Id())
+		return xdcrf.constructSettingsForProcessorPart(pipeline, settings), nil
 	} else {
 		return settings, nil
 	}
@@ -548,6 +857,9 @@ func (xdcrf *XDCRFactory) ConstructUpdateSettingsForPart(pipeline common.Pipelin
 	} else if _, ok := part.(*parts.CapiNozzle); ok {
 		xdcrf.logger.Debugf("Construct update settings for CapiNozzle %s", part.Id())
 		return xdcrf.constructUpdateSettingsForCapiNozzle(pipeline, settings), nil
+	} else if _, ok := part.(*parts.WebhookNozzle); ok {
+		xdcrf.logger.Debugf("Construct update settings for WebhookNozzle %s", part.Id())
+		return xdcrf.constructUpdateSettingsForWebhookNozzle(pipeline, settings), nil
 	} else {
 		return settings, nil
 	}
@@ -558,6 +870,8 @@ func (xdcrf *XDCRFactory) constructUpdateSettingsForXmemNozzle(pipeline common.P
 	repSettings := pipeline.Specification().Settings
 
 	xmemSettings[parts.SETTING_OPTI_REP_THRESHOLD] = getSettingFromSettingsMap(settings, metadata.OptimisticReplicationThreshold, repSettings.OptimisticReplicationThreshold)
+	xmemSettings[parts.SETTING_BANDWIDTH_LIMIT] = getSettingFromSettingsMap(settings, metadata.BandwidthLimit, repSettings.BandwidthLimit)
+	xmemSettings[parts.XMEM_SETTING_DEDUP_IN_BATCH] = getSettingFromSettingsMap(settings, metadata.DedupInBatch, repSettings.DedupInBatch)
 	return xmemSettings
 
 }
@@ -567,9 +881,18 @@ func (xdcrf *XDCRFactory) constructUpdateSettingsForCapiNozzle(pipeline common.P
 	repSettings := pipeline.Specification().Settings
 
 	capiSettings[parts.SETTING_OPTI_REP_THRESHOLD] = getSettingFromSettingsMap(settings, metadata.OptimisticReplicationThreshold, repSettings.OptimisticReplicationThreshold)
+	capiSettings[parts.SETTING_BANDWIDTH_LIMIT] = getSettingFromSettingsMap(settings, metadata.BandwidthLimit, repSettings.BandwidthLimit)
 	return capiSettings
 }
 
+func (xdcrf *XDCRFactory) constructUpdateSettingsForWebhookNozzle(pipeline common.Pipeline, settings map[string]interface{}) map[string]interface{} {
+	webhookSettings := make(map[string]interface{})
+	repSettings := pipeline.Specification().Settings
+
+	webhookSettings[parts.SETTING_BANDWIDTH_LIMIT] = getSettingFromSettingsMap(settings, metadata.BandwidthLimit, repSettings.BandwidthLimit)
+	return webhookSettings
+}
+
 func (xdcrf *XDCRFactory) SetStartSeqno(pipeline common.Pipeline) error {
 	if pipeline == nil {
 		return errors.New("pipeline=nil")
@@ -607,6 +930,11 @@ func (xdcrf *XDCRFactory) constructSettingsForXmemNozzle(pipeline common.Pipelin
 	xmemSettings[parts.SETTING_BATCH_EXPIRATION_TIME] = time.Duration(float64(repSettings.MaxExpectedReplicationLag)*0.7) * time.Millisecond
 	xmemSettings[parts.SETTING_OPTI_REP_THRESHOLD] = getSettingFromSettingsMap(settings, metadata.OptimisticReplicationThreshold, repSettings.OptimisticReplicationThreshold)
 	xmemSettings[parts.SETTING_STATS_INTERVAL] = getSettingFromSettingsMap(settings, metadata.PipelineStatsInterval, repSettings.StatsInterval)
+	xmemSettings[parts.XMEM_SETTING_COMPRESSION_TYPE] = repSettings.CompressionType
+	xmemSettings[parts.SETTING_PRIORITY] = repSettings.Priority
+	xmemSettings[parts.XMEM_SETTING_DEDUP_IN_BATCH] = repSettings.DedupInBatch
+	xmemSettings[parts.SETTING_CONFLICT_LOGGING] = repSettings.ConflictLogDestination != metadata.ConflictLogDestinationNone
+	xmemSettings[parts.SETTING_CONFLICT_LOG_BODIES] = repSettings.ConflictLogBodies
 
 	xmemSettings[parts.XMEM_SETTING_DEMAND_ENCRYPTION] = targetClusterRef.DemandEncryption
 	xmemSettings[parts.XMEM_SETTING_CERTIFICATE] = targetClusterRef.Certificate
@@ -653,11 +981,50 @@ func (xdcrf *XDCRFactory) constructSettingsForCapiNozzle(pipeline common.Pipelin
 	capiSettings[parts.SETTING_RESP_TIMEOUT] = xdcrf.getTargetTimeoutEstimate(pipeline.Topic())
 	capiSettings[parts.SETTING_OPTI_REP_THRESHOLD] = getSettingFromSettingsMap(settings, metadata.OptimisticReplicationThreshold, repSettings.OptimisticReplicationThreshold)
 	capiSettings[parts.SETTING_STATS_INTERVAL] = getSettingFromSettingsMap(settings, metadata.PipelineStatsInterval, repSettings.StatsInterval)
+	capiSettings[parts.SETTING_PRIORITY] = repSettings.Priority
+	capiSettings[parts.SETTING_CONFLICT_LOGGING] = repSettings.ConflictLogDestination != metadata.ConflictLogDestinationNone
+	capiSettings[parts.SETTING_CONFLICT_LOG_BODIES] = repSettings.ConflictLogBodies
 
 	return capiSettings, nil
 
 }
 
+func (xdcrf *XDCRFactory) constructSettingsForFileNozzle(pipeline common.Pipeline, settings map[string]interface{}) map[string]interface{} {
+	fileSettings := make(map[string]interface{})
+	repSettings := pipeline.Specification().Settings
+
+	fileSettings[parts.SETTING_BATCHCOUNT] = getSettingFromSettingsMap(settings, metadata.BatchCount, repSettings.BatchCount)
+	fileSettings[parts.SETTING_BATCHSIZE] = getSettingFromSettingsMap(settings, metadata.BatchSize, repSettings.BatchSize)
+	fileSettings[parts.SETTING_STATS_INTERVAL] = getSettingFromSettingsMap(settings, metadata.PipelineStatsInterval, repSettings.StatsInterval)
+	fileSettings[parts.SETTING_PRIORITY] = repSettings.Priority
+	fileSettings[parts.FILE_SETTING_EXPORT_FORMAT] = repSettings.ExportFormat
+	fileSettings[parts.FILE_SETTING_FILE_SIZE] = repSettings.ExportFileSizeMB * 1024 * 1024
+	fileSettings[parts.FILE_SETTING_MAX_FILES] = repSettings.ExportMaxFiles
+
+	return fileSettings
+}
+
+func (xdcrf *XDCRFactory) constructSettingsForWebhookNozzle(pipeline common.Pipeline, settings map[string]interface{}) map[string]interface{} {
+	webhookSettings := make(map[string]interface{})
+	repSettings := pipeline.Specification().Settings
+
+	webhookSettings[parts.SETTING_BATCHCOUNT] = getSettingFromSettingsMap(settings, metadata.BatchCount, repSettings.BatchCount)
+	webhookSettings[parts.SETTING_BATCHSIZE] = getSettingFromSettingsMap(settings, metadata.BatchSize, repSettings.BatchSize)
+	webhookSettings[parts.SETTING_STATS_INTERVAL] = getSettingFromSettingsMap(settings, metadata.PipelineStatsInterval, repSettings.StatsInterval)
+	webhookSettings[parts.SETTING_PRIORITY] = repSettings.Priority
+
+	return webhookSettings
+}
+
+// processors are constructed with the replication settings, overridden by the pipeline settings if any
+func (xdcrf *XDCRFactory) constructSettingsForProcessorPart(pipeline common.Pipeline, settings map[string]interface{}) map[string]interface{} {
+	processorSettings := pipeline.Specification().Settings.ToMap()
+	for key, value := range settings {
+		processorSettings[key] = value
+	}
+	return processorSettings
+}
+
 func (xdcrf *XDCRFactory) getTargetTimeoutEstimate(topic string) time.Duration {
 	//TODO: implement
 	//need to get the tcp ping time for the estimate
@@ -680,6 +1047,15 @@ func (xdcrf *XDCRFactory) constructSettingsForDcpNozzle(pipeline common.Pipeline
 	return dcpNozzleSettings, nil
 }
 
+// replay nozzles do not roll back, hence do not need vb timestamp updater from checkpoint manager
+func (xdcrf *XDCRFactory) constructSettingsForReplayNozzle(pipeline common.Pipeline, settings map[string]interface{}) map[string]interface{} {
+	replayNozzleSettings := make(map[string]interface{})
+	repSettings := pipeline.Specification().Settings
+
+	replayNozzleSettings[parts.DCP_Stats_Interval] = getSettingFromSettingsMap(settings, metadata.PipelineStatsInterval, repSettings.StatsInterval)
+	return replayNozzleSettings
+}
+
 func (xdcrf *XDCRFactory) registerServices(pipeline common.Pipeline, logger_ctx *log.LoggerContext, kv_vb_map map[string][]uint16, target_bucket_password string, target_kv_vb_map map[string][]uint16, targetClusterRef *metadata.RemoteClusterReference) error {
 	through_seqno_tracker_svc := service_impl.NewThroughSeqnoTrackerSvc(logger_ctx)
 	through_seqno_tracker_svc.Attach(pipeline)
@@ -721,6 +1097,16 @@ func (xdcrf *XDCRFactory) registerServices(pipeline common.Pipeline, logger_ctx
 	if err != nil {
 		return err
 	}
+
+	//register conflict logger if documents that lost conflict resolution are to be recorded
+	settings := pipeline.Specification().Settings
+	if settings.ConflictLogDestination != metadata.ConflictLogDestinationNone {
+		conflictLogger := pipeline_svc.NewConflictLogger(pipeline.Topic(), settings, xdcrf.xdcr_topology_svc, logger_ctx)
+		err = ctx.RegisterService(base.CONFLICT_LOGGER_SVC, conflictLogger)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -802,7 +1188,7 @@ func (xdcrf *XDCRFactory) constructUpdateSettingsForStatsManager(pipeline common
 }
 
 func (xdcrf *XDCRFactory) constructUpdateSettingsForCheckpointManager(pipeline common.Pipeline, settings map[string]interface{}) (map[string]interface{}, error) {
-	xdcrf.logger.Debugf("constructUpdateSettingsForCheckpointManager called with settings=%v\n", settings)
+	xdcrf.logger.Debugf("constructUpdateSettingsForCheckpointManager called with settings=%v\n", metadata.MaskSensitiveSettings(settings))
 	s := make(map[string]interface{})
 	checkpoint_interval := getSettingFromSettingsMap(settings, metadata.CheckpointInterval, nil)
 	if checkpoint_interval != nil {
@@ -0,0 +1,640 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// filter package evaluates filter expressions over the documents being replicated
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// keywords of the document filter language. keywords are case insensitive
+const (
+	KeywordAnd    = "AND"
+	KeywordOr     = "OR"
+	KeywordNot    = "NOT"
+	KeywordIn     = "IN"
+	KeywordExists = "EXISTS"
+	KeywordTrue   = "TRUE"
+	KeywordFalse  = "FALSE"
+	KeywordNull   = "NULL"
+)
+
+var reservedKeywords = []string{KeywordAnd, KeywordOr, KeywordNot, KeywordIn, KeywordExists, KeywordTrue, KeywordFalse, KeywordNull}
+
+var ErrorEmptyDocFilterExpression = errors.New("Document filter expression is empty.")
+
+/************************************
+/* struct DocFilter
+*************************************/
+
+// DocFilter evaluates a boolean expression over the JSON body of a document, e.g.,
+//
+//	type == "order" AND region IN ["eu", "uk"] AND (total >= 100 OR NOT EXISTS(discount))
+//
+// field paths are dot separated, e.g., address.city or items.0.sku, and path segments
+// that are not plain identifiers or that clash with keywords can be quoted with backquotes.
+// a predicate on a field that does not exist in the document, or whose value is of a
+// different type than the literal it is compared with, evaluates to false.
+type DocFilter struct {
+	expression string
+	root       docFilterNode
+}
+
+func NewDocFilter(expression string) (*DocFilter, error) {
+	if len(strings.TrimSpace(expression)) == 0 {
+		return nil, ErrorEmptyDocFilterExpression
+	}
+
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &docFilterParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := parser.peek(); t.typ != tokenEOF {
+		return nil, newDocFilterError(fmt.Sprintf("Unexpected token \"%v\"", t.text), t.pos)
+	}
+
+	return &DocFilter{expression: expression, root: root}, nil
+}
+
+func (filter *DocFilter) Expression() string {
+	return filter.expression
+}
+
+// Match returns whether the document body satisfies the filter.
+// bodies that are not valid JSON never match
+func (filter *DocFilter) Match(body []byte) bool {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return false
+	}
+	return filter.MatchDoc(doc)
+}
+
+// MatchDoc returns whether an already unmarshalled JSON document satisfies the filter
+func (filter *DocFilter) MatchDoc(doc interface{}) bool {
+	return filter.root.evaluate(doc)
+}
+
+func newDocFilterError(msg string, pos int) error {
+	return fmt.Errorf("Invalid document filter expression. %v at position %v.", msg, pos)
+}
+
+/************************************
+/* expression tree
+*************************************/
+
+type docFilterNode interface {
+	evaluate(doc interface{}) bool
+}
+
+type andNode struct {
+	children []docFilterNode
+}
+
+func (node *andNode) evaluate(doc interface{}) bool {
+	for _, child := range node.children {
+		if !child.evaluate(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+type orNode struct {
+	children []docFilterNode
+}
+
+func (node *orNode) evaluate(doc interface{}) bool {
+	for _, child := range node.children {
+		if child.evaluate(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+type notNode struct {
+	child docFilterNode
+}
+
+func (node *notNode) evaluate(doc interface{}) bool {
+	return !node.child.evaluate(doc)
+}
+
+type existsNode struct {
+	path []string
+}
+
+func (node *existsNode) evaluate(doc interface{}) bool {
+	_, found := lookupPath(doc, node.path)
+	return found
+}
+
+type compareNode struct {
+	path  []string
+	op    string
+	value interface{}
+}
+
+func (node *compareNode) evaluate(doc interface{}) bool {
+	fieldValue, found := lookupPath(doc, node.path)
+	if !found {
+		return false
+	}
+
+	switch node.op {
+	case "==":
+		return reflect.DeepEqual(fieldValue, node.value)
+	case "!=":
+		return !reflect.DeepEqual(fieldValue, node.value)
+	}
+
+	result, ok := compareValues(fieldValue, node.value)
+	if !ok {
+		return false
+	}
+	switch node.op {
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	case ">=":
+		return result >= 0
+	}
+	return false
+}
+
+// IN, or NOT IN when negate is true. like !=, NOT IN is false on a field that does not exist
+type inNode struct {
+	path   []string
+	values []interface{}
+	negate bool
+}
+
+func (node *inNode) evaluate(doc interface{}) bool {
+	fieldValue, found := lookupPath(doc, node.path)
+	if !found {
+		return false
+	}
+	for _, value := range node.values {
+		if reflect.DeepEqual(fieldValue, value) {
+			return !node.negate
+		}
+	}
+	return node.negate
+}
+
+// lookupPath returns the value at the specified path in a JSON document
+// and whether such a value exists
+func lookupPath(doc interface{}, path []string) (interface{}, bool) {
+	current := doc
+	for _, segment := range path {
+		switch typed := current.(type) {
+		case map[string]interface{}:
+			value, ok := typed[segment]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(typed) {
+				return nil, false
+			}
+			current = typed[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// compareValues orders two numbers or two strings.
+// the second return value is false when the values cannot be ordered
+func compareValues(a, b interface{}) (int, bool) {
+	switch typedA := a.(type) {
+	case float64:
+		typedB, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		if typedA < typedB {
+			return -1, true
+		} else if typedA > typedB {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		typedB, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(typedA, typedB), true
+	}
+	return 0, false
+}
+
+/************************************
+/* tokenizer
+*************************************/
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenLeftParen
+	tokenRightParen
+	tokenLeftBracket
+	tokenRightBracket
+	tokenComma
+	tokenDot
+)
+
+type token struct {
+	typ  tokenType
+	text string
+	// identifiers quoted with backquotes are never treated as keywords
+	quoted bool
+	pos    int
+}
+
+func tokenize(expression string) ([]*token, error) {
+	tokens := make([]*token, 0)
+	runes := []rune(expression)
+
+	i := 0
+	for i < len(runes) {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, &token{typ: tokenLeftParen, text: "(", pos: start})
+			i++
+		case r == ')':
+			tokens = append(tokens, &token{typ: tokenRightParen, text: ")", pos: start})
+			i++
+		case r == '[':
+			tokens = append(tokens, &token{typ: tokenLeftBracket, text: "[", pos: start})
+			i++
+		case r == ']':
+			tokens = append(tokens, &token{typ: tokenRightBracket, text: "]", pos: start})
+			i++
+		case r == ',':
+			tokens = append(tokens, &token{typ: tokenComma, text: ",", pos: start})
+			i++
+		case r == '.':
+			tokens = append(tokens, &token{typ: tokenDot, text: ".", pos: start})
+			i++
+		case r == '=':
+			// "=" is accepted as an alias of "=="
+			i++
+			if i < len(runes) && runes[i] == '=' {
+				i++
+			}
+			tokens = append(tokens, &token{typ: tokenOperator, text: "==", pos: start})
+		case r == '!':
+			if i+1 >= len(runes) || runes[i+1] != '=' {
+				return nil, newDocFilterError("Expected \"!=\"", start)
+			}
+			i += 2
+			tokens = append(tokens, &token{typ: tokenOperator, text: "!=", pos: start})
+		case r == '<' || r == '>':
+			i++
+			if i < len(runes) && runes[i] == '=' {
+				i++
+			}
+			tokens = append(tokens, &token{typ: tokenOperator, text: string(runes[start:i]), pos: start})
+		case r == '"' || r == '\'':
+			str, next, err := scanString(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, &token{typ: tokenString, text: str, pos: start})
+			i = next
+		case r == '`':
+			i++
+			for i < len(runes) && runes[i] != '`' {
+				i++
+			}
+			if i >= len(runes) {
+				return nil, newDocFilterError("Unterminated quoted identifier", start)
+			}
+			tokens = append(tokens, &token{typ: tokenIdentifier, text: string(runes[start+1 : i]), quoted: true, pos: start})
+			i++
+		case isIdentifierRune(r) && len(tokens) > 0 && tokens[len(tokens)-1].typ == tokenDot:
+			// a path segment following a dot, e.g., 0 and 1 in a.0.1, is never lexed as a number
+			for i < len(runes) && isIdentifierRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, &token{typ: tokenIdentifier, text: string(runes[start:i]), pos: start})
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == 'e' || runes[i] == 'E' ||
+				(runes[i] == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])) ||
+				((runes[i] == '+' || runes[i] == '-') && (runes[i-1] == 'e' || runes[i-1] == 'E'))) {
+				i++
+			}
+			text := string(runes[start:i])
+			if _, err := strconv.ParseFloat(text, 64); err != nil {
+				return nil, newDocFilterError(fmt.Sprintf("Invalid number %v", text), start)
+			}
+			tokens = append(tokens, &token{typ: tokenNumber, text: text, pos: start})
+		case isIdentifierRune(r):
+			for i < len(runes) && isIdentifierRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, &token{typ: tokenIdentifier, text: string(runes[start:i]), pos: start})
+		default:
+			return nil, newDocFilterError(fmt.Sprintf("Unexpected character '%c'", r), start)
+		}
+	}
+
+	tokens = append(tokens, &token{typ: tokenEOF, pos: len(runes)})
+	return tokens, nil
+}
+
+func isIdentifierRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '$'
+}
+
+// scanString scans a quoted string literal starting at runes[start]
+// and returns the unescaped string and the position after the closing quote
+func scanString(runes []rune, start int) (string, int, error) {
+	quote := runes[start]
+	var buf []rune
+	i := start + 1
+	for i < len(runes) {
+		r := runes[i]
+		if r == quote {
+			return string(buf), i + 1, nil
+		}
+		if r == '\\' && i+1 < len(runes) {
+			i++
+			switch runes[i] {
+			case 'n':
+				buf = append(buf, '\n')
+			case 't':
+				buf = append(buf, '\t')
+			case 'r':
+				buf = append(buf, '\r')
+			default:
+				buf = append(buf, runes[i])
+			}
+		} else {
+			buf = append(buf, r)
+		}
+		i++
+	}
+	return "", 0, newDocFilterError("Unterminated string literal", start)
+}
+
+/************************************
+/* parser
+*************************************/
+
+// docFilterParser is a recursive descent parser of the grammar
+//
+//	expr    := and (OR and)*
+//	and     := not (AND not)*
+//	not     := NOT not | primary
+//	primary := "(" expr ")" | EXISTS "(" path ")" | path op literal | path [NOT] IN "[" literal ("," literal)* "]"
+type docFilterParser struct {
+	tokens []*token
+	pos    int
+}
+
+func (parser *docFilterParser) peek() *token {
+	return parser.tokens[parser.pos]
+}
+
+func (parser *docFilterParser) next() *token {
+	t := parser.tokens[parser.pos]
+	if t.typ != tokenEOF {
+		parser.pos++
+	}
+	return t
+}
+
+func (parser *docFilterParser) expect(typ tokenType, text string) error {
+	t := parser.next()
+	if t.typ != typ {
+		return newDocFilterError(fmt.Sprintf("Expected \"%v\"", text), t.pos)
+	}
+	return nil
+}
+
+func isKeyword(t *token, keyword string) bool {
+	return t.typ == tokenIdentifier && !t.quoted && strings.EqualFold(t.text, keyword)
+}
+
+func isReservedKeyword(t *token) bool {
+	for _, keyword := range reservedKeywords {
+		if isKeyword(t, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+func (parser *docFilterParser) parseOr() (docFilterNode, error) {
+	children := make([]docFilterNode, 0)
+	for {
+		child, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+		if !isKeyword(parser.peek(), KeywordOr) {
+			break
+		}
+		parser.next()
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &orNode{children: children}, nil
+}
+
+func (parser *docFilterParser) parseAnd() (docFilterNode, error) {
+	children := make([]docFilterNode, 0)
+	for {
+		child, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+		if !isKeyword(parser.peek(), KeywordAnd) {
+			break
+		}
+		parser.next()
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &andNode{children: children}, nil
+}
+
+func (parser *docFilterParser) parseNot() (docFilterNode, error) {
+	if isKeyword(parser.peek(), KeywordNot) {
+		parser.next()
+		child, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{child: child}, nil
+	}
+	return parser.parsePrimary()
+}
+
+func (parser *docFilterParser) parsePrimary() (docFilterNode, error) {
+	t := parser.peek()
+
+	if t.typ == tokenLeftParen {
+		parser.next()
+		node, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err = parser.expect(tokenRightParen, ")"); err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+
+	if isKeyword(t, KeywordExists) && parser.tokens[parser.pos+1].typ == tokenLeftParen {
+		parser.next()
+		parser.next()
+		path, err := parser.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		if err = parser.expect(tokenRightParen, ")"); err != nil {
+			return nil, err
+		}
+		return &existsNode{path: path}, nil
+	}
+
+	path, err := parser.parsePath()
+	if err != nil {
+		return nil, err
+	}
+
+	t = parser.next()
+	if t.typ == tokenOperator {
+		value, err := parser.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		return &compareNode{path: path, op: t.text, value: value}, nil
+	}
+
+	negate := false
+	if isKeyword(t, KeywordNot) {
+		negate = true
+		t = parser.next()
+	}
+	if !isKeyword(t, KeywordIn) {
+		return nil, newDocFilterError("Expected comparison operator or IN", t.pos)
+	}
+
+	values, err := parser.parseList()
+	if err != nil {
+		return nil, err
+	}
+	return &inNode{path: path, values: values, negate: negate}, nil
+}
+
+func (parser *docFilterParser) parsePath() ([]string, error) {
+	path := make([]string, 0)
+	for {
+		t := parser.next()
+		if t.typ != tokenIdentifier && t.typ != tokenNumber {
+			return nil, newDocFilterError("Expected field name", t.pos)
+		}
+		if isReservedKeyword(t) {
+			return nil, newDocFilterError(fmt.Sprintf("Keyword %v cannot be used as field name without backquotes", t.text), t.pos)
+		}
+		path = append(path, t.text)
+
+		if parser.peek().typ != tokenDot {
+			return path, nil
+		}
+		parser.next()
+	}
+}
+
+func (parser *docFilterParser) parseLiteral() (interface{}, error) {
+	t := parser.next()
+	switch {
+	case t.typ == tokenString:
+		return t.text, nil
+	case t.typ == tokenNumber:
+		// numbers in unmarshalled JSON documents are float64
+		value, _ := strconv.ParseFloat(t.text, 64)
+		return value, nil
+	case isKeyword(t, KeywordTrue):
+		return true, nil
+	case isKeyword(t, KeywordFalse):
+		return false, nil
+	case isKeyword(t, KeywordNull):
+		return nil, nil
+	}
+	return nil, newDocFilterError("Expected string, number, true, false or null", t.pos)
+}
+
+func (parser *docFilterParser) parseList() ([]interface{}, error) {
+	if err := parser.expect(tokenLeftBracket, "["); err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, 0)
+	if parser.peek().typ == tokenRightBracket {
+		parser.next()
+		return values, nil
+	}
+
+	for {
+		value, err := parser.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		t := parser.next()
+		if t.typ == tokenRightBracket {
+			return values, nil
+		}
+		if t.typ != tokenComma {
+			return nil, newDocFilterError("Expected \",\" or \"]\"", t.pos)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package filter
+
+import (
+	"testing"
+)
+
+const testDoc = `{
+	"type": "order",
+	"region": "eu",
+	"total": 120.5,
+	"paid": true,
+	"coupon": null,
+	"address": {"city": "Berlin", "zip code": "10115"},
+	"items": [{"sku": "a1", "qty": 2}, {"sku": "b2", "qty": 1}],
+	"matrix": [[1, 2], [3, 4]],
+	"and": "keyword field"
+}`
+
+func TestDocFilterTokenize(t *testing.T) {
+	tokens, err := tokenize("matrix.0.1 >= -1.5e2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		typ  tokenType
+		text string
+	}{
+		{tokenIdentifier, "matrix"}, {tokenDot, "."}, {tokenIdentifier, "0"}, {tokenDot, "."}, {tokenIdentifier, "1"},
+		{tokenOperator, ">="}, {tokenNumber, "-1.5e2"}, {tokenEOF, ""},
+	}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %v tokens, got %v", len(expected), len(tokens))
+	}
+	for i, e := range expected {
+		if tokens[i].typ != e.typ || tokens[i].text != e.text {
+			t.Errorf("Token %v: expected %v %q, got %v %q", i, e.typ, e.text, tokens[i].typ, tokens[i].text)
+		}
+	}
+}
+
+func TestDocFilterParseErrors(t *testing.T) {
+	invalid := []string{
+		"",
+		"   ",
+		"type ==",
+		"type == \"order",
+		"(type == \"order\"",
+		"type == \"order\" AND",
+		"type ~ 1",
+		"type ! 1",
+		"region IN eu",
+		"region IN [\"eu\" \"uk\"]",
+		"EXISTS(type",
+		"and == 1",
+		"`unterminated == 1",
+		"type == order",
+		"type == \"order\" total > 1",
+	}
+	for _, expression := range invalid {
+		if _, err := NewDocFilter(expression); err == nil {
+			t.Errorf("Expression %q should have been rejected", expression)
+		}
+	}
+}
+
+func TestDocFilterMatch(t *testing.T) {
+	expected := map[string]bool{
+		`type == "order"`:                   true,
+		`type = 'order'`:                    true,
+		`type != "order"`:                   false,
+		`TYPE == "order"`:                   false,
+		`total > 100`:                       true,
+		`total >= 120.5 AND total <= 120.5`: true,
+		`total < 100`:                       false,
+		`total > "100"`:                     false,
+		`region < "fr"`:                     true,
+		`paid == true`:                      true,
+		`paid == TRUE and coupon == null`:   true,
+		`address.city == "Berlin"`:          true,
+		"address.`zip code` == \"10115\"":   true,
+		"`and` == \"keyword field\"":        true,
+		`items.0.sku == "a1"`:               true,
+		`items.1.qty == 1`:                  true,
+		`items.2.sku == "c3"`:               false,
+		`matrix.0.1 == 2`:                   true,
+		`matrix.1.0 == 3`:                   true,
+		`region IN ["eu", "uk"]`:            true,
+		`region NOT IN ["eu", "uk"]`:        false,
+		`region IN []`:                      false,
+		`region NOT IN ["fr"]`:              true,
+		`region NOT IN []`:                  true,
+		`discount NOT IN [1, 2]`:            false,
+		`NOT discount IN [1, 2]`:            true,
+		`EXISTS(address.city)`:              true,
+		`NOT EXISTS(discount)`:              true,
+		`EXISTS(discount)`:                  false,
+		`discount != 1`:                     false,
+		`type == "order" AND (total < 100 OR paid == true)`:  true,
+		`type == "refund" OR region == "eu" AND total > 100`: true,
+		`NOT NOT type == "order"`:                            true,
+	}
+	for expression, match := range expected {
+		filter, err := NewDocFilter(expression)
+		if err != nil {
+			t.Errorf("Error parsing %q. err=%v", expression, err)
+			continue
+		}
+		if filter.Match([]byte(testDoc)) != match {
+			t.Errorf("Expression %q: expected match=%v", expression, match)
+		}
+	}
+}
+
+func TestDocFilterNonJSONBody(t *testing.T) {
+	filter, err := NewDocFilter(`NOT EXISTS(type)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.Match([]byte("not json")) {
+		t.Errorf("Body that is not valid JSON should never match")
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// types of key filter rules
+const (
+	KeyFilterInclude = "include"
+	KeyFilterExclude = "exclude"
+)
+
+var ErrorEmptyKeyFilter = errors.New("Structured key filter expression needs to contain at least one include or exclude pattern.")
+
+/************************************
+/* struct KeyFilter
+*************************************/
+
+// KeyFilter decides whether a document is replicated based on its key.
+// A key filter expression is either
+// 1. a plain regular expression, which keys need to match to be replicated, or
+// 2. a structured expression, which is a json object with ordered include and exclude pattern lists, e.g.,
+//
+//	{"include": ["^order::", "^user::"], "exclude": ["^tmp::", "::draft$"]}
+//
+// With a structured expression, a key is replicated if it matches none of the exclude patterns, and it
+// matches one of the include patterns or no include patterns have been specified.
+// Exclude patterns take precedence over include patterns. Within each list the first matching pattern
+// is reported as the rule that decided the fate of the key.
+type KeyFilter struct {
+	expression string
+	includes   []*KeyFilterRule
+	excludes   []*KeyFilterRule
+}
+
+type KeyFilterRule struct {
+	// KeyFilterInclude or KeyFilterExclude
+	Type string
+	// position of the rule in its list
+	Index   int
+	Pattern string
+	regexp  *regexp.Regexp
+}
+
+func (rule *KeyFilterRule) String() string {
+	return fmt.Sprintf("%v[%v]=%v", rule.Type, rule.Index, rule.Pattern)
+}
+
+type KeyFilterResult struct {
+	// whether the key passes the filter
+	Passed bool
+	// the rule that decided the result. nil if the key did not match any rule
+	Rule *KeyFilterRule
+}
+
+// json representation of structured key filter expression
+type structuredKeyFilter struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+func NewKeyFilter(expression string) (*KeyFilter, error) {
+	keyFilter := &KeyFilter{expression: expression}
+
+	if !IsStructuredKeyFilter(expression) {
+		// plain regular expression
+		regExp, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, err
+		}
+		keyFilter.includes = []*KeyFilterRule{&KeyFilterRule{Type: KeyFilterInclude, Index: 0, Pattern: expression, regexp: regExp}}
+		return keyFilter, nil
+	}
+
+	var structured structuredKeyFilter
+	decoder := json.NewDecoder(strings.NewReader(expression))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&structured)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid structured key filter expression. err=%v", err)
+	}
+	if len(structured.Include) == 0 && len(structured.Exclude) == 0 {
+		return nil, ErrorEmptyKeyFilter
+	}
+
+	keyFilter.includes, err = compileKeyFilterRules(KeyFilterInclude, structured.Include)
+	if err != nil {
+		return nil, err
+	}
+	keyFilter.excludes, err = compileKeyFilterRules(KeyFilterExclude, structured.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	return keyFilter, nil
+}
+
+func compileKeyFilterRules(ruleType string, patterns []string) ([]*KeyFilterRule, error) {
+	rules := make([]*KeyFilterRule, 0, len(patterns))
+	for index, pattern := range patterns {
+		regExp, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v pattern %v. err=%v", ruleType, pattern, err)
+		}
+		rules = append(rules, &KeyFilterRule{Type: ruleType, Index: index, Pattern: pattern, regexp: regExp})
+	}
+	return rules, nil
+}
+
+// a filter expression is structured if it is a json object. a plain regular expression is never a json object
+func IsStructuredKeyFilter(expression string) bool {
+	trimmed := strings.TrimSpace(expression)
+	if !strings.HasPrefix(trimmed, "{") {
+		return false
+	}
+	var obj map[string]interface{}
+	return json.Unmarshal([]byte(trimmed), &obj) == nil
+}
+
+func (keyFilter *KeyFilter) Expression() string {
+	return keyFilter.expression
+}
+
+// Match returns whether the key passes the filter
+func (keyFilter *KeyFilter) Match(key []byte) bool {
+	for _, rule := range keyFilter.excludes {
+		if rule.regexp.Match(key) {
+			return false
+		}
+	}
+	if len(keyFilter.includes) == 0 {
+		return true
+	}
+	for _, rule := range keyFilter.includes {
+		if rule.regexp.Match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate is the same as Match, except that it also returns the rule that decided the result.
+// It is meant for validation and troubleshooting, and is not used in the data path
+func (keyFilter *KeyFilter) Evaluate(key []byte) *KeyFilterResult {
+	for _, rule := range keyFilter.excludes {
+		if rule.regexp.Match(key) {
+			return &KeyFilterResult{Passed: false, Rule: rule}
+		}
+	}
+	if len(keyFilter.includes) == 0 {
+		return &KeyFilterResult{Passed: true}
+	}
+	for _, rule := range keyFilter.includes {
+		if rule.regexp.Match(key) {
+			return &KeyFilterResult{Passed: true, Rule: rule}
+		}
+	}
+	return &KeyFilterResult{Passed: false}
+}
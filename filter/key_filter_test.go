@@ -0,0 +1,111 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package filter
+
+import (
+	"testing"
+)
+
+func TestIsStructuredKeyFilter(t *testing.T) {
+	expected := map[string]bool{
+		`{"include": ["^a"]}`:   true,
+		` {"exclude": ["^a"]} `: true,
+		`{}`:                    true,
+		`^order::`:              false,
+		`{2,3}`:                 false,
+		`a{1}`:                  false,
+		`["^a"]`:                false,
+	}
+	for expression, structured := range expected {
+		if IsStructuredKeyFilter(expression) != structured {
+			t.Errorf("Expression %q: expected structured=%v", expression, structured)
+		}
+	}
+}
+
+func TestKeyFilterInvalidExpressions(t *testing.T) {
+	invalid := []string{
+		`(`,
+		`{}`,
+		`{"include": [], "exclude": []}`,
+		`{"include": ["("]}`,
+		`{"exclude": ["^a", "["]}`,
+		`{"include": ["^a"], "other": ["^b"]}`,
+		`{"include": "^a"}`,
+	}
+	for _, expression := range invalid {
+		if _, err := NewKeyFilter(expression); err == nil {
+			t.Errorf("Expression %q should have been rejected", expression)
+		}
+	}
+}
+
+func TestKeyFilterPlainRegularExpression(t *testing.T) {
+	keyFilter, err := NewKeyFilter(`^order::`)
+	if err != nil {
+		t.Fatalf("Error creating key filter. err=%v", err)
+	}
+	if !keyFilter.Match([]byte("order::1")) || keyFilter.Match([]byte("user::1")) {
+		t.Errorf("Plain regular expression should pass matching keys only")
+	}
+}
+
+func TestKeyFilterIncludeExcludePrecedence(t *testing.T) {
+	keyFilter, err := NewKeyFilter(`{"include": ["^order::", "^user::"], "exclude": ["^tmp::", "::draft$"]}`)
+	if err != nil {
+		t.Fatalf("Error creating key filter. err=%v", err)
+	}
+
+	tests := []struct {
+		key    string
+		passed bool
+		// rule expected to decide the result. empty when no rule matches
+		rule string
+	}{
+		{"order::1", true, "include[0]=^order::"},
+		{"user::1", true, "include[1]=^user::"},
+		// exclude patterns take precedence over include patterns
+		{"order::1::draft", false, "exclude[1]=::draft$"},
+		// the first matching pattern in a list is reported
+		{"tmp::order::draft", false, "exclude[0]=^tmp::"},
+		{"product::1", false, ""},
+	}
+	for _, test := range tests {
+		if keyFilter.Match([]byte(test.key)) != test.passed {
+			t.Errorf("Key %v: expected Match=%v", test.key, test.passed)
+		}
+		result := keyFilter.Evaluate([]byte(test.key))
+		if result.Passed != test.passed {
+			t.Errorf("Key %v: expected Passed=%v", test.key, test.passed)
+		}
+		rule := ""
+		if result.Rule != nil {
+			rule = result.Rule.String()
+		}
+		if rule != test.rule {
+			t.Errorf("Key %v: expected rule %q, got %q", test.key, test.rule, rule)
+		}
+	}
+}
+
+// with exclude patterns only, keys that do not match any of them pass
+func TestKeyFilterExcludeOnly(t *testing.T) {
+	keyFilter, err := NewKeyFilter(`{"exclude": ["^tmp::"]}`)
+	if err != nil {
+		t.Fatalf("Error creating key filter. err=%v", err)
+	}
+
+	if result := keyFilter.Evaluate([]byte("order::1")); !result.Passed || result.Rule != nil {
+		t.Errorf("Expected key to pass without matching any rule, got %v", result)
+	}
+	if !keyFilter.Match([]byte("order::1")) || keyFilter.Match([]byte("tmp::1")) {
+		t.Errorf("Expected only excluded keys to be filtered out")
+	}
+}
@@ -57,6 +57,8 @@ const (
 	XdcrLogFileName      = "xdcr.log"
 	XdcrTraceLogFileName = "xdcr_trace.log"
 	XdcrErrorLogFileName = "xdcr_errors.log"
+	// records of documents that lost conflict resolution
+	XdcrConflictLogFileName = "xdcr_conflicts.log"
 )
 
 // keep module separate from log.Logger so that we can control its formating
@@ -98,6 +100,10 @@ func CopyCtx(ctx_to_copy *LoggerContext) *LoggerContext {
 
 var DefaultLoggerContext *LoggerContext
 
+// writer of conflict records, which are not log entries and are not subject to log levels.
+// it is nil until Init is called, so that conflict records, which may include document bodies, never go to stdout
+var conflictLogWriter io.Writer
+
 // before logging paramters become available, direct all logging to stdout
 func init() {
 	logWriters := make(map[LogLevel]*LogWriter)
@@ -147,9 +153,23 @@ func Init(logFileDir string, maxLogFileSize, maxNumberOfLogFiles uint64) error {
 	xdcrErrorWriterWrapper := DefaultLoggerContext.Log_writers[LogLevelError]
 	xdcrErrorWriterWrapper.writer = xdcrErrorWriter
 
+	// xdcr conflict log file
+	xdcrConflictFilePath := filepath.Join(logFileDir, XdcrConflictLogFileName)
+	xdcrConflictWriter, err := NewRotatingLogFileWriter(xdcrConflictFilePath, maxLogFileSize, maxNumberOfLogFiles)
+	if err != nil {
+		return err
+	}
+	conflictLogWriter = xdcrConflictWriter
+
 	return nil
 }
 
+// returns the writer of conflict records, which is shared by all replications on this node.
+// returns nil when log files have not been set up by Init
+func ConflictLogWriter() io.Writer {
+	return conflictLogWriter
+}
+
 func NewLogger(module string, logger_context *LoggerContext) *CommonLogger {
 	context := DefaultLoggerContext
 	if logger_context != nil {
@@ -19,6 +19,7 @@ import (
 	"github.com/couchbase/goxdcr/service_def"
 	"github.com/couchbase/goxdcr/service_impl"
 	"os"
+	"path/filepath"
 	"runtime"
 	"time"
 )
@@ -37,6 +38,16 @@ var options struct {
 	logFileDir          string
 	maxLogFileSize      uint64
 	maxNumberOfLogFiles uint64
+
+	// config file for standalone mode, where xdcr runs without ns_server
+	standaloneConfig string
+
+	// authentication of adminport requests
+	adminportAuth       string
+	adminportAuthConfig string
+
+	// root directory of the export and replay directories of replications
+	archiveRootDir string
 }
 
 var max_retry_wait_for_metadata_service = 30
@@ -61,6 +72,15 @@ func argParse() {
 	flag.Uint64Var(&options.maxNumberOfLogFiles, "maxNumberOfLogFiles", 5,
 		"maximum number of log files")
 
+	flag.StringVar(&options.standaloneConfig, "standaloneConfig", "",
+		"config file for running xdcr in standalone mode without ns_server")
+	flag.StringVar(&options.adminportAuth, "adminportAuth", "",
+		"type of adminport authentication. cbauth, which is the default, or, in standalone mode only, token or cert. defaults to admin credentials in standalone mode")
+	flag.StringVar(&options.adminportAuthConfig, "adminportAuthConfig", "",
+		"config file for token or cert adminport authentication")
+	flag.StringVar(&options.archiveRootDir, "archiveRootDir", "",
+		"root directory that export and replay directories of replications need to be under. file export and replay are not available when it is not set")
+
 	flag.Parse()
 }
 
@@ -82,6 +102,29 @@ func main() {
 		log.Init(options.logFileDir, options.maxLogFileSize, options.maxNumberOfLogFiles)
 	}
 
+	if options.archiveRootDir != "" {
+		archiveRootDir, err := filepath.Abs(options.archiveRootDir)
+		if err != nil {
+			fmt.Printf("Error resolving archive root directory. err=%v\n", err)
+			os.Exit(1)
+		}
+		base.ArchiveRootDir = archiveRootDir
+	}
+
+	if options.adminportAuth != "" {
+		authenticator, err := rm.NewAdminportAuthenticator(options.adminportAuth, options.adminportAuthConfig, options.standaloneConfig != "")
+		if err != nil {
+			fmt.Printf("Error setting up adminport authentication. err=%v\n", err)
+			os.Exit(1)
+		}
+		rm.SetAdminportAuthenticator(authenticator)
+	}
+
+	if options.standaloneConfig != "" {
+		runStandalone(options.standaloneConfig)
+		return
+	}
+
 	cluster_info_svc := service_impl.NewClusterInfoSvc(nil)
 
 	top_svc, err := service_impl.NewXDCRTopologySvc(uint16(options.sourceKVAdminPort), uint16(options.xdcrRestPort), uint16(options.sslProxyUpstreamPort), options.isEnterprise, cluster_info_svc, nil)
@@ -138,41 +181,49 @@ func main() {
 			os.Exit(1)
 		}
 	} else {
-		uilog_svc := service_impl.NewUILogSvc(top_svc, nil)
-		remote_cluster_svc, err := metadata_svc.NewRemoteClusterService(uilog_svc, metakv_svc, top_svc, cluster_info_svc, nil)
-		if err != nil {
-			fmt.Printf("Error starting remote cluster service. err=%v\n", err)
-			os.Exit(1)
-		}
-		replication_spec_svc, err := metadata_svc.NewReplicationSpecService(uilog_svc, remote_cluster_svc, metakv_svc, top_svc, cluster_info_svc, nil)
-		if err != nil {
-			fmt.Printf("Error starting replication spec service. err=%v\n", err)
-			os.Exit(1)
-		}
-
-		internalSettings_svc := metadata_svc.NewInternalSettingsSvc(metakv_svc, nil)
-
-		// start replication manager in normal mode
-		rm.StartReplicationManager(host,
-			uint16(options.xdcrRestPort),
-			replication_spec_svc,
-			remote_cluster_svc,
-			cluster_info_svc,
-			top_svc,
-			metadata_svc.NewReplicationSettingsSvc(metakv_svc, nil),
-			metadata_svc.NewCheckpointsService(metakv_svc, nil),
-			service_impl.NewCAPIService(cluster_info_svc, nil),
-			audit_svc,
-			uilog_svc,
-			processSetting_svc,
-			bucketSettings_svc,
-			internalSettings_svc)
+		startReplicationManager(host, uint16(options.xdcrRestPort), top_svc, cluster_info_svc, metakv_svc, audit_svc,
+			processSetting_svc, bucketSettings_svc)
 
 		// keep main alive in normal mode
 		<-done
 	}
 }
 
+func startReplicationManager(host string, xdcrRestPort uint16, top_svc service_def.XDCRCompTopologySvc,
+	cluster_info_svc *service_impl.ClusterInfoSvc, metadata_service service_def.MetadataSvc, audit_svc service_def.AuditSvc,
+	processSetting_svc service_def.GlobalSettingsSvc, bucketSettings_svc service_def.BucketSettingsSvc) {
+	uilog_svc := service_impl.NewUILogSvc(top_svc, nil)
+	remote_cluster_svc, err := metadata_svc.NewRemoteClusterService(uilog_svc, metadata_service, top_svc, cluster_info_svc, nil)
+	if err != nil {
+		fmt.Printf("Error starting remote cluster service. err=%v\n", err)
+		os.Exit(1)
+	}
+	replication_spec_svc, err := metadata_svc.NewReplicationSpecService(uilog_svc, remote_cluster_svc, metadata_service, top_svc, cluster_info_svc, nil)
+	if err != nil {
+		fmt.Printf("Error starting replication spec service. err=%v\n", err)
+		os.Exit(1)
+	}
+
+	internalSettings_svc := metadata_svc.NewInternalSettingsSvc(metadata_service, nil)
+
+	// start replication manager in normal mode
+	rm.StartReplicationManager(host,
+		xdcrRestPort,
+		replication_spec_svc,
+		remote_cluster_svc,
+		cluster_info_svc,
+		top_svc,
+		metadata_svc.NewReplicationSettingsSvc(metadata_service, nil),
+		metadata_svc.NewCheckpointsService(metadata_service, nil),
+		service_impl.NewCAPIService(cluster_info_svc, nil),
+		audit_svc,
+		uilog_svc,
+		processSetting_svc,
+		bucketSettings_svc,
+		internalSettings_svc,
+		metadata_service)
+}
+
 // wait [for an upward of 30 seconds] for metadata service to become available
 func waitForMetadataService(metakv_svc service_def.MetadataSvc) error {
 	num_retry := 0
@@ -0,0 +1,78 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/couchbase/goxdcr/metadata_svc"
+	rm "github.com/couchbase/goxdcr/replication_manager"
+	"github.com/couchbase/goxdcr/service_impl"
+	"github.com/couchbase/goxdcr/standalone"
+	"github.com/couchbase/goxdcr/utils"
+	"os"
+)
+
+// runs xdcr without ns_server, cbauth and metakv.
+// cluster info that ns_server would have provided is served from the config file,
+// and metadata is kept in a local file
+func runStandalone(config_file string) {
+	config, err := standalone.LoadConfig(config_file)
+	if err != nil {
+		fmt.Printf("Error loading standalone config. err=%v\n", err)
+		os.Exit(1)
+	}
+	local := config.LocalCluster
+
+	// serve cluster info rest endpoints for all clusters involved
+	for _, cluster := range config.AllClusters() {
+		rest_server, err := standalone.NewClusterRestServer(cluster, nil)
+		if err == nil {
+			err = rest_server.Start()
+		}
+		if err != nil {
+			fmt.Printf("Error starting rest server for cluster %v. err=%v\n", cluster.RestAddr, err)
+			os.Exit(1)
+		}
+	}
+
+	// there is neither cbauth for kv and rest connections nor ns_server stdin to watch
+	utils.UseStaticLocalCredentials(local.Username, local.Password)
+	if options.adminportAuth == "" {
+		rm.SetAdminportAuthenticator(rm.NewStaticCredentialsAuthenticator(config.AdminUsername, config.AdminPassword))
+	}
+	rm.PollStdinForShutdown = false
+
+	localRestPort, err := utils.GetPortNumber(local.RestAddr)
+	if err != nil {
+		fmt.Printf("Error parsing rest address of local cluster. err=%v\n", err)
+		os.Exit(1)
+	}
+	// this process is the only node of local cluster that serves rest endpoints, which is at rest address of local cluster
+	top_svc, err := service_impl.NewStaticXDCRTopologySvc(utils.GetHostName(local.RestAddr), localRestPort, local.KVNodes,
+		local.UUID, local.Version, local.IsEnterprise, local.Username, local.Password, nil)
+	if err != nil {
+		fmt.Printf("Error starting xdcr topology service. err=%v\n", err)
+		os.Exit(1)
+	}
+
+	file_metadata_svc, err := metadata_svc.NewFileMetadataSvc(config.MetadataFile, nil)
+	if err != nil {
+		fmt.Printf("Error starting metadata service. err=%v\n", err)
+		os.Exit(1)
+	}
+
+	startReplicationManager(config.XdcrRestHost, config.XdcrRestPort, top_svc, service_impl.NewClusterInfoSvc(nil),
+		file_metadata_svc, service_impl.NewLogAuditSvc(nil),
+		metadata_svc.NewGlobalSettingsSvc(file_metadata_svc, nil),
+		metadata_svc.NewBucketSettingsService(file_metadata_svc, top_svc, nil))
+
+	// keep main alive
+	<-done
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/couchbase/goxdcr/base"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/simple_utils"
+	"math"
 	"strconv"
 )
 
@@ -18,6 +19,8 @@ var logger_ps *log.CommonLogger = log.NewLogger("GlobalSetting", log.DefaultLogg
 const (
 	GoMaxProcs = "gomaxprocs"
 	GoGC       = "gogc"
+	// bandwidth budget, in bytes per second, shared by all replications on a node
+	BandwidthBudget = "bandwidth_budget"
 	//setting that would be applied at the GOXDCR Process level that would affect all replications
 	DefaultGlobalSettingsKey = "GlobalSettings"
 	GlobalConfigurationKey   = "GlobalConfiguration"
@@ -28,9 +31,13 @@ var GoMaxProcsConfig = &SettingsConfig{4, &Range{1, 10000}}
 // -1 indicates that GC is disabled completely
 var GoGCConfig = &SettingsConfig{100, &Range{-1, 10000}}
 
+// 0 indicates that there is no bandwidth budget
+var BandwidthBudgetConfig = &SettingsConfig{0, &Range{0, math.MaxInt32}}
+
 var GlobalSettingsConfigMap = map[string]*SettingsConfig{
-	GoMaxProcs: GoMaxProcsConfig,
-	GoGC:       GoGCConfig,
+	GoMaxProcs:      GoMaxProcsConfig,
+	GoGC:            GoGCConfig,
+	BandwidthBudget: BandwidthBudgetConfig,
 }
 
 type GlobalSettings struct {
@@ -41,13 +48,17 @@ type GlobalSettings struct {
 	//a collection is triggered when the ratio of freshly allocated data to
 	//live data remaining after the previous collection reaches this percentage.
 	GoGC int `json:"goGC"`
+	//bandwidth budget, in bytes per second, that is divided among the running replications on each node
+	//in proportion to their weights. it applies in addition to the bandwidth limits of individual replications
+	BandwidthBudget int `json:"bandwidthBudget"`
 	// revision number to be used by metadata service. not included in json
 	Revision interface{}
 }
 
 func DefaultGlobalSettings() *GlobalSettings {
 	return &GlobalSettings{GoMaxProcs: GoMaxProcsConfig.defaultValue.(int),
-		GoGC: GoGCConfig.defaultValue.(int)}
+		GoGC:            GoGCConfig.defaultValue.(int),
+		BandwidthBudget: BandwidthBudgetConfig.defaultValue.(int)}
 }
 
 func ValidateGlobalSettingsKey(settingsMap map[string]interface{}) (globalSettingsMap map[string]interface{}) {
@@ -58,6 +69,8 @@ func ValidateGlobalSettingsKey(settingsMap map[string]interface{}) (globalSettin
 		case GoMaxProcs:
 			fallthrough
 		case GoGC:
+			fallthrough
+		case BandwidthBudget:
 			globalSettingsMap[key] = val
 		}
 	}
@@ -94,6 +107,16 @@ func (s *GlobalSettings) UpdateSettingsFromMap(settingsMap map[string]interface{
 				s.GoGC = gogc
 				changedSettingsMap[key] = gogc
 			}
+		case BandwidthBudget:
+			bandwidthBudget, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.BandwidthBudget != bandwidthBudget {
+				s.BandwidthBudget = bandwidthBudget
+				changedSettingsMap[key] = bandwidthBudget
+			}
 		}
 	}
 	return
@@ -104,6 +127,8 @@ func ValidateAndConvertGlobalSettingsValue(key, value, errorKey string) (convert
 	case GoMaxProcs:
 		fallthrough
 	case GoGC:
+		fallthrough
+	case BandwidthBudget:
 		convertedValue, err = strconv.ParseInt(value, base.ParseIntBase, base.ParseIntBitSize)
 		if err != nil {
 			err = simple_utils.IncorrectValueTypeError("an integer")
@@ -125,6 +150,7 @@ func (s *GlobalSettings) ToMap() map[string]interface{} {
 	settings_map := make(map[string]interface{})
 	settings_map[GoMaxProcs] = s.GoMaxProcs
 	settings_map[GoGC] = s.GoGC
+	settings_map[BandwidthBudget] = s.BandwidthBudget
 	return settings_map
 }
 
@@ -142,5 +168,5 @@ func (s *GlobalSettings) String() string {
 	if s == nil {
 		return "nil"
 	}
-	return fmt.Sprintf("GoMaxProcs:%v, GoGC:%v", s.GoMaxProcs, s.GoGC)
+	return fmt.Sprintf("GoMaxProcs:%v, GoGC:%v, BandwidthBudget:%v", s.GoMaxProcs, s.GoGC, s.BandwidthBudget)
 }
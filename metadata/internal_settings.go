@@ -20,6 +20,7 @@ const (
 	TimeoutCheckpointBeforeStopKey         = "TimeoutCheckpointBeforeStop"
 	CapiDataChanSizeMultiplierKey          = "CapiDataChanSizeMultiplier"
 	RefreshRemoteClusterRefIntervalKey     = "RefreshRemoteClusterRefInterval"
+	KnownClustersCycleCheckModeKey         = "KnownClustersCycleCheckMode"
 )
 
 var TopologyChangeCheckIntervalConfig = &SettingsConfig{10, &Range{1, 100}}
@@ -29,6 +30,7 @@ var MaxWorkersForCheckpointingConfig = &SettingsConfig{5, &Range{1, 1000}}
 var TimeoutCheckpointBeforeStopConfig = &SettingsConfig{180, &Range{10, 1800}}
 var CapiDataChanSizeMultiplierConfig = &SettingsConfig{1, &Range{1, 100}}
 var RefreshRemoteClusterRefIntervalConfig = &SettingsConfig{15, &Range{1, 3600}}
+var KnownClustersCycleCheckModeConfig = &SettingsConfig{base.KnownClustersCycleCheckModeWarn, &Range{base.KnownClustersCycleCheckModeOff, base.KnownClustersCycleCheckModeRefuse}}
 
 var XDCRInternalSettingsConfigMap = map[string]*SettingsConfig{
 	TopologyChangeCheckIntervalKey:         TopologyChangeCheckIntervalConfig,
@@ -38,6 +40,7 @@ var XDCRInternalSettingsConfigMap = map[string]*SettingsConfig{
 	TimeoutCheckpointBeforeStopKey:         TimeoutCheckpointBeforeStopConfig,
 	CapiDataChanSizeMultiplierKey:          CapiDataChanSizeMultiplierConfig,
 	RefreshRemoteClusterRefIntervalKey:     RefreshRemoteClusterRefIntervalConfig,
+	KnownClustersCycleCheckModeKey:         KnownClustersCycleCheckModeConfig,
 }
 
 type InternalSettings struct {
@@ -60,6 +63,11 @@ type InternalSettings struct {
 	// interval for refreshing remote cluster references
 	RefreshRemoteClusterRefInterval int
 
+	// what to do when a new replication creates a replication cycle through known clusters, i.e., the local cluster
+	// and the remote clusters it has references to, that is longer than a simple bidirectional pair
+	// 0 - no check, 1 - log a warning, 2 - refuse the replication
+	KnownClustersCycleCheckMode int
+
 	// revision number to be used by metadata service. not included in json
 	Revision interface{}
 }
@@ -72,7 +80,8 @@ func DefaultInternalSettings() *InternalSettings {
 		MaxWorkersForCheckpointing:          MaxWorkersForCheckpointingConfig.defaultValue.(int),
 		TimeoutCheckpointBeforeStop:         TimeoutCheckpointBeforeStopConfig.defaultValue.(int),
 		CapiDataChanSizeMultiplier:          CapiDataChanSizeMultiplierConfig.defaultValue.(int),
-		RefreshRemoteClusterRefInterval:     RefreshRemoteClusterRefIntervalConfig.defaultValue.(int)}
+		RefreshRemoteClusterRefInterval:     RefreshRemoteClusterRefIntervalConfig.defaultValue.(int),
+		KnownClustersCycleCheckMode:         KnownClustersCycleCheckModeConfig.defaultValue.(int)}
 }
 
 func (s *InternalSettings) Equals(s2 *InternalSettings) bool {
@@ -90,7 +99,8 @@ func (s *InternalSettings) Equals(s2 *InternalSettings) bool {
 		s.MaxWorkersForCheckpointing == s2.MaxWorkersForCheckpointing &&
 		s.TimeoutCheckpointBeforeStop == s2.TimeoutCheckpointBeforeStop &&
 		s.CapiDataChanSizeMultiplier == s2.CapiDataChanSizeMultiplier &&
-		s.RefreshRemoteClusterRefInterval == s2.RefreshRemoteClusterRefInterval
+		s.RefreshRemoteClusterRefInterval == s2.RefreshRemoteClusterRefInterval &&
+		s.KnownClustersCycleCheckMode == s2.KnownClustersCycleCheckMode
 }
 
 func (s *InternalSettings) UpdateSettingsFromMap(settingsMap map[string]interface{}) (changed bool, errorMap map[string]error) {
@@ -169,6 +179,16 @@ func (s *InternalSettings) UpdateSettingsFromMap(settingsMap map[string]interfac
 				s.RefreshRemoteClusterRefInterval = refreshInterval
 				changed = true
 			}
+		case KnownClustersCycleCheckModeKey:
+			checkMode, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.KnownClustersCycleCheckMode != checkMode {
+				s.KnownClustersCycleCheckMode = checkMode
+				changed = true
+			}
 		default:
 			errorMap[key] = fmt.Errorf("Invalid key in map, %v", key)
 		}
@@ -181,7 +201,7 @@ func ValidateAndConvertXDCRInternalSettingsValue(key, value string) (convertedVa
 	switch key {
 	case TopologyChangeCheckIntervalKey, MaxTopologyChangeCountBeforeRestartKey, MaxTopologyStableCountBeforeRestartKey,
 		MaxWorkersForCheckpointingKey, TimeoutCheckpointBeforeStopKey, CapiDataChanSizeMultiplierKey,
-		RefreshRemoteClusterRefIntervalKey:
+		RefreshRemoteClusterRefIntervalKey, KnownClustersCycleCheckModeKey:
 		convertedValue, err = strconv.ParseInt(value, base.ParseIntBase, base.ParseIntBitSize)
 		if err != nil {
 			err = simple_utils.IncorrectValueTypeError("an integer")
@@ -209,5 +229,6 @@ func (s *InternalSettings) ToMap() map[string]interface{} {
 	settings_map[TimeoutCheckpointBeforeStopKey] = s.TimeoutCheckpointBeforeStop
 	settings_map[CapiDataChanSizeMultiplierKey] = s.CapiDataChanSizeMultiplier
 	settings_map[RefreshRemoteClusterRefIntervalKey] = s.RefreshRemoteClusterRefInterval
+	settings_map[KnownClustersCycleCheckModeKey] = s.KnownClustersCycleCheckMode
 	return settings_map
 }
@@ -13,15 +13,23 @@ import (
 	"errors"
 	"fmt"
 	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/filter"
 	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/processor"
 	"github.com/couchbase/goxdcr/simple_utils"
-	"regexp"
+	"github.com/couchbase/goxdcr/transform"
+	"math"
+	"net/url"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 const (
 	ReplicationType                = "replication_type"
 	FilterExpression               = "filter_expression"
+	DocFilterExpression            = "doc_filter_expression"
+	FilterChangeMode               = "filter_change_mode"
 	Active                         = "active"
 	CheckpointInterval             = "checkpoint_interval"
 	BatchCount                     = "worker_batch_size"
@@ -34,17 +42,112 @@ const (
 	TimeoutPercentageCap           = "timeout_percentage_cap"
 	PipelineLogLevel               = "log_level"
 	PipelineStatsInterval          = "stats_interval"
+	DropDeletions                  = "drop_deletions"
+	DropExpirations                = "drop_expirations"
+	KeyTransformRules              = "key_transform_rules"
+	RedactionRules                 = "redaction_rules"
+	RedactionHashKey               = "redaction_hash_key"
+	Processors                     = "processors"
+	SamplingPercentage             = "sampling_percentage"
+	CompressionType                = "compression_type"
+	BandwidthLimit                 = "bandwidth_limit"
+	Priority                       = "priority"
+	DedupInBatch                   = "dedup_in_batch"
+	ConflictResolver               = "conflict_resolver"
+	ConflictResolverField          = "conflict_resolver_field"
+	ConflictLogDestination         = "conflict_log_destination"
+	ConflictLogBucket              = "conflict_log_bucket"
+	ConflictLogBodies              = "conflict_log_bodies"
+	ExportDir                      = "export_dir"
+	ExportFormat                   = "export_format"
+	ExportFileSizeMB               = "export_file_size_mb"
+	ExportMaxFiles                 = "export_max_files"
+	ReplayDir                      = "replay_dir"
+	ReplayFormat                   = "replay_format"
+	ReplayStartSeqno               = "replay_start_seqno"
+	ReplayEndSeqno                 = "replay_end_seqno"
+	WebhookURL                     = "webhook_url"
+	WebhookAuthHeader              = "webhook_auth_header"
 )
 
 // settings whose default values cannot be viewed or changed through rest apis
-var ImmutableDefaultSettings = [3]string{ReplicationType, FilterExpression, Active}
+var ImmutableDefaultSettings = [9]string{ReplicationType, FilterExpression, DocFilterExpression, FilterChangeMode, Active,
+	KeyTransformRules, RedactionRules, RedactionHashKey, Processors}
+
+// settings that carry secrets, which are never returned by rest apis, and are masked in logs
+var SensitiveSettings = map[string]bool{RedactionHashKey: true, WebhookAuthHeader: true}
+
+// what the values of sensitive settings are replaced with in logs
+const SensitiveSettingMask = "xxxx"
 
 // settings whose values cannot be changed after replication is created
-var ImmutableSettings = [1]string{FilterExpression}
+var ImmutableSettings = [0]string{}
 
 const (
 	ReplicationTypeXmem = "xmem"
 	ReplicationTypeCapi = "capi"
+	// mutations are exported to local files instead of being sent to a target bucket
+	ReplicationTypeFile = "file"
+	// mutations are posted to an http endpoint instead of being sent to a target bucket
+	ReplicationTypeWebhook = "webhook"
+)
+
+// how changes to filter expressions are applied to an existing replication
+const (
+	// new filter expressions apply to mutations streamed after the change. checkpoints are kept
+	FilterChangeModeForward = "forward"
+	// checkpoints are reset so that documents that newly match the filter expressions are re-sent
+	FilterChangeModeBackfill = "backfill"
+)
+
+// how document bodies are compressed when they are sent to target
+const (
+	CompressionTypeNone = "None"
+	// bodies are compressed with snappy when target supports it and when compression reduces their sizes.
+	// applies to xmem replication only
+	CompressionTypeSnappy = "Snappy"
+)
+
+// priorities of replications
+const (
+	PriorityTypeHigh   = "High"
+	PriorityTypeMedium = "Medium"
+	PriorityTypeLow    = "Low"
+)
+
+// how conflicts between source documents and their existing versions on target are resolved
+const (
+	// revision id based or last write wins, depending on the conflict resolution mode of source bucket
+	ConflictResolverTypeDefault = "Default"
+	// source documents always overwrite their versions on target
+	ConflictResolverTypeSourceWins = "SourceWins"
+	// source documents are sent only when they do not exist on target
+	ConflictResolverTypeTargetWins = "TargetWins"
+	// the version with the greater value of the json field specified by ConflictResolverField wins
+	ConflictResolverTypeField = "Field"
+)
+
+var ErrorEmptyConflictResolverField = errors.New("Conflict resolver field needs to be specified for field based conflict resolution.")
+var ErrorConflictResolverNotSupportedForCapi = errors.New("Only the default conflict resolver is supported for capi replication.")
+var ErrorArchiveRootDirNotSet = errors.New("Archive root directory has not been configured. File export and replay are not available.")
+var ErrorArchiveDirOutsideRoot = errors.New("Export and replay directories need to be under the archive root directory, and cannot contain \"..\".")
+
+// where documents that lost conflict resolution at source side are recorded
+const (
+	// not recorded
+	ConflictLogDestinationNone = "None"
+	// recorded in a rotating file in the log directory of the node. requires xdcr to be started with a log file directory
+	ConflictLogDestinationFile = "File"
+	// recorded as documents in the local bucket specified by ConflictLogBucket
+	ConflictLogDestinationBucket = "Bucket"
+)
+
+// formats of the files that file replications export mutations to
+const (
+	// one json object per line
+	ExportFormatJSON = "JSON"
+	// compact binary records with fixed size headers
+	ExportFormatBinary = "Binary"
 )
 
 type SettingsConfig struct {
@@ -60,6 +163,8 @@ type Range struct {
 // TODO change to "capi"?
 var ReplicationTypeConfig = &SettingsConfig{ReplicationTypeXmem, nil}
 var FilterExpressionConfig = &SettingsConfig{"", nil}
+var DocFilterExpressionConfig = &SettingsConfig{"", nil}
+var FilterChangeModeConfig = &SettingsConfig{FilterChangeModeForward, nil}
 var ActiveConfig = &SettingsConfig{true, nil}
 var CheckpointIntervalConfig = &SettingsConfig{1800, &Range{60, 14400}}
 var BatchCountConfig = &SettingsConfig{500, &Range{10, 10000}}
@@ -72,10 +177,38 @@ var MaxExpectedReplicationLagConfig = &SettingsConfig{1000, &Range{100, 60000}}
 var TimeoutPercentageCapConfig = &SettingsConfig{50, &Range{0, 100}}
 var PipelineLogLevelConfig = &SettingsConfig{log.LogLevelInfo, nil}
 var PipelineStatsIntervalConfig = &SettingsConfig{1000, &Range{200, 600000}}
+var DropDeletionsConfig = &SettingsConfig{false, nil}
+var DropExpirationsConfig = &SettingsConfig{false, nil}
+var KeyTransformRulesConfig = &SettingsConfig{"", nil}
+var RedactionRulesConfig = &SettingsConfig{"", nil}
+var RedactionHashKeyConfig = &SettingsConfig{"", nil}
+var ProcessorsConfig = &SettingsConfig{"", nil}
+var SamplingPercentageConfig = &SettingsConfig{100, &Range{1, 100}}
+var CompressionTypeConfig = &SettingsConfig{CompressionTypeNone, nil}
+var BandwidthLimitConfig = &SettingsConfig{0, &Range{0, math.MaxInt32}}
+var PriorityConfig = &SettingsConfig{PriorityTypeMedium, nil}
+var DedupInBatchConfig = &SettingsConfig{false, nil}
+var ConflictResolverConfig = &SettingsConfig{ConflictResolverTypeDefault, nil}
+var ConflictResolverFieldConfig = &SettingsConfig{"", nil}
+var ConflictLogDestinationConfig = &SettingsConfig{ConflictLogDestinationNone, nil}
+var ConflictLogBucketConfig = &SettingsConfig{"", nil}
+var ConflictLogBodiesConfig = &SettingsConfig{false, nil}
+var ExportDirConfig = &SettingsConfig{"", nil}
+var ExportFormatConfig = &SettingsConfig{ExportFormatJSON, nil}
+var ExportFileSizeMBConfig = &SettingsConfig{64, &Range{1, 10240}}
+var ExportMaxFilesConfig = &SettingsConfig{0, &Range{0, math.MaxInt32}}
+var ReplayDirConfig = &SettingsConfig{"", nil}
+var ReplayFormatConfig = &SettingsConfig{ExportFormatJSON, nil}
+var ReplayStartSeqnoConfig = &SettingsConfig{0, &Range{0, math.MaxInt32}}
+var ReplayEndSeqnoConfig = &SettingsConfig{0, &Range{0, math.MaxInt32}}
+var WebhookURLConfig = &SettingsConfig{"", nil}
+var WebhookAuthHeaderConfig = &SettingsConfig{"", nil}
 
 var SettingsConfigMap = map[string]*SettingsConfig{
 	ReplicationType:                ReplicationTypeConfig,
 	FilterExpression:               FilterExpressionConfig,
+	DocFilterExpression:            DocFilterExpressionConfig,
+	FilterChangeMode:               FilterChangeModeConfig,
 	Active:                         ActiveConfig,
 	CheckpointInterval:             CheckpointIntervalConfig,
 	BatchCount:                     BatchCountConfig,
@@ -88,6 +221,32 @@ var SettingsConfigMap = map[string]*SettingsConfig{
 	TimeoutPercentageCap:           TimeoutPercentageCapConfig,
 	PipelineLogLevel:               PipelineLogLevelConfig,
 	PipelineStatsInterval:          PipelineStatsIntervalConfig,
+	DropDeletions:                  DropDeletionsConfig,
+	DropExpirations:                DropExpirationsConfig,
+	KeyTransformRules:              KeyTransformRulesConfig,
+	RedactionRules:                 RedactionRulesConfig,
+	RedactionHashKey:               RedactionHashKeyConfig,
+	Processors:                     ProcessorsConfig,
+	SamplingPercentage:             SamplingPercentageConfig,
+	CompressionType:                CompressionTypeConfig,
+	BandwidthLimit:                 BandwidthLimitConfig,
+	Priority:                       PriorityConfig,
+	DedupInBatch:                   DedupInBatchConfig,
+	ConflictResolver:               ConflictResolverConfig,
+	ConflictResolverField:          ConflictResolverFieldConfig,
+	ConflictLogDestination:         ConflictLogDestinationConfig,
+	ConflictLogBucket:              ConflictLogBucketConfig,
+	ConflictLogBodies:              ConflictLogBodiesConfig,
+	ExportDir:                      ExportDirConfig,
+	ExportFormat:                   ExportFormatConfig,
+	ExportFileSizeMB:               ExportFileSizeMBConfig,
+	ExportMaxFiles:                 ExportMaxFilesConfig,
+	ReplayDir:                      ReplayDirConfig,
+	ReplayFormat:                   ReplayFormatConfig,
+	ReplayStartSeqno:               ReplayStartSeqnoConfig,
+	ReplayEndSeqno:                 ReplayEndSeqnoConfig,
+	WebhookURL:                     WebhookURLConfig,
+	WebhookAuthHeader:              WebhookAuthHeaderConfig,
 }
 
 /***********************************
@@ -98,9 +257,17 @@ type ReplicationSettings struct {
 	//type - XMEM or CAPI
 	RepType string `json:"type"`
 
-	//the filter expression
+	//the filter expression on document keys. either a regular expression, or a json object
+	//with include and exclude pattern lists, e.g., {"include": ["^order::"], "exclude": ["^tmp::"]}
 	FilterExpression string `json:"filter_exp"`
 
+	//the filter expression on document bodies, e.g., type == "order" AND region IN ["eu", "uk"]
+	DocFilterExpression string `json:"doc_filter_exp"`
+
+	//how the last change to filter expressions is applied, forward or backfill
+	//default: forward
+	FilterChangeMode string `json:"filter_change_mode"`
+
 	//if the replication is active
 	//default is true
 	Active bool `json:"active"`
@@ -160,6 +327,100 @@ type ReplicationSettings struct {
 	//default:5 second
 	StatsInterval int `json:"stats_interval"`
 
+	//if true, deletions are not replicated to target
+	//default: false
+	DropDeletions bool `json:"drop_deletions"`
+
+	//if true, expirations are not replicated to target
+	//default: false
+	DropExpirations bool `json:"drop_expirations"`
+
+	//rules that rewrite document keys before they are sent to target, as a json array, e.g.,
+	//[{"type": "addPrefix", "value": "siteA::"}]. default: no rewriting
+	KeyTransformRules string `json:"key_transform_rules"`
+
+	//rules that mask fields in json document bodies before they are sent to target, as a json array, e.g.,
+	//[{"field": "email", "action": "hash"}]. default: no redaction
+	RedactionRules string `json:"redaction_rules"`
+
+	//key of the hmac that hash action of redaction rules replaces field values with. needed by hash action only
+	RedactionHashKey string `json:"redaction_hash_key"`
+
+	//comma separated list of registered processor types, e.g., "mask,enrich", which are run in the order listed
+	//on documents between routers and outgoing nozzles. default: no processors
+	Processors string `json:"processors"`
+
+	// percentage of document keys to be replicated. documents are sampled deterministically by the hash of their keys,
+	// so the same subset of documents is replicated every time. 100 replicates all documents
+	SamplingPercentage int `json:"sampling_percentage"`
+
+	// whether document bodies are compressed when they are sent to target, CompressionTypeNone or CompressionTypeSnappy
+	CompressionType string `json:"compression_type"`
+
+	// limit on the network bandwidth, in bytes per second, that the replication can use on each node
+	// to send data to target. 0 means no limit
+	BandwidthLimit int `json:"bandwidth_limit"`
+
+	// priority of the replication, PriorityTypeHigh, PriorityTypeMedium or PriorityTypeLow. replications with higher priorities
+	// are started first, and get more of the resources of the node, e.g., network bandwidth, when they compete for them
+	Priority string `json:"priority"`
+
+	// whether only the newest version of each document in a batch is sent to target when a batch contains multiple versions
+	// of the same document. applies to xmem replication only
+	DedupInBatch bool `json:"dedup_in_batch"`
+
+	// how conflicts between source documents and their existing versions on target are resolved,
+	// ConflictResolverTypeDefault, ConflictResolverTypeSourceWins, ConflictResolverTypeTargetWins or ConflictResolverTypeField.
+	// capi replication supports ConflictResolverTypeDefault only
+	ConflictResolver string `json:"conflict_resolver"`
+
+	// the json field, e.g., updatedAt, whose values decide conflicts when conflict resolver is ConflictResolverTypeField.
+	// nested fields are specified as dotted paths
+	ConflictResolverField string `json:"conflict_resolver_field"`
+
+	// where documents that lost conflict resolution at source side are recorded, ConflictLogDestinationNone,
+	// ConflictLogDestinationFile or ConflictLogDestinationBucket
+	ConflictLogDestination string `json:"conflict_log_destination"`
+
+	// the local bucket that conflict records are written to when conflict log destination is ConflictLogDestinationBucket
+	ConflictLogBucket string `json:"conflict_log_bucket"`
+
+	// whether the bodies of both source and target versions of documents are included in conflict records
+	ConflictLogBodies bool `json:"conflict_log_bodies"`
+
+	// the local directory that file replications export mutations to. applies to file replication only
+	ExportDir string `json:"export_dir"`
+
+	// format of export files, ExportFormatJSON or ExportFormatBinary. applies to file replication only
+	ExportFormat string `json:"export_format"`
+
+	// size, in MB, beyond which export files are rotated. applies to file replication only
+	ExportFileSizeMB int `json:"export_file_size_mb"`
+
+	// the maximum number of export files kept for each vbucket. the oldest files are removed when
+	// newer ones are rotated to. 0 means that all files are kept. applies to file replication only
+	ExportMaxFiles int `json:"export_max_files"`
+
+	// the archive directory, written by a file replication, that mutations are replayed from.
+	// when specified, source nozzles read archive files in the directory instead of streaming from dcp
+	ReplayDir string `json:"replay_dir"`
+
+	// format of the archive files in replay directory, ExportFormatJSON or ExportFormatBinary
+	ReplayFormat string `json:"replay_format"`
+
+	// the smallest source seqno of the mutations to be replayed. 0 means that there is no lower bound
+	ReplayStartSeqno int `json:"replay_start_seqno"`
+
+	// the largest source seqno of the mutations to be replayed. 0 means that there is no upper bound
+	ReplayEndSeqno int `json:"replay_end_seqno"`
+
+	// the http or https url that mutations are posted to. applies to webhook replication only
+	WebhookURL string `json:"webhook_url"`
+
+	// value of the Authorization header of the requests posted to webhook url, e.g., "Bearer <token>".
+	// no Authorization header is sent when empty. applies to webhook replication only
+	WebhookAuthHeader string `json:"webhook_auth_header"`
+
 	// revision number to be used by metadata service. not included in json
 	Revision interface{}
 }
@@ -168,6 +429,8 @@ func DefaultSettings() *ReplicationSettings {
 	return &ReplicationSettings{
 		RepType:                        ReplicationTypeConfig.defaultValue.(string),
 		FilterExpression:               FilterExpressionConfig.defaultValue.(string),
+		DocFilterExpression:            DocFilterExpressionConfig.defaultValue.(string),
+		FilterChangeMode:               FilterChangeModeConfig.defaultValue.(string),
 		Active:                         ActiveConfig.defaultValue.(bool),
 		CheckpointInterval:             CheckpointIntervalConfig.defaultValue.(int),
 		BatchCount:                     BatchCountConfig.defaultValue.(int),
@@ -180,6 +443,32 @@ func DefaultSettings() *ReplicationSettings {
 		TimeoutPercentageCap:           TimeoutPercentageCapConfig.defaultValue.(int),
 		LogLevel:                       PipelineLogLevelConfig.defaultValue.(log.LogLevel),
 		StatsInterval:                  PipelineStatsIntervalConfig.defaultValue.(int),
+		DropDeletions:                  DropDeletionsConfig.defaultValue.(bool),
+		DropExpirations:                DropExpirationsConfig.defaultValue.(bool),
+		KeyTransformRules:              KeyTransformRulesConfig.defaultValue.(string),
+		RedactionRules:                 RedactionRulesConfig.defaultValue.(string),
+		RedactionHashKey:               RedactionHashKeyConfig.defaultValue.(string),
+		Processors:                     ProcessorsConfig.defaultValue.(string),
+		SamplingPercentage:             SamplingPercentageConfig.defaultValue.(int),
+		CompressionType:                CompressionTypeConfig.defaultValue.(string),
+		BandwidthLimit:                 BandwidthLimitConfig.defaultValue.(int),
+		Priority:                       PriorityConfig.defaultValue.(string),
+		DedupInBatch:                   DedupInBatchConfig.defaultValue.(bool),
+		ConflictResolver:               ConflictResolverConfig.defaultValue.(string),
+		ConflictResolverField:          ConflictResolverFieldConfig.defaultValue.(string),
+		ConflictLogDestination:         ConflictLogDestinationConfig.defaultValue.(string),
+		ConflictLogBucket:              ConflictLogBucketConfig.defaultValue.(string),
+		ConflictLogBodies:              ConflictLogBodiesConfig.defaultValue.(bool),
+		ExportDir:                      ExportDirConfig.defaultValue.(string),
+		ExportFormat:                   ExportFormatConfig.defaultValue.(string),
+		ExportFileSizeMB:               ExportFileSizeMBConfig.defaultValue.(int),
+		ExportMaxFiles:                 ExportMaxFilesConfig.defaultValue.(int),
+		ReplayDir:                      ReplayDirConfig.defaultValue.(string),
+		ReplayFormat:                   ReplayFormatConfig.defaultValue.(string),
+		ReplayStartSeqno:               ReplayStartSeqnoConfig.defaultValue.(int),
+		ReplayEndSeqno:                 ReplayEndSeqnoConfig.defaultValue.(int),
+		WebhookURL:                     WebhookURLConfig.defaultValue.(string),
+		WebhookAuthHeader:              WebhookAuthHeaderConfig.defaultValue.(string),
 	}
 }
 
@@ -221,6 +510,26 @@ func (s *ReplicationSettings) UpdateSettingsFromMap(settingsMap map[string]inter
 				s.FilterExpression = filterExpression
 				changedSettingsMap[key] = filterExpression
 			}
+		case DocFilterExpression:
+			docFilterExpression, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.DocFilterExpression != docFilterExpression {
+				s.DocFilterExpression = docFilterExpression
+				changedSettingsMap[key] = docFilterExpression
+			}
+		case FilterChangeMode:
+			filterChangeMode, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.FilterChangeMode != filterChangeMode {
+				s.FilterChangeMode = filterChangeMode
+				changedSettingsMap[key] = filterChangeMode
+			}
 		case Active:
 			active, ok := val.(bool)
 			if !ok {
@@ -342,6 +651,266 @@ func (s *ReplicationSettings) UpdateSettingsFromMap(settingsMap map[string]inter
 				s.StatsInterval = interval
 				changedSettingsMap[key] = interval
 			}
+		case DropDeletions:
+			dropDeletions, ok := val.(bool)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "bool")
+				continue
+			}
+			if s.DropDeletions != dropDeletions {
+				s.DropDeletions = dropDeletions
+				changedSettingsMap[key] = dropDeletions
+			}
+		case DropExpirations:
+			dropExpirations, ok := val.(bool)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "bool")
+				continue
+			}
+			if s.DropExpirations != dropExpirations {
+				s.DropExpirations = dropExpirations
+				changedSettingsMap[key] = dropExpirations
+			}
+		case KeyTransformRules:
+			keyTransformRules, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.KeyTransformRules != keyTransformRules {
+				s.KeyTransformRules = keyTransformRules
+				changedSettingsMap[key] = keyTransformRules
+			}
+		case RedactionRules:
+			redactionRules, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.RedactionRules != redactionRules {
+				s.RedactionRules = redactionRules
+				changedSettingsMap[key] = redactionRules
+			}
+		case RedactionHashKey:
+			redactionHashKey, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.RedactionHashKey != redactionHashKey {
+				s.RedactionHashKey = redactionHashKey
+				changedSettingsMap[key] = redactionHashKey
+			}
+		case Processors:
+			processors, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.Processors != processors {
+				s.Processors = processors
+				changedSettingsMap[key] = processors
+			}
+		case SamplingPercentage:
+			samplingPercentage, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.SamplingPercentage != samplingPercentage {
+				s.SamplingPercentage = samplingPercentage
+				changedSettingsMap[key] = samplingPercentage
+			}
+		case CompressionType:
+			compressionType, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.CompressionType != compressionType {
+				s.CompressionType = compressionType
+				changedSettingsMap[key] = compressionType
+			}
+		case BandwidthLimit:
+			bandwidthLimit, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.BandwidthLimit != bandwidthLimit {
+				s.BandwidthLimit = bandwidthLimit
+				changedSettingsMap[key] = bandwidthLimit
+			}
+		case Priority:
+			priority, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.Priority != priority {
+				s.Priority = priority
+				changedSettingsMap[key] = priority
+			}
+		case DedupInBatch:
+			dedupInBatch, ok := val.(bool)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "bool")
+				continue
+			}
+			if s.DedupInBatch != dedupInBatch {
+				s.DedupInBatch = dedupInBatch
+				changedSettingsMap[key] = dedupInBatch
+			}
+		case ConflictResolver:
+			conflictResolver, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.ConflictResolver != conflictResolver {
+				s.ConflictResolver = conflictResolver
+				changedSettingsMap[key] = conflictResolver
+			}
+		case ConflictResolverField:
+			conflictResolverField, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.ConflictResolverField != conflictResolverField {
+				s.ConflictResolverField = conflictResolverField
+				changedSettingsMap[key] = conflictResolverField
+			}
+		case ConflictLogDestination:
+			conflictLogDestination, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.ConflictLogDestination != conflictLogDestination {
+				s.ConflictLogDestination = conflictLogDestination
+				changedSettingsMap[key] = conflictLogDestination
+			}
+		case ConflictLogBucket:
+			conflictLogBucket, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.ConflictLogBucket != conflictLogBucket {
+				s.ConflictLogBucket = conflictLogBucket
+				changedSettingsMap[key] = conflictLogBucket
+			}
+		case ConflictLogBodies:
+			conflictLogBodies, ok := val.(bool)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "bool")
+				continue
+			}
+			if s.ConflictLogBodies != conflictLogBodies {
+				s.ConflictLogBodies = conflictLogBodies
+				changedSettingsMap[key] = conflictLogBodies
+			}
+		case ExportDir:
+			exportDir, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.ExportDir != exportDir {
+				s.ExportDir = exportDir
+				changedSettingsMap[key] = exportDir
+			}
+		case ExportFormat:
+			exportFormat, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.ExportFormat != exportFormat {
+				s.ExportFormat = exportFormat
+				changedSettingsMap[key] = exportFormat
+			}
+		case ExportFileSizeMB:
+			exportFileSizeMB, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.ExportFileSizeMB != exportFileSizeMB {
+				s.ExportFileSizeMB = exportFileSizeMB
+				changedSettingsMap[key] = exportFileSizeMB
+			}
+		case ExportMaxFiles:
+			exportMaxFiles, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.ExportMaxFiles != exportMaxFiles {
+				s.ExportMaxFiles = exportMaxFiles
+				changedSettingsMap[key] = exportMaxFiles
+			}
+		case ReplayDir:
+			replayDir, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.ReplayDir != replayDir {
+				s.ReplayDir = replayDir
+				changedSettingsMap[key] = replayDir
+			}
+		case ReplayFormat:
+			replayFormat, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.ReplayFormat != replayFormat {
+				s.ReplayFormat = replayFormat
+				changedSettingsMap[key] = replayFormat
+			}
+		case ReplayStartSeqno:
+			replayStartSeqno, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.ReplayStartSeqno != replayStartSeqno {
+				s.ReplayStartSeqno = replayStartSeqno
+				changedSettingsMap[key] = replayStartSeqno
+			}
+		case ReplayEndSeqno:
+			replayEndSeqno, ok := val.(int)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "int")
+				continue
+			}
+			if s.ReplayEndSeqno != replayEndSeqno {
+				s.ReplayEndSeqno = replayEndSeqno
+				changedSettingsMap[key] = replayEndSeqno
+			}
+		case WebhookURL:
+			webhookURL, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.WebhookURL != webhookURL {
+				s.WebhookURL = webhookURL
+				changedSettingsMap[key] = webhookURL
+			}
+		case WebhookAuthHeader:
+			webhookAuthHeader, ok := val.(string)
+			if !ok {
+				errorMap[key] = simple_utils.IncorrectValueTypeInMapError(key, val, "string")
+				continue
+			}
+			if s.WebhookAuthHeader != webhookAuthHeader {
+				s.WebhookAuthHeader = webhookAuthHeader
+				changedSettingsMap[key] = webhookAuthHeader
+			}
 		default:
 			errorMap[key] = errors.New(fmt.Sprintf("Invalid key in map, %v", key))
 		}
@@ -350,10 +919,100 @@ func (s *ReplicationSettings) UpdateSettingsFromMap(settingsMap map[string]inter
 	return
 }
 
+// validates the settings that depend on other settings, which cannot be validated one at a time when they are set.
+// returns a map of errors keyed by settings
+func (s *ReplicationSettings) ValidateDependentSettings() map[string]error {
+	errorMap := make(map[string]error)
+	// hash action of redaction rules needs the redaction hash key
+	if len(s.RedactionRules) > 0 {
+		_, err := transform.NewFieldRedactor(s.RedactionRules, s.RedactionHashKey)
+		if err != nil {
+			errorMap[RedactionRules] = err
+		}
+	}
+	if s.ConflictResolver == ConflictResolverTypeField && len(s.ConflictResolverField) == 0 {
+		errorMap[ConflictResolverField] = ErrorEmptyConflictResolverField
+	}
+	if s.RepType == ReplicationTypeCapi && !ConflictResolverSupportedForCapi(s.ConflictResolver) {
+		errorMap[ConflictResolver] = ErrorConflictResolverNotSupportedForCapi
+	}
+	// export and replay directories come from rest requests, and are confined to the archive root directory
+	if len(s.ExportDir) > 0 {
+		if _, err := ResolveArchiveDir(s.ExportDir); err != nil {
+			errorMap[ExportDir] = err
+		}
+	}
+	if len(s.ReplayDir) > 0 {
+		if _, err := ResolveArchiveDir(s.ReplayDir); err != nil {
+			errorMap[ReplayDir] = err
+		}
+	}
+	return errorMap
+}
+
+// capi replication looks up documents on target with _revs_diff queries, which tell only whether target is missing
+// the revisions of documents and not which versions target has, and target resolves conflicts by revisions on its own.
+// hence the default resolver is the only one that capi replication can honor
+func ConflictResolverSupportedForCapi(resolverType string) bool {
+	return resolverType == ConflictResolverTypeDefault || len(resolverType) == 0
+}
+
+// returns the local path of an export or replay directory. relative directories are relative to base.ArchiveRootDir,
+// and absolute ones need to be under it. directories with ".." elements are refused even when they stay under the root
+func ResolveArchiveDir(dir string) (string, error) {
+	if len(base.ArchiveRootDir) == 0 {
+		return "", ErrorArchiveRootDirNotSet
+	}
+	for _, element := range strings.FieldsFunc(filepath.ToSlash(dir), func(r rune) bool { return r == '/' }) {
+		if element == ".." {
+			return "", ErrorArchiveDirOutsideRoot
+		}
+	}
+
+	root := filepath.Clean(base.ArchiveRootDir)
+	path := filepath.Clean(dir)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	relPath, err := filepath.Rel(root, path)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", ErrorArchiveDirOutsideRoot
+	}
+	return path, nil
+}
+
+// whether the replication writes to the target bucket. file and webhook replications send mutations elsewhere,
+// and do not depend on the target bucket or its topology
+func (s *ReplicationSettings) HasTargetBucket() bool {
+	return s.RepType != ReplicationTypeFile && s.RepType != ReplicationTypeWebhook
+}
+
 func (s *ReplicationSettings) ToMap() map[string]interface{} {
 	return s.toMap(false)
 }
 
+// sensitive settings are masked, so that settings can be logged
+func (s *ReplicationSettings) String() string {
+	if s == nil {
+		return "nil"
+	}
+	return fmt.Sprintf("%v", MaskSensitiveSettings(s.ToMap()))
+}
+
+// returns a copy of the settings map with the values of sensitive settings masked, so that the map can be logged.
+// the map can be a map of replication settings, or any settings map derived from it, e.g., the settings of a pipeline
+func MaskSensitiveSettings(settings map[string]interface{}) map[string]interface{} {
+	masked := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		if SensitiveSettings[key] {
+			masked[key] = SensitiveSettingMask
+		} else {
+			masked[key] = value
+		}
+	}
+	return masked
+}
+
 func (s *ReplicationSettings) ToDefaultSettingsMap() map[string]interface{} {
 	return s.toMap(true)
 }
@@ -373,7 +1032,13 @@ func (s *ReplicationSettings) toMap(isDefaultSettings bool) map[string]interface
 	if !isDefaultSettings {
 		settings_map[ReplicationType] = s.RepType
 		settings_map[FilterExpression] = s.FilterExpression
+		settings_map[DocFilterExpression] = s.DocFilterExpression
+		settings_map[FilterChangeMode] = s.FilterChangeMode
 		settings_map[Active] = s.Active
+		settings_map[Processors] = s.Processors
+		settings_map[RedactionRules] = s.RedactionRules
+		settings_map[RedactionHashKey] = s.RedactionHashKey
+		settings_map[KeyTransformRules] = s.KeyTransformRules
 	}
 	settings_map[CheckpointInterval] = s.CheckpointInterval
 	settings_map[BatchCount] = s.BatchCount
@@ -387,13 +1052,36 @@ func (s *ReplicationSettings) toMap(isDefaultSettings bool) map[string]interface
 	settings_map[TimeoutPercentageCap] = s.TimeoutPercentageCap*/
 	settings_map[PipelineLogLevel] = s.LogLevel.String()
 	settings_map[PipelineStatsInterval] = s.StatsInterval
+	settings_map[DropDeletions] = s.DropDeletions
+	settings_map[DropExpirations] = s.DropExpirations
+	settings_map[SamplingPercentage] = s.SamplingPercentage
+	settings_map[CompressionType] = s.CompressionType
+	settings_map[BandwidthLimit] = s.BandwidthLimit
+	settings_map[Priority] = s.Priority
+	settings_map[DedupInBatch] = s.DedupInBatch
+	settings_map[ConflictResolver] = s.ConflictResolver
+	settings_map[ConflictResolverField] = s.ConflictResolverField
+	settings_map[ConflictLogDestination] = s.ConflictLogDestination
+	settings_map[ConflictLogBucket] = s.ConflictLogBucket
+	settings_map[ConflictLogBodies] = s.ConflictLogBodies
+	settings_map[ExportDir] = s.ExportDir
+	settings_map[ExportFormat] = s.ExportFormat
+	settings_map[ExportFileSizeMB] = s.ExportFileSizeMB
+	settings_map[ExportMaxFiles] = s.ExportMaxFiles
+	settings_map[ReplayDir] = s.ReplayDir
+	settings_map[ReplayFormat] = s.ReplayFormat
+	settings_map[ReplayStartSeqno] = s.ReplayStartSeqno
+	settings_map[ReplayEndSeqno] = s.ReplayEndSeqno
+	settings_map[WebhookURL] = s.WebhookURL
+	settings_map[WebhookAuthHeader] = s.WebhookAuthHeader
 	return settings_map
 }
 
 func ValidateAndConvertSettingsValue(key, value, errorKey string) (convertedValue interface{}, err error) {
 	switch key {
 	case ReplicationType:
-		if value != ReplicationTypeXmem && value != ReplicationTypeCapi {
+		if value != ReplicationTypeXmem && value != ReplicationTypeCapi && value != ReplicationTypeFile &&
+			value != ReplicationTypeWebhook {
 			err = simple_utils.GenericInvalidValueError(errorKey)
 		} else {
 			convertedValue = value
@@ -405,12 +1093,27 @@ func ValidateAndConvertSettingsValue(key, value, errorKey string) (convertedValu
 			convertedValue = value
 		}
 	case FilterExpression:
-		// check that filter expression is a valid regular expression
-		_, err = regexp.Compile(value)
+		// check that filter expression is a valid regular expression or structured include/exclude filter
+		_, err = filter.NewKeyFilter(value)
 		if err != nil {
 			return
 		}
 		convertedValue = value
+	case DocFilterExpression:
+		// check that doc filter expression can be parsed. empty value means no filtering
+		if len(value) > 0 {
+			_, err = filter.NewDocFilter(value)
+			if err != nil {
+				return
+			}
+		}
+		convertedValue = value
+	case FilterChangeMode:
+		if value != FilterChangeModeForward && value != FilterChangeModeBackfill {
+			err = simple_utils.GenericInvalidValueError(errorKey)
+		} else {
+			convertedValue = value
+		}
 	case Active:
 		var paused bool
 		paused, err = strconv.ParseBool(value)
@@ -420,10 +1123,112 @@ func ValidateAndConvertSettingsValue(key, value, errorKey string) (convertedValu
 		}
 		convertedValue = !paused
 
+	// boolean settings
+	case DropDeletions, DropExpirations, DedupInBatch, ConflictLogBodies:
+		convertedValue, err = strconv.ParseBool(value)
+		if err != nil {
+			err = simple_utils.IncorrectValueTypeError("a boolean")
+			return
+		}
+
+	case KeyTransformRules:
+		// check that key transform rules can be parsed. empty value means no rewriting
+		if len(value) > 0 {
+			_, err = transform.NewKeyTransformer(value)
+			if err != nil {
+				return
+			}
+		}
+		convertedValue = value
+
+	case RedactionRules:
+		// check that redaction rules can be parsed. empty value means no redaction
+		if len(value) > 0 {
+			err = transform.ValidateRedactionRules(value)
+			if err != nil {
+				return
+			}
+		}
+		convertedValue = value
+
+	case RedactionHashKey:
+		convertedValue = value
+
+	case Processors:
+		// check that all listed processor types have been registered
+		_, err = processor.ParseProcessorTypes(value)
+		if err != nil {
+			return
+		}
+		convertedValue = value
+
+	case CompressionType:
+		if value != CompressionTypeNone && value != CompressionTypeSnappy {
+			err = simple_utils.GenericInvalidValueError(errorKey)
+		} else {
+			convertedValue = value
+		}
+
+	case Priority:
+		if value != PriorityTypeHigh && value != PriorityTypeMedium && value != PriorityTypeLow {
+			err = simple_utils.GenericInvalidValueError(errorKey)
+		} else {
+			convertedValue = value
+		}
+
+	case ConflictResolver:
+		if value != ConflictResolverTypeDefault && value != ConflictResolverTypeSourceWins &&
+			value != ConflictResolverTypeTargetWins && value != ConflictResolverTypeField {
+			err = simple_utils.GenericInvalidValueError(errorKey)
+		} else {
+			convertedValue = value
+		}
+
+	case ConflictResolverField:
+		convertedValue = strings.TrimSpace(value)
+
+	case ConflictLogDestination:
+		if value != ConflictLogDestinationNone && value != ConflictLogDestinationFile && value != ConflictLogDestinationBucket {
+			err = simple_utils.GenericInvalidValueError(errorKey)
+		} else {
+			convertedValue = value
+		}
+
+	case ConflictLogBucket:
+		convertedValue = strings.TrimSpace(value)
+
+	case ExportDir:
+		convertedValue = strings.TrimSpace(value)
+
+	case ReplayDir:
+		convertedValue = strings.TrimSpace(value)
+
+	case WebhookURL:
+		value = strings.TrimSpace(value)
+		if len(value) > 0 {
+			parsedURL, parseErr := url.Parse(value)
+			if parseErr != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || len(parsedURL.Host) == 0 {
+				err = simple_utils.GenericInvalidValueError(errorKey)
+				return
+			}
+		}
+		convertedValue = value
+
+	case WebhookAuthHeader:
+		convertedValue = strings.TrimSpace(value)
+
+	case ExportFormat, ReplayFormat:
+		if value != ExportFormatJSON && value != ExportFormatBinary {
+			err = simple_utils.GenericInvalidValueError(errorKey)
+		} else {
+			convertedValue = value
+		}
+
 	case CheckpointInterval, BatchCount, BatchSize, FailureRestartInterval,
 		OptimisticReplicationThreshold, SourceNozzlePerNode,
 		TargetNozzlePerNode, MaxExpectedReplicationLag, TimeoutPercentageCap,
-		PipelineStatsInterval:
+		PipelineStatsInterval, SamplingPercentage, BandwidthLimit, ExportFileSizeMB,
+		ExportMaxFiles, ReplayStartSeqno, ReplayEndSeqno:
 		convertedValue, err = strconv.ParseInt(value, base.ParseIntBase, base.ParseIntBitSize)
 		if err != nil {
 			err = simple_utils.IncorrectValueTypeError("an integer")
@@ -475,7 +1280,7 @@ func ValidateSettingsKey(settingsMap map[string]interface{}) (returnedSettingsMa
 	for key, val := range settingsMap {
 		switch key {
 
-		case ReplicationType, FilterExpression,
+		case ReplicationType, FilterExpression, DocFilterExpression, FilterChangeMode,
 			Active,
 			CheckpointInterval,
 			BatchCount,
@@ -487,7 +1292,33 @@ func ValidateSettingsKey(settingsMap map[string]interface{}) (returnedSettingsMa
 			MaxExpectedReplicationLag,
 			TimeoutPercentageCap,
 			PipelineLogLevel,
-			PipelineStatsInterval:
+			PipelineStatsInterval,
+			DropDeletions,
+			DropExpirations,
+			KeyTransformRules,
+			RedactionRules,
+			RedactionHashKey,
+			Processors,
+			SamplingPercentage,
+			CompressionType,
+			BandwidthLimit,
+			Priority,
+			DedupInBatch,
+			ConflictResolver,
+			ConflictResolverField,
+			ConflictLogDestination,
+			ConflictLogBucket,
+			ConflictLogBodies,
+			ExportDir,
+			ExportFormat,
+			ExportFileSizeMB,
+			ExportMaxFiles,
+			ReplayDir,
+			ReplayFormat,
+			ReplayStartSeqno,
+			ReplayEndSeqno,
+			WebhookURL,
+			WebhookAuthHeader:
 			returnedSettingsMap[key] = val
 		}
 	}
@@ -503,3 +1334,16 @@ func RangeCheck(intValue int, settingsConfig *SettingsConfig) error {
 	}
 	return nil
 }
+
+// returns the relative weight of replications with the priority when they share the resources of the node.
+// replications created before priorities were introduced have empty priorities and are treated as medium priority ones
+func PriorityWeight(priority string) int {
+	switch priority {
+	case PriorityTypeHigh:
+		return 4
+	case PriorityTypeLow:
+		return 1
+	default:
+		return 2
+	}
+}
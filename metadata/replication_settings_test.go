@@ -0,0 +1,112 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package metadata
+
+import (
+	"github.com/couchbase/goxdcr/base"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveArchiveDir(t *testing.T) {
+	defer func(rootDir string) { base.ArchiveRootDir = rootDir }(base.ArchiveRootDir)
+
+	base.ArchiveRootDir = ""
+	if _, err := ResolveArchiveDir("export"); err != ErrorArchiveRootDirNotSet {
+		t.Errorf("expected ErrorArchiveRootDirNotSet without archive root directory, got %v", err)
+	}
+
+	root := filepath.Join(string(filepath.Separator), "data", "archive")
+	base.ArchiveRootDir = root
+
+	accepted := map[string]string{
+		"export":                      filepath.Join(root, "export"),
+		"export/daily":                filepath.Join(root, "export", "daily"),
+		filepath.Join(root, "export"): filepath.Join(root, "export"),
+		root:                          root,
+		"./export//daily/":            filepath.Join(root, "export", "daily"),
+	}
+	for dir, expected := range accepted {
+		path, err := ResolveArchiveDir(dir)
+		if err != nil || path != expected {
+			t.Errorf("expected %v to be resolved to %v, got %v and err %v", dir, expected, path, err)
+		}
+	}
+
+	refused := []string{
+		"..",
+		"../etc",
+		"export/../../etc",
+		"export/../other",
+		filepath.Join(string(filepath.Separator), "etc"),
+		filepath.Join(string(filepath.Separator), "data", "archive2"),
+		filepath.Join(string(filepath.Separator), "data"),
+	}
+	for _, dir := range refused {
+		if path, err := ResolveArchiveDir(dir); err != ErrorArchiveDirOutsideRoot {
+			t.Errorf("expected %v to be refused, got %v and err %v", dir, path, err)
+		}
+	}
+}
+
+func TestValidateArchiveDirSettings(t *testing.T) {
+	defer func(rootDir string) { base.ArchiveRootDir = rootDir }(base.ArchiveRootDir)
+	base.ArchiveRootDir = filepath.Join(string(filepath.Separator), "data", "archive")
+
+	settings := DefaultSettings()
+	settings.ExportDir = "export"
+	settings.ReplayDir = "../replay"
+	errorMap := settings.ValidateDependentSettings()
+	if _, ok := errorMap[ExportDir]; ok {
+		t.Errorf("expected export directory to be accepted, got %v", errorMap[ExportDir])
+	}
+	if errorMap[ReplayDir] != ErrorArchiveDirOutsideRoot {
+		t.Errorf("expected replay directory to be refused, got %v", errorMap[ReplayDir])
+	}
+}
+
+func TestSensitiveSettingsMasked(t *testing.T) {
+	settings := DefaultSettings()
+	settings.WebhookAuthHeader = "Bearer secret"
+	settings.RedactionHashKey = "hashkey"
+
+	settingsMap := settings.ToMap()
+	masked := MaskSensitiveSettings(settingsMap)
+	if masked[WebhookAuthHeader] != SensitiveSettingMask || masked[RedactionHashKey] != SensitiveSettingMask {
+		t.Errorf("expected sensitive settings to be masked, got %v and %v", masked[WebhookAuthHeader], masked[RedactionHashKey])
+	}
+	if masked[BatchCount] != settingsMap[BatchCount] {
+		t.Errorf("expected other settings to be kept, got %v", masked[BatchCount])
+	}
+	if settingsMap[WebhookAuthHeader] != "Bearer secret" {
+		t.Errorf("expected original settings map to be left unchanged, got %v", settingsMap[WebhookAuthHeader])
+	}
+	if str := settings.String(); strings.Contains(str, "secret") || strings.Contains(str, "hashkey") {
+		t.Errorf("expected sensitive settings to be masked in %v", str)
+	}
+}
+
+func TestValidateSamplingPercentage(t *testing.T) {
+	accepted := map[string]int{"1": 1, "50": 50, "100": 100}
+	for value, expected := range accepted {
+		convertedValue, err := ValidateAndConvertSettingsValue(SamplingPercentage, value, SamplingPercentage)
+		if err != nil || convertedValue != expected {
+			t.Errorf("expected %v to be accepted as %v, got %v and err %v", value, expected, convertedValue, err)
+		}
+	}
+
+	refused := []string{"0", "-1", "101", "50.5", "half"}
+	for _, value := range refused {
+		if _, err := ValidateAndConvertSettingsValue(SamplingPercentage, value, SamplingPercentage); err == nil {
+			t.Errorf("expected %v to be refused", value)
+		}
+	}
+}
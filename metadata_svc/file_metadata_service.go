@@ -0,0 +1,190 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// metadata service implementation that keeps metadata in a local file,
+// for use when xdcr runs without ns_server and hence without metakv
+package metadata_svc
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/couchbase/goxdcr/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the file may contain sensitive metadata, e.g., remote cluster passwords
+var MetadataFilePermission os.FileMode = 0600
+
+// how often checkpoint changes are written to the metadata file. checkpoints are written once per vbucket
+// in every checkpoint interval, and losing the latest ones on crash only means that some mutations are replicated again
+var MetadataFileCheckpointsFlushInterval = 1 * time.Second
+
+// format of the metadata file
+type fileMetadataContent struct {
+	// last revision assigned, so that revisions keep increasing across restarts
+	Rev     uint64                       `json:"rev"`
+	Entries map[string]*memMetadataEntry `json:"entries"`
+}
+
+// FileMetadataSvc keeps metadata in memory, same as MemMetadataSvc, and writes all of it to the metadata file.
+// changes, other than those to checkpoints, are written before they return. changes that arrive while the file is
+// being written are written together, in the next write. checkpoint changes are written by a background routine
+// every MetadataFileCheckpointsFlushInterval, or along with other changes, whichever comes first
+type FileMetadataSvc struct {
+	*MemMetadataSvc
+	file_path string
+	// held while writing the file, so that writes are serialized
+	write_lock sync.Mutex
+	// the number of commits, see MemMetadataSvc.commit_seq, that have been written to the file
+	written_seq uint64
+	finch       chan bool
+	close_once  sync.Once
+	waitGrp     sync.WaitGroup
+}
+
+// loads existing metadata from file_path when the file exists
+func NewFileMetadataSvc(file_path string, logger_ctx *log.LoggerContext) (*FileMetadataSvc, error) {
+	content, err := loadMetadataFile(file_path)
+	if err != nil {
+		return nil, err
+	}
+
+	file_meta_svc := &FileMetadataSvc{file_path: file_path,
+		finch: make(chan bool),
+	}
+	file_meta_svc.MemMetadataSvc = newMemMetadataSvc(content.Entries, content.Rev, file_meta_svc.persist, "FileMetadataSvc", logger_ctx)
+	file_meta_svc.logger.Infof("Loaded %v metadata entries from %v", len(content.Entries), file_path)
+
+	file_meta_svc.waitGrp.Add(1)
+	go file_meta_svc.flushCheckpoints()
+	return file_meta_svc, nil
+}
+
+func (file_meta_svc *FileMetadataSvc) FilePath() string {
+	return file_meta_svc.file_path
+}
+
+// stops the background routine, and writes changes that have not been written yet
+func (file_meta_svc *FileMetadataSvc) Close() error {
+	file_meta_svc.close_once.Do(func() {
+		close(file_meta_svc.finch)
+		file_meta_svc.waitGrp.Wait()
+	})
+	return file_meta_svc.flush()
+}
+
+// changes to checkpoints are left to flushCheckpoints. other changes are written right away
+func (file_meta_svc *FileMetadataSvc) persist(paths []string) error {
+	checkpoints_path := GetCatalogPathFromCatalogKey(CheckpointsCatalogKeyPrefix)
+	for _, path := range paths {
+		if !strings.HasPrefix(path, checkpoints_path) {
+			return file_meta_svc.flush()
+		}
+	}
+	return nil
+}
+
+func (file_meta_svc *FileMetadataSvc) flushCheckpoints() {
+	defer file_meta_svc.waitGrp.Done()
+
+	ticker := time.NewTicker(MetadataFileCheckpointsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-file_meta_svc.finch:
+			return
+		case <-ticker.C:
+			err := file_meta_svc.flush()
+			if err != nil {
+				file_meta_svc.logger.Errorf("Failed to write checkpoints to %v. err=%v", file_meta_svc.file_path, err)
+			}
+		}
+	}
+}
+
+// writes all commits made so far to the file, unless they have been written already,
+// e.g., by a concurrent flush which the caller has waited on
+func (file_meta_svc *FileMetadataSvc) flush() error {
+	file_meta_svc.write_lock.Lock()
+	defer file_meta_svc.write_lock.Unlock()
+
+	entries, rev, commit_seq := file_meta_svc.snapshot()
+	if commit_seq <= file_meta_svc.written_seq {
+		return nil
+	}
+	err := file_meta_svc.write(entries, rev)
+	if err == nil {
+		file_meta_svc.written_seq = commit_seq
+	}
+	return err
+}
+
+// writes to a temporary file first and then renames it, so that the metadata file is never left partially written
+func (file_meta_svc *FileMetadataSvc) write(entries map[string]*memMetadataEntry, rev uint64) error {
+	data, err := json.Marshal(&fileMetadataContent{Rev: rev, Entries: entries})
+	if err != nil {
+		return err
+	}
+
+	tmp_file_path := file_meta_svc.file_path + ".tmp"
+	file, err := os.OpenFile(tmp_file_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, MetadataFilePermission)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	close_err := file.Close()
+	if err == nil {
+		err = close_err
+	}
+	if err != nil {
+		os.Remove(tmp_file_path)
+		return err
+	}
+
+	return os.Rename(tmp_file_path, file_meta_svc.file_path)
+}
+
+func loadMetadataFile(file_path string) (*fileMetadataContent, error) {
+	content := &fileMetadataContent{}
+
+	data, err := ioutil.ReadFile(file_path)
+	if os.IsNotExist(err) {
+		// start with empty metadata. make sure that the file can be created later
+		err = os.MkdirAll(filepath.Dir(file_path), 0700)
+		if err != nil {
+			return nil, err
+		}
+		content.Entries = make(map[string]*memMetadataEntry)
+		return content, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, content)
+	if err != nil {
+		return nil, fmt.Errorf("Metadata file %v is corrupted. err=%v", file_path, err)
+	}
+	if content.Entries == nil {
+		content.Entries = make(map[string]*memMetadataEntry)
+	}
+	for path, entry := range content.Entries {
+		if entry == nil || entry.Rev > content.Rev {
+			return nil, fmt.Errorf("Metadata file %v is corrupted. invalid entry for path %v", file_path, path)
+		}
+	}
+	return content, nil
+}
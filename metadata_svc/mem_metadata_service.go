@@ -0,0 +1,392 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// metadata service implementation that keeps metadata in memory.
+// it mirrors the semantics of metakv, i.e., revisions, catalogs and change notifications,
+// so that it can be used in place of metakv in tests
+package metadata_svc
+
+import (
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/service_def"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metadata entry as maintained in memory
+type memMetadataEntry struct {
+	Value     []byte `json:"value"`
+	Rev       uint64 `json:"rev"`
+	Sensitive bool   `json:"sensitive"`
+}
+
+// change to a metadata entry, which is delivered to observers
+type memMetadataChange struct {
+	path  string
+	value []byte
+	rev   interface{}
+}
+
+// observer registered through ObserveChildren
+type memMetadataObserver struct {
+	dirpath      string
+	changes      []*memMetadataChange
+	changes_lock sync.Mutex
+	// signaled when new changes have been queued
+	notify_ch chan bool
+}
+
+func newMemMetadataObserver(dirpath string) *memMetadataObserver {
+	return &memMetadataObserver{
+		dirpath:   dirpath,
+		changes:   make([]*memMetadataChange, 0),
+		notify_ch: make(chan bool, 1),
+	}
+}
+
+// queues change without blocking so that metadata updates never wait on slow observers
+func (observer *memMetadataObserver) queue(change *memMetadataChange) {
+	observer.changes_lock.Lock()
+	observer.changes = append(observer.changes, change)
+	observer.changes_lock.Unlock()
+
+	select {
+	case observer.notify_ch <- true:
+	default:
+	}
+}
+
+func (observer *memMetadataObserver) dequeueAll() []*memMetadataChange {
+	observer.changes_lock.Lock()
+	defer observer.changes_lock.Unlock()
+	changes := observer.changes
+	observer.changes = make([]*memMetadataChange, 0)
+	return changes
+}
+
+// persists changes to paths, which have already been applied in memory. it is called without lock held,
+// so that a slow persister does not block readers and other writers
+type memMetadataPersistFunc func(paths []string) error
+
+type MemMetadataSvc struct {
+	// metadata entries keyed by path
+	entries map[string]*memMetadataEntry
+	// last revision assigned. revisions are unique across all entries
+	rev uint64
+	// number of commits made, which tells persisters whether a snapshot covers a commit
+	commit_seq uint64
+	observers  map[*memMetadataObserver]bool
+	// when not nil, called after every change, which is visible by then, and before the change returns
+	persist_func memMetadataPersistFunc
+	lock         sync.RWMutex
+	logger       *log.CommonLogger
+}
+
+func NewMemMetadataSvc(logger_ctx *log.LoggerContext) (*MemMetadataSvc, error) {
+	return newMemMetadataSvc(nil, 0, nil, "MemMetadataSvc", logger_ctx), nil
+}
+
+func newMemMetadataSvc(entries map[string]*memMetadataEntry, rev uint64, persist_func memMetadataPersistFunc,
+	logger_name string, logger_ctx *log.LoggerContext) *MemMetadataSvc {
+	if entries == nil {
+		entries = make(map[string]*memMetadataEntry)
+	}
+	return &MemMetadataSvc{
+		entries:      entries,
+		rev:          rev,
+		observers:    make(map[*memMetadataObserver]bool),
+		persist_func: persist_func,
+		logger:       log.NewLogger(logger_name, logger_ctx),
+	}
+}
+
+// if the key is not found, return nil, nil, service_def.MetadataNotFoundErr
+func (meta_svc *MemMetadataSvc) Get(key string) ([]byte, interface{}, error) {
+	meta_svc.lock.RLock()
+	defer meta_svc.lock.RUnlock()
+
+	entry, ok := meta_svc.entries[getPathFromKey(key)]
+	if !ok {
+		meta_svc.logger.Debugf("Can't find key=%v", key)
+		return nil, nil, service_def.MetadataNotFoundErr
+	}
+	return copyBytes(entry.Value), entry.Rev, nil
+}
+
+func (meta_svc *MemMetadataSvc) Add(key string, value []byte) error {
+	return meta_svc.add(key, value, false)
+}
+
+func (meta_svc *MemMetadataSvc) AddSensitive(key string, value []byte) error {
+	return meta_svc.add(key, value, true)
+}
+
+// if the key already exists, return service_def.ErrorKeyAlreadyExist
+func (meta_svc *MemMetadataSvc) add(key string, value []byte, sensitive bool) error {
+	return meta_svc.update(func() (map[string]*memMetadataEntry, error) {
+		path := getPathFromKey(key)
+		if _, ok := meta_svc.entries[path]; ok {
+			return nil, service_def.ErrorKeyAlreadyExist
+		}
+		return map[string]*memMetadataEntry{path: meta_svc.newEntry(value, sensitive)}, nil
+	})
+}
+
+// keys already contain catalogKey as prefix. catalogKey is ignored, as is done by MetaKVMetadataSvc
+func (meta_svc *MemMetadataSvc) AddWithCatalog(catalogKey, key string, value []byte) error {
+	return meta_svc.Add(key, value)
+}
+
+func (meta_svc *MemMetadataSvc) AddSensitiveWithCatalog(catalogKey, key string, value []byte) error {
+	return meta_svc.AddSensitive(key, value)
+}
+
+func (meta_svc *MemMetadataSvc) Set(key string, value []byte, rev interface{}) error {
+	return meta_svc.set(key, value, rev, false)
+}
+
+func (meta_svc *MemMetadataSvc) SetSensitive(key string, value []byte, rev interface{}) error {
+	return meta_svc.set(key, value, rev, true)
+}
+
+// nil rev sets the value regardless of the current revision
+// if the rev provided doesn't match with the current rev, return service_def.ErrorRevisionMismatch
+func (meta_svc *MemMetadataSvc) set(key string, value []byte, rev interface{}, sensitive bool) error {
+	return meta_svc.update(func() (map[string]*memMetadataEntry, error) {
+		path := getPathFromKey(key)
+		if !meta_svc.revMatches(path, rev) {
+			return nil, service_def.ErrorRevisionMismatch
+		}
+		return map[string]*memMetadataEntry{path: meta_svc.newEntry(value, sensitive)}, nil
+	})
+}
+
+// nil rev deletes the key regardless of the current revision
+// if the rev provided doesn't match with the current rev, return service_def.ErrorRevisionMismatch
+func (meta_svc *MemMetadataSvc) Del(key string, rev interface{}) error {
+	return meta_svc.update(func() (map[string]*memMetadataEntry, error) {
+		path := getPathFromKey(key)
+		if !meta_svc.revMatches(path, rev) {
+			return nil, service_def.ErrorRevisionMismatch
+		}
+		if _, ok := meta_svc.entries[path]; !ok {
+			// deleting a non-existent key is a no-op, as with metakv
+			return nil, nil
+		}
+		return map[string]*memMetadataEntry{path: nil}, nil
+	})
+}
+
+func (meta_svc *MemMetadataSvc) DelWithCatalog(catalogKey, key string, rev interface{}) error {
+	// ignore catalogKey
+	return meta_svc.Del(key, rev)
+}
+
+func (meta_svc *MemMetadataSvc) DelAllFromCatalog(catalogKey string) error {
+	return meta_svc.update(func() (map[string]*memMetadataEntry, error) {
+		changes := make(map[string]*memMetadataEntry)
+		for _, path := range meta_svc.childPaths(GetCatalogPathFromCatalogKey(catalogKey)) {
+			changes[path] = nil
+		}
+		return changes, nil
+	})
+}
+
+// returns all entries under catalog, ordered by key
+func (meta_svc *MemMetadataSvc) GetAllMetadataFromCatalog(catalogKey string) ([]*service_def.MetadataEntry, error) {
+	meta_svc.lock.RLock()
+	defer meta_svc.lock.RUnlock()
+
+	entries := make([]*service_def.MetadataEntry, 0)
+	for _, path := range meta_svc.childPaths(GetCatalogPathFromCatalogKey(catalogKey)) {
+		entry := meta_svc.entries[path]
+		entries = append(entries, &service_def.MetadataEntry{GetKeyFromPath(path), copyBytes(entry.Value), entry.Rev})
+	}
+	return entries, nil
+}
+
+// get all keys from a catalog
+func (meta_svc *MemMetadataSvc) GetAllKeysFromCatalog(catalogKey string) ([]string, error) {
+	keys := make([]string, 0)
+
+	metaEntries, err := meta_svc.GetAllMetadataFromCatalog(catalogKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, metaEntry := range metaEntries {
+		keys = append(keys, metaEntry.Key)
+	}
+	return keys, nil
+}
+
+// whether the value of key has been stored as sensitive
+func (meta_svc *MemMetadataSvc) IsSensitive(key string) (bool, error) {
+	meta_svc.lock.RLock()
+	defer meta_svc.lock.RUnlock()
+
+	entry, ok := meta_svc.entries[getPathFromKey(key)]
+	if !ok {
+		return false, service_def.MetadataNotFoundErr
+	}
+	return entry.Sensitive, nil
+}
+
+// callback is first invoked on existing children of dirpath, in the order of their paths,
+// and then on every change to them in the order in which the changes are made.
+// this is the same contract as metakv.RunObserveChildren
+func (meta_svc *MemMetadataSvc) ObserveChildren(dirpath string, callback base.MetadataServiceCallback, cancel chan struct{}) error {
+	observer := newMemMetadataObserver(dirpath)
+
+	meta_svc.lock.Lock()
+	for _, path := range meta_svc.childPaths(dirpath) {
+		entry := meta_svc.entries[path]
+		observer.queue(&memMetadataChange{path, copyBytes(entry.Value), entry.Rev})
+	}
+	meta_svc.observers[observer] = true
+	meta_svc.lock.Unlock()
+
+	defer func() {
+		meta_svc.lock.Lock()
+		delete(meta_svc.observers, observer)
+		meta_svc.lock.Unlock()
+	}()
+
+	for {
+		select {
+		case <-cancel:
+			return nil
+		case <-observer.notify_ch:
+			for _, change := range observer.dequeueAll() {
+				err := callback(change.path, change.value, change.rev)
+				if err != nil {
+					meta_svc.logger.Errorf("Stopped observing children of %v since callback failed. err=%v", dirpath, err)
+					return err
+				}
+			}
+		}
+	}
+}
+
+// computes changes, where a nil entry indicates deletion, and commits them under write lock,
+// and then persists them, when needed, without lock held.
+// when persistence fails, the changes stay in memory, and are persisted along with later changes
+func (meta_svc *MemMetadataSvc) update(prepare func() (map[string]*memMetadataEntry, error)) error {
+	meta_svc.lock.Lock()
+	changes, err := prepare()
+	if err != nil || len(changes) == 0 {
+		meta_svc.lock.Unlock()
+		return err
+	}
+	paths := meta_svc.commit(changes)
+	meta_svc.lock.Unlock()
+
+	if meta_svc.persist_func != nil {
+		err = meta_svc.persist_func(paths)
+		if err != nil {
+			meta_svc.logger.Errorf("Failed to persist metadata. err=%v", err)
+		}
+	}
+	return err
+}
+
+// applies changes and notifies observers of them. returns the paths changed, in sorted order
+// caller needs to hold write lock
+func (meta_svc *MemMetadataSvc) commit(changes map[string]*memMetadataEntry) []string {
+	paths := make([]string, 0, len(changes))
+	for path, entry := range changes {
+		meta_svc.putEntry(path, entry)
+		paths = append(paths, path)
+	}
+	meta_svc.commit_seq++
+
+	sort.Strings(paths)
+	for _, path := range paths {
+		change := &memMetadataChange{path: path}
+		if entry := changes[path]; entry != nil {
+			change.value = copyBytes(entry.Value)
+			change.rev = entry.Rev
+		}
+		for observer, _ := range meta_svc.observers {
+			if strings.HasPrefix(path, observer.dirpath) {
+				observer.queue(change)
+			}
+		}
+	}
+	return paths
+}
+
+// returns a copy of all entries, the last revision assigned and the number of commits they cover.
+// entries are never modified once created, hence they are shared with the copy
+func (meta_svc *MemMetadataSvc) snapshot() (map[string]*memMetadataEntry, uint64, uint64) {
+	meta_svc.lock.RLock()
+	defer meta_svc.lock.RUnlock()
+
+	entries := make(map[string]*memMetadataEntry, len(meta_svc.entries))
+	for path, entry := range meta_svc.entries {
+		entries[path] = entry
+	}
+	return entries, meta_svc.rev, meta_svc.commit_seq
+}
+
+func (meta_svc *MemMetadataSvc) putEntry(path string, entry *memMetadataEntry) {
+	if entry == nil {
+		delete(meta_svc.entries, path)
+	} else {
+		meta_svc.entries[path] = entry
+	}
+}
+
+// caller needs to hold write lock
+func (meta_svc *MemMetadataSvc) newEntry(value []byte, sensitive bool) *memMetadataEntry {
+	meta_svc.rev++
+	return &memMetadataEntry{
+		Value:     copyBytes(value),
+		Rev:       meta_svc.rev,
+		Sensitive: sensitive,
+	}
+}
+
+// nil rev matches any current revision, including the non-existence of path
+// caller needs to hold lock
+func (meta_svc *MemMetadataSvc) revMatches(path string, rev interface{}) bool {
+	if rev == nil {
+		return true
+	}
+	entry, ok := meta_svc.entries[path]
+	if !ok {
+		return false
+	}
+	rev_uint64, ok := rev.(uint64)
+	return ok && rev_uint64 == entry.Rev
+}
+
+// returns paths under dirpath in sorted order
+// caller needs to hold lock
+func (meta_svc *MemMetadataSvc) childPaths(dirpath string) []string {
+	paths := make([]string, 0)
+	for path, _ := range meta_svc.entries {
+		if strings.HasPrefix(path, dirpath) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// values are copied in and out so that callers can never modify stored metadata
+func copyBytes(value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	copied := make([]byte, len(value))
+	copy(copied, value)
+	return copied
+}
@@ -0,0 +1,283 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package metadata_svc
+
+import (
+	"fmt"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/service_def"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testCatalogKey = "testCatalog"
+	changeTimeout  = 5 * time.Second
+)
+
+func testKey(id string) string {
+	return testCatalogKey + "/" + id
+}
+
+type observedChange struct {
+	path  string
+	value []byte
+}
+
+// starts observing the test catalog. the returned channel receives all changes observed
+func observeCatalog(meta_svc service_def.MetadataSvc, cancel chan struct{}) chan *observedChange {
+	changes := make(chan *observedChange, 100)
+	go meta_svc.ObserveChildren(GetCatalogPathFromCatalogKey(testCatalogKey), func(path string, value []byte, rev interface{}) error {
+		changes <- &observedChange{path, value}
+		return nil
+	}, cancel)
+	return changes
+}
+
+func nextChange(t *testing.T, changes chan *observedChange) *observedChange {
+	select {
+	case change := <-changes:
+		return change
+	case <-time.After(changeTimeout):
+		t.Fatalf("timed out waiting for metadata change")
+	}
+	return nil
+}
+
+func verifyMetadataSvc(t *testing.T, meta_svc service_def.MetadataSvc) {
+	if _, _, err := meta_svc.Get(testKey("a")); err != service_def.MetadataNotFoundErr {
+		t.Fatalf("expected MetadataNotFoundErr, got %v", err)
+	}
+
+	cancel := make(chan struct{})
+	defer close(cancel)
+
+	if err := meta_svc.AddWithCatalog(testCatalogKey, testKey("a"), []byte("a1")); err != nil {
+		t.Fatal(err)
+	}
+	changes := observeCatalog(meta_svc, cancel)
+	// existing children are delivered first
+	if change := nextChange(t, changes); change.path != "/"+testKey("a") || string(change.value) != "a1" {
+		t.Fatalf("unexpected change %v", change)
+	}
+
+	if err := meta_svc.AddWithCatalog(testCatalogKey, testKey("a"), []byte("a2")); err != service_def.ErrorKeyAlreadyExist {
+		t.Fatalf("expected ErrorKeyAlreadyExist, got %v", err)
+	}
+
+	_, rev, err := meta_svc.Get(testKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = meta_svc.Set(testKey("a"), []byte("a2"), rev); err != nil {
+		t.Fatal(err)
+	}
+	// the old revision no longer matches
+	if err = meta_svc.Set(testKey("a"), []byte("a3"), rev); err != service_def.ErrorRevisionMismatch {
+		t.Fatalf("expected ErrorRevisionMismatch, got %v", err)
+	}
+	if change := nextChange(t, changes); string(change.value) != "a2" {
+		t.Fatalf("unexpected change %v", change)
+	}
+
+	if err = meta_svc.AddSensitiveWithCatalog(testCatalogKey, testKey("b"), []byte("b1")); err != nil {
+		t.Fatal(err)
+	}
+	if change := nextChange(t, changes); change.path != "/"+testKey("b") {
+		t.Fatalf("unexpected change %v", change)
+	}
+	// keys outside of the catalog are neither listed nor observed
+	if err = meta_svc.Add("otherCatalog/c", []byte("c1")); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := meta_svc.GetAllMetadataFromCatalog(testCatalogKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Key != testKey("a") || string(entries[0].Value) != "a2" || entries[1].Key != testKey("b") {
+		t.Fatalf("unexpected entries in catalog %v", entries)
+	}
+
+	_, rev, _ = meta_svc.Get(testKey("b"))
+	if err = meta_svc.DelWithCatalog(testCatalogKey, testKey("b"), rev); err != nil {
+		t.Fatal(err)
+	}
+	// deletion is delivered with nil value
+	if change := nextChange(t, changes); change.path != "/"+testKey("b") || change.value != nil {
+		t.Fatalf("unexpected change %v", change)
+	}
+
+	if err = meta_svc.DelAllFromCatalog(testCatalogKey); err != nil {
+		t.Fatal(err)
+	}
+	if change := nextChange(t, changes); change.path != "/"+testKey("a") || change.value != nil {
+		t.Fatalf("unexpected change %v", change)
+	}
+	if keys, _ := meta_svc.GetAllKeysFromCatalog(testCatalogKey); len(keys) != 0 {
+		t.Fatalf("expected empty catalog, got %v", keys)
+	}
+}
+
+func TestMemMetadataSvc(t *testing.T) {
+	meta_svc, _ := NewMemMetadataSvc(log.DefaultLoggerContext)
+	verifyMetadataSvc(t, meta_svc)
+}
+
+func TestFileMetadataSvc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file_path := filepath.Join(dir, "metadata.json")
+
+	meta_svc, err := NewFileMetadataSvc(file_path, log.DefaultLoggerContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer meta_svc.Close()
+	verifyMetadataSvc(t, meta_svc)
+
+	if err = meta_svc.AddSensitive(testKey("d"), []byte("d1")); err != nil {
+		t.Fatal(err)
+	}
+	_, rev, _ := meta_svc.Get(testKey("d"))
+
+	// metadata, including revisions and the sensitive flag, survives a restart
+	meta_svc, err = NewFileMetadataSvc(file_path, log.DefaultLoggerContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer meta_svc.Close()
+	value, reloaded_rev, err := meta_svc.Get(testKey("d"))
+	if err != nil || string(value) != "d1" || reloaded_rev != rev {
+		t.Fatalf("unexpected metadata after reload. value=%s, rev=%v, err=%v", value, reloaded_rev, err)
+	}
+	if sensitive, _ := meta_svc.IsSensitive(testKey("d")); !sensitive {
+		t.Errorf("expected %v to be sensitive after reload", testKey("d"))
+	}
+	if _, _, err = meta_svc.Get("otherCatalog/c"); err != nil {
+		t.Errorf("expected otherCatalog/c to exist after reload. err=%v", err)
+	}
+}
+
+func newTestFileMetadataSvc(t *testing.T) (*FileMetadataSvc, func()) {
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta_svc, err := NewFileMetadataSvc(filepath.Join(dir, "metadata.json"), log.DefaultLoggerContext)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return meta_svc, func() {
+		meta_svc.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// the value of key in the metadata file, or nil if the file does not have key
+func valueInFile(t *testing.T, file_path, key string) []byte {
+	content, err := loadMetadataFile(file_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := content.Entries[getPathFromKey(key)]; ok {
+		return entry.Value
+	}
+	return nil
+}
+
+func TestFileMetadataSvcConcurrentWrites(t *testing.T) {
+	meta_svc, cleanup := newTestFileMetadataSvc(t)
+	defer cleanup()
+
+	// each change is in the file by the time it returns, whichever write it went out with
+	waitGrp := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		waitGrp.Add(1)
+		go func(id string) {
+			defer waitGrp.Done()
+			if err := meta_svc.Add(testKey(id), []byte(id)); err != nil {
+				t.Errorf("failed to add %v. err=%v", id, err)
+				return
+			}
+			if value := valueInFile(t, meta_svc.FilePath(), testKey(id)); string(value) != id {
+				t.Errorf("expected %v in metadata file, got %s", id, value)
+			}
+		}(fmt.Sprintf("key%v", i))
+	}
+	waitGrp.Wait()
+}
+
+func TestFileMetadataSvcDefersCheckpoints(t *testing.T) {
+	defer func(interval time.Duration) { MetadataFileCheckpointsFlushInterval = interval }(MetadataFileCheckpointsFlushInterval)
+	MetadataFileCheckpointsFlushInterval = time.Hour
+
+	meta_svc, cleanup := newTestFileMetadataSvc(t)
+	defer cleanup()
+
+	ckpt_key := CheckpointsKeyPrefix + "/replication/0"
+	if err := meta_svc.Set(ckpt_key, []byte("ckpt1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// checkpoints are visible right away, but are not written yet
+	if value, _, err := meta_svc.Get(ckpt_key); err != nil || string(value) != "ckpt1" {
+		t.Fatalf("expected ckpt1, got %s, err=%v", value, err)
+	}
+	if value := valueInFile(t, meta_svc.FilePath(), ckpt_key); value != nil {
+		t.Fatalf("expected checkpoint not to be written yet, got %s", value)
+	}
+
+	// they go out with the next change that is written right away
+	if err := meta_svc.Add(testKey("a"), []byte("a1")); err != nil {
+		t.Fatal(err)
+	}
+	if value := valueInFile(t, meta_svc.FilePath(), ckpt_key); string(value) != "ckpt1" {
+		t.Fatalf("expected checkpoint to be written along with other changes, got %s", value)
+	}
+
+	// or on close
+	if err := meta_svc.Set(ckpt_key, []byte("ckpt2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := meta_svc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if value := valueInFile(t, meta_svc.FilePath(), ckpt_key); string(value) != "ckpt2" {
+		t.Fatalf("expected checkpoint to be written on close, got %s", value)
+	}
+}
+
+func TestFileMetadataSvcFlushesCheckpoints(t *testing.T) {
+	defer func(interval time.Duration) { MetadataFileCheckpointsFlushInterval = interval }(MetadataFileCheckpointsFlushInterval)
+	MetadataFileCheckpointsFlushInterval = 10 * time.Millisecond
+
+	meta_svc, cleanup := newTestFileMetadataSvc(t)
+	defer cleanup()
+
+	ckpt_key := CheckpointsKeyPrefix + "/replication/0"
+	if err := meta_svc.Set(ckpt_key, []byte("ckpt1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(changeTimeout)
+	for string(valueInFile(t, meta_svc.FilePath(), ckpt_key)) != "ckpt1" {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for checkpoint to be written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -212,6 +212,11 @@ func (meta_svc *MetaKVMetadataSvc) GetAllKeysFromCatalog(catalogKey string) ([]s
 	return keys, nil
 }
 
+// observe changes to children of dirpath through metakv
+func (meta_svc *MetaKVMetadataSvc) ObserveChildren(dirpath string, callback base.MetadataServiceCallback, cancel chan struct{}) error {
+	return metakv.RunObserveChildren(dirpath, callback, cancel)
+}
+
 // metakv requires that all paths start with "/"
 func getPathFromKey(key string) string {
 	return base.KeyPartsDelimiter + key
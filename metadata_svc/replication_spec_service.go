@@ -68,6 +68,7 @@ type ReplicationSpecService struct {
 	uilog_svc                service_def.UILogSvc
 	remote_cluster_svc       service_def.RemoteClusterSvc
 	cluster_info_svc         service_def.ClusterInfoSvc
+	topology_analyzer        *ReplicationTopologyAnalyzer
 	cache                    *MetadataCache
 	cache_lock               *sync.Mutex
 	logger                   *log.CommonLogger
@@ -88,6 +89,7 @@ func NewReplicationSpecService(uilog_svc service_def.UILogSvc, remote_cluster_sv
 		cache_lock:             &sync.Mutex{},
 		logger:                 logger,
 	}
+	svc.topology_analyzer = NewReplicationTopologyAnalyzer(xdcr_comp_topology_svc, remote_cluster_svc, svc, logger_ctx)
 
 	err := svc.initCache()
 	if err != nil {
@@ -233,8 +235,40 @@ func (service *ReplicationSpecService) ValidateNewReplicationSpec(sourceBucket,
 		return "", "", nil, errorMap
 	}
 
-	// if replication type is set to xmem, validate that the target cluster is xmem compatible
+	err = service.validateReplicationTopology(sourceBucket, targetClusterRef, targetBucket)
+	if err != nil {
+		errorMap[base.PlaceHolderFieldKey] = err
+		return "", "", nil, errorMap
+	}
+
+	// file replications need a directory to export mutations to
 	repl_type, ok := settings[metadata.ReplicationType]
+	if ok && repl_type == metadata.ReplicationTypeFile {
+		exportDir, _ := settings[metadata.ExportDir].(string)
+		if len(exportDir) == 0 {
+			errorMap[base.PlaceHolderFieldKey] = errors.New("Export directory needs to be specified for file replication")
+			return "", "", nil, errorMap
+		}
+	}
+
+	// webhook replications need a url to post mutations to
+	if ok && repl_type == metadata.ReplicationTypeWebhook {
+		webhookURL, _ := settings[metadata.WebhookURL].(string)
+		if len(webhookURL) == 0 {
+			errorMap[base.PlaceHolderFieldKey] = errors.New("Webhook url needs to be specified for webhook replication")
+			return "", "", nil, errorMap
+		}
+	}
+
+	// seqno range of replay, when bounded, cannot be empty
+	replayStartSeqno, _ := settings[metadata.ReplayStartSeqno].(int)
+	replayEndSeqno, _ := settings[metadata.ReplayEndSeqno].(int)
+	if replayEndSeqno > 0 && replayEndSeqno < replayStartSeqno {
+		errorMap[base.PlaceHolderFieldKey] = errors.New("Replay end seqno cannot be smaller than replay start seqno")
+		return "", "", nil, errorMap
+	}
+
+	// if replication type is set to xmem, validate that the target cluster is xmem compatible
 	if !ok || repl_type == metadata.ReplicationTypeXmem {
 		xmemCompatible, err := service.cluster_info_svc.IsClusterCompatible(targetClusterRef, []int{2, 2})
 		if err != nil {
@@ -277,6 +311,36 @@ func (service *ReplicationSpecService) ValidateNewReplicationSpec(sourceBucket,
 	return sourceBucketUUID, targetBucketUUID, targetClusterRef, errorMap
 }
 
+// checks whether the new replication creates a replication cycle through known clusters that is longer than
+// a simple bidirectional pair. depending on base.KnownClustersCycleCheckMode, such cycles are either logged or refused
+func (service *ReplicationSpecService) validateReplicationTopology(sourceBucket string, targetClusterRef *metadata.RemoteClusterReference, targetBucket string) error {
+	if base.KnownClustersCycleCheckMode == base.KnownClustersCycleCheckModeOff {
+		return nil
+	}
+
+	start_time := time.Now()
+	cycle, err := service.topology_analyzer.FindCycle(sourceBucket, targetClusterRef.Uuid, targetBucket)
+	if err != nil {
+		// cycle check is best effort and should not block replication creation
+		service.logger.Warnf("Skipped replication cycle check since replication topology cannot be analyzed. err=%v\n", err)
+		return nil
+	}
+	service.logger.Infof("Analyzed replication topology. cycle=%v, time taken=%v\n", cycle, time.Since(start_time))
+
+	// a cycle of source -> target -> source is a simple bidirectional pair, which is allowed
+	if len(cycle) <= 3 {
+		return nil
+	}
+
+	errMsg := fmt.Sprintf("Replication creates a replication cycle of length %v: %v", len(cycle)-1, strings.Join(cycle, " -> "))
+	if base.KnownClustersCycleCheckMode == base.KnownClustersCycleCheckModeRefuse {
+		service.logger.Error(errMsg)
+		return errors.New(errMsg)
+	}
+	service.logger.Warn(errMsg)
+	return nil
+}
+
 func (service *ReplicationSpecService) validateBucket(sourceBucket, targetCluster, targetBucket, bucketType string, err error, errorMap map[string]error, isSourceBucket bool) {
 	var qualifier, errKey, bucketName string
 	if isSourceBucket {
@@ -0,0 +1,261 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// analyzer of the replication topology formed by the local cluster and its remote clusters
+package metadata_svc
+
+import (
+	"fmt"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"github.com/couchbase/goxdcr/service_def"
+	"github.com/couchbase/goxdcr/utils"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// task type of xdcr replications in the task list of ns_server
+	XDCRTaskType = "xdcr"
+	// keys in xdcr task entries
+	TaskTypeKey = "type"
+	TaskIdKey   = "id"
+)
+
+// a bucket in the replication topology, identified by the uuid of the cluster it belongs to and its name
+type topologyNode struct {
+	clusterUuid string
+	bucketName  string
+}
+
+func (node topologyNode) String() string {
+	return node.clusterUuid + base.KeyPartsDelimiter + node.bucketName
+}
+
+// source bucket -> target buckets
+type replicationGraph map[topologyNode][]topologyNode
+
+func (graph replicationGraph) addEdge(source, target topologyNode) {
+	for _, existingTarget := range graph[source] {
+		if existingTarget == target {
+			return
+		}
+	}
+	graph[source] = append(graph[source], target)
+}
+
+// finds a path from start to end. returns nil if there is no such path
+func (graph replicationGraph) findPath(start, end topologyNode) []topologyNode {
+	visited := make(map[topologyNode]bool)
+	return graph.findPathFrom(start, end, visited)
+}
+
+func (graph replicationGraph) findPathFrom(current, end topologyNode, visited map[topologyNode]bool) []topologyNode {
+	if current == end {
+		return []topologyNode{current}
+	}
+	visited[current] = true
+	for _, next := range graph[current] {
+		if visited[next] {
+			continue
+		}
+		path := graph.findPathFrom(next, end, visited)
+		if path != nil {
+			return append([]topologyNode{current}, path...)
+		}
+	}
+	return nil
+}
+
+// ReplicationTopologyAnalyzer builds a graph of source bucket -> target bucket edges from the replications
+// of the local cluster and of the remote clusters that the local cluster has references to,
+// and checks whether a new replication would create a replication cycle.
+// only the clusters that the local cluster knows are queried, i.e., the analyzer looks one hop away from
+// the local cluster. remote clusters that the local cluster has no reference to cannot be queried, since the local
+// cluster has no credentials for them, and replications on them are not visible to the analyzer.
+// for example, with replications A -> B -> C -> A, the cycle is found on A only when A has a reference to C
+type ReplicationTopologyAnalyzer struct {
+	xdcr_comp_topology_svc service_def.XDCRCompTopologySvc
+	remote_cluster_svc     service_def.RemoteClusterSvc
+	repl_spec_svc          service_def.ReplicationSpecSvc
+	// retrieves the ids of the replications on a remote cluster
+	remote_replication_ids_getter func(ref *metadata.RemoteClusterReference) ([]string, error)
+	logger                        *log.CommonLogger
+}
+
+func NewReplicationTopologyAnalyzer(xdcr_comp_topology_svc service_def.XDCRCompTopologySvc, remote_cluster_svc service_def.RemoteClusterSvc,
+	repl_spec_svc service_def.ReplicationSpecSvc, logger_ctx *log.LoggerContext) *ReplicationTopologyAnalyzer {
+	analyzer := &ReplicationTopologyAnalyzer{
+		xdcr_comp_topology_svc: xdcr_comp_topology_svc,
+		remote_cluster_svc:     remote_cluster_svc,
+		repl_spec_svc:          repl_spec_svc,
+		logger:                 log.NewLogger("ReplTopologyAnalyzer", logger_ctx),
+	}
+	analyzer.remote_replication_ids_getter = analyzer.getRemoteReplicationIds
+	return analyzer
+}
+
+// checks whether a new replication from sourceBucket in local cluster to targetBucket in target cluster creates a cycle
+// through known clusters. returns the buckets in the cycle, starting and ending with the source bucket, or nil if no cycle is found.
+// a simple bidirectional pair, i.e., a cycle of length 2, is returned when there is no longer cycle, and it is up to the caller to decide what to do with it.
+// remote clusters are queried concurrently within base.CycleCheckRemoteQueryTimeout, so that replication creation is not held up
+// by slow remote clusters
+func (analyzer *ReplicationTopologyAnalyzer) FindCycle(sourceBucket, targetClusterUuid, targetBucket string) ([]string, error) {
+	localClusterUuid, err := analyzer.xdcr_comp_topology_svc.MyClusterUuid()
+	if err != nil {
+		return nil, err
+	}
+
+	specs, err := analyzer.repl_spec_svc.AllReplicationSpecs()
+	if err != nil {
+		return nil, err
+	}
+
+	remoteClusterRefs, err := analyzer.remote_cluster_svc.RemoteClusters(false)
+	if err != nil {
+		return nil, err
+	}
+
+	graph := analyzer.buildGraph(localClusterUuid, specs, remoteClusterRefs)
+	return findCycle(graph, topologyNode{localClusterUuid, sourceBucket}, topologyNode{targetClusterUuid, targetBucket}), nil
+}
+
+// finds a path from start to end that does not take the direct edge from start to end, i.e., that goes through
+// at least one other node. returns nil if there is no such path
+func (graph replicationGraph) findIndirectPath(start, end topologyNode) []topologyNode {
+	visited := map[topologyNode]bool{start: true}
+	for _, next := range graph[start] {
+		if next == end || visited[next] {
+			continue
+		}
+		path := graph.findPathFrom(next, end, visited)
+		if path != nil {
+			return append([]topologyNode{start}, path...)
+		}
+	}
+	return nil
+}
+
+// returns the cycle that an edge from sourceNode to targetNode would create, or nil if there is none.
+// cycles through other buckets are looked for first, so that a direct edge from targetNode back to sourceNode,
+// i.e., a bidirectional pair, does not hide a longer cycle
+func findCycle(graph replicationGraph, sourceNode, targetNode topologyNode) []string {
+	path := graph.findIndirectPath(targetNode, sourceNode)
+	if path == nil {
+		path = graph.findPath(targetNode, sourceNode)
+	}
+	if path == nil {
+		return nil
+	}
+
+	cycle := make([]string, 0, len(path)+1)
+	cycle = append(cycle, sourceNode.String())
+	for _, node := range path {
+		cycle = append(cycle, node.String())
+	}
+	return cycle
+}
+
+// replication ids retrieved from a remote cluster
+type remoteReplicationIds struct {
+	ref            *metadata.RemoteClusterReference
+	replicationIds []string
+	err            error
+}
+
+func (analyzer *ReplicationTopologyAnalyzer) buildGraph(localClusterUuid string, specs map[string]*metadata.ReplicationSpecification,
+	remoteClusterRefs map[string]*metadata.RemoteClusterReference) replicationGraph {
+	graph := make(replicationGraph)
+
+	for _, spec := range specs {
+		graph.addEdge(topologyNode{localClusterUuid, spec.SourceBucketName}, topologyNode{spec.TargetClusterUUID, spec.TargetBucketName})
+	}
+
+	// the channel is buffered so that queries that finish after the timeout do not block
+	results_ch := make(chan *remoteReplicationIds, len(remoteClusterRefs))
+	pending := make(map[*metadata.RemoteClusterReference]bool)
+	for _, ref := range remoteClusterRefs {
+		if ref.Uuid == localClusterUuid {
+			continue
+		}
+		pending[ref] = true
+		go func(ref *metadata.RemoteClusterReference) {
+			replicationIds, err := analyzer.remote_replication_ids_getter(ref)
+			results_ch <- &remoteReplicationIds{ref, replicationIds, err}
+		}(ref)
+	}
+
+	timer := time.NewTimer(base.CycleCheckRemoteQueryTimeout)
+	defer timer.Stop()
+	for len(pending) > 0 {
+		select {
+		case result := <-results_ch:
+			delete(pending, result.ref)
+			if result.err != nil {
+				// topology analysis is best effort. skip remote clusters that cannot be reached
+				analyzer.logger.Warnf("Skipping remote cluster %v in topology analysis since its replications cannot be retrieved. err=%v\n", result.ref.Name, result.err)
+				continue
+			}
+			analyzer.addRemoteEdges(graph, result.ref, result.replicationIds)
+		case <-timer.C:
+			for ref := range pending {
+				analyzer.logger.Warnf("Skipping remote cluster %v in topology analysis since its replications cannot be retrieved within %v\n", ref.Name, base.CycleCheckRemoteQueryTimeout)
+			}
+			return graph
+		}
+	}
+
+	return graph
+}
+
+func (analyzer *ReplicationTopologyAnalyzer) addRemoteEdges(graph replicationGraph, ref *metadata.RemoteClusterReference, replicationIds []string) {
+	for _, replicationId := range replicationIds {
+		parts := strings.Split(replicationId, base.KeyPartsDelimiter)
+		if len(parts) != 3 {
+			analyzer.logger.Warnf("Skipping invalid replication id %v from remote cluster %v\n", replicationId, ref.Name)
+			continue
+		}
+		graph.addEdge(topologyNode{ref.Uuid, parts[1]}, topologyNode{parts[0], parts[2]})
+	}
+}
+
+// retrieves the ids of the replications on the remote cluster from the task list of its ns_server
+func (analyzer *ReplicationTopologyAnalyzer) getRemoteReplicationIds(ref *metadata.RemoteClusterReference) ([]string, error) {
+	connStr, err := ref.MyConnectionStr()
+	if err != nil {
+		return nil, err
+	}
+	username, password, certificate, sanInCertificate, err := ref.MyCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []interface{}
+	err, statusCode := utils.QueryRestApiWithAuth(connStr, base.DefaultPoolTasksPath, false, username, password, certificate, sanInCertificate, base.MethodGet, "", nil, base.CycleCheckRemoteQueryTimeout, &tasks, nil, false, analyzer.logger)
+	if err != nil || statusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed on calling host=%v, path=%v, err=%v, statusCode=%v", connStr, base.DefaultPoolTasksPath, err, statusCode)
+	}
+
+	replicationIds := make([]string, 0)
+	for _, task := range tasks {
+		taskMap, ok := task.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if taskType, ok := taskMap[TaskTypeKey].(string); !ok || taskType != XDCRTaskType {
+			continue
+		}
+		if replicationId, ok := taskMap[TaskIdKey].(string); ok {
+			replicationIds = append(replicationIds, replicationId)
+		}
+	}
+	return replicationIds, nil
+}
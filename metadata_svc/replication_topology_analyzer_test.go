@@ -0,0 +1,135 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package metadata_svc
+
+import (
+	"errors"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// replications that exist on local cluster A and on remote clusters B and C, which form a ring with A -> B
+func testRingReplicationIds() map[string][]string {
+	return map[string][]string{
+		"B": {"C/b/c"},
+		"C": {"A/c/a"},
+	}
+}
+
+func newTestTopologyAnalyzer(remoteReplicationIds map[string][]string, delays map[string]time.Duration) *ReplicationTopologyAnalyzer {
+	return &ReplicationTopologyAnalyzer{
+		remote_replication_ids_getter: func(ref *metadata.RemoteClusterReference) ([]string, error) {
+			time.Sleep(delays[ref.Uuid])
+			replicationIds, ok := remoteReplicationIds[ref.Uuid]
+			if !ok {
+				return nil, errors.New("cluster cannot be reached")
+			}
+			return replicationIds, nil
+		},
+		logger: log.NewLogger("TestAnalyzer", log.DefaultLoggerContext),
+	}
+}
+
+func testRemoteClusterRefs(uuids ...string) map[string]*metadata.RemoteClusterReference {
+	refs := make(map[string]*metadata.RemoteClusterReference)
+	for _, uuid := range uuids {
+		refs[uuid] = &metadata.RemoteClusterReference{Id: uuid, Uuid: uuid, Name: "cluster" + uuid}
+	}
+	return refs
+}
+
+func findTestCycle(analyzer *ReplicationTopologyAnalyzer, refs map[string]*metadata.RemoteClusterReference,
+	specs map[string]*metadata.ReplicationSpecification, targetClusterUuid, targetBucket string) []string {
+	graph := analyzer.buildGraph("A", specs, refs)
+	return findCycle(graph, topologyNode{"A", "a"}, topologyNode{targetClusterUuid, targetBucket})
+}
+
+func TestFindCycleThroughKnownClusters(t *testing.T) {
+	analyzer := newTestTopologyAnalyzer(testRingReplicationIds(), nil)
+
+	cycle := findTestCycle(analyzer, testRemoteClusterRefs("B", "C"), nil, "B", "b")
+	expected := []string{"A/a", "B/b", "C/c", "A/a"}
+	if !reflect.DeepEqual(cycle, expected) {
+		t.Errorf("expected cycle %v, got %v", expected, cycle)
+	}
+}
+
+// replications on clusters that local cluster has no reference to are not visible
+func TestFindCycleDoesNotSeeUnknownClusters(t *testing.T) {
+	analyzer := newTestTopologyAnalyzer(testRingReplicationIds(), nil)
+
+	if cycle := findTestCycle(analyzer, testRemoteClusterRefs("B"), nil, "B", "b"); cycle != nil {
+		t.Errorf("expected no cycle to be found without a reference to C, got %v", cycle)
+	}
+}
+
+func TestFindCycleBidirectionalPair(t *testing.T) {
+	analyzer := newTestTopologyAnalyzer(map[string][]string{"B": {"A/b/a"}}, nil)
+
+	cycle := findTestCycle(analyzer, testRemoteClusterRefs("B"), nil, "B", "b")
+	expected := []string{"A/a", "B/b", "A/a"}
+	if !reflect.DeepEqual(cycle, expected) {
+		t.Errorf("expected cycle %v, got %v", expected, cycle)
+	}
+}
+
+// a bidirectional pair does not hide a longer cycle through the same buckets
+func TestFindCycleBidirectionalPairAndRing(t *testing.T) {
+	analyzer := newTestTopologyAnalyzer(map[string][]string{"B": {"A/b/a", "C/b/c"}, "C": {"A/c/a"}}, nil)
+
+	cycle := findTestCycle(analyzer, testRemoteClusterRefs("B", "C"), nil, "B", "b")
+	expected := []string{"A/a", "B/b", "C/c", "A/a"}
+	if !reflect.DeepEqual(cycle, expected) {
+		t.Errorf("expected cycle %v, got %v", expected, cycle)
+	}
+}
+
+func TestFindCycleWithLocalReplications(t *testing.T) {
+	analyzer := newTestTopologyAnalyzer(map[string][]string{"B": {"A/b/x"}}, nil)
+	specs := map[string]*metadata.ReplicationSpecification{
+		"spec": {SourceBucketName: "x", TargetClusterUUID: "C", TargetBucketName: "c"},
+	}
+
+	// A/a -> B/b -> A/x -> C/c -> A/a
+	refs := testRemoteClusterRefs("B", "C")
+	cycle := findTestCycle(analyzer, refs, specs, "B", "b")
+	if cycle != nil {
+		t.Errorf("expected no cycle since C has no replication back to A, got %v", cycle)
+	}
+
+	analyzer = newTestTopologyAnalyzer(map[string][]string{"B": {"A/b/x"}, "C": {"A/c/a"}}, nil)
+	cycle = findTestCycle(analyzer, refs, specs, "B", "b")
+	expected := []string{"A/a", "B/b", "A/x", "C/c", "A/a"}
+	if !reflect.DeepEqual(cycle, expected) {
+		t.Errorf("expected cycle %v, got %v", expected, cycle)
+	}
+}
+
+func TestFindCycleSkipsSlowAndUnreachableClusters(t *testing.T) {
+	oldTimeout := base.CycleCheckRemoteQueryTimeout
+	base.CycleCheckRemoteQueryTimeout = 100 * time.Millisecond
+	defer func() { base.CycleCheckRemoteQueryTimeout = oldTimeout }()
+
+	// C is too slow to respond and D cannot be reached
+	analyzer := newTestTopologyAnalyzer(testRingReplicationIds(), map[string]time.Duration{"C": 5 * time.Second})
+
+	start := time.Now()
+	cycle := findTestCycle(analyzer, testRemoteClusterRefs("B", "C", "D"), nil, "B", "b")
+	if cycle != nil {
+		t.Errorf("expected no cycle to be found when C does not respond in time, got %v", cycle)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected topology analysis to give up on C after the timeout, took %v", elapsed)
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// defines the format and the layout of archived mutation files, which are written by file nozzles
+package parts
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/metadata"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// operations of archive records
+const (
+	ArchiveOpMutation   = "mutation"
+	ArchiveOpDeletion   = "deletion"
+	ArchiveOpExpiration = "expiration"
+)
+
+const (
+	// name of the directory of a vbucket in the archive directory of a replication, e.g., vb_12
+	ArchiveVBDirPrefix = "vb_"
+	// archive files of a vbucket are named after their segment numbers, e.g., 0000000003.jsonl
+	ArchiveJSONFileExt   = ".jsonl"
+	ArchiveBinaryFileExt = ".bin"
+	archiveSegmentDigits = 10
+
+	// op(1) datatype(1) vb(2) seqno(8) revSeqno(8) cas(8) flags(4) expiry(4) keyLen(2) bodyLen(4)
+	archiveBinaryHeaderSize = 42
+)
+
+var ErrorInvalidArchiveRecord = errors.New("Invalid archive record")
+
+// a mutation, deletion or expiration in an archive file
+type ArchiveRecord struct {
+	Op       string `json:"op"`
+	VBucket  uint16 `json:"vb"`
+	Seqno    uint64 `json:"seqno"`
+	Key      string `json:"key"`
+	RevSeqno uint64 `json:"rev"`
+	Cas      uint64 `json:"cas"`
+	Flags    uint32 `json:"flags"`
+	Expiry   uint32 `json:"expiry"`
+	DataType uint8  `json:"datatype"`
+	Body     []byte `json:"body,omitempty"`
+}
+
+// constructs an archive record from a request routed from dcp. the body of the record shares the
+// memory of the request, hence the record needs to be encoded before the request is recycled
+func NewArchiveRecord(req *base.WrappedMCRequest) (*ArchiveRecord, error) {
+	var op string
+	switch req.Req.Opcode {
+	case mc.UPR_MUTATION:
+		op = ArchiveOpMutation
+	case mc.UPR_DELETION:
+		op = ArchiveOpDeletion
+	case mc.UPR_EXPIRATION:
+		op = ArchiveOpExpiration
+	default:
+		return nil, fmt.Errorf("Cannot archive request with opcode %v", req.Req.Opcode)
+	}
+	if len(req.Req.Extras) < 24 {
+		return nil, fmt.Errorf("Cannot archive request with extras of length %v", len(req.Req.Extras))
+	}
+
+	return &ArchiveRecord{Op: op,
+		VBucket:  req.Req.VBucket,
+		Seqno:    req.Seqno,
+		Key:      string(req.Req.Key),
+		RevSeqno: binary.BigEndian.Uint64(req.Req.Extras[8:16]),
+		Cas:      req.Req.Cas,
+		Flags:    binary.BigEndian.Uint32(req.Req.Extras[0:4]),
+		Expiry:   binary.BigEndian.Uint32(req.Req.Extras[4:8]),
+		DataType: req.Req.DataType,
+		Body:     req.Req.Body,
+	}, nil
+}
+
+// the dcp opcode of the record
+func (record *ArchiveRecord) Opcode() (mc.CommandCode, error) {
+	switch record.Op {
+	case ArchiveOpMutation:
+		return mc.UPR_MUTATION, nil
+	case ArchiveOpDeletion:
+		return mc.UPR_DELETION, nil
+	case ArchiveOpExpiration:
+		return mc.UPR_EXPIRATION, nil
+	default:
+		return 0, fmt.Errorf("Invalid op %v in archive record", record.Op)
+	}
+}
+
+// encodes the record in the specified format, metadata.ExportFormatJSON or metadata.ExportFormatBinary
+func (record *ArchiveRecord) Encode(format string) ([]byte, error) {
+	if format == metadata.ExportFormatJSON {
+		bytes, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		// one record per line
+		return append(bytes, '\n'), nil
+	}
+
+	opcode, err := record.Opcode()
+	if err != nil {
+		return nil, err
+	}
+	if len(record.Key) > 0xFFFF {
+		return nil, fmt.Errorf("Key of length %v is too long for archive record", len(record.Key))
+	}
+
+	bytes := make([]byte, archiveBinaryHeaderSize+len(record.Key)+len(record.Body))
+	bytes[0] = uint8(opcode)
+	bytes[1] = record.DataType
+	binary.BigEndian.PutUint16(bytes[2:4], record.VBucket)
+	binary.BigEndian.PutUint64(bytes[4:12], record.Seqno)
+	binary.BigEndian.PutUint64(bytes[12:20], record.RevSeqno)
+	binary.BigEndian.PutUint64(bytes[20:28], record.Cas)
+	binary.BigEndian.PutUint32(bytes[28:32], record.Flags)
+	binary.BigEndian.PutUint32(bytes[32:36], record.Expiry)
+	binary.BigEndian.PutUint16(bytes[36:38], uint16(len(record.Key)))
+	binary.BigEndian.PutUint32(bytes[38:42], uint32(len(record.Body)))
+	copy(bytes[archiveBinaryHeaderSize:], record.Key)
+	copy(bytes[archiveBinaryHeaderSize+len(record.Key):], record.Body)
+	return bytes, nil
+}
+
+// reads archive records of the specified format from an archive file
+type ArchiveRecordReader struct {
+	reader *bufio.Reader
+	format string
+}
+
+func NewArchiveRecordReader(reader io.Reader, format string) *ArchiveRecordReader {
+	return &ArchiveRecordReader{reader: bufio.NewReader(reader),
+		format: format}
+}
+
+// returns the next record, or io.EOF when there are no more records.
+// a partially written record at the end of the file, e.g., one written right before a crash, is treated as end of file
+func (archiveReader *ArchiveRecordReader) Next() (*ArchiveRecord, error) {
+	if archiveReader.format == metadata.ExportFormatJSON {
+		line, err := archiveReader.reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a line without line break is a partial record
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+		record := &ArchiveRecord{}
+		err = json.Unmarshal(line, record)
+		if err != nil {
+			return nil, ErrorInvalidArchiveRecord
+		}
+		return record, nil
+	}
+
+	header := make([]byte, archiveBinaryHeaderSize)
+	_, err := io.ReadFull(archiveReader.reader, header)
+	if err == io.ErrUnexpectedEOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	record := &ArchiveRecord{DataType: header[1],
+		VBucket:  binary.BigEndian.Uint16(header[2:4]),
+		Seqno:    binary.BigEndian.Uint64(header[4:12]),
+		RevSeqno: binary.BigEndian.Uint64(header[12:20]),
+		Cas:      binary.BigEndian.Uint64(header[20:28]),
+		Flags:    binary.BigEndian.Uint32(header[28:32]),
+		Expiry:   binary.BigEndian.Uint32(header[32:36]),
+	}
+	switch mc.CommandCode(header[0]) {
+	case mc.UPR_MUTATION:
+		record.Op = ArchiveOpMutation
+	case mc.UPR_DELETION:
+		record.Op = ArchiveOpDeletion
+	case mc.UPR_EXPIRATION:
+		record.Op = ArchiveOpExpiration
+	default:
+		return nil, ErrorInvalidArchiveRecord
+	}
+
+	keyLen := int(binary.BigEndian.Uint16(header[36:38]))
+	bodyLen := int(binary.BigEndian.Uint32(header[38:42]))
+	data := make([]byte, keyLen+bodyLen)
+	_, err = io.ReadFull(archiveReader.reader, data)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, err
+	}
+	record.Key = string(data[:keyLen])
+	if bodyLen > 0 {
+		record.Body = data[keyLen:]
+	}
+	return record, nil
+}
+
+// the directory under exportDir where the archive files of a replication are kept
+func ArchiveDirForReplication(exportDir, topic string) string {
+	// replication ids contain "/", which cannot be in directory names
+	return filepath.Join(exportDir, strings.Replace(topic, base.KeyPartsDelimiter, "_", -1))
+}
+
+// the directory where the archive files of a vbucket are kept
+func ArchiveVBDir(archiveDir string, vbno uint16) string {
+	return filepath.Join(archiveDir, ArchiveVBDirPrefix+strconv.Itoa(int(vbno)))
+}
+
+func archiveFileExt(format string) string {
+	if format == metadata.ExportFormatJSON {
+		return ArchiveJSONFileExt
+	}
+	return ArchiveBinaryFileExt
+}
+
+func archiveSegmentFileName(segment int, format string) string {
+	return fmt.Sprintf("%0*d%v", archiveSegmentDigits, segment, archiveFileExt(format))
+}
+
+// returns the segment numbers of the archive files of the specified format in vbDir, in ascending order.
+// returns an empty list when vbDir does not exist
+func ArchiveSegments(vbDir, format string) ([]int, error) {
+	fileInfos, err := ioutil.ReadDir(vbDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []int{}, nil
+		}
+		return nil, err
+	}
+
+	ext := archiveFileExt(format)
+	segments := make([]int, 0, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if fileInfo.IsDir() || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		segment, err := strconv.Atoi(strings.TrimSuffix(name, ext))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// returns the path of the archive file with the specified segment number in vbDir
+func ArchiveSegmentPath(vbDir string, segment int, format string) string {
+	return filepath.Join(vbDir, archiveSegmentFileName(segment, format))
+}
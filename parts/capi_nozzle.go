@@ -64,7 +64,11 @@ var capi_setting_defs base.SettingDefinitions = base.SettingDefinitions{SETTING_
 	SETTING_READ_TIMEOUT:          base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
 	SETTING_MAX_RETRY_INTERVAL:    base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
 	SETTING_UPLOAD_WINDOW_SIZE:    base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
-	SETTING_CONNECTION_TIMEOUT:    base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false)}
+	SETTING_CONNECTION_TIMEOUT:    base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
+	SETTING_BANDWIDTH_LIMIT:       base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	SETTING_PRIORITY:              base.NewSettingDef(reflect.TypeOf((*string)(nil)), false),
+	SETTING_CONFLICT_LOGGING:      base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
+	SETTING_CONFLICT_LOG_BODIES:   base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false)}
 
 var NewEditsKey = "new_edits"
 var DocsKey = "docs"
@@ -198,6 +202,14 @@ type CapiNozzle struct {
 	lock_handle_error sync.RWMutex
 	dataObj_recycler  base.DataObjRecycler
 	topic             string
+
+	// limits the bandwidth used by writes to target. shared by the outgoing nozzles of the replication
+	bandwidth_throttler *base.BandwidthThrottler
+	// total time, in nanoseconds, that writes have been delayed by bandwidth_throttler
+	counter_throttled_time int64
+
+	// decides which documents are looked up on target before they are sent
+	conflict_resolver ConflictResolver
 }
 
 func NewCapiNozzle(id string,
@@ -237,6 +249,7 @@ func NewCapiNozzle(id string,
 		counter_received:  0,
 		dataObj_recycler:  dataObj_recycler,
 		topic:             topic,
+		conflict_resolver: &defaultConflictResolver{},
 	}
 
 	capi.config.connectStr = connectString
@@ -316,6 +329,8 @@ func (capi *CapiNozzle) Start(settings map[string]interface{}) error {
 	err = capi.initialize(settings)
 	capi.Logger().Infof("%v initialized\n", capi.Id())
 	if err == nil {
+		capi.config.registerRunningNozzle(capi.Id())
+
 		capi.childrenWaitGrp.Add(1)
 		go capi.selfMonitor(capi.selfMonitor_finch, &capi.childrenWaitGrp)
 
@@ -340,6 +355,7 @@ func (capi *CapiNozzle) Start(settings map[string]interface{}) error {
 
 func (capi *CapiNozzle) Stop() error {
 	capi.Logger().Infof("%v stopping \n", capi.Id())
+	unregisterRunningNozzle(capi.Id())
 
 	err := capi.SetState(common.Part_Stopping)
 	if err != nil {
@@ -479,11 +495,13 @@ func (capi *CapiNozzle) processData_batch(finch chan bool, waitGrp *sync.WaitGro
 				}
 				if capi.IsOpen() {
 					capi.Logger().Debugf("%v Batch Send..., %v batches ready, %v items in queue, count_recieved=%v, count_sent=%v\n", capi.Id(), len(capi.batches_ready), atomic.LoadInt32(&capi.items_in_dataChan), atomic.LoadUint32(&capi.counter_received), atomic.LoadUint32(&capi.counter_sent))
+					batch_start_time := time.Now()
 					err = capi.send_internal(batch)
 					if err != nil {
 						capi.handleGeneralError(err)
 						goto done
 					}
+					capi.config.yieldAfterBatch(time.Since(batch_start_time), finch)
 				}
 			}
 		case <-capi.batches_nonempty_ch:
@@ -695,7 +713,11 @@ func (capi *CapiNozzle) batchSendWithRetry(batch *capiBatch) error {
 				additionalInfo := DataFailedCRSourceEventAdditional{Seqno: item.Seqno,
 					Opcode:      encodeOpCode(item.Req.Opcode),
 					IsExpirySet: (binary.BigEndian.Uint32(item.Req.Extras[4:8]) != 0),
-					VBucket:     item.Req.VBucket,
+					VBucket:     item.SrcVBucket,
+				}
+				if capi.config.conflictLogging {
+					// _revs_diff query does not return the metadata of target documents
+					additionalInfo.Conflict = newConflictRecord(item, decodeSetMetaReq(item), nil, capi.config.conflictLogBodies)
 				}
 				capi.RaiseEvent(common.NewEvent(common.DataFailedCRSource, nil, capi, nil, additionalInfo))
 			}
@@ -715,7 +737,7 @@ func (capi *CapiNozzle) batchSendWithRetry(batch *capiBatch) error {
 				Commit_time: time.Since(req.Start_time),
 				Opcode:      req.Req.Opcode,
 				IsExpirySet: (binary.BigEndian.Uint32(req.Req.Extras[4:8]) != 0),
-				VBucket:     req.Req.VBucket,
+				VBucket:     req.SrcVBucket,
 				Req_size:    req.Req.Size(),
 			}
 			capi.RaiseEvent(common.NewEvent(common.DataSent, nil, capi, nil, additionalInfo))
@@ -761,7 +783,8 @@ func (capi *CapiNozzle) selfMonitor(finch chan bool, waitGrp *sync.WaitGroup) {
 		case <-finch:
 			goto done
 		case <-statsTicker.C:
-			capi.RaiseEvent(common.NewEvent(common.StatsUpdate, nil, capi, nil, []int{int(atomic.LoadInt32(&capi.items_in_dataChan)), int(atomic.LoadInt64(&capi.bytes_in_dataChan))}))
+			capi.RaiseEvent(common.NewEvent(common.StatsUpdate, nil, capi, nil, []int{int(atomic.LoadInt32(&capi.items_in_dataChan)), int(atomic.LoadInt64(&capi.bytes_in_dataChan)),
+				int(time.Duration(atomic.LoadInt64(&capi.counter_throttled_time)) / time.Millisecond)}))
 		}
 	}
 done:
@@ -987,6 +1010,12 @@ func (capi *CapiNozzle) tcpProxy(vbno uint16, part_ch chan []byte, resp_ch chan
 		case part, ok := <-part_ch:
 
 			if ok {
+				// throttle before setting write deadline so that the time spent waiting does not count towards write timeout
+				if capi.bandwidth_throttler != nil {
+					throttled_time := capi.bandwidth_throttler.Wait(len(part), fin_ch)
+					atomic.AddInt64(&capi.counter_throttled_time, int64(throttled_time))
+				}
+
 				client := capi.getClient()
 				client.SetWriteDeadline(time.Now().Add(capi.config.writeTimeout))
 				_, err := client.Write(part)
@@ -1113,7 +1142,7 @@ func (capi *CapiNozzle) initialize(settings map[string]interface{}) error {
 
 	capi.vb_dataChan_map = make(map[uint16]chan *base.WrappedMCRequest)
 	for vbno, _ := range capi.config.vbCouchApiBaseMap {
-		capi.vb_dataChan_map[vbno] = make(chan *base.WrappedMCRequest, capi.config.maxCount*base.CapiDataChanSizeMultiplier)
+		capi.vb_dataChan_map[vbno] = make(chan *base.WrappedMCRequest, capi.config.dataChanSize(capi.config.maxCount*base.CapiDataChanSizeMultiplier))
 	}
 	capi.items_in_dataChan = 0
 	capi.bytes_in_dataChan = 0
@@ -1241,6 +1270,38 @@ func (capi *CapiNozzle) UpdateSettings(settings map[string]interface{}) error {
 	}
 
 	atomic.StoreUint32(&capi.config.optiRepThreshold, uint32(optimisticReplicationThreshold))
+
+	return capi.updateBandwidthLimit(settings)
+}
+
+// sets the conflict resolver, which needs to be done before the nozzle is started.
+// _revs_diff query tells only whether target is missing the revisions of documents, and target always resolves
+// conflicts by revisions, hence the default resolver is the only one supported, as metadata.ConflictResolverSupportedForCapi says
+func (capi *CapiNozzle) SetConflictResolver(resolver ConflictResolver) error {
+	if _, ok := resolver.(*defaultConflictResolver); !ok {
+		return fmt.Errorf("Conflict resolver %T is not supported for capi replication", resolver)
+	}
+	capi.conflict_resolver = resolver
+	return nil
+}
+
+// sets the throttler that limits the bandwidth used by the nozzle. needs to be called before the nozzle is started
+func (capi *CapiNozzle) SetBandwidthThrottler(throttler *base.BandwidthThrottler) {
+	capi.bandwidth_throttler = throttler
+}
+
+func (capi *CapiNozzle) updateBandwidthLimit(settings map[string]interface{}) error {
+	if bandwidthLimitObj, ok := settings[SETTING_BANDWIDTH_LIMIT]; ok && capi.bandwidth_throttler != nil {
+		bandwidthLimit, ok := bandwidthLimitObj.(int)
+		if !ok {
+			return fmt.Errorf("Setting %v is of wrong type", SETTING_BANDWIDTH_LIMIT)
+		}
+		// the throttler is shared, hence the limit may have been updated by other nozzles already
+		if capi.bandwidth_throttler.Limit() != bandwidthLimit {
+			capi.bandwidth_throttler.SetLimit(bandwidthLimit)
+			capi.Logger().Infof("%v updated bandwidth limit to %v\n", capi.Id(), bandwidthLimit)
+		}
+	}
 	return nil
 }
 
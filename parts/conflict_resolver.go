@@ -0,0 +1,238 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"math/big"
+	"strings"
+)
+
+// how outgoing nozzles look up the versions of documents on target before resolving conflicts
+type ConflictLookupMode int
+
+const (
+	// documents larger than optimistic replication threshold have their metadata looked up on target.
+	// smaller documents are sent without lookups, and their conflicts are resolved by target
+	LookupBigDocs ConflictLookupMode = iota
+	// no document is looked up
+	LookupNone ConflictLookupMode = iota
+	// all documents have their metadata looked up on target
+	LookupAllDocs ConflictLookupMode = iota
+	// all documents are looked up on target with their bodies, which come with cas and flags but not with other metadata
+	LookupAllDocsWithBody ConflictLookupMode = iota
+)
+
+// ConflictResolver decides whether a source document is to be sent to target when a version of the document
+// exists on target. It is consulted by outgoing nozzles for the documents that they look up on target
+type ConflictResolver interface {
+	// returns true if the source document wins, in which case it is sent to target
+	Resolve(doc_meta_source documentMetadata, doc_meta_target documentMetadata, logger *log.CommonLogger) bool
+	LookupMode() ConflictLookupMode
+	// whether the source documents sent are to be written regardless of the conflict resolution on target.
+	// needed when the resolver has the final say, since target would otherwise resolve conflicts by its own rules
+	SkipTargetResolution() bool
+}
+
+// constructs the conflict resolver of the specified type, which is one of metadata.ConflictResolverTypeXXX.
+// the empty type of replications created before resolvers were introduced is treated as the default type
+func NewConflictResolver(resolverType string, field string, source_cr_mode base.ConflictResolutionMode) (ConflictResolver, error) {
+	switch resolverType {
+	case metadata.ConflictResolverTypeDefault, "":
+		return &defaultConflictResolver{source_cr_mode: source_cr_mode}, nil
+	case metadata.ConflictResolverTypeSourceWins:
+		return &sourceWinsConflictResolver{}, nil
+	case metadata.ConflictResolverTypeTargetWins:
+		return &targetWinsConflictResolver{}, nil
+	case metadata.ConflictResolverTypeField:
+		if len(field) == 0 {
+			return nil, metadata.ErrorEmptyConflictResolverField
+		}
+		return &fieldConflictResolver{field: field, path: strings.Split(field, ".")}, nil
+	default:
+		return nil, fmt.Errorf("Invalid conflict resolver type %v", resolverType)
+	}
+}
+
+/************************************
+/* struct defaultConflictResolver
+*************************************/
+
+// resolves conflicts by revision id or by cas, depending on the conflict resolution mode of source bucket,
+// the same way as target does
+type defaultConflictResolver struct {
+	source_cr_mode base.ConflictResolutionMode
+}
+
+func (resolver *defaultConflictResolver) Resolve(doc_meta_source documentMetadata, doc_meta_target documentMetadata, logger *log.CommonLogger) bool {
+	return resolveConflict(doc_meta_source, doc_meta_target, resolver.source_cr_mode, logger)
+}
+
+func (resolver *defaultConflictResolver) LookupMode() ConflictLookupMode {
+	return LookupBigDocs
+}
+
+func (resolver *defaultConflictResolver) SkipTargetResolution() bool {
+	return false
+}
+
+/************************************
+/* struct sourceWinsConflictResolver
+*************************************/
+
+// source documents always overwrite their versions on target, hence there is no need to look them up
+type sourceWinsConflictResolver struct {
+}
+
+func (resolver *sourceWinsConflictResolver) Resolve(doc_meta_source documentMetadata, doc_meta_target documentMetadata, logger *log.CommonLogger) bool {
+	return true
+}
+
+func (resolver *sourceWinsConflictResolver) LookupMode() ConflictLookupMode {
+	return LookupNone
+}
+
+func (resolver *sourceWinsConflictResolver) SkipTargetResolution() bool {
+	return true
+}
+
+/************************************
+/* struct targetWinsConflictResolver
+*************************************/
+
+// source documents are sent only when they do not exist on target. deleted documents on target exist
+// as tombstones until they are purged, hence they win too
+type targetWinsConflictResolver struct {
+}
+
+func (resolver *targetWinsConflictResolver) Resolve(doc_meta_source documentMetadata, doc_meta_target documentMetadata, logger *log.CommonLogger) bool {
+	return false
+}
+
+func (resolver *targetWinsConflictResolver) LookupMode() ConflictLookupMode {
+	return LookupAllDocs
+}
+
+func (resolver *targetWinsConflictResolver) SkipTargetResolution() bool {
+	return false
+}
+
+/************************************
+/* struct fieldConflictResolver
+*************************************/
+
+// the version with the greater value of a json field, e.g., updatedAt, wins. numbers are compared numerically
+// and strings lexicographically, which works for timestamps in ISO 8601 format.
+// a version with the field wins over a version without it. deletions carry no bodies and are resolved by cas,
+// as are versions that both lack the field or whose values of the field are equal or not comparable
+type fieldConflictResolver struct {
+	field string
+	path  []string
+}
+
+func (resolver *fieldConflictResolver) Resolve(doc_meta_source documentMetadata, doc_meta_target documentMetadata, logger *log.CommonLogger) bool {
+	if !doc_meta_source.deletion {
+		sourceValue, sourceHasField := resolver.fieldValue(doc_meta_source.body)
+		targetValue, targetHasField := resolver.fieldValue(doc_meta_target.body)
+		if sourceHasField && !targetHasField {
+			return true
+		} else if !sourceHasField && targetHasField {
+			return false
+		} else if sourceHasField && targetHasField {
+			result, comparable := compareFieldValues(sourceValue, targetValue)
+			if comparable && result != 0 {
+				return result > 0
+			}
+			if !comparable && logger.GetLogLevel() >= log.LogLevelDebug {
+				logger.Debugf("Values of field %v of doc %s cannot be compared. source value=%v, target value=%v\n", resolver.field, doc_meta_source.key, sourceValue, targetValue)
+			}
+		}
+	}
+	return doc_meta_source.cas > doc_meta_target.cas
+}
+
+func (resolver *fieldConflictResolver) LookupMode() ConflictLookupMode {
+	return LookupAllDocsWithBody
+}
+
+func (resolver *fieldConflictResolver) SkipTargetResolution() bool {
+	return true
+}
+
+// returns the value of the field in body, and whether body is a json object that contains the field
+func (resolver *fieldConflictResolver) fieldValue(body []byte) (interface{}, bool) {
+	if len(body) == 0 {
+		return nil, false
+	}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if decoder.Decode(&value) != nil {
+		return nil, false
+	}
+	for _, segment := range resolver.path {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = obj[segment]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// compares two field values. returns the result of the comparison, and whether the values are comparable,
+// i.e., whether both are numbers or both are strings
+func compareFieldValues(value1 interface{}, value2 interface{}) (int, bool) {
+	switch v1 := value1.(type) {
+	case json.Number:
+		v2, ok := value2.(json.Number)
+		if !ok {
+			return 0, false
+		}
+		return compareJsonNumbers(v1, v2)
+	case string:
+		v2, ok := value2.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(v1, v2), true
+	default:
+		return 0, false
+	}
+}
+
+// compares two json numbers exactly. converting them to float64 would lose precision for integers above 2^53,
+// e.g., for timestamps in nanoseconds, and would treat distinct values as equal
+func compareJsonNumbers(n1 json.Number, n2 json.Number) (int, bool) {
+	f1, ok1 := parseJsonNumber(n1)
+	f2, ok2 := parseJsonNumber(n2)
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	return f1.Cmp(f2), true
+}
+
+// parses a json number with enough precision to hold all of its digits
+func parseJsonNumber(n json.Number) (*big.Float, bool) {
+	prec := uint(len(n))*4 + 64
+	f, _, err := big.ParseFloat(string(n), 10, prec, big.ToNearestEven)
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
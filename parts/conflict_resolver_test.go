@@ -0,0 +1,97 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"encoding/json"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"testing"
+)
+
+func TestCompareFieldValues(t *testing.T) {
+	tests := []struct {
+		value1     interface{}
+		value2     interface{}
+		result     int
+		comparable bool
+	}{
+		{json.Number("2"), json.Number("10"), -1, true},
+		{json.Number("1.5"), json.Number("1.50"), 0, true},
+		{json.Number("1e3"), json.Number("999"), 1, true},
+		// equal once converted to float64
+		{json.Number("9007199254740993"), json.Number("9007199254740992"), 1, true},
+		{json.Number("1700000000000000001"), json.Number("1700000000000000002"), -1, true},
+		{"2024-01-02T00:00:00Z", "2024-01-01T00:00:00Z", 1, true},
+		{json.Number("1"), "1", 0, false},
+		{true, false, 0, false},
+	}
+
+	for _, test := range tests {
+		result, comparable := compareFieldValues(test.value1, test.value2)
+		if result != test.result || comparable != test.comparable {
+			t.Errorf("expected comparison of %v and %v to be %v and comparable=%v, got %v and %v",
+				test.value1, test.value2, test.result, test.comparable, result, comparable)
+		}
+	}
+}
+
+func TestFieldConflictResolver(t *testing.T) {
+	resolver, err := NewConflictResolver(metadata.ConflictResolverTypeField, "meta.updatedAt", base.CRMode_RevId)
+	if err != nil {
+		t.Fatalf("failed to construct resolver. err=%v", err)
+	}
+
+	newer := documentMetadata{key: []byte("k"), cas: 1, body: []byte(`{"meta": {"updatedAt": 1700000000000000001}}`)}
+	older := documentMetadata{key: []byte("k"), cas: 2, body: []byte(`{"meta": {"updatedAt": 1700000000000000000}}`)}
+	missing := documentMetadata{key: []byte("k"), cas: 3, body: []byte(`{"meta": {}}`)}
+	logger := log.NewLogger("test", log.DefaultLoggerContext)
+
+	if !resolver.Resolve(newer, older, logger) {
+		t.Errorf("expected source with greater field value to win")
+	}
+	if resolver.Resolve(older, newer, logger) {
+		t.Errorf("expected source with smaller field value to lose")
+	}
+	if !resolver.Resolve(older, missing, logger) {
+		t.Errorf("expected source with field to win over target without it")
+	}
+}
+
+func TestFieldConflictResolverNeedsField(t *testing.T) {
+	_, err := NewConflictResolver(metadata.ConflictResolverTypeField, "", base.CRMode_RevId)
+	if err != metadata.ErrorEmptyConflictResolverField {
+		t.Errorf("expected ErrorEmptyConflictResolverField, got %v", err)
+	}
+}
+
+// capi nozzle accepts exactly the resolvers that replication settings allow for capi replication
+func TestCapiConflictResolverMatchesSettingsValidation(t *testing.T) {
+	resolverTypes := []string{"", metadata.ConflictResolverTypeDefault, metadata.ConflictResolverTypeSourceWins,
+		metadata.ConflictResolverTypeTargetWins, metadata.ConflictResolverTypeField}
+	for _, resolverType := range resolverTypes {
+		resolver, err := NewConflictResolver(resolverType, "updatedAt", base.CRMode_RevId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acceptedByNozzle := (&CapiNozzle{}).SetConflictResolver(resolver) == nil
+
+		settings := metadata.DefaultSettings()
+		settings.RepType = metadata.ReplicationTypeCapi
+		settings.ConflictResolver = resolverType
+		settings.ConflictResolverField = "updatedAt"
+		_, refused := settings.ValidateDependentSettings()[metadata.ConflictResolver]
+
+		if acceptedByNozzle == refused || acceptedByNozzle != metadata.ConflictResolverSupportedForCapi(resolverType) {
+			t.Errorf("resolver %q is accepted by capi nozzle=%v, refused by settings validation=%v", resolverType, acceptedByNozzle, refused)
+		}
+	}
+}
@@ -0,0 +1,655 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/couchbase/goxdcr/base"
+	common "github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/gen_server"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"github.com/couchbase/goxdcr/utils"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//configuration param names
+	FILE_SETTING_EXPORT_FORMAT = "export_format"
+	// size, in bytes, beyond which archive files are rotated
+	FILE_SETTING_FILE_SIZE = "file_size"
+	// the maximum number of archive files kept for each vbucket. 0 means that all files are kept
+	FILE_SETTING_MAX_FILES = "max_files"
+
+	//default configuration
+	default_file_size                int           = 64 * 1024 * 1024
+	default_selfMonitorInterval_file time.Duration = 300 * time.Millisecond
+	default_writer_buffer_size_file  int           = 64 * 1024
+)
+
+var file_setting_defs base.SettingDefinitions = base.SettingDefinitions{SETTING_BATCHCOUNT: base.NewSettingDef(reflect.TypeOf((*int)(nil)), true),
+	SETTING_BATCHSIZE:          base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	SETTING_STATS_INTERVAL:     base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	SETTING_PRIORITY:           base.NewSettingDef(reflect.TypeOf((*string)(nil)), false),
+	FILE_SETTING_EXPORT_FORMAT: base.NewSettingDef(reflect.TypeOf((*string)(nil)), true),
+	FILE_SETTING_FILE_SIZE:     base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	FILE_SETTING_MAX_FILES:     base.NewSettingDef(reflect.TypeOf((*int)(nil)), false)}
+
+/************************************
+/* struct fileConfig
+*************************************/
+type fileConfig struct {
+	baseConfig
+	// metadata.ExportFormatJSON or metadata.ExportFormatBinary
+	format   string
+	fileSize int
+	maxFiles int
+}
+
+func newFileConfig(logger *log.CommonLogger) fileConfig {
+	return fileConfig{
+		baseConfig: baseConfig{maxCount: -1,
+			maxSize:             -1,
+			selfMonitorInterval: default_selfMonitorInterval_file,
+			logger:              logger,
+		},
+		format:   metadata.ExportFormatJSON,
+		fileSize: default_file_size,
+	}
+}
+
+func (config *fileConfig) initializeConfig(settings map[string]interface{}) error {
+	err := utils.ValidateSettings(file_setting_defs, settings, config.logger)
+
+	if err == nil {
+		config.baseConfig.initializeConfig(settings)
+
+		if val, ok := settings[FILE_SETTING_EXPORT_FORMAT]; ok {
+			config.format = val.(string)
+		}
+		if val, ok := settings[FILE_SETTING_FILE_SIZE]; ok {
+			config.fileSize = val.(int)
+		}
+		if val, ok := settings[FILE_SETTING_MAX_FILES]; ok {
+			config.maxFiles = val.(int)
+		}
+	}
+	return err
+}
+
+/************************************
+/* struct archiveWriter
+*************************************/
+
+// archiveWriter appends records to the archive files of a vbucket, and rotates to a new file
+// when the current one exceeds the size limit. when maxFiles is set, the oldest files beyond it are removed on rotation
+type archiveWriter struct {
+	vbDir    string
+	format   string
+	fileSize int
+	maxFiles int
+
+	segment int
+	file    *os.File
+	writer  *bufio.Writer
+	// size of the current file, including data buffered in writer
+	size int
+}
+
+func newArchiveWriter(vbDir, format string, fileSize, maxFiles int) (*archiveWriter, error) {
+	err := os.MkdirAll(vbDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := ArchiveSegments(vbDir, format)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &archiveWriter{vbDir: vbDir,
+		format:   format,
+		fileSize: fileSize,
+		maxFiles: maxFiles,
+	}
+
+	// always start a new file, unless the last one is empty, so that records are never
+	// appended after a partial record left behind by an earlier crash
+	segment := 0
+	if len(segments) > 0 {
+		segment = segments[len(segments)-1]
+		fileInfo, err := os.Stat(ArchiveSegmentPath(vbDir, segment, format))
+		if err != nil {
+			return nil, err
+		}
+		if fileInfo.Size() > 0 {
+			segment++
+		}
+	}
+
+	err = writer.open(segment)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.removeOldFiles()
+	if err != nil {
+		writer.close()
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (writer *archiveWriter) open(segment int) error {
+	file, err := os.OpenFile(ArchiveSegmentPath(writer.vbDir, segment, writer.format), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	writer.segment = segment
+	writer.file = file
+	writer.writer = bufio.NewWriterSize(file, default_writer_buffer_size_file)
+	writer.size = 0
+	return nil
+}
+
+func (writer *archiveWriter) write(data []byte) error {
+	if writer.size > 0 && writer.size+len(data) > writer.fileSize {
+		err := writer.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := writer.writer.Write(data)
+	if err != nil {
+		return err
+	}
+	writer.size += len(data)
+	return nil
+}
+
+func (writer *archiveWriter) rotate() error {
+	err := writer.close()
+	if err != nil {
+		return err
+	}
+	err = writer.open(writer.segment + 1)
+	if err != nil {
+		return err
+	}
+	return writer.removeOldFiles()
+}
+
+// removes the oldest archive files of the vbucket, so that at most maxFiles files, including the current one, are kept
+func (writer *archiveWriter) removeOldFiles() error {
+	if writer.maxFiles <= 0 {
+		return nil
+	}
+
+	segments, err := ArchiveSegments(writer.vbDir, writer.format)
+	if err != nil {
+		return err
+	}
+	for len(segments) > writer.maxFiles && segments[0] < writer.segment {
+		err = os.Remove(ArchiveSegmentPath(writer.vbDir, segments[0], writer.format))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		segments = segments[1:]
+	}
+	return nil
+}
+
+// writes buffered records to the file and syncs the file to disk
+func (writer *archiveWriter) flush() error {
+	err := writer.writer.Flush()
+	if err != nil {
+		return err
+	}
+	return writer.file.Sync()
+}
+
+func (writer *archiveWriter) close() error {
+	err := writer.flush()
+	err1 := writer.file.Close()
+	if err == nil {
+		err = err1
+	}
+	return err
+}
+
+/************************************
+/* struct FileNozzle
+*************************************/
+
+// FileNozzle exports the mutations, deletions and expirations of a set of vbuckets into per-vbucket
+// append-only archive files under the archive directory of the replication.
+// DataSent events are raised for records only after they have been synced to disk, so that checkpoints
+// never cover records that could be lost. records written after the last checkpoint are exported again
+// when the replication restarts from the checkpoint, hence archive files may contain duplicates
+type FileNozzle struct {
+
+	//parent inheritance
+	gen_server.GenServer
+	AbstractPart
+
+	bOpen      bool
+	lock_bOpen sync.RWMutex
+
+	topic      string
+	archiveDir string
+	vbList     []uint16
+
+	config fileConfig
+
+	dataChan chan *base.WrappedMCRequest
+	//the total number of items queued in dataChan
+	items_in_dataChan int32
+	//the total size of data (in bytes) queued in dataChan
+	bytes_in_dataChan int64
+
+	// accessed by the writer routine only
+	writers map[uint16]*archiveWriter
+
+	childrenWaitGrp   sync.WaitGroup
+	writer_finch      chan bool
+	selfMonitor_finch chan bool
+
+	counter_received uint32
+	counter_sent     uint32
+	// total size of records written
+	counter_bytes_written uint64
+
+	handle_error      bool
+	lock_handle_error sync.RWMutex
+	dataObj_recycler  base.DataObjRecycler
+}
+
+// records written but not yet synced to disk
+type pendingFileRecord struct {
+	vbno       uint16
+	additional DataSentEventAdditional
+}
+
+func NewFileNozzle(id string,
+	topic string,
+	archiveDir string,
+	vbList []uint16,
+	dataObj_recycler base.DataObjRecycler,
+	logger_context *log.LoggerContext) *FileNozzle {
+
+	//callback functions from GenServer
+	var msg_callback_func gen_server.Msg_Callback_Func
+	var exit_callback_func gen_server.Exit_Callback_Func
+	var error_handler_func gen_server.Error_Handler_Func
+
+	server := gen_server.NewGenServer(&msg_callback_func,
+		&exit_callback_func, &error_handler_func, logger_context, "FileNozzle")
+	part := NewAbstractPartWithLogger(id, server.Logger())
+
+	file := &FileNozzle{GenServer: server,
+		AbstractPart:      part,
+		bOpen:             true,
+		lock_bOpen:        sync.RWMutex{},
+		topic:             topic,
+		archiveDir:        archiveDir,
+		vbList:            vbList,
+		config:            newFileConfig(server.Logger()),
+		childrenWaitGrp:   sync.WaitGroup{},
+		writer_finch:      make(chan bool, 1),
+		selfMonitor_finch: make(chan bool, 1),
+		handle_error:      true,
+		lock_handle_error: sync.RWMutex{},
+		dataObj_recycler:  dataObj_recycler,
+	}
+
+	msg_callback_func = nil
+	exit_callback_func = file.onExit
+	error_handler_func = file.handleGeneralError
+
+	return file
+}
+
+func (file *FileNozzle) IsOpen() bool {
+	file.lock_bOpen.RLock()
+	defer file.lock_bOpen.RUnlock()
+	return file.bOpen
+}
+
+func (file *FileNozzle) Open() error {
+	file.lock_bOpen.Lock()
+	defer file.lock_bOpen.Unlock()
+	if !file.bOpen {
+		file.bOpen = true
+	}
+	return nil
+}
+
+func (file *FileNozzle) Close() error {
+	file.lock_bOpen.Lock()
+	defer file.lock_bOpen.Unlock()
+	if file.bOpen {
+		file.bOpen = false
+	}
+	return nil
+}
+
+func (file *FileNozzle) handleError() bool {
+	file.lock_handle_error.RLock()
+	defer file.lock_handle_error.RUnlock()
+	return file.handle_error
+}
+
+func (file *FileNozzle) disableHandleError() {
+	file.lock_handle_error.Lock()
+	defer file.lock_handle_error.Unlock()
+	file.handle_error = false
+}
+
+func (file *FileNozzle) Start(settings map[string]interface{}) error {
+	file.Logger().Infof("%v starting ....\n", file.Id())
+
+	err := file.SetState(common.Part_Starting)
+	if err != nil {
+		return err
+	}
+
+	err = file.initialize(settings)
+	if err == nil {
+		file.config.registerRunningNozzle(file.Id())
+		file.Logger().Infof("%v initialized with archive directory %v, format %v\n", file.Id(), file.archiveDir, file.config.format)
+
+		file.childrenWaitGrp.Add(1)
+		go file.selfMonitor(file.selfMonitor_finch, &file.childrenWaitGrp)
+
+		file.childrenWaitGrp.Add(1)
+		go file.processData(file.writer_finch, &file.childrenWaitGrp)
+
+		err = file.Start_server()
+	}
+
+	if err == nil {
+		err = file.SetState(common.Part_Running)
+		if err == nil {
+			file.Logger().Infof("%v has been started successfully\n", file.Id())
+		}
+	}
+	if err != nil {
+		file.Logger().Errorf("%v failed to start. err=%v\n", file.Id(), err)
+	}
+	return err
+}
+
+func (file *FileNozzle) initialize(settings map[string]interface{}) error {
+	err := file.config.initializeConfig(settings)
+	if err != nil {
+		return err
+	}
+
+	file.dataChan = make(chan *base.WrappedMCRequest, file.config.dataChanSize(file.config.maxCount*10))
+	file.items_in_dataChan = 0
+	file.bytes_in_dataChan = 0
+
+	file.writers = make(map[uint16]*archiveWriter)
+	for _, vbno := range file.vbList {
+		writer, err := newArchiveWriter(ArchiveVBDir(file.archiveDir, vbno), file.config.format, file.config.fileSize, file.config.maxFiles)
+		if err != nil {
+			file.closeWriters()
+			return fmt.Errorf("Error opening archive file for vb=%v. err=%v", vbno, err)
+		}
+		file.writers[vbno] = writer
+	}
+	return nil
+}
+
+func (file *FileNozzle) Stop() error {
+	file.Logger().Infof("%v stopping \n", file.Id())
+	unregisterRunningNozzle(file.Id())
+
+	err := file.SetState(common.Part_Stopping)
+	if err != nil {
+		return err
+	}
+
+	file.Logger().Debugf("%v processed %v items\n", file.Id(), atomic.LoadUint32(&file.counter_sent))
+
+	err = file.Stop_server()
+
+	err = file.SetState(common.Part_Stopped)
+	if err == nil {
+		file.Logger().Infof("%v has been stopped\n", file.Id())
+	} else {
+		file.Logger().Errorf("%v failed to stop. err=%v\n", file.Id(), err)
+	}
+
+	return err
+}
+
+func (file *FileNozzle) Receive(data interface{}) error {
+	// the attempt to write to dataChan may panic if dataChan has been closed
+	defer func() {
+		if r := recover(); r != nil {
+			file.Logger().Errorf("%v recovered from %v", file.Id(), r)
+			if file.validateRunningState() == nil {
+				// report error only when file nozzle is still in running state
+				file.handleGeneralError(errors.New(fmt.Sprintf("%v", r)))
+			}
+		}
+	}()
+
+	err := file.validateRunningState()
+	if err != nil {
+		file.Logger().Infof("%v is in %v state, Recieve did no-op", file.Id(), file.State())
+		return err
+	}
+
+	req, ok := data.(*base.WrappedMCRequest)
+	if !ok {
+		err = fmt.Errorf("Got data of unexpected type. data=%v", data)
+		file.handleGeneralError(err)
+		return err
+	}
+
+	atomic.AddUint32(&file.counter_received, 1)
+	atomic.AddInt32(&file.items_in_dataChan, 1)
+	atomic.AddInt64(&file.bytes_in_dataChan, int64(req.Req.Size()))
+
+	file.dataChan <- req
+
+	return nil
+}
+
+// writes requests in dataChan to archive files. files are synced, and DataSent events are raised for the records
+// written, when dataChan has been drained or when the number of unsynced records reaches batch count
+func (file *FileNozzle) processData(finch chan bool, waitGrp *sync.WaitGroup) {
+	defer waitGrp.Done()
+
+	pending := make([]pendingFileRecord, 0, file.config.maxCount)
+	var batch_start_time time.Time
+	for {
+		select {
+		case <-finch:
+			goto done
+		case req := <-file.dataChan:
+			atomic.AddInt32(&file.items_in_dataChan, -1)
+			atomic.AddInt64(&file.bytes_in_dataChan, int64(0-req.Req.Size()))
+
+			if len(pending) == 0 {
+				batch_start_time = time.Now()
+			}
+			record, err := file.write(req)
+			if err != nil {
+				file.handleGeneralError(err)
+				goto done
+			}
+			pending = append(pending, record)
+
+			if len(file.dataChan) == 0 || len(pending) >= file.config.maxCount {
+				err = file.flush(pending)
+				if err != nil {
+					file.handleGeneralError(err)
+					goto done
+				}
+				pending = pending[:0]
+				file.config.yieldAfterBatch(time.Since(batch_start_time), finch)
+			}
+		}
+	}
+done:
+	file.Logger().Infof("%v processData routine exits", file.Id())
+}
+
+// writes the request to the archive file of its vbucket, and recycles the request
+func (file *FileNozzle) write(req *base.WrappedMCRequest) (pendingFileRecord, error) {
+	defer file.recycleDataObj(req)
+
+	vbno := req.Req.VBucket
+	writer, ok := file.writers[vbno]
+	if !ok {
+		return pendingFileRecord{}, fmt.Errorf("%v received a request with unexpected vb %v", file.Id(), vbno)
+	}
+
+	record, err := NewArchiveRecord(req)
+	if err != nil {
+		return pendingFileRecord{}, err
+	}
+	data, err := record.Encode(file.config.format)
+	if err != nil {
+		return pendingFileRecord{}, err
+	}
+
+	err = writer.write(data)
+	if err != nil {
+		return pendingFileRecord{}, fmt.Errorf("Error writing to archive file for vb=%v. err=%v", vbno, err)
+	}
+	atomic.AddUint64(&file.counter_bytes_written, uint64(len(data)))
+
+	return pendingFileRecord{vbno: vbno,
+		additional: DataSentEventAdditional{Seqno: req.Seqno,
+			IsOptRepd:   false,
+			Opcode:      encodeOpCode(req.Req.Opcode),
+			IsExpirySet: record.Expiry != 0,
+			VBucket:     vbno,
+			Req_size:    len(data),
+			Commit_time: time.Since(req.Start_time),
+		},
+	}, nil
+}
+
+// syncs the archive files involved in pending records, and raises DataSent events for the records
+func (file *FileNozzle) flush(pending []pendingFileRecord) error {
+	flushed := make(map[uint16]bool)
+	for _, record := range pending {
+		if flushed[record.vbno] {
+			continue
+		}
+		err := file.writers[record.vbno].flush()
+		if err != nil {
+			return fmt.Errorf("Error syncing archive file for vb=%v. err=%v", record.vbno, err)
+		}
+		flushed[record.vbno] = true
+	}
+
+	for _, record := range pending {
+		file.RaiseEvent(common.NewEvent(common.DataSent, nil, file, nil, record.additional))
+	}
+	atomic.AddUint32(&file.counter_sent, uint32(len(pending)))
+	return nil
+}
+
+func (file *FileNozzle) closeWriters() {
+	for vbno, writer := range file.writers {
+		err := writer.close()
+		if err != nil {
+			file.Logger().Warnf("%v error closing archive file for vb=%v. err=%v\n", file.Id(), vbno, err)
+		}
+	}
+}
+
+func (file *FileNozzle) onExit() {
+	//in the process of stopping, no need to report any error to replication manager anymore
+	file.disableHandleError()
+
+	//notify the writer routine
+	close(file.writer_finch)
+	close(file.selfMonitor_finch)
+	file.childrenWaitGrp.Wait()
+
+	//cleanup
+	file.closeWriters()
+
+	// recycle requests left in dataChan
+	for {
+		select {
+		case req := <-file.dataChan:
+			file.recycleDataObj(req)
+		default:
+			return
+		}
+	}
+}
+
+func (file *FileNozzle) selfMonitor(finch chan bool, waitGrp *sync.WaitGroup) {
+	defer waitGrp.Done()
+	statsTicker := time.NewTicker(file.config.statsInterval)
+	defer statsTicker.Stop()
+	for {
+		select {
+		case <-finch:
+			goto done
+		case <-statsTicker.C:
+			file.RaiseEvent(common.NewEvent(common.StatsUpdate, nil, file, nil, []int{int(atomic.LoadInt32(&file.items_in_dataChan)), int(atomic.LoadInt64(&file.bytes_in_dataChan)), 0}))
+		}
+	}
+done:
+	file.Logger().Infof("%v selfMonitor routine exits", file.Id())
+}
+
+func (file *FileNozzle) validateRunningState() error {
+	state := file.State()
+	if state == common.Part_Stopping || state == common.Part_Stopped || state == common.Part_Error {
+		return PartStoppedError
+	}
+	return nil
+}
+
+// export settings cannot be changed on a running file nozzle. changes to them lead to pipeline reconstruction
+func (file *FileNozzle) UpdateSettings(settings map[string]interface{}) error {
+	return nil
+}
+
+func (file *FileNozzle) ArchiveDir() string {
+	return file.archiveDir
+}
+
+func (file *FileNozzle) StatusSummary() string {
+	return fmt.Sprintf("%v received %v items, exported %v items, %v bytes", file.Id(), atomic.LoadUint32(&file.counter_received),
+		atomic.LoadUint32(&file.counter_sent), atomic.LoadUint64(&file.counter_bytes_written))
+}
+
+func (file *FileNozzle) handleGeneralError(err error) {
+	if file.handleError() {
+		file.Logger().Errorf("%v raise error condition %v\n", file.Id(), err)
+		file.RaiseEvent(common.NewEvent(common.ErrorEncountered, nil, file, nil, err))
+	} else {
+		file.Logger().Debugf("%v in shutdown process, err=%v is ignored\n", file.Id(), err)
+	}
+}
+
+func (file *FileNozzle) recycleDataObj(req *base.WrappedMCRequest) {
+	if file.dataObj_recycler != nil {
+		file.dataObj_recycler(file.topic, req)
+	}
+}
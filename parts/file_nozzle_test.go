@@ -0,0 +1,72 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"github.com/couchbase/goxdcr/metadata"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// writes numRecords records of 10 bytes each with an archive writer that rotates after every record
+func writeTestArchiveFiles(t *testing.T, vbDir string, maxFiles, numRecords int) {
+	writer, err := newArchiveWriter(vbDir, metadata.ExportFormatJSON, 10, maxFiles)
+	if err != nil {
+		t.Fatalf("failed to construct archive writer. err=%v", err)
+	}
+	for i := 0; i < numRecords; i++ {
+		err = writer.write([]byte("123456789\n"))
+		if err != nil {
+			t.Fatalf("failed to write record. err=%v", err)
+		}
+	}
+	err = writer.close()
+	if err != nil {
+		t.Fatalf("failed to close archive writer. err=%v", err)
+	}
+}
+
+func checkArchiveSegments(t *testing.T, vbDir string, expected []int) {
+	segments, err := ArchiveSegments(vbDir, metadata.ExportFormatJSON)
+	if err != nil {
+		t.Fatalf("failed to list archive files. err=%v", err)
+	}
+	if !reflect.DeepEqual(segments, expected) {
+		t.Errorf("expected archive files %v, got %v", expected, segments)
+	}
+}
+
+func TestArchiveWriterRemovesOldFiles(t *testing.T) {
+	vbDir, err := ioutil.TempDir("", "archive_writer_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir. err=%v", err)
+	}
+	defer os.RemoveAll(vbDir)
+
+	writeTestArchiveFiles(t, vbDir, 2, 5)
+	checkArchiveSegments(t, vbDir, []int{3, 4})
+
+	// restarted writers start a new file, and apply the limit right away
+	writeTestArchiveFiles(t, vbDir, 2, 1)
+	checkArchiveSegments(t, vbDir, []int{4, 5})
+}
+
+func TestArchiveWriterKeepsAllFilesWithoutLimit(t *testing.T) {
+	vbDir, err := ioutil.TempDir("", "archive_writer_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir. err=%v", err)
+	}
+	defer os.RemoveAll(vbDir)
+
+	writeTestArchiveFiles(t, vbDir, 0, 5)
+	checkArchiveSegments(t, vbDir, []int{0, 1, 2, 3, 4})
+}
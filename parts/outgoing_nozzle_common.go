@@ -12,10 +12,14 @@ package parts
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	mc "github.com/couchbase/gomemcached"
 	base "github.com/couchbase/goxdcr/base"
 	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -32,6 +36,10 @@ const (
 	SETTING_MAX_RETRY_INTERVAL    = "max_retry_interval"
 	SETTING_SELF_MONITOR_INTERVAL = "self_monitor_interval"
 	SETTING_STATS_INTERVAL        = "stats_interval"
+	SETTING_BANDWIDTH_LIMIT       = "bandwidth_limit"
+	SETTING_PRIORITY              = "priority"
+	SETTING_CONFLICT_LOGGING      = "conflict_logging"
+	SETTING_CONFLICT_LOG_BODIES   = "conflict_log_bodies"
 
 	STATS_QUEUE_SIZE               = "queue_size"
 	STATS_QUEUE_SIZE_BYTES         = "queue_size_bytes"
@@ -47,6 +55,17 @@ const (
 	EVENT_ADDI_REQ_SIZE       = "req_size"
 )
 
+// the longest pause of low priority nozzles between batches, so that they keep up with their sources
+// when sending a batch takes unusually long, e.g., when target is slow
+var MaxBatchDelay = 1 * time.Second
+
+// priority weights of the outgoing nozzles that are running on this node, keyed by nozzle id, and the number of
+// running nozzles of each weight. low priority nozzles pause between batches only while nozzles of higher
+// priority replications are running, since there is nothing to make room for otherwise
+var running_nozzle_weights = make(map[string]int)
+var running_nozzle_counts = make(map[int]int)
+var running_nozzles_lock sync.RWMutex
+
 type NeedSendStatus int
 
 const (
@@ -82,7 +101,12 @@ type baseConfig struct {
 	connectStr         string
 	username           string
 	password           string
-	logger             *log.CommonLogger
+	// priority of the replication, which affects the sizes of data channels and the scheduling of nozzles
+	priority string
+	// whether documents that lost conflict resolution are recorded, and whether their bodies are included in the records
+	conflictLogging   bool
+	conflictLogBodies bool
+	logger            *log.CommonLogger
 }
 
 type documentMetadata struct {
@@ -92,6 +116,8 @@ type documentMetadata struct {
 	flags    uint32 // Item flags
 	expiry   uint32 // Item expiration time
 	deletion bool
+	// document body. only populated for source documents and for target documents looked up with their bodies
+	body []byte
 }
 
 func (doc_meta documentMetadata) String() string {
@@ -109,6 +135,107 @@ type DataFailedCRSourceEventAdditional struct {
 	Opcode      mc.CommandCode
 	IsExpirySet bool
 	VBucket     uint16
+	// the conflict that the document lost. nil when conflict logging is not enabled
+	Conflict *ConflictRecord
+}
+
+// a document that lost conflict resolution at source side
+type ConflictRecord struct {
+	Key     string `json:"key"`
+	VBucket uint16 `json:"vb"`
+	Seqno   uint64 `json:"seqno"`
+	// when the conflict was resolved
+	Time   time.Time        `json:"time"`
+	Source *ConflictVersion `json:"source"`
+	// nil when the version on target is not known, e.g., for capi replication, where target only tells
+	// whether it is missing the revision of the source document
+	Target *ConflictVersion `json:"target,omitempty"`
+}
+
+// a version of a document involved in a conflict
+type ConflictVersion struct {
+	RevSeq   uint64 `json:"rev"`
+	Cas      uint64 `json:"cas"`
+	Expiry   uint32 `json:"expiry"`
+	Flags    uint32 `json:"flags"`
+	Deletion bool   `json:"deletion"`
+	// only populated when bodies are to be recorded. json bodies are kept in Body so that they show up as json
+	// in records, other bodies are kept in BinaryBody and show up encoded in base64
+	Body       json.RawMessage `json:"body,omitempty"`
+	BinaryBody []byte          `json:"binary_body,omitempty"`
+}
+
+func newConflictVersion(doc_meta documentMetadata, withBody bool) *ConflictVersion {
+	version := &ConflictVersion{RevSeq: doc_meta.revSeq,
+		Cas:      doc_meta.cas,
+		Expiry:   doc_meta.expiry,
+		Flags:    doc_meta.flags,
+		Deletion: doc_meta.deletion,
+	}
+	if withBody {
+		version.setBody(doc_meta.body)
+	}
+	return version
+}
+
+func (version *ConflictVersion) setBody(body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	// the body of the source document is owned by its request, which gets recycled
+	bodyCopy := make([]byte, len(body))
+	copy(bodyCopy, body)
+	if json.Valid(bodyCopy) {
+		version.Body = json.RawMessage(bodyCopy)
+	} else {
+		version.BinaryBody = bodyCopy
+	}
+}
+
+func (version *ConflictVersion) withoutBody() *ConflictVersion {
+	if version == nil {
+		return nil
+	}
+	versionCopy := *version
+	versionCopy.Body = nil
+	versionCopy.BinaryBody = nil
+	return &versionCopy
+}
+
+// returns a copy of the record that keeps the bodies of the versions only when specified
+func (record *ConflictRecord) CopyWithBodies(sourceBody bool, targetBody bool) *ConflictRecord {
+	recordCopy := *record
+	if !sourceBody {
+		recordCopy.Source = record.Source.withoutBody()
+	}
+	if !targetBody {
+		recordCopy.Target = record.Target.withoutBody()
+	}
+	return &recordCopy
+}
+
+func newConflictRecord(req *base.WrappedMCRequest, doc_meta_source documentMetadata, doc_meta_target *documentMetadata, withBody bool) *ConflictRecord {
+	record := &ConflictRecord{Key: string(req.Req.Key),
+		VBucket: req.SrcVBucket,
+		Seqno:   req.Seqno,
+		Time:    time.Now(),
+		Source:  newConflictVersion(doc_meta_source, withBody),
+	}
+	if doc_meta_target != nil {
+		record.Target = newConflictVersion(*doc_meta_target, withBody)
+	}
+	return record
+}
+
+type DataDeduplicatedEventAdditional struct {
+	Seqno   uint64
+	VBucket uint16
+}
+
+type DataDeadLetteredEventAdditional struct {
+	Seqno   uint64
+	VBucket uint16
+	Status  mc.Status
 }
 
 type DataSentEventAdditional struct {
@@ -151,7 +278,104 @@ func (config *baseConfig) initializeConfig(settings map[string]interface{}) {
 	if val, ok := settings[SETTING_OPTI_REP_THRESHOLD]; ok {
 		config.optiRepThreshold = uint32(val.(int))
 	}
+	if val, ok := settings[SETTING_PRIORITY]; ok {
+		config.priority = val.(string)
+	}
+	if val, ok := settings[SETTING_CONFLICT_LOGGING]; ok {
+		config.conflictLogging = val.(bool)
+	}
+	if val, ok := settings[SETTING_CONFLICT_LOG_BODIES]; ok {
+		config.conflictLogBodies = val.(bool)
+	}
+
+}
+
+// returns the size of a data channel, given its size for medium priority replications.
+// nozzles of higher priority replications can buffer more data, so that their upstream parts are blocked less often
+func (config *baseConfig) dataChanSize(mediumPrioritySize int) int {
+	size := mediumPrioritySize * metadata.PriorityWeight(config.priority) / metadata.PriorityWeight(metadata.PriorityTypeMedium)
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// records that the nozzle with the specified id is running with the priority in config.
+// called by outgoing nozzles once their configs have been initialized on start
+func (config *baseConfig) registerRunningNozzle(id string) {
+	running_nozzles_lock.Lock()
+	defer running_nozzles_lock.Unlock()
+
+	if _, ok := running_nozzle_weights[id]; ok {
+		return
+	}
+	weight := metadata.PriorityWeight(config.priority)
+	running_nozzle_weights[id] = weight
+	running_nozzle_counts[weight]++
+}
+
+// records that the nozzle with the specified id is no longer running. it is a no-op when the nozzle is not registered
+func unregisterRunningNozzle(id string) {
+	running_nozzles_lock.Lock()
+	defer running_nozzles_lock.Unlock()
+
+	weight, ok := running_nozzle_weights[id]
+	if !ok {
+		return
+	}
+	delete(running_nozzle_weights, id)
+	running_nozzle_counts[weight]--
+	if running_nozzle_counts[weight] == 0 {
+		delete(running_nozzle_counts, weight)
+	}
+}
+
+// whether nozzles with priority weights higher than weight are running on this node
+func higherPriorityNozzlesRunning(weight int) bool {
+	running_nozzles_lock.RLock()
+	defer running_nozzles_lock.RUnlock()
+
+	for running_weight := range running_nozzle_counts {
+		if running_weight > weight {
+			return true
+		}
+	}
+	return false
+}
+
+// called after a batch has been sent, with the time that sending the batch took.
+// nozzles of low priority replications pause before sending the next batch, so that they take a smaller share
+// of the node and of the target than nozzles of higher priority replications, while such nozzles are running.
+// returns early when finch is closed
+func (config *baseConfig) yieldAfterBatch(sendTime time.Duration, finch chan bool) {
+	delay := config.batchDelay(sendTime)
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-finch:
+	case <-timer.C:
+	}
+}
 
+// returns how long to pause after a batch that took sendTime to send.
+// medium and high priority nozzles do not pause. nozzles with lower weights pause in proportion to the send time,
+// so that they spend weight/mediumWeight of their time sending, i.e., half of it for low priority nozzles,
+// but only while nozzles of higher priority replications are running
+func (config *baseConfig) batchDelay(sendTime time.Duration) time.Duration {
+	weight := metadata.PriorityWeight(config.priority)
+	mediumWeight := metadata.PriorityWeight(metadata.PriorityTypeMedium)
+	if weight >= mediumWeight || sendTime <= 0 || !higherPriorityNozzlesRunning(weight) {
+		return 0
+	}
+	delay := sendTime * time.Duration(mediumWeight-weight) / time.Duration(weight)
+	if delay > MaxBatchDelay {
+		delay = MaxBatchDelay
+	}
+	return delay
 }
 
 /************************************
@@ -166,7 +390,10 @@ type dataBatch struct {
 	// value of the map has two possible values:
 	// 1. true - docs failed source side conflict resolution. in this case the docs will be counted in docs_failed_cr_source stats
 	// 2. false - docs that will get rejected by target for other reasons, e.g., since target no longer owns the vbucket involved. in this case the docs will not be counted in docs_failed_cr_source stats
-	bigDoc_noRep_map  map[string]bool
+	bigDoc_noRep_map map[string]bool
+	// the conflicts that the docs in bigDoc_noRep_map lost. only populated when conflict logging is enabled
+	// key of the map is the document key_revSeqno
+	conflict_map      map[string]*ConflictRecord
 	curCount          uint32
 	curSize           uint32
 	capacity_count    uint32
@@ -175,6 +402,15 @@ type dataBatch struct {
 	logger            *log.CommonLogger
 	batch_nonempty_ch chan bool
 	nonempty_set      bool
+	// tracks the newest version of each document in the batch when in-batch deduplication is enabled. nil otherwise
+	// key of the map is the vbucket and key of the document
+	newest_version_map map[string]*documentVersion
+}
+
+// a version of a document in a batch
+type documentVersion struct {
+	seqno     uint64
+	uniqueKey string
 }
 
 func newBatch(cap_count uint32, cap_size uint32, logger *log.CommonLogger) *dataBatch {
@@ -208,6 +444,9 @@ func (b *dataBatch) accumuBatch(req *base.WrappedMCRequest, classifyFunc func(re
 		if !classifyFunc(req.Req) {
 			b.bigDoc_map[req.UniqueKey] = req
 		}
+		if b.newest_version_map != nil {
+			b.recordNewestVersion(req)
+		}
 		curSize := b.incrementSize(uint32(size))
 		if curCount < b.capacity_count && curSize < b.capacity_size*1000 {
 			ret = false
@@ -216,6 +455,44 @@ func (b *dataBatch) accumuBatch(req *base.WrappedMCRequest, classifyFunc func(re
 	return curCount, isFirst, ret
 }
 
+// enables in-batch deduplication, which needs to be done before any request is added to the batch
+func (b *dataBatch) enableDedup() {
+	b.newest_version_map = make(map[string]*documentVersion)
+}
+
+// versions are keyed by source vbucket, since seqnos are comparable within a source vbucket only.
+// target vbuckets would not do, since documents from different source vbuckets can end up with the same
+// target key and target vbucket when keys are transformed
+func dedupKey(req *base.WrappedMCRequest) string {
+	// vbucket numbers contain no "/", hence the key is unambiguous
+	return strconv.Itoa(int(req.SrcVBucket)) + "/" + string(req.Req.Key)
+}
+
+// records req as the newest version of its document in the batch. requests are added to the batch in seqno order
+// for each vbucket, hence req supersedes the version recorded earlier, if any. the superseded version will not be sent,
+// hence there is no need to get its metadata from target either
+func (b *dataBatch) recordNewestVersion(req *base.WrappedMCRequest) {
+	if req.Seqno == 0 {
+		// documents re-driven from dead-letter queue do not have seqnos. they are older than any version
+		// from dcp and should never supersede one
+		return
+	}
+	key := dedupKey(req)
+	if oldVersion, ok := b.newest_version_map[key]; ok && oldVersion.uniqueKey != req.UniqueKey {
+		delete(b.bigDoc_map, oldVersion.uniqueKey)
+	}
+	b.newest_version_map[key] = &documentVersion{seqno: req.Seqno, uniqueKey: req.UniqueKey}
+}
+
+// whether a newer version of the document of req is in the batch. always false when in-batch deduplication is not enabled
+func (b *dataBatch) isSuperseded(req *base.WrappedMCRequest) bool {
+	if b.newest_version_map == nil {
+		return false
+	}
+	newestVersion, ok := b.newest_version_map[dedupKey(req)]
+	return ok && newestVersion.seqno > req.Seqno
+}
+
 func (b *dataBatch) count() uint32 {
 	return atomic.LoadUint32(&b.curCount)
 }
@@ -260,6 +537,7 @@ func decodeSetMetaReq(wrapped_req *base.WrappedMCRequest) documentMetadata {
 	ret.revSeq = binary.BigEndian.Uint64(req.Extras[8:16])
 	ret.cas = req.Cas
 	ret.deletion = (req.Opcode == base.DELETE_WITH_META)
+	ret.body = req.Body
 
 	return ret
 }
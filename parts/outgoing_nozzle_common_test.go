@@ -0,0 +1,148 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"encoding/json"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"strings"
+	"testing"
+	"time"
+)
+
+// registers a running nozzle of a high priority replication. returns its id
+func runHighPriorityNozzle() string {
+	id := "xmem_high"
+	(&baseConfig{priority: metadata.PriorityTypeHigh}).registerRunningNozzle(id)
+	return id
+}
+
+func TestBatchDelay(t *testing.T) {
+	defer unregisterRunningNozzle(runHighPriorityNozzle())
+
+	tests := []struct {
+		priority string
+		sendTime time.Duration
+		expected time.Duration
+	}{
+		{metadata.PriorityTypeHigh, 100 * time.Millisecond, 0},
+		{metadata.PriorityTypeMedium, 100 * time.Millisecond, 0},
+		// replications created before priorities were introduced
+		{"", 100 * time.Millisecond, 0},
+		{metadata.PriorityTypeLow, 100 * time.Millisecond, 100 * time.Millisecond},
+		{metadata.PriorityTypeLow, 0, 0},
+		{metadata.PriorityTypeLow, 10 * time.Second, MaxBatchDelay},
+	}
+
+	for _, test := range tests {
+		config := &baseConfig{priority: test.priority}
+		if delay := config.batchDelay(test.sendTime); delay != test.expected {
+			t.Errorf("expected delay of %v for priority %q and send time %v, got %v", test.expected, test.priority, test.sendTime, delay)
+		}
+	}
+}
+
+func TestBatchDelayWithoutHigherPriorityNozzles(t *testing.T) {
+	lowConfig := &baseConfig{priority: metadata.PriorityTypeLow}
+	if delay := lowConfig.batchDelay(100 * time.Millisecond); delay != 0 {
+		t.Errorf("expected no delay when no higher priority nozzle is running, got %v", delay)
+	}
+
+	// nozzles of the same priority do not make low priority nozzles pause
+	lowConfig.registerRunningNozzle("xmem_low")
+	defer unregisterRunningNozzle("xmem_low")
+	if delay := lowConfig.batchDelay(100 * time.Millisecond); delay != 0 {
+		t.Errorf("expected no delay when only low priority nozzles are running, got %v", delay)
+	}
+
+	mediumConfig := &baseConfig{priority: metadata.PriorityTypeMedium}
+	mediumConfig.registerRunningNozzle("xmem_medium")
+	if delay := lowConfig.batchDelay(100 * time.Millisecond); delay != 100*time.Millisecond {
+		t.Errorf("expected delay of 100ms while a medium priority nozzle is running, got %v", delay)
+	}
+
+	// unregistering is idempotent
+	unregisterRunningNozzle("xmem_medium")
+	unregisterRunningNozzle("xmem_medium")
+	if delay := lowConfig.batchDelay(100 * time.Millisecond); delay != 0 {
+		t.Errorf("expected no delay once the medium priority nozzle has stopped, got %v", delay)
+	}
+}
+
+func TestYieldAfterBatchStopsOnFinch(t *testing.T) {
+	defer unregisterRunningNozzle(runHighPriorityNozzle())
+	config := &baseConfig{priority: metadata.PriorityTypeLow}
+	finch := make(chan bool)
+	close(finch)
+
+	start := time.Now()
+	config.yieldAfterBatch(time.Minute, finch)
+	if elapsed := time.Since(start); elapsed >= MaxBatchDelay {
+		t.Errorf("expected yieldAfterBatch to return once finch is closed, took %v", elapsed)
+	}
+}
+
+func TestConflictRecordBodies(t *testing.T) {
+	record := &ConflictRecord{Key: "k",
+		Source: newConflictVersion(documentMetadata{cas: 2, body: []byte(`{"a":1}`)}, true),
+		Target: newConflictVersion(documentMetadata{cas: 1, body: []byte{0xff, 0x01}}, true),
+	}
+
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("failed to marshal record. err=%v", err)
+	}
+	if !strings.Contains(string(encoded), `"body":{"a":1}`) {
+		t.Errorf("expected json body to be kept as json, got %v", string(encoded))
+	}
+	if !strings.Contains(string(encoded), `"binary_body":"/wE="`) {
+		t.Errorf("expected binary body to be encoded in base64, got %v", string(encoded))
+	}
+
+	recordCopy := record.CopyWithBodies(true, false)
+	if string(recordCopy.Source.Body) != `{"a":1}` || recordCopy.Target.BinaryBody != nil || recordCopy.Target.Cas != 1 {
+		t.Errorf("expected copy to keep only source body, got source %+v and target %+v", recordCopy.Source, recordCopy.Target)
+	}
+	if record.Target.BinaryBody == nil {
+		t.Errorf("expected original record to keep its bodies")
+	}
+	if noBodies := record.CopyWithBodies(false, false); noBodies.Source.Body != nil || noBodies.Target.BinaryBody != nil {
+		t.Errorf("expected copy to have no bodies, got source %+v and target %+v", noBodies.Source, noBodies.Target)
+	}
+}
+
+func TestBatchDedupBySourceVBucket(t *testing.T) {
+	batch := newBatch(100, 1000, log.NewLogger("TestBatch", log.DefaultLoggerContext))
+	batch.enableDedup()
+	newRequest := func(srcVBucket uint16, seqno uint64, uniqueKey string) *base.WrappedMCRequest {
+		// all requests have the same key and target vbucket, as they would after a key transform
+		return &base.WrappedMCRequest{SrcVBucket: srcVBucket, Seqno: seqno, UniqueKey: uniqueKey,
+			Req: &mc.MCRequest{VBucket: 5, Key: []byte("key")}}
+	}
+	sendAll := func(req *mc.MCRequest) bool { return true }
+
+	req1 := newRequest(1, 10, "u1")
+	req2 := newRequest(2, 5, "u2")
+	batch.accumuBatch(req1, sendAll)
+	batch.accumuBatch(req2, sendAll)
+	// seqnos of different source vbuckets are not comparable, hence neither version supersedes the other
+	if batch.isSuperseded(req1) || batch.isSuperseded(req2) {
+		t.Errorf("versions from different source vbuckets should not supersede each other")
+	}
+
+	req3 := newRequest(1, 20, "u3")
+	batch.accumuBatch(req3, sendAll)
+	if !batch.isSuperseded(req1) || batch.isSuperseded(req2) || batch.isSuperseded(req3) {
+		t.Errorf("only the older version from the same source vbucket should be superseded")
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mcc "github.com/couchbase/gomemcached/client"
+	"github.com/couchbase/goxdcr/base"
+	common "github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/gen_server"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/processor"
+	"sync/atomic"
+)
+
+var ErrorNoConnectorForProcessorPart = errors.New("No downstream connector has been defined for processor part.")
+
+/************************************
+/* struct ProcessorPart
+*************************************/
+
+// ProcessorPart sits between routers and an outgoing nozzle and runs the requests routed to the outgoing nozzle
+// through a chain of registered processors before forwarding them.
+// Requests are processed synchronously in the goroutines of the upstream routers, hence the processors
+// need to be safe for concurrent use
+type ProcessorPart struct {
+	gen_server.GenServer
+	AbstractPart
+	topic string
+	// processor types in the order they are run
+	processorTypes []string
+	// constructed when the part is started
+	processors       []processor.Processor
+	dataObj_recycler base.DataObjRecycler
+
+	counter_received uint64
+	counter_dropped  uint64
+}
+
+func NewProcessorPart(id string, topic string, processorTypes []string,
+	dataObj_recycler base.DataObjRecycler,
+	logger_context *log.LoggerContext) *ProcessorPart {
+
+	//callback functions from GenServer
+	var msg_callback_func gen_server.Msg_Callback_Func
+	var exit_callback_func gen_server.Exit_Callback_Func
+	var error_handler_func gen_server.Error_Handler_Func
+
+	server := gen_server.NewGenServer(&msg_callback_func,
+		&exit_callback_func, &error_handler_func, logger_context, "ProcessorPart")
+	part := NewAbstractPartWithLogger(id, server.Logger())
+
+	return &ProcessorPart{GenServer: server,
+		AbstractPart:     part,
+		topic:            topic,
+		processorTypes:   processorTypes,
+		dataObj_recycler: dataObj_recycler,
+	}
+}
+
+// settings are the settings of the replication, with which processors are constructed
+func (processorPart *ProcessorPart) Start(settings map[string]interface{}) error {
+	processorPart.Logger().Infof("%v starting with processors %v....\n", processorPart.Id(), processorPart.processorTypes)
+
+	err := processorPart.SetState(common.Part_Starting)
+	if err != nil {
+		return err
+	}
+
+	processors := make([]processor.Processor, 0, len(processorPart.processorTypes))
+	for _, processorType := range processorPart.processorTypes {
+		proc, err := processor.NewProcessor(processorType, settings, processorPart.Logger().LoggerContext())
+		if err != nil {
+			processorPart.Logger().Errorf("%v failed to construct processor %v. err=%v\n", processorPart.Id(), processorType, err)
+			return err
+		}
+		processors = append(processors, proc)
+	}
+	processorPart.processors = processors
+
+	err = processorPart.Start_server()
+	if err == nil {
+		err = processorPart.SetState(common.Part_Running)
+	}
+	if err == nil {
+		processorPart.Logger().Infof("%v has been started successfully\n", processorPart.Id())
+	} else {
+		processorPart.Logger().Errorf("%v failed to start. err=%v\n", processorPart.Id(), err)
+	}
+	return err
+}
+
+func (processorPart *ProcessorPart) Stop() error {
+	processorPart.Logger().Infof("%v stopping \n", processorPart.Id())
+
+	err := processorPart.SetState(common.Part_Stopping)
+	if err != nil {
+		return err
+	}
+
+	processorPart.Logger().Infof("%v received %v items, dropped %v items\n", processorPart.Id(),
+		atomic.LoadUint64(&processorPart.counter_received), atomic.LoadUint64(&processorPart.counter_dropped))
+
+	err = processorPart.Stop_server()
+
+	err = processorPart.SetState(common.Part_Stopped)
+	if err == nil {
+		processorPart.Logger().Infof("%v has been stopped\n", processorPart.Id())
+	} else {
+		processorPart.Logger().Errorf("%v failed to stop. err=%v\n", processorPart.Id(), err)
+	}
+	return err
+}
+
+func (processorPart *ProcessorPart) Receive(data interface{}) error {
+	state := processorPart.State()
+	if state != common.Part_Running {
+		processorPart.Logger().Warnf("%v is in %v state, Receive did no-op", processorPart.Id(), state)
+		return PartStoppedError
+	}
+
+	request, ok := data.(*base.WrappedMCRequest)
+	if !ok {
+		err := fmt.Errorf("Got data of unexpected type. data=%v", data)
+		processorPart.handleGeneralError(err)
+		return err
+	}
+	atomic.AddUint64(&processorPart.counter_received, 1)
+
+	// keep the info needed to report the request as filtered, since processors may modify the request
+	filteredEvent := newFilteredEvent(request)
+
+	for index, proc := range processorPart.processors {
+		processedRequest, err := proc.Process(request)
+		if err != nil {
+			err = fmt.Errorf("Processor %v failed to process request with key %v. err=%v", processorPart.processorTypes[index], string(filteredEvent.Key), err)
+			processorPart.handleGeneralError(err)
+			return err
+		}
+		if processedRequest == nil {
+			// like data filtered by routers, dropped data is reported through DataFiltered events
+			// so that its seqnos are still accounted for in checkpoints
+			atomic.AddUint64(&processorPart.counter_dropped, 1)
+			processorPart.RaiseEvent(common.NewEvent(common.DataFiltered, filteredEvent, processorPart, nil, nil))
+			processorPart.recycleDataObj(request)
+			return nil
+		}
+		if processedRequest != request {
+			// the new request takes over the seqno of the request it replaces, which is no longer referenced
+			processedRequest.Seqno = request.Seqno
+			processedRequest.SrcVBucket = request.SrcVBucket
+			processedRequest.Start_time = request.Start_time
+			processedRequest.ConstructUniqueKey()
+			processorPart.recycleDataObj(request)
+		}
+		request = processedRequest
+	}
+
+	connector := processorPart.Connector()
+	if connector == nil {
+		processorPart.handleGeneralError(ErrorNoConnectorForProcessorPart)
+		return ErrorNoConnectorForProcessorPart
+	}
+	return connector.Forward(request)
+}
+
+func (processorPart *ProcessorPart) recycleDataObj(request *base.WrappedMCRequest) {
+	if processorPart.dataObj_recycler != nil {
+		processorPart.dataObj_recycler(processorPart.topic, request)
+	}
+}
+
+// constructs the UprEvent carried by the DataFiltered event for a dropped request
+func newFilteredEvent(request *base.WrappedMCRequest) *mcc.UprEvent {
+	filteredEvent := &mcc.UprEvent{
+		Opcode:  request.Req.Opcode,
+		VBucket: request.SrcVBucket,
+		Seqno:   request.Seqno,
+		Key:     request.Req.Key,
+	}
+	if len(request.Req.Extras) >= 8 {
+		filteredEvent.Expiry = binary.BigEndian.Uint32(request.Req.Extras[4:8])
+	}
+	return filteredEvent
+}
+
+func (processorPart *ProcessorPart) UpdateSettings(settings map[string]interface{}) error {
+	for index, proc := range processorPart.processors {
+		err := proc.UpdateSettings(settings)
+		if err != nil {
+			processorPart.Logger().Errorf("%v failed to update settings on processor %v. err=%v\n", processorPart.Id(), processorPart.processorTypes[index], err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (processorPart *ProcessorPart) ProcessorTypes() []string {
+	return processorPart.processorTypes
+}
+
+func (processorPart *ProcessorPart) handleGeneralError(err error) {
+	err1 := processorPart.SetState(common.Part_Error)
+	if err1 == nil {
+		processorPart.RaiseEvent(common.NewEvent(common.ErrorEncountered, nil, processorPart, nil, err))
+		processorPart.Logger().Errorf("%v Raise error condition %v\n", processorPart.Id(), err)
+	} else {
+		processorPart.Logger().Infof("%v in shutdown process, err=%v is ignored\n", processorPart.Id(), err)
+	}
+}
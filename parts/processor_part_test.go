@@ -0,0 +1,219 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"errors"
+	mc "github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
+	"github.com/couchbase/goxdcr/base"
+	common "github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/processor"
+	"strings"
+	"testing"
+	"time"
+)
+
+// test processor types. testDrop drops requests whose keys start with "drop", testReplace replaces requests
+// whose keys start with "replace" with new requests, and testFail fails requests whose keys start with "fail"
+const (
+	testProcessorTypeDrop    = "testDrop"
+	testProcessorTypeReplace = "testReplace"
+	testProcessorTypeFail    = "testFail"
+)
+
+type testProcessor struct {
+	processorType string
+}
+
+func (proc *testProcessor) Process(req *base.WrappedMCRequest) (*base.WrappedMCRequest, error) {
+	key := string(req.Req.Key)
+	switch {
+	case proc.processorType == testProcessorTypeDrop && strings.HasPrefix(key, "drop"):
+		return nil, nil
+	case proc.processorType == testProcessorTypeReplace && strings.HasPrefix(key, "replace"):
+		return &base.WrappedMCRequest{Req: &mc.MCRequest{Opcode: req.Req.Opcode,
+			VBucket: req.Req.VBucket,
+			Key:     []byte("replaced"),
+			Body:    []byte(`{"replaced":true}`),
+			Extras:  req.Req.Extras,
+		}}, nil
+	case proc.processorType == testProcessorTypeFail && strings.HasPrefix(key, "fail"):
+		return nil, errors.New("test failure")
+	}
+	return req, nil
+}
+
+func (proc *testProcessor) UpdateSettings(settings map[string]interface{}) error {
+	return nil
+}
+
+func registerTestProcessorTypes(t *testing.T) {
+	for _, processorType := range []string{testProcessorTypeDrop, testProcessorTypeReplace, testProcessorTypeFail} {
+		if processor.IsProcessorTypeRegistered(processorType) {
+			continue
+		}
+		constructorType := processorType
+		err := processor.RegisterProcessorType(processorType, func(settings map[string]interface{}, logger_context *log.LoggerContext) (processor.Processor, error) {
+			return &testProcessor{processorType: constructorType}, nil
+		})
+		if err != nil {
+			t.Fatalf("failed to register processor type %v. err=%v", processorType, err)
+		}
+	}
+}
+
+// connector that keeps the requests forwarded to it
+type testForwardConnector struct {
+	common.Connector
+	forwarded []*base.WrappedMCRequest
+}
+
+func (connector *testForwardConnector) Forward(data interface{}) error {
+	connector.forwarded = append(connector.forwarded, data.(*base.WrappedMCRequest))
+	return nil
+}
+
+type testEventListener struct {
+	events []*common.Event
+}
+
+func (listener *testEventListener) OnEvent(event *common.Event) {
+	listener.events = append(listener.events, event)
+}
+
+type testProcessorPart struct {
+	part      *ProcessorPart
+	connector *testForwardConnector
+	filtered  *testEventListener
+	errors    *testEventListener
+	recycled  []*base.WrappedMCRequest
+}
+
+func newTestProcessorPart(t *testing.T, processorTypes []string) *testProcessorPart {
+	registerTestProcessorTypes(t)
+
+	test := &testProcessorPart{connector: &testForwardConnector{},
+		filtered: &testEventListener{},
+		errors:   &testEventListener{},
+	}
+	recycler := func(topic string, dataObj *base.WrappedMCRequest) {
+		test.recycled = append(test.recycled, dataObj)
+	}
+	test.part = NewProcessorPart("processor_test", "test_topic", processorTypes, recycler, log.DefaultLoggerContext)
+	test.part.SetConnector(test.connector)
+	test.part.RegisterComponentEventListener(common.DataFiltered, test.filtered)
+	test.part.RegisterComponentEventListener(common.ErrorEncountered, test.errors)
+	if err := test.part.Start(nil); err != nil {
+		t.Fatalf("failed to start processor part. err=%v", err)
+	}
+	return test
+}
+
+func newTestProcessorRequest(key string, seqno uint64) *base.WrappedMCRequest {
+	extras := make([]byte, 24)
+	return &base.WrappedMCRequest{Seqno: seqno,
+		SrcVBucket: 3,
+		Req: &mc.MCRequest{Opcode: mc.UPR_MUTATION,
+			VBucket: 5,
+			Key:     []byte(key),
+			Body:    []byte(`{"a":1}`),
+			Extras:  extras,
+		},
+		Start_time: time.Now(),
+	}
+}
+
+func TestProcessorPartForwardsProcessedRequests(t *testing.T) {
+	test := newTestProcessorPart(t, []string{testProcessorTypeDrop, testProcessorTypeReplace, processor.ProcessorTypeRemoveExpiry})
+	defer test.part.Stop()
+
+	req := newTestProcessorRequest("keep", 1)
+	if err := test.part.Receive(req); err != nil {
+		t.Fatalf("failed to receive request. err=%v", err)
+	}
+	if len(test.connector.forwarded) != 1 || test.connector.forwarded[0] != req {
+		t.Fatalf("expected request to be forwarded as is, got %v", test.connector.forwarded)
+	}
+	if len(test.recycled) != 0 || len(test.filtered.events) != 0 {
+		t.Errorf("expected request to be neither recycled nor filtered")
+	}
+}
+
+func TestProcessorPartDropsRequests(t *testing.T) {
+	test := newTestProcessorPart(t, []string{testProcessorTypeDrop, testProcessorTypeFail})
+	defer test.part.Stop()
+
+	// processors after the one that drops the request are not run
+	req := newTestProcessorRequest("drop_fail", 2)
+	if err := test.part.Receive(req); err != nil {
+		t.Fatalf("failed to receive request. err=%v", err)
+	}
+	if len(test.connector.forwarded) != 0 {
+		t.Errorf("expected dropped request not to be forwarded")
+	}
+	if len(test.recycled) != 1 || test.recycled[0] != req {
+		t.Errorf("expected dropped request to be recycled")
+	}
+
+	// dropped requests are reported with their source vbuckets, so that their seqnos are accounted for in checkpoints
+	if len(test.filtered.events) != 1 {
+		t.Fatalf("expected 1 DataFiltered event, got %v", len(test.filtered.events))
+	}
+	uprEvent := test.filtered.events[0].Data.(*mcc.UprEvent)
+	if uprEvent.VBucket != 3 || uprEvent.Seqno != 2 || string(uprEvent.Key) != "drop_fail" {
+		t.Errorf("unexpected filtered event vb=%v, seqno=%v, key=%s", uprEvent.VBucket, uprEvent.Seqno, uprEvent.Key)
+	}
+}
+
+func TestProcessorPartReplacesRequests(t *testing.T) {
+	test := newTestProcessorPart(t, []string{testProcessorTypeReplace, processor.ProcessorTypeRemoveExpiry})
+	defer test.part.Stop()
+
+	req := newTestProcessorRequest("replace", 4)
+	start_time := req.Start_time
+	if err := test.part.Receive(req); err != nil {
+		t.Fatalf("failed to receive request. err=%v", err)
+	}
+	if len(test.connector.forwarded) != 1 {
+		t.Fatalf("expected 1 forwarded request, got %v", len(test.connector.forwarded))
+	}
+
+	// the new request takes over the seqno, source vbucket and start time of the request it replaces
+	replaced := test.connector.forwarded[0]
+	if replaced == req || string(replaced.Req.Key) != "replaced" {
+		t.Fatalf("expected replacing request to be forwarded, got key %s", replaced.Req.Key)
+	}
+	if replaced.Seqno != 4 || replaced.SrcVBucket != 3 || !replaced.Start_time.Equal(start_time) {
+		t.Errorf("unexpected seqno=%v, vb=%v, start time=%v", replaced.Seqno, replaced.SrcVBucket, replaced.Start_time)
+	}
+	if replaced.UniqueKey == "" {
+		t.Errorf("expected unique key of replacing request to be constructed")
+	}
+	if len(test.recycled) != 1 || test.recycled[0] != req {
+		t.Errorf("expected replaced request to be recycled")
+	}
+}
+
+func TestProcessorPartRaisesErrorOnProcessorFailure(t *testing.T) {
+	test := newTestProcessorPart(t, []string{testProcessorTypeFail})
+	defer test.part.Stop()
+
+	if err := test.part.Receive(newTestProcessorRequest("fail", 5)); err == nil {
+		t.Fatalf("expected processor failure to be returned")
+	}
+	if len(test.connector.forwarded) != 0 {
+		t.Errorf("expected failed request not to be forwarded")
+	}
+	if len(test.errors.events) != 1 || test.part.State() != common.Part_Error {
+		t.Errorf("expected error to be raised, got %v events and state %v", len(test.errors.events), test.part.State())
+	}
+}
@@ -0,0 +1,674 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"errors"
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
+	base "github.com/couchbase/goxdcr/base"
+	common "github.com/couchbase/goxdcr/common"
+	gen_server "github.com/couchbase/goxdcr/gen_server"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/utils"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the max number of archive records that are read from archive files and dispatched as one snapshot
+var ReplayBatchCount = 500
+
+// size of the channel between the archive reading routine and the data processing routine
+var ReplayDataChanLength = 10000
+
+var replay_stream_start_check_interval = 100 * time.Millisecond
+
+type ReplayStreamState int
+
+const (
+	// starting seqno of the vb has not been set
+	Replay_Stream_NonInit ReplayStreamState = iota
+	// archive files of the vb are being replayed
+	Replay_Stream_Active ReplayStreamState = iota
+	// all archive records of the vb within the seqno range have been replayed
+	Replay_Stream_Done ReplayStreamState = iota
+)
+
+// replay state of a vbucket. it is accessed by the archive reading routine only, except for state
+type replayStream struct {
+	vbno  uint16
+	vbDir string
+	state ReplayStreamState
+	// the segments of archive files, listed when the stream is started.
+	// archive files created afterwards, e.g., by a file replication that is still running, are not replayed
+	segments      []int
+	segment_index int
+	file          *os.File
+	reader        *ArchiveRecordReader
+	// the largest seqno that has been dispatched, or the seqno to start after.
+	// records with smaller or equal seqnos, e.g., those exported again after the restart of a file replication, are skipped
+	last_seqno uint64
+}
+
+/************************************
+/* struct ReplayNozzle
+*************************************/
+// ReplayNozzle is a source nozzle that reads mutations from the archive files written by file nozzles,
+// and feeds them downstream the same way as DcpNozzle feeds dcp mutations
+type ReplayNozzle struct {
+
+	//parent inheritance
+	gen_server.GenServer
+	AbstractPart
+
+	// the list of vbuckets that the replay nozzle is responsible for
+	vbnos []uint16
+
+	// immutable fields
+	archiveDir string
+	// metadata.ExportFormatJSON or metadata.ExportFormatBinary
+	format string
+	// the seqno range of mutations to replay. 0 means no bound
+	startSeqno uint64
+	endSeqno   uint64
+
+	streams    map[uint16]*replayStream
+	lock_state sync.RWMutex
+
+	cur_ts map[uint16]*vbtsWithLock
+
+	dataChan chan *mcc.UprEvent
+
+	finch chan bool
+
+	bOpen      bool
+	lock_bOpen sync.RWMutex
+
+	childrenWaitGrp sync.WaitGroup
+
+	counter_received uint32
+	counter_sent     uint32
+
+	start_time time.Time
+
+	stats_interval           time.Duration
+	stats_interval_change_ch chan bool
+}
+
+func NewReplayNozzle(id string,
+	archiveDir, format string,
+	startSeqno, endSeqno uint64,
+	vbnos []uint16,
+	logger_context *log.LoggerContext) *ReplayNozzle {
+
+	//callback functions from GenServer
+	var msg_callback_func gen_server.Msg_Callback_Func
+	var exit_callback_func gen_server.Exit_Callback_Func
+	var error_handler_func gen_server.Error_Handler_Func
+
+	server := gen_server.NewGenServer(&msg_callback_func,
+		&exit_callback_func, &error_handler_func, logger_context, "ReplayNozzle")
+	part := NewAbstractPartWithLogger(id, server.Logger())
+
+	replay := &ReplayNozzle{
+		archiveDir:               archiveDir,
+		format:                   format,
+		startSeqno:               startSeqno,
+		endSeqno:                 endSeqno,
+		vbnos:                    vbnos,
+		GenServer:                server, /*gen_server.GenServer*/
+		AbstractPart:             part,   /*AbstractPart*/
+		bOpen:                    true,   /*bOpen	bool*/
+		lock_bOpen:               sync.RWMutex{},
+		childrenWaitGrp:          sync.WaitGroup{}, /*childrenWaitGrp sync.WaitGroup*/
+		streams:                  make(map[uint16]*replayStream),
+		cur_ts:                   make(map[uint16]*vbtsWithLock),
+		stats_interval_change_ch: make(chan bool, 1),
+	}
+
+	msg_callback_func = nil
+	exit_callback_func = replay.onExit
+	error_handler_func = replay.handleGeneralError
+
+	for _, vbno := range vbnos {
+		replay.cur_ts[vbno] = &vbtsWithLock{lock: &sync.RWMutex{}, ts: nil}
+		replay.streams[vbno] = &replayStream{vbno: vbno,
+			vbDir: ArchiveVBDir(archiveDir, vbno),
+			state: Replay_Stream_NonInit}
+	}
+
+	replay.Logger().Debugf("Constructed replay nozzle %v with vblist %v\n", replay.Id(), vbnos)
+
+	return replay
+}
+
+func (replay *ReplayNozzle) initialize(settings map[string]interface{}) error {
+	replay.finch = make(chan bool)
+	replay.dataChan = make(chan *mcc.UprEvent, ReplayDataChanLength)
+
+	if val, ok := settings[DCP_Stats_Interval]; ok {
+		replay.stats_interval = time.Duration(val.(int)) * time.Millisecond
+	} else {
+		return errors.New("setting 'stats_interval' is missing")
+	}
+
+	fileInfo, err := os.Stat(replay.archiveDir)
+	if err != nil {
+		return fmt.Errorf("Cannot access replay directory %v. err=%v", replay.archiveDir, err)
+	}
+	if !fileInfo.IsDir() {
+		return fmt.Errorf("Replay directory %v is not a directory", replay.archiveDir)
+	}
+
+	return nil
+}
+
+func (replay *ReplayNozzle) Open() error {
+	replay.lock_bOpen.Lock()
+	defer replay.lock_bOpen.Unlock()
+	if !replay.bOpen {
+		replay.bOpen = true
+	}
+	return nil
+}
+
+func (replay *ReplayNozzle) Close() error {
+	replay.lock_bOpen.Lock()
+	defer replay.lock_bOpen.Unlock()
+	if replay.bOpen {
+		replay.bOpen = false
+	}
+	return nil
+}
+
+func (replay *ReplayNozzle) IsOpen() bool {
+	replay.lock_bOpen.RLock()
+	defer replay.lock_bOpen.RUnlock()
+	return replay.bOpen
+}
+
+func (replay *ReplayNozzle) Start(settings map[string]interface{}) error {
+	replay.Logger().Infof("Replay nozzle %v starting ....\n", replay.Id())
+
+	err := replay.SetState(common.Part_Starting)
+	if err != nil {
+		return err
+	}
+
+	err = utils.ValidateSettings(dcp_setting_defs, settings, replay.Logger())
+	if err != nil {
+		return err
+	}
+
+	err = replay.initialize(settings)
+	if err != nil {
+		return err
+	}
+	replay.Logger().Infof("%v has been initialized\n", replay.Id())
+
+	// start gen_server
+	replay.start_time = time.Now()
+	err = replay.Start_server()
+	if err != nil {
+		return err
+	}
+
+	//start datachan length stats collection
+	replay.childrenWaitGrp.Add(1)
+	go replay.collectDataChanLen()
+
+	// start data processing routine
+	replay.childrenWaitGrp.Add(1)
+	go replay.processData()
+
+	// start reading archive files
+	replay.childrenWaitGrp.Add(1)
+	go replay.replayArchives()
+
+	err = replay.SetState(common.Part_Running)
+	if err == nil {
+		replay.Logger().Infof("%v has been started", replay.Id())
+	} else {
+		replay.Logger().Errorf("%v failed to start. err=%v", replay.Id(), err)
+	}
+
+	return err
+}
+
+func (replay *ReplayNozzle) Stop() error {
+	replay.Logger().Infof("%v is stopping...\n", replay.Id())
+	err := replay.SetState(common.Part_Stopping)
+	if err != nil {
+		return err
+	}
+
+	//notify children routines
+	if replay.finch != nil {
+		close(replay.finch)
+	}
+
+	replay.Logger().Debugf("%v received %v items, sent %v items\n", replay.Id(), replay.counterReceived(), replay.counterSent())
+	err = replay.Stop_server()
+
+	err = replay.SetState(common.Part_Stopped)
+	if err != nil {
+		return err
+	}
+	replay.Logger().Infof("%v has been stopped\n", replay.Id())
+	return err
+}
+
+func (replay *ReplayNozzle) Receive(data interface{}) error {
+	// ReplayNozzle is a source nozzle and does not receive from upstream nodes
+	return nil
+}
+
+// dispatches the events put on data channel by the archive reading routine
+func (replay *ReplayNozzle) processData() {
+	replay.Logger().Infof("%v processData starts..........\n", replay.Id())
+	defer replay.childrenWaitGrp.Done()
+
+	finch := replay.finch
+	for {
+		select {
+		case <-finch:
+			goto done
+		case m := <-replay.dataChan:
+			switch m.Opcode {
+			case mc.UPR_STREAMREQ:
+				replay.RaiseEvent(common.NewEvent(common.StreamingStart, m, replay, nil, nil))
+			case mc.UPR_SNAPSHOT:
+				replay.RaiseEvent(common.NewEvent(common.SnapshotMarkerReceived, m, replay, nil /*derivedItems*/, nil /*otherInfos*/))
+			case mc.UPR_MUTATION, mc.UPR_DELETION, mc.UPR_EXPIRATION:
+				if !replay.IsOpen() {
+					continue
+				}
+				start_time := time.Now()
+				replay.incCounterReceived()
+				replay.RaiseEvent(common.NewEvent(common.DataReceived, m, replay, nil /*derivedItems*/, nil /*otherInfos*/))
+
+				// forward mutation downstream through connector
+				if err := replay.Connector().Forward(m); err != nil {
+					replay.handleGeneralError(err)
+					goto done
+				}
+				replay.incCounterSent()
+				// raise event for statistics collection
+				dispatch_time := time.Since(start_time)
+				replay.RaiseEvent(common.NewEvent(common.DataProcessed, m, replay, nil /*derivedItems*/, dispatch_time.Seconds()*1000000 /*otherInfos*/))
+			default:
+				replay.Logger().Debugf("%v Uprevent OpCode=%v, is skipped\n", replay.Id(), m.Opcode)
+			}
+		}
+	}
+done:
+	replay.Logger().Infof("%v processData exits\n", replay.Id())
+}
+
+// starts the stream of a vb as soon as its starting seqno is set, and replays the archive files of vbs one vb at a time,
+// so that at most one archive file is open at any time
+func (replay *ReplayNozzle) replayArchives() {
+	defer replay.childrenWaitGrp.Done()
+	defer replay.closeStreams()
+
+	replay.Logger().Infof("%v: replaying archive files in %v for %v...\n", replay.Id(), replay.archiveDir, replay.GetVBList())
+
+	finch := replay.finch
+	ticker := time.NewTicker(replay_stream_start_check_interval)
+	defer ticker.Stop()
+
+	for {
+		if !replay.startStreams() {
+			return
+		}
+
+		active_stream := replay.nextActiveStream()
+		if active_stream == nil {
+			if len(replay.streamsWithState(Replay_Stream_Done)) == len(replay.GetVBList()) {
+				replay.Logger().Infof("%v: all archive files have been replayed. received %v items\n", replay.Id(), replay.counterReceived())
+				return
+			}
+			// wait for starting seqnos of the remaining vbs to be set
+			select {
+			case <-finch:
+				return
+			case <-ticker.C:
+			}
+			continue
+		}
+
+		events, err := replay.readBatch(active_stream)
+		if err != nil {
+			err = fmt.Errorf("Failed to replay archive files of vb=%v in %v. err=%v", active_stream.vbno, active_stream.vbDir, err)
+			replay.Logger().Errorf("%v %v", replay.Id(), err)
+			replay.closeStream(active_stream, Replay_Stream_Done)
+			replay.handleVBError(active_stream.vbno, err)
+			continue
+		}
+		if !replay.dispatch(events...) {
+			return
+		}
+	}
+}
+
+// starts the streams whose starting seqnos have been set. returns false if the nozzle is being stopped
+func (replay *ReplayNozzle) startStreams() bool {
+	for _, vbno := range replay.streamsWithState(Replay_Stream_NonInit) {
+		vbts, err := replay.getTS(vbno, true)
+		if err != nil || vbts == nil {
+			continue
+		}
+
+		stream := replay.streams[vbno]
+		segments, err := ArchiveSegments(stream.vbDir, replay.format)
+		if err != nil {
+			replay.Logger().Errorf("%v Failed to list archive files of vb=%v in %v. err=%v", replay.Id(), vbno, stream.vbDir, err)
+			replay.setStreamState(stream, Replay_Stream_Done)
+			replay.handleVBError(vbno, err)
+			continue
+		}
+		stream.segments = segments
+		stream.segment_index = 0
+
+		// same as dcp, the stream starts after the seqno in the starting timestamp.
+		// checkpoints are reset when replay source or start seqno is changed, hence a checkpointed seqno
+		// always comes from the current archive, and is never before the start seqno of an earlier replay
+		stream.last_seqno = vbts.Seqno
+		if replay.startSeqno > 0 && replay.startSeqno-1 > stream.last_seqno {
+			stream.last_seqno = replay.startSeqno - 1
+		}
+		replay.setStreamState(stream, Replay_Stream_Active)
+		replay.Logger().Debugf("%v started replay stream for vb=%v, start_seqno=%v, segments=%v\n", replay.Id(), vbno, stream.last_seqno, segments)
+
+		// archive files do not carry failover logs of the original source.
+		// the single entry lets checkpoint manager find a vbuuid, 0, for any seqno
+		streamReq := &mcc.UprEvent{Opcode: mc.UPR_STREAMREQ,
+			Status:      mc.SUCCESS,
+			VBucket:     vbno,
+			FailoverLog: &mcc.FailoverLog{{0, 0}}}
+		if !replay.dispatch(streamReq) {
+			return false
+		}
+	}
+	return true
+}
+
+func (replay *ReplayNozzle) nextActiveStream() *replayStream {
+	for _, vbno := range replay.GetVBList() {
+		stream := replay.streams[vbno]
+		if replay.getStreamState(stream) == Replay_Stream_Active {
+			return stream
+		}
+	}
+	return nil
+}
+
+// reads up to ReplayBatchCount records of the stream, and returns them as a snapshot marker followed by mutations.
+// the stream is closed when its archive files are exhausted or its seqno range has been covered
+func (replay *ReplayNozzle) readBatch(stream *replayStream) ([]*mcc.UprEvent, error) {
+	events := make([]*mcc.UprEvent, 1, ReplayBatchCount+1)
+	for len(events) <= ReplayBatchCount {
+		if stream.reader == nil {
+			if stream.segment_index >= len(stream.segments) {
+				replay.closeStream(stream, Replay_Stream_Done)
+				break
+			}
+			file, err := os.Open(ArchiveSegmentPath(stream.vbDir, stream.segments[stream.segment_index], replay.format))
+			if err != nil {
+				return nil, err
+			}
+			stream.file = file
+			stream.reader = NewArchiveRecordReader(file, replay.format)
+		}
+
+		record, err := stream.reader.Next()
+		if err == io.EOF {
+			replay.closeFile(stream)
+			stream.segment_index++
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if record.VBucket != stream.vbno {
+			return nil, ErrorInvalidArchiveRecord
+		}
+		if record.Seqno <= stream.last_seqno {
+			continue
+		}
+		if replay.endSeqno > 0 && record.Seqno > replay.endSeqno {
+			replay.closeStream(stream, Replay_Stream_Done)
+			break
+		}
+
+		event, err := newReplayEvent(record)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+		stream.last_seqno = record.Seqno
+	}
+
+	if len(events) == 1 {
+		return nil, nil
+	}
+
+	// records of a batch are in ascending seqno order, hence can be treated as a snapshot
+	events[0] = &mcc.UprEvent{Opcode: mc.UPR_SNAPSHOT,
+		VBucket:      stream.vbno,
+		SnapstartSeq: events[1].Seqno,
+		SnapendSeq:   events[len(events)-1].Seqno}
+	return events, nil
+}
+
+// constructs the dcp event that an archive record was exported from
+func newReplayEvent(record *ArchiveRecord) (*mcc.UprEvent, error) {
+	opcode, err := record.Opcode()
+	if err != nil {
+		return nil, err
+	}
+	return &mcc.UprEvent{Opcode: opcode,
+		VBucket:  record.VBucket,
+		DataType: record.DataType,
+		Seqno:    record.Seqno,
+		RevSeqno: record.RevSeqno,
+		Cas:      record.Cas,
+		Flags:    record.Flags,
+		Expiry:   record.Expiry,
+		Key:      []byte(record.Key),
+		Value:    record.Body,
+	}, nil
+}
+
+// puts events on data channel. returns false if the nozzle is being stopped
+func (replay *ReplayNozzle) dispatch(events ...*mcc.UprEvent) bool {
+	for _, event := range events {
+		select {
+		case <-replay.finch:
+			return false
+		case replay.dataChan <- event:
+		}
+	}
+	return true
+}
+
+func (replay *ReplayNozzle) closeStream(stream *replayStream, state ReplayStreamState) {
+	replay.closeFile(stream)
+	replay.setStreamState(stream, state)
+	if state == Replay_Stream_Done {
+		replay.Logger().Debugf("%v replay stream for vb=%v is done. last_seqno=%v\n", replay.Id(), stream.vbno, stream.last_seqno)
+	}
+}
+
+func (replay *ReplayNozzle) closeFile(stream *replayStream) {
+	if stream.file != nil {
+		err := stream.file.Close()
+		if err != nil {
+			replay.Logger().Warnf("%v Failed to close archive file %v. err=%v", replay.Id(), stream.file.Name(), err)
+		}
+		stream.file = nil
+	}
+	stream.reader = nil
+}
+
+func (replay *ReplayNozzle) closeStreams() {
+	for _, stream := range replay.streams {
+		replay.closeFile(stream)
+	}
+}
+
+func (replay *ReplayNozzle) onExit() {
+	replay.childrenWaitGrp.Wait()
+}
+
+func (replay *ReplayNozzle) StatusSummary() string {
+	msg := fmt.Sprintf("%v received %v items, sent %v items.", replay.Id(), replay.counterReceived(), replay.counterSent())
+	streams_non_init := replay.streamsWithState(Replay_Stream_NonInit)
+	if len(streams_non_init) > 0 {
+		msg += fmt.Sprintf(" streams not started: %v", streams_non_init)
+	}
+	msg += fmt.Sprintf(" streams done: %v/%v", len(replay.streamsWithState(Replay_Stream_Done)), len(replay.GetVBList()))
+	return msg
+}
+
+func (replay *ReplayNozzle) handleGeneralError(err error) {
+	err1 := replay.SetState(common.Part_Error)
+	if err1 == nil {
+		replay.RaiseEvent(common.NewEvent(common.ErrorEncountered, nil, replay, nil, err))
+		replay.Logger().Errorf("%v Raise error condition %v\n", replay.Id(), err)
+	} else {
+		replay.Logger().Debugf("%v in shutdown process. err=%v is ignored\n", replay.Id(), err)
+	}
+}
+
+func (replay *ReplayNozzle) handleVBError(vbno uint16, err error) {
+	additionalInfo := &base.VBErrorEventAdditional{vbno, err, base.VBErrorType_Source}
+	replay.RaiseEvent(common.NewEvent(common.VBErrorEncountered, nil, replay, nil, additionalInfo))
+}
+
+func (replay *ReplayNozzle) GetVBList() []uint16 {
+	return replay.vbnos
+}
+
+func (replay *ReplayNozzle) ArchiveDir() string {
+	return replay.archiveDir
+}
+
+func (replay *ReplayNozzle) streamsWithState(state ReplayStreamState) []uint16 {
+	ret := []uint16{}
+	for _, vbno := range replay.GetVBList() {
+		if replay.getStreamState(replay.streams[vbno]) == state {
+			ret = append(ret, vbno)
+		}
+	}
+	return ret
+}
+
+func (replay *ReplayNozzle) setStreamState(stream *replayStream, state ReplayStreamState) {
+	replay.lock_state.Lock()
+	defer replay.lock_state.Unlock()
+	stream.state = state
+}
+
+func (replay *ReplayNozzle) getStreamState(stream *replayStream) ReplayStreamState {
+	replay.lock_state.RLock()
+	defer replay.lock_state.RUnlock()
+	return stream.state
+}
+
+func (replay *ReplayNozzle) UpdateSettings(settings map[string]interface{}) error {
+	ts_obj := utils.GetSettingFromSettings(settings, DCP_VBTimestamp)
+	if ts_obj != nil {
+		new_ts, ok := settings[DCP_VBTimestamp].(map[uint16]*base.VBTimestamp)
+		if !ok || new_ts == nil {
+			panic(fmt.Sprintf("setting %v should have type of map[uint16]*base.VBTimestamp", DCP_VBTimestamp))
+		}
+		replay.onUpdateStartingSeqno(new_ts)
+	}
+
+	if _, ok := settings[DCP_Stats_Interval]; ok {
+		replay.stats_interval = time.Duration(settings[DCP_Stats_Interval].(int)) * time.Millisecond
+		replay.stats_interval_change_ch <- true
+	}
+
+	return nil
+}
+
+func (replay *ReplayNozzle) onUpdateStartingSeqno(new_startingSeqnos map[uint16]*base.VBTimestamp) {
+	for vbno, vbts := range new_startingSeqnos {
+		ts_withlock, ok := replay.cur_ts[vbno]
+		if ok && ts_withlock != nil {
+			ts_withlock.lock.Lock()
+			//only update the cur_ts if starting seqno has not been set yet
+			if ts_withlock.ts == nil {
+				ts_withlock.ts = vbts
+			}
+			ts_withlock.lock.Unlock()
+		}
+	}
+}
+
+func (replay *ReplayNozzle) getTS(vbno uint16, need_lock bool) (*base.VBTimestamp, error) {
+	ts_entry := replay.cur_ts[vbno]
+	if ts_entry != nil {
+		if need_lock {
+			ts_entry.lock.RLock()
+			defer ts_entry.lock.RUnlock()
+		}
+		return ts_entry.ts, nil
+	} else {
+		return nil, fmt.Errorf("getTS failed: vbno=%v is not tracked in cur_ts map", vbno)
+	}
+}
+
+// there is no producer outside of xdcr that replay nozzles depend on. health check is not applicable
+func (replay *ReplayNozzle) SetMaxMissCount(max_miss_count int) {
+}
+
+func (replay *ReplayNozzle) CheckStuckness(dcp_stats map[string]map[string]string) error {
+	return nil
+}
+
+func (replay *ReplayNozzle) counterReceived() uint32 {
+	return atomic.LoadUint32(&replay.counter_received)
+}
+
+func (replay *ReplayNozzle) incCounterReceived() {
+	atomic.AddUint32(&replay.counter_received, 1)
+}
+
+func (replay *ReplayNozzle) counterSent() uint32 {
+	return atomic.LoadUint32(&replay.counter_sent)
+}
+
+func (replay *ReplayNozzle) incCounterSent() {
+	atomic.AddUint32(&replay.counter_sent, 1)
+}
+
+func (replay *ReplayNozzle) collectDataChanLen() {
+	defer replay.childrenWaitGrp.Done()
+	ticker := time.NewTicker(replay.stats_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-replay.finch:
+			return
+		case <-replay.stats_interval_change_ch:
+			ticker.Stop()
+			ticker = time.NewTicker(replay.stats_interval)
+		case <-ticker.C:
+			replay.RaiseEvent(common.NewEvent(common.StatsUpdate, nil, replay, nil, len(replay.dataChan)))
+		}
+	}
+}
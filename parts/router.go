@@ -17,9 +17,14 @@ import (
 	"github.com/couchbase/goxdcr/base"
 	common "github.com/couchbase/goxdcr/common"
 	connector "github.com/couchbase/goxdcr/connector"
+	"github.com/couchbase/goxdcr/filter"
 	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"github.com/couchbase/goxdcr/simple_utils"
+	"github.com/couchbase/goxdcr/transform"
 	"github.com/couchbase/goxdcr/utils"
-	"regexp"
+	"hash/fnv"
+	"sync"
 	"time"
 )
 
@@ -27,44 +32,68 @@ var ErrorInvalidDataForRouter = errors.New("Input data to Router is invalid.")
 var ErrorNoDownStreamNodesForRouter = errors.New("No downstream nodes have been defined for the Router.")
 var ErrorNoRoutingMapForRouter = errors.New("No routingMap has been defined for Router.")
 var ErrorInvalidRoutingMapForRouter = errors.New("routingMap in Router is invalid.")
+var ErrorInvalidRouterSettings = errors.New("Router settings are of wrong type.")
 
 type ReqCreator func(id string) (*base.WrappedMCRequest, error)
 
+// additional info carried by the DataFiltered events of routers
+type DataFilteredEventAdditional struct {
+	// whether the document has been dropped since its body cannot be redacted
+	Unredactable bool
+}
+
 // XDCR Router does two things:
 // 1. converts UprEvent to MCRequest
 // 2. routes MCRequest to downstream parts
 type Router struct {
 	id string
 	*connector.Router
-	filterRegexp *regexp.Regexp    // filter expression
-	routingMap   map[uint16]string // pvbno -> partId. This defines the loading balancing strategy of which vbnos would be routed to which part
-	req_creator  ReqCreator
-	topic        string
+	keyFilter *filter.KeyFilter // filter expression on document keys
+	docFilter *filter.DocFilter // filter expression on document bodies
+	// rewrites document keys before they are sent to target
+	keyTransformer *transform.KeyTransformer
+	// masks fields in document bodies before they are sent to target
+	fieldRedactor *transform.FieldRedactor
+	// whether deletions and expirations are dropped
+	dropDeletions   bool
+	dropExpirations bool
+	// percentage of document keys to be replicated
+	samplingPercentage int
+	// filters and the settings above may be changed on a running replication
+	filterLock  sync.RWMutex
+	routingMap  map[uint16]string // pvbno -> partId. This defines the loading balancing strategy of which vbnos would be routed to which part
+	req_creator ReqCreator
+	topic       string
+	// number of vbuckets in target bucket, which is needed to find the target vbuckets of rewritten keys.
+	// it is 0 when target is not a bucket, e.g., for file and webhook replications
+	targetNumVBuckets uint16
 	// whether lww conflict resolution mode has been enabled
 	sourceCRMode base.ConflictResolutionMode
 }
 
-func NewRouter(id string, topic string, filterExpression string,
+func NewRouter(id string, topic string, filterExpression string, docFilterExpression string,
 	downStreamParts map[string]common.Part,
 	routingMap map[uint16]string,
+	targetNumVBuckets uint16,
 	sourceCRMode base.ConflictResolutionMode,
 	logger_context *log.LoggerContext, req_creator ReqCreator) (*Router, error) {
-	// compile filter expression
-	var filterRegexp *regexp.Regexp
-	var err error
-	if len(filterExpression) > 0 {
-		filterRegexp, err = regexp.Compile(filterExpression)
-		if err != nil {
-			return nil, err
-		}
+	keyFilter, err := compileKeyFilter(filterExpression)
+	if err != nil {
+		return nil, err
+	}
+	docFilter, err := compileDocFilter(docFilterExpression)
+	if err != nil {
+		return nil, err
 	}
 	router := &Router{
-		id:           id,
-		filterRegexp: filterRegexp,
-		routingMap:   routingMap,
-		topic:        topic,
-		sourceCRMode: sourceCRMode,
-		req_creator:  req_creator}
+		id:                id,
+		keyFilter:         keyFilter,
+		docFilter:         docFilter,
+		routingMap:        routingMap,
+		targetNumVBuckets: targetNumVBuckets,
+		topic:             topic,
+		sourceCRMode:      sourceCRMode,
+		req_creator:       req_creator}
 
 	var routingFunc connector.Routing_Callback_Func = router.route
 	router.Router = connector.NewRouter(id, downStreamParts, &routingFunc, logger_context, "XDCRRouter")
@@ -85,6 +114,8 @@ func (router *Router) ComposeMCRequest(event *mcc.UprEvent) (*base.WrappedMCRequ
 	req.VBucket = event.VBucket
 	req.Key = event.Key
 	req.Body = event.Value
+	// request objects are reused. clear the datatype that may have been set by outgoing nozzles, e.g., for compression
+	req.DataType = 0
 	//opCode
 	req.Opcode = event.Opcode
 
@@ -122,6 +153,7 @@ func (router *Router) ComposeMCRequest(event *mcc.UprEvent) (*base.WrappedMCRequ
 	}
 
 	wrapped_req.Seqno = event.Seqno
+	wrapped_req.SrcVBucket = event.VBucket
 	wrapped_req.Start_time = time.Now()
 	wrapped_req.ConstructUniqueKey()
 
@@ -149,22 +181,274 @@ func (router *Router) route(data interface{}) (map[string]interface{}, error) {
 		return nil, ErrorInvalidRoutingMapForRouter
 	}
 
+	router.filterLock.RLock()
+	keyFilter := router.keyFilter
+	docFilter := router.docFilter
+	dropDeletions := router.dropDeletions
+	dropExpirations := router.dropExpirations
+	keyTransformer := router.keyTransformer
+	fieldRedactor := router.fieldRedactor
+	samplingPercentage := router.samplingPercentage
+	router.filterLock.RUnlock()
+
+	// drop deletions and expirations if requested. like filtered data, dropped data is reported
+	// through DataFiltered events so that its seqnos are still accounted for in checkpoints
+	if (dropDeletions && uprEvent.Opcode == mc.UPR_DELETION) ||
+		(dropExpirations && uprEvent.Opcode == mc.UPR_EXPIRATION) {
+		router.RaiseEvent(common.NewEvent(common.DataFiltered, uprEvent, router, nil, nil))
+		return result, nil
+	}
+
+	// drop data whose key has not been sampled. all mutations, deletions and expirations of a document
+	// are either replicated or dropped, since sampling depends on document key only
+	if !isKeySampled(uprEvent.Key, samplingPercentage) {
+		router.RaiseEvent(common.NewEvent(common.DataFiltered, uprEvent, router, nil, nil))
+		return result, nil
+	}
+
 	// filter data if filter expession has been defined
-	if router.filterRegexp != nil {
-		if !utils.RegexpMatch(router.filterRegexp, uprEvent.Key) {
+	if keyFilter != nil {
+		if !keyFilter.Match(uprEvent.Key) {
 			// if data does not match filter expression, drop it. return empty result
 			router.RaiseEvent(common.NewEvent(common.DataFiltered, uprEvent, router, nil, nil))
 			return result, nil
 		}
 	}
+
+	// filter data if doc filter expession has been defined.
+	// only mutations carry document bodies. deletions and expirations are always replicated
+	if docFilter != nil && uprEvent.Opcode == mc.UPR_MUTATION {
+		if !docFilter.Match(uprEvent.Value) {
+			// if document body does not match doc filter expression, drop it. return empty result
+			router.RaiseEvent(common.NewEvent(common.DataFiltered, uprEvent, router, nil, nil))
+			return result, nil
+		}
+	}
+
+	// redact document body. the size of the redacted body may be different from that of the original body.
+	// outgoing nozzles compute request size, e.g., for optimistic replication decisions, from the redacted body.
+	// redaction fails closed. bodies that cannot be checked for the redacted fields, e.g., non-json bodies,
+	// are dropped and reported through DataFiltered events, so that they are accounted for in checkpoints and stats
+	body := uprEvent.Value
+	if fieldRedactor != nil && uprEvent.Opcode == mc.UPR_MUTATION {
+		var err error
+		body, err = fieldRedactor.Redact(uprEvent.Value)
+		if err != nil {
+			router.Logger().Debugf("%v dropped doc that cannot be redacted. key=%v, err=%v\n", router.id, string(uprEvent.Key), err)
+			router.RaiseEvent(common.NewEvent(common.DataFiltered, uprEvent, router, nil, DataFilteredEventAdditional{Unredactable: true}))
+			return result, nil
+		}
+	}
+
 	mcRequest, err := router.ComposeMCRequest(uprEvent)
 	if err != nil {
 		return nil, utils.NewEnhancedError("Error creating new memcached request.", err)
 	}
+	mcRequest.Req.Body = body
+	// rewrite key after filters have been applied, so that filters always work on source keys.
+	// all downstream processing, e.g., getMeta and setWithMeta in xmem and doc map in capi, uses the rewritten key
+	if keyTransformer != nil {
+		mcRequest.Req.Key = keyTransformer.Transform(mcRequest.Req.Key)
+		// the rewritten key may belong to a different vbucket on target, which may be owned by a different part.
+		// SrcVBucket of the request remains the source vbucket, in which its seqno is accounted for
+		if router.targetNumVBuckets > 0 {
+			mcRequest.Req.VBucket = simple_utils.GetVBucketForKey(mcRequest.Req.Key, router.targetNumVBuckets)
+			partId, ok = router.routingMap[mcRequest.Req.VBucket]
+			if !ok {
+				return nil, ErrorInvalidRoutingMapForRouter
+			}
+		}
+		mcRequest.ConstructUniqueKey()
+	}
 	result[partId] = mcRequest
 	return result, nil
 }
 
+// whether the document with the specified key is to be replicated when the specified percentage of keys is sampled.
+// the decision depends on the hash of the key only, so that the same subset of keys is sampled by all routers
+// and across pipeline restarts
+func isKeySampled(key []byte, samplingPercentage int) bool {
+	// samplingPercentage is 0 for replications created before sampling was introduced
+	if samplingPercentage <= 0 || samplingPercentage >= 100 {
+		return true
+	}
+	hash := fnv.New32a()
+	hash.Write(key)
+	return hash.Sum32()%100 < uint32(samplingPercentage)
+}
+
+// compile filter expression, which is either a regular expression or a structured include/exclude filter.
+// returns nil filter when filter expression is empty
+func compileKeyFilter(filterExpression string) (*filter.KeyFilter, error) {
+	if len(filterExpression) == 0 {
+		return nil, nil
+	}
+	return filter.NewKeyFilter(filterExpression)
+}
+
+// compile key transform rules. returns nil transformer when no rules have been specified
+func compileKeyTransformer(keyTransformRules string) (*transform.KeyTransformer, error) {
+	if len(keyTransformRules) == 0 {
+		return nil, nil
+	}
+	return transform.NewKeyTransformer(keyTransformRules)
+}
+
+// compile redaction rules. returns nil redactor when no rules have been specified
+func compileFieldRedactor(redactionRules string, redactionHashKey string) (*transform.FieldRedactor, error) {
+	if len(redactionRules) == 0 {
+		return nil, nil
+	}
+	return transform.NewFieldRedactor(redactionRules, redactionHashKey)
+}
+
+// compile doc filter expression. returns nil filter when doc filter expression is empty
+func compileDocFilter(docFilterExpression string) (*filter.DocFilter, error) {
+	if len(docFilterExpression) == 0 {
+		return nil, nil
+	}
+	return filter.NewDocFilter(docFilterExpression)
+}
+
+// replaces filters when filter expressions have been changed on a running replication,
+// and applies changes to key transform rules, redaction rules, and deletion and expiration handling.
+// the new settings apply to mutations routed after the update
+func (router *Router) UpdateSettings(settings map[string]interface{}) error {
+	router.filterLock.Lock()
+	defer router.filterLock.Unlock()
+
+	if filterExpressionObj, ok := settings[metadata.FilterExpression]; ok {
+		filterExpression, ok := filterExpressionObj.(string)
+		if !ok {
+			return ErrorInvalidRouterSettings
+		}
+		if !isSameKeyFilter(router.keyFilter, filterExpression) {
+			keyFilter, err := compileKeyFilter(filterExpression)
+			if err != nil {
+				return err
+			}
+			router.keyFilter = keyFilter
+			router.Logger().Infof("%v updated filter expression to %v\n", router.id, filterExpression)
+		}
+	}
+
+	if docFilterExpressionObj, ok := settings[metadata.DocFilterExpression]; ok {
+		docFilterExpression, ok := docFilterExpressionObj.(string)
+		if !ok {
+			return ErrorInvalidRouterSettings
+		}
+		if !isSameDocFilter(router.docFilter, docFilterExpression) {
+			docFilter, err := compileDocFilter(docFilterExpression)
+			if err != nil {
+				return err
+			}
+			router.docFilter = docFilter
+			router.Logger().Infof("%v updated doc filter expression to %v\n", router.id, docFilterExpression)
+		}
+	}
+
+	if keyTransformRulesObj, ok := settings[metadata.KeyTransformRules]; ok {
+		keyTransformRules, ok := keyTransformRulesObj.(string)
+		if !ok {
+			return ErrorInvalidRouterSettings
+		}
+		if !isSameKeyTransformer(router.keyTransformer, keyTransformRules) {
+			keyTransformer, err := compileKeyTransformer(keyTransformRules)
+			if err != nil {
+				return err
+			}
+			router.keyTransformer = keyTransformer
+			router.Logger().Infof("%v updated key transform rules to %v\n", router.id, keyTransformRules)
+		}
+	}
+
+	// redaction rules and hash key are compiled together. either of them may be left out of settings when unchanged
+	redactionRules, redactionHashKey := "", ""
+	if router.fieldRedactor != nil {
+		redactionRules, redactionHashKey = router.fieldRedactor.Rules(), router.fieldRedactor.HashKey()
+	}
+	if redactionRulesObj, ok := settings[metadata.RedactionRules]; ok {
+		redactionRules, ok = redactionRulesObj.(string)
+		if !ok {
+			return ErrorInvalidRouterSettings
+		}
+	}
+	if redactionHashKeyObj, ok := settings[metadata.RedactionHashKey]; ok {
+		redactionHashKey, ok = redactionHashKeyObj.(string)
+		if !ok {
+			return ErrorInvalidRouterSettings
+		}
+	}
+	if !isSameFieldRedactor(router.fieldRedactor, redactionRules, redactionHashKey) {
+		fieldRedactor, err := compileFieldRedactor(redactionRules, redactionHashKey)
+		if err != nil {
+			return err
+		}
+		router.fieldRedactor = fieldRedactor
+		router.Logger().Infof("%v updated redaction rules to %v\n", router.id, redactionRules)
+	}
+
+	if err := updateBoolSetting(settings, metadata.DropDeletions, &router.dropDeletions); err != nil {
+		return err
+	}
+	if err := updateBoolSetting(settings, metadata.DropExpirations, &router.dropExpirations); err != nil {
+		return err
+	}
+
+	if samplingPercentageObj, ok := settings[metadata.SamplingPercentage]; ok {
+		samplingPercentage, ok := samplingPercentageObj.(int)
+		if !ok {
+			return ErrorInvalidRouterSettings
+		}
+		if router.samplingPercentage != samplingPercentage {
+			router.samplingPercentage = samplingPercentage
+			router.Logger().Infof("%v updated sampling percentage to %v\n", router.id, samplingPercentage)
+		}
+	}
+
+	return nil
+}
+
+// updates the bool setting pointed to by value when key is present in settings
+func updateBoolSetting(settings map[string]interface{}, key string, value *bool) error {
+	if obj, ok := settings[key]; ok {
+		boolValue, ok := obj.(bool)
+		if !ok {
+			return ErrorInvalidRouterSettings
+		}
+		*value = boolValue
+	}
+	return nil
+}
+
+func isSameKeyFilter(keyFilter *filter.KeyFilter, filterExpression string) bool {
+	if keyFilter == nil {
+		return len(filterExpression) == 0
+	}
+	return keyFilter.Expression() == filterExpression
+}
+
+func isSameDocFilter(docFilter *filter.DocFilter, docFilterExpression string) bool {
+	if docFilter == nil {
+		return len(docFilterExpression) == 0
+	}
+	return docFilter.Expression() == docFilterExpression
+}
+
+func isSameKeyTransformer(keyTransformer *transform.KeyTransformer, keyTransformRules string) bool {
+	if keyTransformer == nil {
+		return len(keyTransformRules) == 0
+	}
+	return keyTransformer.Rules() == keyTransformRules
+}
+
+func isSameFieldRedactor(fieldRedactor *transform.FieldRedactor, redactionRules string, redactionHashKey string) bool {
+	if fieldRedactor == nil {
+		return len(redactionRules) == 0
+	}
+	return fieldRedactor.Rules() == redactionRules && fieldRedactor.HashKey() == redactionHashKey
+}
+
 func (router *Router) RoutingMap() map[uint16]string {
 	return router.routingMap
 }
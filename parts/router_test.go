@@ -0,0 +1,188 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"github.com/couchbase/goxdcr/simple_utils"
+	"testing"
+)
+
+const testNumVBuckets = 1024
+
+// routes each vb to a part of its own, so that the part that a request is routed to tells its vb
+func testRoutingMap() map[uint16]string {
+	routingMap := make(map[uint16]string)
+	for vbno := uint16(0); vbno < testNumVBuckets; vbno++ {
+		routingMap[vbno] = testPartId(vbno)
+	}
+	return routingMap
+}
+
+func testPartId(vbno uint16) string {
+	return fmt.Sprintf("part_%v", vbno)
+}
+
+func newTestRouter(t *testing.T, targetNumVBuckets uint16, keyTransformRules string) *Router {
+	router, err := NewRouter("testRouter", "testTopic", "", "", nil, testRoutingMap(), targetNumVBuckets, base.CRMode_RevId, log.DefaultLoggerContext, nil)
+	if err != nil {
+		t.Fatalf("failed to construct router. err=%v", err)
+	}
+	err = router.UpdateSettings(map[string]interface{}{metadata.KeyTransformRules: keyTransformRules})
+	if err != nil {
+		t.Fatalf("failed to set key transform rules. err=%v", err)
+	}
+	return router
+}
+
+func routeTestMutation(t *testing.T, router *Router, key string, vbno uint16) (string, *base.WrappedMCRequest) {
+	event := &mcc.UprEvent{Opcode: mc.UPR_MUTATION,
+		VBucket: vbno,
+		Seqno:   10,
+		Key:     []byte(key),
+		Value:   []byte(`{"a":1}`),
+	}
+	result, err := router.route(event)
+	if err != nil {
+		t.Fatalf("failed to route mutation. err=%v", err)
+	}
+	if len(result) != 1 {
+		t.Fatalf("expected mutation to be routed to one part, got %v", result)
+	}
+	for partId, data := range result {
+		return partId, data.(*base.WrappedMCRequest)
+	}
+	return "", nil
+}
+
+func TestGetVBucketForKey(t *testing.T) {
+	if vbno := simple_utils.GetVBucketForKey([]byte("foo"), testNumVBuckets); vbno != 115 {
+		t.Errorf("expected foo to be in vb 115, got %v", vbno)
+	}
+	if vbno := simple_utils.GetVBucketForKey([]byte("siteA::foo"), testNumVBuckets); vbno != 145 {
+		t.Errorf("expected siteA::foo to be in vb 145, got %v", vbno)
+	}
+}
+
+func TestRouteRewrittenKeyToTargetVBucket(t *testing.T) {
+	router := newTestRouter(t, testNumVBuckets, `[{"type": "addPrefix", "value": "siteA::"}]`)
+
+	partId, req := routeTestMutation(t, router, "foo", 115)
+	if string(req.Req.Key) != "siteA::foo" {
+		t.Fatalf("expected key to be rewritten to siteA::foo, got %v", string(req.Req.Key))
+	}
+	if req.Req.VBucket != 145 {
+		t.Errorf("expected request to be for target vb 145, got %v", req.Req.VBucket)
+	}
+	if req.SrcVBucket != 115 || req.Seqno != 10 {
+		t.Errorf("expected request to keep source vb 115 and seqno 10, got vb %v and seqno %v", req.SrcVBucket, req.Seqno)
+	}
+	if partId != testPartId(145) {
+		t.Errorf("expected request to be routed to %v, which owns target vb 145, got %v", testPartId(145), partId)
+	}
+}
+
+func TestRouteWithoutKeyTransform(t *testing.T) {
+	router := newTestRouter(t, testNumVBuckets, "")
+
+	partId, req := routeTestMutation(t, router, "foo", 115)
+	if req.Req.VBucket != 115 || req.SrcVBucket != 115 {
+		t.Errorf("expected request to be for vb 115 on both source and target, got %v and %v", req.SrcVBucket, req.Req.VBucket)
+	}
+	if partId != testPartId(115) {
+		t.Errorf("expected request to be routed to %v, got %v", testPartId(115), partId)
+	}
+}
+
+// without a target bucket, e.g., for file replications, rewritten keys stay in their source vbs
+func TestRouteRewrittenKeyWithoutTargetBucket(t *testing.T) {
+	router := newTestRouter(t, 0, `[{"type": "addPrefix", "value": "siteA::"}]`)
+
+	partId, req := routeTestMutation(t, router, "foo", 115)
+	if req.Req.VBucket != 115 || partId != testPartId(115) {
+		t.Errorf("expected request to stay in vb 115, got vb %v and part %v", req.Req.VBucket, partId)
+	}
+}
+
+func TestIsKeySampled(t *testing.T) {
+	keys := make([][]byte, 10000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("doc_%v", i))
+	}
+
+	// 0 is the percentage of replications created before sampling was introduced
+	for _, samplingPercentage := range []int{-1, 0, 100, 101} {
+		for _, key := range keys {
+			if !isKeySampled(key, samplingPercentage) {
+				t.Fatalf("expected all keys to be sampled with sampling percentage %v, %s was not", samplingPercentage, key)
+			}
+		}
+	}
+
+	for _, samplingPercentage := range []int{1, 10, 50, 99} {
+		numSampled := 0
+		for _, key := range keys {
+			sampled := isKeySampled(key, samplingPercentage)
+			if sampled != isKeySampled(key, samplingPercentage) {
+				t.Fatalf("expected sampling of %s to be deterministic", key)
+			}
+			// keys sampled at a lower percentage stay sampled when the percentage is raised
+			if sampled && !isKeySampled(key, samplingPercentage+1) {
+				t.Errorf("expected %s to be sampled at %v%% since it is sampled at %v%%", key, samplingPercentage+1, samplingPercentage)
+			}
+			if sampled {
+				numSampled++
+			}
+		}
+		expected := len(keys) * samplingPercentage / 100
+		if numSampled < expected*8/10 || numSampled > expected*12/10 {
+			t.Errorf("expected about %v keys to be sampled at %v%%, got %v", expected, samplingPercentage, numSampled)
+		}
+	}
+}
+
+func TestRouteDropsUnsampledKeys(t *testing.T) {
+	router := newTestRouter(t, testNumVBuckets, "")
+	if err := router.UpdateSettings(map[string]interface{}{metadata.SamplingPercentage: 1}); err != nil {
+		t.Fatalf("failed to set sampling percentage. err=%v", err)
+	}
+
+	// find a key that is not sampled at 1%
+	key := ""
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("doc_%v", i)
+		if !isKeySampled([]byte(key), 1) {
+			break
+		}
+	}
+
+	// mutations and deletions of the key are dropped alike
+	for _, opcode := range []mc.CommandCode{mc.UPR_MUTATION, mc.UPR_DELETION} {
+		event := &mcc.UprEvent{Opcode: opcode, VBucket: 115, Seqno: 10, Key: []byte(key)}
+		result, err := router.route(event)
+		if err != nil || len(result) != 0 {
+			t.Errorf("expected %v of unsampled key %v to be dropped, got %v. err=%v", opcode, key, result, err)
+		}
+	}
+
+	if err := router.UpdateSettings(map[string]interface{}{metadata.SamplingPercentage: 100}); err != nil {
+		t.Fatalf("failed to set sampling percentage. err=%v", err)
+	}
+	routeTestMutation(t, router, key, 115)
+
+	if err := router.UpdateSettings(map[string]interface{}{metadata.SamplingPercentage: "1"}); err != ErrorInvalidRouterSettings {
+		t.Errorf("expected ErrorInvalidRouterSettings on sampling percentage of wrong type, got %v", err)
+	}
+}
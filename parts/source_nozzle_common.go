@@ -0,0 +1,32 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// defines types common to both dcp and replay nozzles
+package parts
+
+import (
+	common "github.com/couchbase/goxdcr/common"
+)
+
+// source nozzles of a pipeline. they are either dcp nozzles, which stream mutations from the source bucket,
+// or replay nozzles, which read mutations from archive files
+type SourceNozzle interface {
+	common.Nozzle
+
+	// the list of vbuckets that the source nozzle is responsible for
+	GetVBList() []uint16
+
+	StatusSummary() string
+
+	// the number of health checks that the source nozzle is allowed to fail before it is considered stuck
+	SetMaxMissCount(max_miss_count int)
+
+	// returns error if the source nozzle is stuck
+	CheckStuckness(dcp_stats map[string]map[string]string) error
+}
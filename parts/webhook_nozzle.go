@@ -0,0 +1,629 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/couchbase/goxdcr/base"
+	common "github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/gen_server"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//default configuration
+	default_numofretry_webhook          int           = 6
+	default_retry_interval_webhook      time.Duration = 500 * time.Millisecond
+	default_maxRetryInterval_webhook    time.Duration = 30 * time.Second
+	default_writeTimeout_webhook        time.Duration = 60 * time.Second
+	default_selfMonitorInterval_webhook time.Duration = 300 * time.Millisecond
+)
+
+var webhook_setting_defs base.SettingDefinitions = base.SettingDefinitions{SETTING_BATCHCOUNT: base.NewSettingDef(reflect.TypeOf((*int)(nil)), true),
+	SETTING_BATCHSIZE:          base.NewSettingDef(reflect.TypeOf((*int)(nil)), true),
+	SETTING_NUMOFRETRY:         base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	SETTING_WRITE_TIMEOUT:      base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
+	SETTING_MAX_RETRY_INTERVAL: base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
+	SETTING_STATS_INTERVAL:     base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	SETTING_PRIORITY:           base.NewSettingDef(reflect.TypeOf((*string)(nil)), false)}
+
+/************************************
+/* struct webhookConfig
+*************************************/
+type webhookConfig struct {
+	baseConfig
+	// the interval before the first retry. it doubles on each retry, up to maxRetryInterval
+	retryInterval time.Duration
+}
+
+func newWebhookConfig(logger *log.CommonLogger) webhookConfig {
+	return webhookConfig{
+		baseConfig: baseConfig{maxCount: -1,
+			maxSize:             -1,
+			maxRetry:            default_numofretry_webhook,
+			writeTimeout:        default_writeTimeout_webhook,
+			maxRetryInterval:    default_maxRetryInterval_webhook,
+			selfMonitorInterval: default_selfMonitorInterval_webhook,
+			logger:              logger,
+		},
+		retryInterval: default_retry_interval_webhook,
+	}
+}
+
+func (config *webhookConfig) initializeConfig(settings map[string]interface{}) error {
+	err := utils.ValidateSettings(webhook_setting_defs, settings, config.logger)
+
+	if err == nil {
+		config.baseConfig.initializeConfig(settings)
+	}
+	return err
+}
+
+// the body of the requests posted to webhook url
+type webhookPayload struct {
+	Replication string            `json:"replication"`
+	Mutations   []json.RawMessage `json:"mutations"`
+}
+
+// a mutation, deletion or expiration in webhook payload
+type webhookMutation struct {
+	Op       string `json:"op"`
+	VBucket  uint16 `json:"vb"`
+	Seqno    uint64 `json:"seqno"`
+	Key      string `json:"key"`
+	RevSeqno uint64 `json:"rev"`
+	Cas      uint64 `json:"cas"`
+	Flags    uint32 `json:"flags"`
+	Expiry   uint32 `json:"expiry"`
+	// document body, when it is a json document
+	Doc json.RawMessage `json:"doc,omitempty"`
+	// document body, base64 encoded, when it is not a json document
+	Body []byte `json:"body,omitempty"`
+}
+
+// a mutation that has been encoded and is waiting to be posted
+type webhookItem struct {
+	data       []byte
+	start_time time.Time
+	additional DataSentEventAdditional
+}
+
+// error returned by webhook that retrying the same request would not fix
+type webhookPermanentError struct {
+	statusCode int
+	message    string
+}
+
+func (err *webhookPermanentError) Error() string {
+	return fmt.Sprintf("webhook rejected request with status code %v. response=%v", err.statusCode, err.message)
+}
+
+var ErrorWebhookNozzleStopped = errors.New("Webhook nozzle has been stopped")
+
+/************************************
+/* struct WebhookNozzle
+*************************************/
+
+// WebhookNozzle posts mutations, in json batches, to an http endpoint.
+// batches are posted one at a time, and failed posts are retried with exponential backoff, up to maxRetry times,
+// hence mutations of a vbucket, which is always handled by the same nozzle, are received by the endpoint in seqno order.
+// when a batch is rejected with a permanent error, or is still not accepted after the last retry, the nozzle raises
+// an error, and the pipeline is restarted from its last checkpoint.
+// DataSent events are raised for mutations only after the endpoint has accepted them, so that checkpoints
+// never cover mutations that have not been delivered. delivery is at least once
+type WebhookNozzle struct {
+
+	//parent inheritance
+	gen_server.GenServer
+	AbstractPart
+
+	bOpen      bool
+	lock_bOpen sync.RWMutex
+
+	topic string
+	// immutable fields
+	url        string
+	authHeader string
+
+	config webhookConfig
+	client *http.Client
+
+	dataChan chan *base.WrappedMCRequest
+	//the total number of items queued in dataChan
+	items_in_dataChan int32
+	//the total size of data (in bytes) queued in dataChan
+	bytes_in_dataChan int64
+
+	childrenWaitGrp   sync.WaitGroup
+	sender_finch      chan bool
+	selfMonitor_finch chan bool
+
+	counter_received uint32
+	counter_sent     uint32
+	// the number of posts that have been retried
+	counter_retried uint32
+
+	bandwidth_throttler *base.BandwidthThrottler
+	// total time, in nanoseconds, that posts have been delayed by bandwidth_throttler
+	counter_throttled_time int64
+
+	handle_error      bool
+	lock_handle_error sync.RWMutex
+	dataObj_recycler  base.DataObjRecycler
+}
+
+func NewWebhookNozzle(id string,
+	topic string,
+	url, authHeader string,
+	dataObj_recycler base.DataObjRecycler,
+	logger_context *log.LoggerContext) *WebhookNozzle {
+
+	//callback functions from GenServer
+	var msg_callback_func gen_server.Msg_Callback_Func
+	var exit_callback_func gen_server.Exit_Callback_Func
+	var error_handler_func gen_server.Error_Handler_Func
+
+	server := gen_server.NewGenServer(&msg_callback_func,
+		&exit_callback_func, &error_handler_func, logger_context, "WebhookNozzle")
+	part := NewAbstractPartWithLogger(id, server.Logger())
+
+	webhook := &WebhookNozzle{GenServer: server,
+		AbstractPart:      part,
+		bOpen:             true,
+		lock_bOpen:        sync.RWMutex{},
+		topic:             topic,
+		url:               url,
+		authHeader:        authHeader,
+		config:            newWebhookConfig(server.Logger()),
+		childrenWaitGrp:   sync.WaitGroup{},
+		sender_finch:      make(chan bool, 1),
+		selfMonitor_finch: make(chan bool, 1),
+		handle_error:      true,
+		lock_handle_error: sync.RWMutex{},
+		dataObj_recycler:  dataObj_recycler,
+	}
+
+	msg_callback_func = nil
+	exit_callback_func = webhook.onExit
+	error_handler_func = webhook.handleGeneralError
+
+	return webhook
+}
+
+func (webhook *WebhookNozzle) IsOpen() bool {
+	webhook.lock_bOpen.RLock()
+	defer webhook.lock_bOpen.RUnlock()
+	return webhook.bOpen
+}
+
+func (webhook *WebhookNozzle) Open() error {
+	webhook.lock_bOpen.Lock()
+	defer webhook.lock_bOpen.Unlock()
+	if !webhook.bOpen {
+		webhook.bOpen = true
+	}
+	return nil
+}
+
+func (webhook *WebhookNozzle) Close() error {
+	webhook.lock_bOpen.Lock()
+	defer webhook.lock_bOpen.Unlock()
+	if webhook.bOpen {
+		webhook.bOpen = false
+	}
+	return nil
+}
+
+func (webhook *WebhookNozzle) handleError() bool {
+	webhook.lock_handle_error.RLock()
+	defer webhook.lock_handle_error.RUnlock()
+	return webhook.handle_error
+}
+
+func (webhook *WebhookNozzle) disableHandleError() {
+	webhook.lock_handle_error.Lock()
+	defer webhook.lock_handle_error.Unlock()
+	webhook.handle_error = false
+}
+
+func (webhook *WebhookNozzle) Start(settings map[string]interface{}) error {
+	webhook.Logger().Infof("%v starting ....\n", webhook.Id())
+
+	err := webhook.SetState(common.Part_Starting)
+	if err != nil {
+		return err
+	}
+
+	err = webhook.initialize(settings)
+	if err == nil {
+		webhook.config.registerRunningNozzle(webhook.Id())
+		webhook.Logger().Infof("%v initialized with url %v\n", webhook.Id(), webhook.url)
+
+		webhook.childrenWaitGrp.Add(1)
+		go webhook.selfMonitor(webhook.selfMonitor_finch, &webhook.childrenWaitGrp)
+
+		webhook.childrenWaitGrp.Add(1)
+		go webhook.processData(webhook.sender_finch, &webhook.childrenWaitGrp)
+
+		err = webhook.Start_server()
+	}
+
+	if err == nil {
+		err = webhook.SetState(common.Part_Running)
+		if err == nil {
+			webhook.Logger().Infof("%v has been started successfully\n", webhook.Id())
+		}
+	}
+	if err != nil {
+		webhook.Logger().Errorf("%v failed to start. err=%v\n", webhook.Id(), err)
+	}
+	return err
+}
+
+func (webhook *WebhookNozzle) initialize(settings map[string]interface{}) error {
+	err := webhook.config.initializeConfig(settings)
+	if err != nil {
+		return err
+	}
+
+	webhook.dataChan = make(chan *base.WrappedMCRequest, webhook.config.dataChanSize(webhook.config.maxCount*10))
+	webhook.items_in_dataChan = 0
+	webhook.bytes_in_dataChan = 0
+
+	// redirects are not followed, so that mutations, and the auth header, are only ever posted to the configured url
+	webhook.client = &http.Client{Timeout: webhook.config.writeTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return nil
+}
+
+func (webhook *WebhookNozzle) Stop() error {
+	webhook.Logger().Infof("%v stopping \n", webhook.Id())
+	unregisterRunningNozzle(webhook.Id())
+
+	err := webhook.SetState(common.Part_Stopping)
+	if err != nil {
+		return err
+	}
+
+	webhook.Logger().Debugf("%v processed %v items\n", webhook.Id(), atomic.LoadUint32(&webhook.counter_sent))
+
+	err = webhook.Stop_server()
+
+	err = webhook.SetState(common.Part_Stopped)
+	if err == nil {
+		webhook.Logger().Infof("%v has been stopped\n", webhook.Id())
+	} else {
+		webhook.Logger().Errorf("%v failed to stop. err=%v\n", webhook.Id(), err)
+	}
+
+	return err
+}
+
+func (webhook *WebhookNozzle) Receive(data interface{}) error {
+	// the attempt to write to dataChan may panic if dataChan has been closed
+	defer func() {
+		if r := recover(); r != nil {
+			webhook.Logger().Errorf("%v recovered from %v", webhook.Id(), r)
+			if webhook.validateRunningState() == nil {
+				// report error only when webhook nozzle is still in running state
+				webhook.handleGeneralError(errors.New(fmt.Sprintf("%v", r)))
+			}
+		}
+	}()
+
+	err := webhook.validateRunningState()
+	if err != nil {
+		webhook.Logger().Infof("%v is in %v state, Recieve did no-op", webhook.Id(), webhook.State())
+		return err
+	}
+
+	req, ok := data.(*base.WrappedMCRequest)
+	if !ok {
+		err = fmt.Errorf("Got data of unexpected type. data=%v", data)
+		webhook.handleGeneralError(err)
+		return err
+	}
+
+	atomic.AddUint32(&webhook.counter_received, 1)
+	atomic.AddInt32(&webhook.items_in_dataChan, 1)
+	atomic.AddInt64(&webhook.bytes_in_dataChan, int64(req.Req.Size()))
+
+	webhook.dataChan <- req
+
+	return nil
+}
+
+// batches requests in dataChan and posts the batches. a batch is posted when dataChan has been drained,
+// or when it reaches batch count or batch size
+func (webhook *WebhookNozzle) processData(finch chan bool, waitGrp *sync.WaitGroup) {
+	defer waitGrp.Done()
+
+	batch := make([]webhookItem, 0, webhook.config.maxCount)
+	batch_size := 0
+	for {
+		select {
+		case <-finch:
+			goto done
+		case req := <-webhook.dataChan:
+			atomic.AddInt32(&webhook.items_in_dataChan, -1)
+			atomic.AddInt64(&webhook.bytes_in_dataChan, int64(0-req.Req.Size()))
+
+			item, err := webhook.encode(req)
+			if err != nil {
+				webhook.handleGeneralError(err)
+				goto done
+			}
+			batch = append(batch, item)
+			batch_size += len(item.data)
+
+			if len(webhook.dataChan) == 0 || len(batch) >= webhook.config.maxCount || batch_size >= webhook.config.maxSize*1000 {
+				batch_start_time := time.Now()
+				err = webhook.send(batch, finch)
+				if err == ErrorWebhookNozzleStopped {
+					goto done
+				} else if err != nil {
+					webhook.handleGeneralError(err)
+					goto done
+				}
+				batch = batch[:0]
+				batch_size = 0
+				webhook.config.yieldAfterBatch(time.Since(batch_start_time), finch)
+			}
+		}
+	}
+done:
+	webhook.Logger().Infof("%v processData routine exits", webhook.Id())
+}
+
+// encodes the request into a json mutation, and recycles the request
+func (webhook *WebhookNozzle) encode(req *base.WrappedMCRequest) (webhookItem, error) {
+	defer webhook.recycleDataObj(req)
+
+	record, err := NewArchiveRecord(req)
+	if err != nil {
+		return webhookItem{}, err
+	}
+
+	mutation := &webhookMutation{Op: record.Op,
+		VBucket:  record.VBucket,
+		Seqno:    record.Seqno,
+		Key:      record.Key,
+		RevSeqno: record.RevSeqno,
+		Cas:      record.Cas,
+		Flags:    record.Flags,
+		Expiry:   record.Expiry,
+	}
+	if len(record.Body) > 0 {
+		if json.Valid(record.Body) {
+			mutation.Doc = json.RawMessage(record.Body)
+		} else {
+			mutation.Body = record.Body
+		}
+	}
+
+	// the mutation is marshaled before the request, whose body it shares, is recycled
+	data, err := json.Marshal(mutation)
+	if err != nil {
+		return webhookItem{}, err
+	}
+
+	return webhookItem{data: data,
+		start_time: req.Start_time,
+		additional: DataSentEventAdditional{Seqno: req.Seqno,
+			IsOptRepd:   false,
+			Opcode:      encodeOpCode(req.Req.Opcode),
+			IsExpirySet: record.Expiry != 0,
+			VBucket:     record.VBucket,
+			Req_size:    len(data),
+		},
+	}, nil
+}
+
+// posts the batch, retrying with exponential backoff up to maxRetry times, and raises DataSent events for its mutations once it is accepted.
+// returns an error if the batch is rejected with a permanent error or is not accepted after the last retry
+// returns ErrorWebhookNozzleStopped if the nozzle is stopped before the batch is accepted
+func (webhook *WebhookNozzle) send(batch []webhookItem, finch chan bool) error {
+	payload := &webhookPayload{Replication: webhook.topic,
+		Mutations: make([]json.RawMessage, len(batch))}
+	for index, item := range batch {
+		payload.Mutations[index] = json.RawMessage(item.data)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	retry_interval := webhook.config.retryInterval
+	var resp_wait_time time.Duration
+	for attempt := 0; ; attempt++ {
+		if webhook.bandwidth_throttler != nil {
+			throttled_time := webhook.bandwidth_throttler.Wait(len(body), finch)
+			atomic.AddInt64(&webhook.counter_throttled_time, int64(throttled_time))
+		}
+
+		post_time := time.Now()
+		err = webhook.post(body)
+		resp_wait_time = time.Since(post_time)
+		if err == nil {
+			break
+		}
+		if _, ok := err.(*webhookPermanentError); ok {
+			return err
+		}
+		if attempt >= webhook.config.maxRetry {
+			return fmt.Errorf("Failed to post %v mutations to webhook after %v retries. err=%v", len(batch), attempt, err)
+		}
+
+		webhook.Logger().Warnf("%v failed to post %v mutations to webhook. retrying in %v. err=%v\n", webhook.Id(), len(batch), retry_interval, err)
+		atomic.AddUint32(&webhook.counter_retried, 1)
+		select {
+		case <-finch:
+			return ErrorWebhookNozzleStopped
+		case <-time.After(retry_interval):
+		}
+		retry_interval *= 2
+		if retry_interval > webhook.config.maxRetryInterval {
+			retry_interval = webhook.config.maxRetryInterval
+		}
+	}
+
+	for _, item := range batch {
+		additional := item.additional
+		additional.Commit_time = time.Since(item.start_time)
+		additional.Resp_wait_time = resp_wait_time
+		webhook.RaiseEvent(common.NewEvent(common.DataSent, nil, webhook, nil, additional))
+	}
+	atomic.AddUint32(&webhook.counter_sent, uint32(len(batch)))
+	return nil
+}
+
+// posts body to webhook url. 2xx responses mean that the mutations have been accepted.
+// 3xx responses, which are not followed, and 4xx responses, other than request timeout and too many requests, are permanent errors
+func (webhook *WebhookNozzle) post(body []byte) error {
+	request, err := http.NewRequest(base.MethodPost, webhook.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set(base.ContentType, base.JsonContentType)
+	request.Header.Set(base.UserAgent, base.GoxdcrUserAgent)
+	if len(webhook.authHeader) > 0 {
+		request.Header.Set("Authorization", webhook.authHeader)
+	}
+
+	response, err := webhook.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		// drain the body so that the connection can be reused
+		io.Copy(ioutil.Discard, response.Body)
+		return nil
+	}
+
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	if response.StatusCode >= 300 && response.StatusCode < 400 {
+		return &webhookPermanentError{statusCode: response.StatusCode,
+			message: fmt.Sprintf("redirect to %v is not followed", response.Header.Get("Location"))}
+	}
+	if response.StatusCode >= 400 && response.StatusCode < 500 &&
+		response.StatusCode != http.StatusRequestTimeout && response.StatusCode != http.StatusTooManyRequests {
+		return &webhookPermanentError{statusCode: response.StatusCode, message: string(message)}
+	}
+	return fmt.Errorf("webhook returned status code %v. response=%v", response.StatusCode, string(message))
+}
+
+func (webhook *WebhookNozzle) onExit() {
+	//in the process of stopping, no need to report any error to replication manager anymore
+	webhook.disableHandleError()
+
+	//notify the sender routine
+	close(webhook.sender_finch)
+	close(webhook.selfMonitor_finch)
+	webhook.childrenWaitGrp.Wait()
+
+	// recycle requests left in dataChan
+	for {
+		select {
+		case req := <-webhook.dataChan:
+			webhook.recycleDataObj(req)
+		default:
+			return
+		}
+	}
+}
+
+func (webhook *WebhookNozzle) selfMonitor(finch chan bool, waitGrp *sync.WaitGroup) {
+	defer waitGrp.Done()
+	statsTicker := time.NewTicker(webhook.config.statsInterval)
+	defer statsTicker.Stop()
+	for {
+		select {
+		case <-finch:
+			goto done
+		case <-statsTicker.C:
+			webhook.RaiseEvent(common.NewEvent(common.StatsUpdate, nil, webhook, nil, []int{int(atomic.LoadInt32(&webhook.items_in_dataChan)), int(atomic.LoadInt64(&webhook.bytes_in_dataChan)),
+				int(time.Duration(atomic.LoadInt64(&webhook.counter_throttled_time)) / time.Millisecond)}))
+		}
+	}
+done:
+	webhook.Logger().Infof("%v selfMonitor routine exits", webhook.Id())
+}
+
+func (webhook *WebhookNozzle) validateRunningState() error {
+	state := webhook.State()
+	if state == common.Part_Stopping || state == common.Part_Stopped || state == common.Part_Error {
+		return PartStoppedError
+	}
+	return nil
+}
+
+func (webhook *WebhookNozzle) UpdateSettings(settings map[string]interface{}) error {
+	return webhook.updateBandwidthLimit(settings)
+}
+
+// sets the throttler that limits the bandwidth used by the nozzle. needs to be called before the nozzle is started
+func (webhook *WebhookNozzle) SetBandwidthThrottler(throttler *base.BandwidthThrottler) {
+	webhook.bandwidth_throttler = throttler
+}
+
+func (webhook *WebhookNozzle) updateBandwidthLimit(settings map[string]interface{}) error {
+	if bandwidthLimitObj, ok := settings[SETTING_BANDWIDTH_LIMIT]; ok && webhook.bandwidth_throttler != nil {
+		bandwidthLimit, ok := bandwidthLimitObj.(int)
+		if !ok {
+			return fmt.Errorf("Setting %v is of wrong type", SETTING_BANDWIDTH_LIMIT)
+		}
+		// the throttler is shared, hence the limit may have been updated by other nozzles already
+		if webhook.bandwidth_throttler.Limit() != bandwidthLimit {
+			webhook.bandwidth_throttler.SetLimit(bandwidthLimit)
+			webhook.Logger().Infof("%v updated bandwidth limit to %v\n", webhook.Id(), bandwidthLimit)
+		}
+	}
+	return nil
+}
+
+func (webhook *WebhookNozzle) URL() string {
+	return webhook.url
+}
+
+func (webhook *WebhookNozzle) StatusSummary() string {
+	return fmt.Sprintf("%v received %v items, posted %v items, retried %v posts", webhook.Id(), atomic.LoadUint32(&webhook.counter_received),
+		atomic.LoadUint32(&webhook.counter_sent), atomic.LoadUint32(&webhook.counter_retried))
+}
+
+func (webhook *WebhookNozzle) handleGeneralError(err error) {
+	if webhook.handleError() {
+		webhook.Logger().Errorf("%v raise error condition %v\n", webhook.Id(), err)
+		webhook.RaiseEvent(common.NewEvent(common.ErrorEncountered, nil, webhook, nil, err))
+	} else {
+		webhook.Logger().Debugf("%v in shutdown process, err=%v is ignored\n", webhook.Id(), err)
+	}
+}
+
+func (webhook *WebhookNozzle) recycleDataObj(req *base.WrappedMCRequest) {
+	if webhook.dataObj_recycler != nil {
+		webhook.dataObj_recycler(webhook.topic, req)
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	common "github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// records the posts received by a test webhook endpoint, and answers them with the given status codes in turn.
+// the last status code is used for all remaining posts
+type testWebhookServer struct {
+	*httptest.Server
+	statusCodes []int
+	// mutations in each post, including posts that have been rejected
+	posts [][]webhookMutation
+	// the number of DataSent events that had been raised when each post was received
+	eventsAtPost []int
+	authHeaders  []string
+	listener     *testDataSentListener
+	lock         sync.Mutex
+}
+
+func newTestWebhookServer(t *testing.T, listener *testDataSentListener, statusCodes ...int) *testWebhookServer {
+	server := &testWebhookServer{statusCodes: statusCodes, listener: listener}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := &webhookPayload{}
+		if err := json.NewDecoder(r.Body).Decode(payload); err != nil {
+			t.Errorf("failed to decode payload. err=%v", err)
+		}
+		mutations := make([]webhookMutation, len(payload.Mutations))
+		for index, data := range payload.Mutations {
+			if err := json.Unmarshal(data, &mutations[index]); err != nil {
+				t.Errorf("failed to decode mutation. err=%v", err)
+			}
+		}
+
+		server.lock.Lock()
+		server.posts = append(server.posts, mutations)
+		server.eventsAtPost = append(server.eventsAtPost, len(listener.sentSeqnos()))
+		server.authHeaders = append(server.authHeaders, r.Header.Get("Authorization"))
+		statusCode := server.statusCodes[0]
+		if len(server.statusCodes) > 1 {
+			server.statusCodes = server.statusCodes[1:]
+		}
+		server.lock.Unlock()
+
+		if statusCode >= 300 && statusCode < 400 {
+			w.Header().Set("Location", "/elsewhere")
+		}
+		w.WriteHeader(statusCode)
+	}))
+	return server
+}
+
+// the seqnos of the mutations in each post
+func (server *testWebhookServer) postedSeqnos() [][]uint64 {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	seqnos := make([][]uint64, 0, len(server.posts))
+	for _, mutations := range server.posts {
+		postSeqnos := make([]uint64, 0, len(mutations))
+		for _, mutation := range mutations {
+			postSeqnos = append(postSeqnos, mutation.Seqno)
+		}
+		seqnos = append(seqnos, postSeqnos)
+	}
+	return seqnos
+}
+
+type testDataSentListener struct {
+	seqnos []uint64
+	lock   sync.Mutex
+}
+
+func (listener *testDataSentListener) OnEvent(event *common.Event) {
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+	listener.seqnos = append(listener.seqnos, event.OtherInfos.(DataSentEventAdditional).Seqno)
+}
+
+func (listener *testDataSentListener) sentSeqnos() []uint64 {
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+	return append([]uint64{}, listener.seqnos...)
+}
+
+func newTestWebhookNozzle(t *testing.T, url string, batchCount int, listener *testDataSentListener) *WebhookNozzle {
+	webhook := NewWebhookNozzle("webhook_test", "test_topic", url, "Bearer secret", nil, log.DefaultLoggerContext)
+	webhook.RegisterComponentEventListener(common.DataSent, listener)
+	err := webhook.initialize(map[string]interface{}{SETTING_BATCHCOUNT: batchCount,
+		SETTING_BATCHSIZE: 1024,
+	})
+	if err != nil {
+		t.Fatalf("failed to initialize webhook nozzle. err=%v", err)
+	}
+	webhook.config.retryInterval = time.Millisecond
+	webhook.config.maxRetryInterval = 4 * time.Millisecond
+	return webhook
+}
+
+func newTestWebhookRequest(seqno uint64) *base.WrappedMCRequest {
+	extras := make([]byte, 24)
+	binary.BigEndian.PutUint64(extras[8:16], 1)
+	return &base.WrappedMCRequest{Seqno: seqno,
+		Req: &mc.MCRequest{Opcode: mc.UPR_MUTATION,
+			VBucket: 1,
+			Key:     []byte("key"),
+			Extras:  extras,
+			Body:    []byte(`{"a":1}`),
+		},
+		Start_time: time.Now(),
+	}
+}
+
+// queues requests with seqnos from 1 to numOfRequests, and then runs processData until all of them have been posted
+func processTestWebhookRequests(t *testing.T, webhook *WebhookNozzle, listener *testDataSentListener, numOfRequests int) {
+	for seqno := 1; seqno <= numOfRequests; seqno++ {
+		webhook.dataChan <- newTestWebhookRequest(uint64(seqno))
+	}
+
+	finch := make(chan bool)
+	waitGrp := &sync.WaitGroup{}
+	waitGrp.Add(1)
+	go webhook.processData(finch, waitGrp)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(listener.sentSeqnos()) < numOfRequests && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(finch)
+	waitGrp.Wait()
+}
+
+func expectedTestSeqnos(from, to uint64) []uint64 {
+	seqnos := make([]uint64, 0, to-from+1)
+	for seqno := from; seqno <= to; seqno++ {
+		seqnos = append(seqnos, seqno)
+	}
+	return seqnos
+}
+
+func TestWebhookNozzleBatching(t *testing.T) {
+	listener := &testDataSentListener{}
+	server := newTestWebhookServer(t, listener, http.StatusOK)
+	defer server.Close()
+
+	// queued requests are posted in batches of up to batch count
+	webhook := newTestWebhookNozzle(t, server.URL, 2, listener)
+	processTestWebhookRequests(t, webhook, listener, 5)
+
+	expected := [][]uint64{{1, 2}, {3, 4}, {5}}
+	if posted := server.postedSeqnos(); !reflect.DeepEqual(posted, expected) {
+		t.Errorf("expected posts %v, got %v", expected, posted)
+	}
+	if sent := listener.sentSeqnos(); !reflect.DeepEqual(sent, expectedTestSeqnos(1, 5)) {
+		t.Errorf("expected DataSent events in seqno order, got %v", sent)
+	}
+	for _, authHeader := range server.authHeaders {
+		if authHeader != "Bearer secret" {
+			t.Errorf("expected auth header to be sent, got %q", authHeader)
+		}
+	}
+}
+
+func TestWebhookNozzleRetriesWithBackoff(t *testing.T) {
+	listener := &testDataSentListener{}
+	server := newTestWebhookServer(t, listener, http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusOK)
+	defer server.Close()
+
+	webhook := newTestWebhookNozzle(t, server.URL, 10, listener)
+	processTestWebhookRequests(t, webhook, listener, 3)
+
+	// the same batch is posted until it is accepted, and DataSent events are raised only after that
+	expected := [][]uint64{{1, 2, 3}, {1, 2, 3}, {1, 2, 3}}
+	if posted := server.postedSeqnos(); !reflect.DeepEqual(posted, expected) {
+		t.Errorf("expected posts %v, got %v", expected, posted)
+	}
+	if !reflect.DeepEqual(server.eventsAtPost, []int{0, 0, 0}) {
+		t.Errorf("expected no DataSent events before the batch is accepted, got %v", server.eventsAtPost)
+	}
+	if sent := listener.sentSeqnos(); !reflect.DeepEqual(sent, expectedTestSeqnos(1, 3)) {
+		t.Errorf("expected DataSent events in seqno order, got %v", sent)
+	}
+	if webhook.counter_retried != 2 {
+		t.Errorf("expected 2 retries, got %v", webhook.counter_retried)
+	}
+}
+
+func TestWebhookNozzleGivesUpAfterMaxRetry(t *testing.T) {
+	listener := &testDataSentListener{}
+	server := newTestWebhookServer(t, listener, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	webhook := newTestWebhookNozzle(t, server.URL, 10, listener)
+	webhook.config.maxRetry = 2
+	err := webhook.send([]webhookItem{{data: []byte(`{}`)}}, make(chan bool))
+	if err == nil {
+		t.Fatalf("expected error once retries are exhausted")
+	}
+	if posts := len(server.postedSeqnos()); posts != 3 {
+		t.Errorf("expected 3 posts, got %v", posts)
+	}
+	if sent := listener.sentSeqnos(); len(sent) != 0 {
+		t.Errorf("expected no DataSent events, got %v", sent)
+	}
+}
+
+func TestWebhookNozzlePermanentErrors(t *testing.T) {
+	// redirects are not followed, and are not retried either
+	for _, statusCode := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusFound, http.StatusTemporaryRedirect} {
+		listener := &testDataSentListener{}
+		server := newTestWebhookServer(t, listener, statusCode, http.StatusOK)
+
+		webhook := newTestWebhookNozzle(t, server.URL, 10, listener)
+		err := webhook.send([]webhookItem{{data: []byte(`{}`)}}, make(chan bool))
+		if permanentErr, ok := err.(*webhookPermanentError); !ok || permanentErr.statusCode != statusCode {
+			t.Errorf("expected permanent error for status code %v, got %v", statusCode, err)
+		}
+		if posts := len(server.postedSeqnos()); posts != 1 {
+			t.Errorf("expected 1 post for status code %v, got %v", statusCode, posts)
+		}
+		if sent := listener.sentSeqnos(); len(sent) != 0 {
+			t.Errorf("expected no DataSent events for status code %v, got %v", statusCode, sent)
+		}
+		server.Close()
+	}
+}
+
+func TestWebhookNozzleStopsRetryingOnFinch(t *testing.T) {
+	listener := &testDataSentListener{}
+	server := newTestWebhookServer(t, listener, http.StatusInternalServerError)
+	defer server.Close()
+
+	webhook := newTestWebhookNozzle(t, server.URL, 10, listener)
+	webhook.config.retryInterval = time.Minute
+	finch := make(chan bool)
+	close(finch)
+	if err := webhook.send([]webhookItem{{data: []byte(`{}`)}}, finch); err != ErrorWebhookNozzleStopped {
+		t.Errorf("expected ErrorWebhookNozzleStopped, got %v", err)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/metadata"
 	"github.com/couchbase/goxdcr/utils"
+	"github.com/golang/snappy"
 	"io"
 	"math"
 	"math/rand"
@@ -45,6 +46,8 @@ const (
 	XMEM_SETTING_REMOTE_PROXY_PORT   = "remote_proxy_port"
 	XMEM_SETTING_LOCAL_PROXY_PORT    = "local_proxy_port"
 	XMEM_SETTING_REMOTE_MEM_SSL_PORT = "remote_ssl_port"
+	XMEM_SETTING_COMPRESSION_TYPE    = "compression_type"
+	XMEM_SETTING_DEDUP_IN_BATCH      = "dedup_in_batch"
 
 	//default configuration
 	default_numofretry int = 5
@@ -83,6 +86,12 @@ var xmem_setting_defs base.SettingDefinitions = base.SettingDefinitions{SETTING_
 	XMEM_SETTING_CERTIFICATE:        base.NewSettingDef(reflect.TypeOf((*[]byte)(nil)), false),
 	XMEM_SETTING_SAN_IN_CERITICATE:  base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
 	XMEM_SETTING_INSECURESKIPVERIFY: base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
+	XMEM_SETTING_COMPRESSION_TYPE:   base.NewSettingDef(reflect.TypeOf((*string)(nil)), false),
+	SETTING_BANDWIDTH_LIMIT:         base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	SETTING_PRIORITY:                base.NewSettingDef(reflect.TypeOf((*string)(nil)), false),
+	XMEM_SETTING_DEDUP_IN_BATCH:     base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
+	SETTING_CONFLICT_LOGGING:        base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
+	SETTING_CONFLICT_LOG_BODIES:     base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
 
 	//only used for xmem over ssl via ns_proxy for 2.5
 	XMEM_SETTING_REMOTE_PROXY_PORT: base.NewSettingDef(reflect.TypeOf((*uint16)(nil)), false),
@@ -90,8 +99,6 @@ var xmem_setting_defs base.SettingDefinitions = base.SettingDefinitions{SETTING_
 
 var UninitializedReseverationNumber = -1
 
-type ConflictResolver func(doc_metadata_source documentMetadata, doc_metadata_target documentMetadata, source_cr_mode base.ConflictResolutionMode, logger *log.CommonLogger) bool
-
 var GetMetaClientName = "client_getMeta"
 var SetMetaClientName = "client_setMeta"
 
@@ -442,7 +449,20 @@ type xmemConfig struct {
 	san_in_certificate bool
 	respTimeout        unsafe.Pointer // *time.Duration
 	max_read_downtime  time.Duration
-	logger             *log.CommonLogger
+	// metadata.CompressionTypeNone or metadata.CompressionTypeSnappy
+	compressionType string
+	// 1 if only the newest version of each document in a batch is sent, 0 otherwise.
+	// applies to batches created after it is set
+	dedupInBatch uint32
+	logger       *log.CommonLogger
+}
+
+func (config *xmemConfig) setDedupInBatch(dedupInBatch bool) {
+	var val uint32 = 0
+	if dedupInBatch {
+		val = 1
+	}
+	atomic.StoreUint32(&config.dedupInBatch, val)
 }
 
 func newConfig(logger *log.CommonLogger) xmemConfig {
@@ -465,6 +485,7 @@ func newConfig(logger *log.CommonLogger) xmemConfig {
 		local_proxy_port:   0,
 		max_read_downtime:  default_max_read_downtime,
 		memcached_ssl_port: 0,
+		compressionType:    metadata.CompressionTypeNone,
 		logger:             logger,
 	}
 
@@ -481,6 +502,12 @@ func (config *xmemConfig) initializeConfig(settings map[string]interface{}) erro
 
 	if err == nil {
 		config.baseConfig.initializeConfig(settings)
+		if val, ok := settings[XMEM_SETTING_COMPRESSION_TYPE]; ok {
+			config.compressionType = val.(string)
+		}
+		if val, ok := settings[XMEM_SETTING_DEDUP_IN_BATCH]; ok {
+			config.setDedupInBatch(val.(bool))
+		}
 		if val, ok := settings[XMEM_SETTING_DEMAND_ENCRYPTION]; ok {
 			config.demandEncryption = val.(bool)
 		}
@@ -784,6 +811,20 @@ type XmemNozzle struct {
 
 	getMetaUserAgent string
 	setMetaUserAgent string
+
+	// 1 if snappy has been negotiated on the setMeta connection, 0 otherwise
+	snappy_enabled uint32
+	// total size of SetWithMeta bodies before and after compression. bodies are counted only when snappy is enabled
+	counter_bytes_before_compression uint64
+	counter_bytes_after_compression  uint64
+
+	// limits the bandwidth used by writes to target. shared by the outgoing nozzles of the replication
+	bandwidth_throttler *base.BandwidthThrottler
+	// total time, in nanoseconds, that writes have been delayed by bandwidth_throttler
+	counter_throttled_time int64
+
+	// keeps the documents rejected by target with permanent errors. shared by the outgoing nozzles of the replication
+	dead_letter_queue *base.DeadLetterQueue
 }
 
 func NewXmemNozzle(id string,
@@ -835,7 +876,7 @@ func NewXmemNozzle(id string,
 	atomic.StorePointer(&xmem.last_ten_batches_size, unsafe.Pointer(&initial_last_ten_batches_size))
 
 	//set conflict resolver
-	xmem.conflict_resolver = resolveConflict
+	xmem.conflict_resolver = &defaultConflictResolver{source_cr_mode: source_cr_mode}
 
 	xmem.config.connectStr = connectString
 	xmem.config.bucketName = targetBucketName
@@ -892,6 +933,7 @@ func (xmem *XmemNozzle) Start(settings map[string]interface{}) error {
 	if err != nil {
 		return err
 	}
+	xmem.config.registerRunningNozzle(xmem.Id())
 	xmem.Logger().Infof("%v finished initializing.", xmem.Id())
 	xmem.childrenWaitGrp.Add(1)
 	go xmem.selfMonitor(xmem.finish_ch, &xmem.childrenWaitGrp)
@@ -915,6 +957,7 @@ func (xmem *XmemNozzle) Start(settings map[string]interface{}) error {
 
 func (xmem *XmemNozzle) Stop() error {
 	xmem.Logger().Infof("Stopping %v\n", xmem.Id())
+	unregisterRunningNozzle(xmem.Id())
 	err := xmem.SetState(common.Part_Stopping)
 	if err != nil {
 		return err
@@ -1073,12 +1116,14 @@ func (xmem *XmemNozzle) processData_sendbatch(finch chan bool, waitGrp *sync.Wai
 				goto done
 			}
 
+			batch_start_time := time.Now()
 			//batch get meta to find what need to be sent
-			bigDoc_noRep_map, err := xmem.batchGetMeta(batch.bigDoc_map)
+			bigDoc_noRep_map, conflict_map, err := xmem.batchGetMeta(batch.bigDoc_map)
 			if err != nil {
 				xmem.Logger().Errorf("%v batchGetMeta failed. err=%v\n", xmem.Id(), err)
 			} else {
 				batch.bigDoc_noRep_map = bigDoc_noRep_map
+				batch.conflict_map = conflict_map
 			}
 
 			err = xmem.processBatch(batch)
@@ -1090,6 +1135,7 @@ func (xmem *XmemNozzle) processData_sendbatch(finch chan bool, waitGrp *sync.Wai
 				xmem.handleGeneralError(err)
 			}
 			xmem.recordBatchSize(batch.count())
+			xmem.config.yieldAfterBatch(time.Since(batch_start_time), finch)
 		case <-xmem.getBatchNonEmptyCh():
 			if xmem.validateRunningState() != nil {
 				xmem.Logger().Infof("%v has stopped.", xmem.Id())
@@ -1178,9 +1224,23 @@ func (xmem *XmemNozzle) batchSetMetaWithRetry(batch *dataBatch, numOfRetry int)
 
 		if item != nil {
 			atomic.AddUint32(&xmem.counter_waittime, uint32(time.Since(item.Start_time).Seconds()*1000))
+			if batch.isSuperseded(item) {
+				// a newer version of the document is in the same batch and will be sent in place of this one.
+				// the seqno of this version is reported so that checkpoints can still advance
+				additionalInfo := DataDeduplicatedEventAdditional{Seqno: item.Seqno,
+					VBucket: item.SrcVBucket,
+				}
+				xmem.RaiseEvent(common.NewEvent(common.DataDeduplicated, nil, xmem, nil, additionalInfo))
+				xmem.recycleDataObj(item)
+				continue
+			}
+
 			needSend := needSend(item, batch, xmem.Logger())
 			if needSend == Send {
 
+				xmem.compressRequest(item)
+				xmem.skipTargetConflictResolution(item)
+
 				//blocking
 				index, reserv_num, item_bytes := xmem.buf.enSlot(item)
 
@@ -1216,7 +1276,8 @@ func (xmem *XmemNozzle) batchSetMetaWithRetry(batch *dataBatch, numOfRetry int)
 					additionalInfo := DataFailedCRSourceEventAdditional{Seqno: item.Seqno,
 						Opcode:      encodeOpCode(item.Req.Opcode),
 						IsExpirySet: (binary.BigEndian.Uint32(item.Req.Extras[4:8]) != 0),
-						VBucket:     item.Req.VBucket,
+						VBucket:     item.SrcVBucket,
+						Conflict:    batch.conflict_map[item.UniqueKey],
 					}
 					xmem.RaiseEvent(common.NewEvent(common.DataFailedCRSource, nil, xmem, nil, additionalInfo))
 				}
@@ -1331,16 +1392,9 @@ func (xmem *XmemNozzle) sendSetMeta_internal(batch *dataBatch) error {
 	return err
 }
 
-//batch call to memcached GetMeta command for document size larger than the optimistic threshold
-func (xmem *XmemNozzle) batchGetMeta(bigDoc_map map[string]*base.WrappedMCRequest) (map[string]bool, error) {
-	bigDoc_noRep_map := make(map[string]bool)
-
-	//if the bigDoc_map size is 0, return
-	if len(bigDoc_map) == 0 {
-		return bigDoc_noRep_map, nil
-	}
-
-	xmem.Logger().Debugf("%v GetMeta for %v documents\n", xmem.Id(), len(bigDoc_map))
+// sends GET_WITH_META requests, or GET requests when withBody is true, to target for the documents in bigDoc_map.
+// returns the responses received. key of the map is the document key
+func (xmem *XmemNozzle) sendGetRequests(bigDoc_map map[string]*base.WrappedMCRequest, withBody bool) (map[string]*mc.MCResponse, error) {
 	respMap := make(map[string]*mc.MCResponse, xmem.config.maxCount)
 	opaque_keySeqno_map := make(map[uint32][]interface{})
 	receiver_fin_ch := make(chan bool, 1)
@@ -1364,7 +1418,12 @@ func (xmem *XmemNozzle) batchGetMeta(bigDoc_map map[string]*base.WrappedMCReques
 		}
 
 		if _, ok := sent_key_map[docKey]; !ok {
-			req := xmem.composeRequestForGetMeta(docKey, originalReq.Req.VBucket, opaque)
+			var req *mc.MCRequest
+			if withBody {
+				req = xmem.composeRequestForGet(docKey, originalReq.Req.VBucket, opaque)
+			} else {
+				req = xmem.composeRequestForGetMeta(docKey, originalReq.Req.VBucket, opaque)
+			}
 			reqs_bytes = append(reqs_bytes, req.Bytes()...)
 			opaque_keySeqno_map[opaque] = []interface{}{docKey, originalReq.Seqno, originalReq.Req.VBucket, time.Now()}
 			opaque++
@@ -1508,17 +1567,49 @@ func (xmem *XmemNozzle) batchGetMeta(bigDoc_map map[string]*base.WrappedMCReques
 	//wait for receiver to finish
 	<-receiver_return_ch
 
+	return respMap, nil
+}
+
+//batch call to memcached GetMeta command for document size larger than the optimistic threshold
+func (xmem *XmemNozzle) batchGetMeta(bigDoc_map map[string]*base.WrappedMCRequest) (map[string]bool, map[string]*ConflictRecord, error) {
+	bigDoc_noRep_map := make(map[string]bool)
+	var conflict_map map[string]*ConflictRecord
+	if xmem.config.conflictLogging {
+		conflict_map = make(map[string]*ConflictRecord)
+	}
+
+	//if the bigDoc_map size is 0, return
+	if len(bigDoc_map) == 0 {
+		return bigDoc_noRep_map, conflict_map, nil
+	}
+
+	xmem.Logger().Debugf("%v GetMeta for %v documents\n", xmem.Id(), len(bigDoc_map))
+	// conflict resolvers that look into document bodies need the target documents themselves rather than their metadata
+	withBody := xmem.conflict_resolver.LookupMode() == LookupAllDocsWithBody
+	respMap, err := xmem.sendGetRequests(bigDoc_map, withBody)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	for _, wrappedReq := range bigDoc_map {
 		key := string(wrappedReq.Req.Key)
 		resp, ok := respMap[key]
 		if ok && resp.Status == mc.SUCCESS {
-			doc_meta_target := xmem.decodeGetMetaResp([]byte(key), resp)
+			var doc_meta_target documentMetadata
+			if withBody {
+				doc_meta_target = xmem.decodeGetResp([]byte(key), resp)
+			} else {
+				doc_meta_target = xmem.decodeGetMetaResp([]byte(key), resp)
+			}
 			doc_meta_source := decodeSetMetaReq(wrappedReq)
-			if !xmem.conflict_resolver(doc_meta_source, doc_meta_target, xmem.source_cr_mode, xmem.Logger()) {
+			if !xmem.conflict_resolver.Resolve(doc_meta_source, doc_meta_target, xmem.Logger()) {
 				if xmem.Logger().GetLogLevel() >= log.LogLevelDebug {
 					xmem.Logger().Debugf("%v doc %v failed source side conflict resolution. source meta=%v, target meta=%v. no need to send\n", xmem.Id(), key, doc_meta_source, doc_meta_target)
 				}
 				bigDoc_noRep_map[wrappedReq.UniqueKey] = true
+				if conflict_map != nil {
+					conflict_map[wrappedReq.UniqueKey] = newConflictRecord(wrappedReq, doc_meta_source, &doc_meta_target, xmem.config.conflictLogBodies)
+				}
 			} else if xmem.Logger().GetLogLevel() >= log.LogLevelDebug {
 				xmem.Logger().Debugf("%v doc %v succeeded source side conflict resolution. source meta=%v, target meta=%v. sending it to target\n", xmem.Id(), key, doc_meta_source, doc_meta_target)
 			}
@@ -1535,8 +1626,38 @@ func (xmem *XmemNozzle) batchGetMeta(bigDoc_map map[string]*base.WrappedMCReques
 		}
 	}
 
+	if xmem.config.conflictLogBodies && !withBody && len(conflict_map) > 0 {
+		xmem.getTargetBodiesForConflicts(bigDoc_map, conflict_map)
+	}
+
 	xmem.Logger().Debugf("%v Done with batchGetMeta, bigDoc_noRep_map=%v\n", xmem.Id(), bigDoc_noRep_map)
-	return bigDoc_noRep_map, nil
+	return bigDoc_noRep_map, conflict_map, nil
+}
+
+// GET_WITH_META responses do not carry document bodies. gets the bodies of the target documents in conflict_map
+// when they are to be recorded. failures are not fatal, the conflicts are recorded without target bodies
+func (xmem *XmemNozzle) getTargetBodiesForConflicts(bigDoc_map map[string]*base.WrappedMCRequest, conflict_map map[string]*ConflictRecord) {
+	conflictDoc_map := make(map[string]*base.WrappedMCRequest)
+	for uniqueKey, _ := range conflict_map {
+		if wrappedReq, ok := bigDoc_map[uniqueKey]; ok {
+			conflictDoc_map[uniqueKey] = wrappedReq
+		}
+	}
+
+	respMap, err := xmem.sendGetRequests(conflictDoc_map, true)
+	if err != nil {
+		xmem.Logger().Warnf("%v failed to get target bodies for conflict records. err=%v\n", xmem.Id(), err)
+		return
+	}
+	for uniqueKey, wrappedReq := range conflictDoc_map {
+		resp, ok := respMap[string(wrappedReq.Req.Key)]
+		record := conflict_map[uniqueKey]
+		if ok && resp.Status == mc.SUCCESS && record.Target != nil && record.Target.Cas == resp.Cas {
+			// the target document may have been changed since its metadata was retrieved, in which case
+			// its body does not belong to the version recorded
+			record.Target.setBody(resp.Body)
+		}
+	}
 }
 
 func (xmem *XmemNozzle) decodeGetMetaResp(key []byte, resp *mc.MCResponse) documentMetadata {
@@ -1553,6 +1674,26 @@ func (xmem *XmemNozzle) decodeGetMetaResp(key []byte, resp *mc.MCResponse) docum
 
 }
 
+// GET response carries cas and flags of the document in addition to its body, but not the other metadata
+func (xmem *XmemNozzle) decodeGetResp(key []byte, resp *mc.MCResponse) documentMetadata {
+	ret := documentMetadata{}
+	ret.key = key
+	if len(resp.Extras) >= 4 {
+		ret.flags = binary.BigEndian.Uint32(resp.Extras[0:4])
+	}
+	ret.cas = resp.Cas
+	ret.body = resp.Body
+
+	return ret
+}
+
+func (xmem *XmemNozzle) composeRequestForGet(key string, vb uint16, opaque uint32) *mc.MCRequest {
+	return &mc.MCRequest{VBucket: vb,
+		Key:    []byte(key),
+		Opaque: opaque,
+		Opcode: mc.GET}
+}
+
 func (xmem *XmemNozzle) composeRequestForGetMeta(key string, vb uint16, opaque uint32) *mc.MCRequest {
 	return &mc.MCRequest{VBucket: vb,
 		Key:    []byte(key),
@@ -1560,6 +1701,46 @@ func (xmem *XmemNozzle) composeRequestForGetMeta(key string, vb uint16, opaque u
 		Opcode: base.GET_WITH_META}
 }
 
+// compresses the body of a SetWithMeta request with snappy if snappy has been negotiated with target.
+// the compressed body is kept only when it is smaller than the original body.
+// the original body is never modified, since it may be shared with the source event
+func (xmem *XmemNozzle) compressRequest(item *base.WrappedMCRequest) {
+	req := item.Req
+	if atomic.LoadUint32(&xmem.snappy_enabled) == 0 || req.Opcode != mc.UPR_MUTATION ||
+		len(req.Body) == 0 || req.DataType&base.SnappyDataType != 0 {
+		return
+	}
+
+	atomic.AddUint64(&xmem.counter_bytes_before_compression, uint64(len(req.Body)))
+	compressedBody := snappy.Encode(nil, req.Body)
+	if len(compressedBody) < len(req.Body) {
+		req.Body = compressedBody
+		req.DataType |= base.SnappyDataType
+	}
+	atomic.AddUint64(&xmem.counter_bytes_after_compression, uint64(len(req.Body)))
+}
+
+// when the conflict resolver has the final say on which version wins, asks target to skip its own
+// conflict resolution and accept the request. the options field is appended to extras when absent.
+// docs re-driven from dead-letter queue, which have 0 seqnos, are resolved by target as usual,
+// since newer versions of them may have reached target after they were dead-lettered
+func (xmem *XmemNozzle) skipTargetConflictResolution(item *base.WrappedMCRequest) {
+	if !xmem.conflict_resolver.SkipTargetResolution() || item.Seqno == 0 {
+		return
+	}
+	req := item.Req
+	if req.Opcode != mc.UPR_MUTATION && req.Opcode != mc.UPR_DELETION && req.Opcode != mc.UPR_EXPIRATION {
+		return
+	}
+	if len(req.Extras) == 24 {
+		req.Extras = append(req.Extras, 0, 0, 0, 0)
+	} else if len(req.Extras) != 28 {
+		return
+	}
+	options := binary.BigEndian.Uint32(req.Extras[24:28])
+	binary.BigEndian.PutUint32(req.Extras[24:28], options|base.SKIP_CONFLICT_RESOLUTION_FLAG)
+}
+
 func (xmem *XmemNozzle) sendSingleSetMeta(adjustRequest bool, item *base.WrappedMCRequest, index uint16, numOfRetry int) error {
 	var err error
 	if xmem.client_for_setMeta != nil {
@@ -1676,6 +1857,9 @@ func (xmem *XmemNozzle) getPoolName() string {
 func (xmem *XmemNozzle) initNewBatch() {
 	xmem.Logger().Debugf("%v initializing a new batch", xmem.Id())
 	xmem.batch = newBatch(uint32(xmem.config.maxCount), uint32(xmem.config.maxSize), xmem.Logger())
+	if atomic.LoadUint32(&xmem.config.dedupInBatch) == 1 {
+		xmem.batch.enableDedup()
+	}
 	atomic.StoreUint32(&xmem.cur_batch_count, 0)
 }
 
@@ -1684,7 +1868,7 @@ func (xmem *XmemNozzle) initialize(settings map[string]interface{}) error {
 	if err != nil {
 		return err
 	}
-	xmem.dataChan = make(chan *base.WrappedMCRequest, xmem.config.maxCount*10)
+	xmem.dataChan = make(chan *base.WrappedMCRequest, xmem.config.dataChanSize(xmem.config.maxCount*10))
 	xmem.bytes_in_dataChan = 0
 	xmem.dataChan_control = make(chan bool, 1)
 	xmem.dataChan_control <- true
@@ -1785,6 +1969,9 @@ func (xmem *XmemNozzle) receiveResponse(finch chan bool, waitGrp *sync.WaitGroup
 								// make GOXDCR exhibit the same behavior as that of 3.x XDCR -> log the error and resend the doc
 								xmem.Logger().Errorf("%v received KEY_ENOENT error from setMeta client. response status=%v, opcode=%v, seqno=%v, req.Key=%v, req.Cas=%v, req.Extras=%v\n", xmem.Id(), response.Status, response.Opcode, seqno, string(req.Key), req.Cas, req.Extras)
 								_, err = xmem.buf.modSlot(pos, xmem.resendWithReset)
+							} else if isPermanentMCError(response.Status) && xmem.dead_letter_queue != nil {
+								// retrying the doc would get the same error. move it to dead-letter queue and move on
+								xmem.deadLetter(pos, wrappedReq, response.Status)
 							} else {
 								// for other non-temporary errors, repair connections
 								xmem.Logger().Errorf("%v received error response from setMeta client. Repairing connection. response status=%v, opcode=%v, seqno=%v, req.Key=%v, req.Cas=%v, req.Extras=%v\n", xmem.Id(), response.Status, response.Opcode, seqno, string(req.Key), req.Cas, req.Extras)
@@ -1808,11 +1995,13 @@ func (xmem *XmemNozzle) receiveResponse(finch chan bool, waitGrp *sync.WaitGroup
 				}
 				var req *mc.MCRequest
 				var seqno uint64
+				var srcVBucket uint16
 				var committing_time time.Duration
 				var resp_wait_time time.Duration
 				if wrappedReq != nil {
 					req = wrappedReq.Req
 					seqno = wrappedReq.Seqno
+					srcVBucket = wrappedReq.SrcVBucket
 					committing_time = time.Since(wrappedReq.Start_time)
 					resp_wait_time = time.Since(*sent_time)
 				}
@@ -1822,7 +2011,7 @@ func (xmem *XmemNozzle) receiveResponse(finch chan bool, waitGrp *sync.WaitGroup
 						IsOptRepd:      xmem.optimisticRep(req),
 						Opcode:         req.Opcode,
 						IsExpirySet:    (binary.BigEndian.Uint32(req.Extras[4:8]) != 0),
-						VBucket:        req.VBucket,
+						VBucket:        srcVBucket,
 						Req_size:       req.Size(),
 						Commit_time:    committing_time,
 						Resp_wait_time: resp_wait_time,
@@ -1855,6 +2044,26 @@ done:
 	xmem.Logger().Infof("%v receiveResponse exits\n", xmem.Id())
 }
 
+func (xmem *XmemNozzle) deadLetter(pos uint16, wrappedReq *base.WrappedMCRequest, status mc.Status) {
+	req := wrappedReq.Req
+	letter, dropped := xmem.dead_letter_queue.Add(req, wrappedReq.SrcVBucket, wrappedReq.Seqno, status)
+	xmem.Logger().Errorf("%v moved doc to dead-letter queue since target rejected it with permanent error. status=%v, id=%v, seqno=%v, vb=%v, req.Key=%v, req.Size=%v\n", xmem.Id(), status, letter.Id, wrappedReq.Seqno, wrappedReq.SrcVBucket, string(req.Key), req.Size())
+	if dropped != nil {
+		xmem.Logger().Warnf("%v dropped the oldest doc from full dead-letter queue. id=%v, vb=%v, key=%v\n", xmem.Id(), dropped.Id, dropped.VBucket, dropped.Key)
+	}
+
+	additionalInfo := DataDeadLetteredEventAdditional{Seqno: wrappedReq.Seqno,
+		VBucket: wrappedReq.SrcVBucket,
+		Status:  status,
+	}
+	xmem.RaiseEvent(common.NewEvent(common.DataDeadLettered, nil, xmem, nil, additionalInfo))
+
+	if xmem.buf.evictSlot(pos) != nil {
+		panic(fmt.Sprintf("Failed to evict slot %d\n", pos))
+	}
+	xmem.recycleDataObj(wrappedReq)
+}
+
 func (xmem *XmemNozzle) handleVBError(vbno uint16, err error) {
 	additionalInfo := &base.VBErrorEventAdditional{vbno, err, base.VBErrorType_Target}
 	xmem.RaiseEvent(common.NewEvent(common.VBErrorEncountered, nil, xmem, nil, additionalInfo))
@@ -1919,6 +2128,23 @@ func isTemporaryMCError(resp_status mc.Status) bool {
 	}
 }
 
+// check if memcached response status indicates error of permanent nature, in which case retrying
+// corresponding requests would get the same error
+func isPermanentMCError(resp_status mc.Status) bool {
+	switch resp_status {
+	case mc.E2BIG:
+		fallthrough
+	case mc.EINVAL:
+		fallthrough
+	case mc.NOT_STORED:
+		fallthrough
+	case mc.ERANGE:
+		return true
+	default:
+		return false
+	}
+}
+
 // check if memcached response status indicates ignorable error, which requires no corrective action at all
 func isIgnorableMCError(resp_status mc.Status) bool {
 	switch resp_status {
@@ -2019,7 +2245,9 @@ func (xmem *XmemNozzle) selfMonitor(finch chan bool, waitGrp *sync.WaitGroup) {
 				goto done
 			}
 		case <-statsTicker.C:
-			xmem.RaiseEvent(common.NewEvent(common.StatsUpdate, nil, xmem, nil, []int{len(xmem.dataChan), xmem.bytesInDataChan()}))
+			xmem.RaiseEvent(common.NewEvent(common.StatsUpdate, nil, xmem, nil, []int{len(xmem.dataChan), xmem.bytesInDataChan(),
+				int(time.Duration(atomic.LoadInt64(&xmem.counter_throttled_time)) / time.Millisecond),
+				int(atomic.LoadUint64(&xmem.counter_bytes_before_compression)), int(atomic.LoadUint64(&xmem.counter_bytes_after_compression))}))
 		}
 	}
 done:
@@ -2177,6 +2405,12 @@ func (xmem *XmemNozzle) handleGeneralError(err error) {
 }
 
 func (xmem *XmemNozzle) optimisticRep(req *mc.MCRequest) bool {
+	switch xmem.conflict_resolver.LookupMode() {
+	case LookupNone:
+		return true
+	case LookupAllDocs, LookupAllDocsWithBody:
+		return false
+	}
 	if req != nil {
 		return uint32(req.Size()) < xmem.getOptiRepThreshold()
 	}
@@ -2186,7 +2420,24 @@ func (xmem *XmemNozzle) optimisticRep(req *mc.MCRequest) bool {
 // ignore errors around HELO command since they are not critical to replication
 func (xmem *XmemNozzle) sendHELO(setMeta bool) {
 	if setMeta {
-		utils.SendHELO(xmem.client_for_setMeta.getMemClient(), xmem.setMetaUserAgent, xmem.config.readTimeout, xmem.config.writeTimeout, xmem.Logger())
+		// only setMeta connection sends document bodies and needs compression
+		var features []uint16
+		if xmem.config.compressionType == metadata.CompressionTypeSnappy {
+			features = append(features, base.HELOFeatureSnappy)
+		}
+		enabledFeatures := utils.SendHELOWithFeatures(xmem.client_for_setMeta.getMemClient(), xmem.setMetaUserAgent, xmem.config.readTimeout, xmem.config.writeTimeout, features, xmem.Logger())
+		if len(features) == 0 {
+			return
+		}
+		for _, feature := range enabledFeatures {
+			if feature == base.HELOFeatureSnappy {
+				atomic.StoreUint32(&xmem.snappy_enabled, 1)
+				xmem.Logger().Infof("%v snappy compression has been enabled\n", xmem.Id())
+				return
+			}
+		}
+		atomic.StoreUint32(&xmem.snappy_enabled, 0)
+		xmem.Logger().Warnf("%v target does not support snappy compression. documents will be sent uncompressed\n", xmem.Id())
 	} else {
 		utils.SendHELO(xmem.client_for_getMeta.getMemClient(), xmem.getMetaUserAgent, xmem.config.readTimeout, xmem.config.writeTimeout, xmem.Logger())
 	}
@@ -2239,6 +2490,12 @@ func (xmem *XmemNozzle) writeToClient(client *xmemClient, bytes []byte, renewTim
 		time.Sleep(time.Duration(backoffFactor) * default_backoff_wait_time)
 	}
 
+	// throttle before getting connection so that the time spent waiting does not count towards write timeout
+	if xmem.bandwidth_throttler != nil {
+		throttled_time := xmem.bandwidth_throttler.Wait(len(bytes), xmem.finish_ch)
+		atomic.AddInt64(&xmem.counter_throttled_time, int64(throttled_time))
+	}
+
 	conn, rev, err := xmem.getConn(client, false, renewTimeout)
 	if err != nil {
 		return err, rev
@@ -2389,11 +2646,51 @@ func (xmem *XmemNozzle) UpdateSettings(settings map[string]interface{}) error {
 		return err
 	}
 	atomic.StoreUint32(&xmem.config.optiRepThreshold, uint32(optimisticReplicationThreshold))
+
+	if dedupInBatchObj, ok := settings[XMEM_SETTING_DEDUP_IN_BATCH]; ok {
+		dedupInBatch, ok := dedupInBatchObj.(bool)
+		if !ok {
+			return fmt.Errorf("Setting %v is of wrong type", XMEM_SETTING_DEDUP_IN_BATCH)
+		}
+		xmem.config.setDedupInBatch(dedupInBatch)
+	}
+
+	return xmem.updateBandwidthLimit(settings)
+}
+
+// sets the conflict resolver, which needs to be done before the nozzle is started
+func (xmem *XmemNozzle) SetConflictResolver(resolver ConflictResolver) {
+	xmem.conflict_resolver = resolver
+}
+
+// sets the throttler that limits the bandwidth used by the nozzle. needs to be called before the nozzle is started
+func (xmem *XmemNozzle) SetBandwidthThrottler(throttler *base.BandwidthThrottler) {
+	xmem.bandwidth_throttler = throttler
+}
+
+// sets the dead-letter queue for the documents rejected by target with permanent errors.
+// needs to be called before the nozzle is started. without the queue, such errors lead to connection repairs
+func (xmem *XmemNozzle) SetDeadLetterQueue(queue *base.DeadLetterQueue) {
+	xmem.dead_letter_queue = queue
+}
+
+func (xmem *XmemNozzle) updateBandwidthLimit(settings map[string]interface{}) error {
+	if bandwidthLimitObj, ok := settings[SETTING_BANDWIDTH_LIMIT]; ok && xmem.bandwidth_throttler != nil {
+		bandwidthLimit, ok := bandwidthLimitObj.(int)
+		if !ok {
+			return fmt.Errorf("Setting %v is of wrong type", SETTING_BANDWIDTH_LIMIT)
+		}
+		// the throttler is shared, hence the limit may have been updated by other nozzles already
+		if xmem.bandwidth_throttler.Limit() != bandwidthLimit {
+			xmem.bandwidth_throttler.SetLimit(bandwidthLimit)
+			xmem.Logger().Infof("%v updated bandwidth limit to %v\n", xmem.Id(), bandwidthLimit)
+		}
+	}
 	return nil
 }
 
 func (xmem *XmemNozzle) dataChanControl() {
-	if xmem.bytesInDataChan() < max_datachannelSize {
+	if xmem.bytesInDataChan() < xmem.config.dataChanSize(max_datachannelSize) {
 		select {
 		case xmem.dataChan_control <- true:
 		default:
@@ -0,0 +1,77 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"bytes"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/golang/snappy"
+	"testing"
+)
+
+// a body that compresses well
+var testCompressibleBody = bytes.Repeat([]byte(`{"field":"value"}`), 100)
+
+func newTestCompressRequest(opcode mc.CommandCode, body []byte, dataType uint8) *base.WrappedMCRequest {
+	return &base.WrappedMCRequest{Seqno: 1,
+		Req: &mc.MCRequest{Opcode: opcode,
+			Key:      []byte("k"),
+			Body:     body,
+			DataType: dataType,
+		},
+	}
+}
+
+func TestCompressRequest(t *testing.T) {
+	xmem := &XmemNozzle{snappy_enabled: 1}
+
+	item := newTestCompressRequest(mc.UPR_MUTATION, testCompressibleBody, 0x01)
+	xmem.compressRequest(item)
+	if item.Req.DataType != 0x01|base.SnappyDataType {
+		t.Fatalf("expected snappy data type to be added to json data type, got %v", item.Req.DataType)
+	}
+	body, err := snappy.Decode(nil, item.Req.Body)
+	if err != nil || !bytes.Equal(body, testCompressibleBody) {
+		t.Errorf("expected body to be snappy-compressed. err=%v", err)
+	}
+	if xmem.counter_bytes_before_compression != uint64(len(testCompressibleBody)) || xmem.counter_bytes_after_compression != uint64(len(item.Req.Body)) {
+		t.Errorf("unexpected compression stats before=%v, after=%v", xmem.counter_bytes_before_compression, xmem.counter_bytes_after_compression)
+	}
+
+	// bodies that have been compressed already are not compressed again
+	compressedBody := item.Req.Body
+	xmem.compressRequest(item)
+	if !bytes.Equal(item.Req.Body, compressedBody) {
+		t.Errorf("expected compressed body to be left as is")
+	}
+}
+
+func TestCompressRequestSkipped(t *testing.T) {
+	// bodies that do not get smaller are sent uncompressed
+	incompressible := []byte("a")
+	tests := []struct {
+		snappyEnabled uint32
+		item          *base.WrappedMCRequest
+	}{
+		{0, newTestCompressRequest(mc.UPR_MUTATION, testCompressibleBody, 0)},
+		{1, newTestCompressRequest(mc.UPR_DELETION, testCompressibleBody, 0)},
+		{1, newTestCompressRequest(mc.UPR_MUTATION, nil, 0)},
+		{1, newTestCompressRequest(mc.UPR_MUTATION, incompressible, 0)},
+	}
+	for index, test := range tests {
+		xmem := &XmemNozzle{snappy_enabled: test.snappyEnabled}
+		body := test.item.Req.Body
+		xmem.compressRequest(test.item)
+		if test.item.Req.DataType != 0 || !bytes.Equal(test.item.Req.Body, body) {
+			t.Errorf("test %v: expected request not to be compressed, got data type %v", index, test.item.Req.DataType)
+		}
+	}
+}
@@ -595,7 +595,7 @@ func (genericPipeline *GenericPipeline) Layout() string {
 	footer := "-----------------------------"
 	content := ""
 	for _, sourceNozzle := range genericPipeline.Sources() {
-		dcpSection := fmt.Sprintf("\t%s:{vbList=%v}\n", sourceNozzle.Id(), sourceNozzle.(*parts.DcpNozzle).GetVBList())
+		dcpSection := fmt.Sprintf("\t%s:{vbList=%v}\n", sourceNozzle.Id(), sourceNozzle.(parts.SourceNozzle).GetVBList())
 		router := sourceNozzle.Connector().(*parts.Router)
 		routerSection := fmt.Sprintf("\t\t%s :{\nroutingMap=%v}\n", router.Id(), router.RoutingMapByDownstreams())
 		downstreamParts := router.DownStreams()
@@ -655,7 +655,7 @@ func (genericPipeline *GenericPipeline) SetProgressRecorder(recorder common.Pipe
 }
 
 func (genericPipeline *GenericPipeline) UpdateSettings(settings map[string]interface{}) error {
-	genericPipeline.logger.Debugf("%v update settings called with settings=%v\n", genericPipeline.InstanceId(), settings)
+	genericPipeline.logger.Debugf("%v update settings called with settings=%v\n", genericPipeline.InstanceId(), metadata.MaskSensitiveSettings(settings))
 
 	if len(settings) == 0 {
 		return nil
@@ -666,7 +666,7 @@ func (genericPipeline *GenericPipeline) UpdateSettings(settings map[string]inter
 
 	// update settings on parts and services in pipeline
 	if genericPipeline.partSetting_constructor != nil {
-		genericPipeline.logger.Debugf("%v calling part update setting constructor with settings=%v\n", genericPipeline.InstanceId(), settings)
+		genericPipeline.logger.Debugf("%v calling part update setting constructor with settings=%v\n", genericPipeline.InstanceId(), metadata.MaskSensitiveSettings(settings))
 		for _, part := range GetAllParts(genericPipeline) {
 			partSettings, err := genericPipeline.partUpdateSetting_constructor(genericPipeline, part, settings)
 			if err != nil {
@@ -679,8 +679,16 @@ func (genericPipeline *GenericPipeline) UpdateSettings(settings map[string]inter
 		}
 	}
 
+	// update settings on connectors in pipeline. connectors do not have setting constructors and get the settings as they are
+	for _, connector := range GetAllConnectors(genericPipeline) {
+		err := connector.UpdateSettings(settings)
+		if err != nil {
+			return err
+		}
+	}
+
 	if genericPipeline.context != nil {
-		genericPipeline.logger.Debugf("%v calling update setting constructor on runtime context with settings=%v\n", genericPipeline.InstanceId(), settings)
+		genericPipeline.logger.Debugf("%v calling update setting constructor on runtime context with settings=%v\n", genericPipeline.InstanceId(), metadata.MaskSensitiveSettings(settings))
 		return genericPipeline.context.UpdateSettings(settings)
 	}
 
@@ -14,6 +14,7 @@ import (
 	"fmt"
 	common "github.com/couchbase/goxdcr/common"
 	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
 	"sync"
 )
 
@@ -173,7 +174,7 @@ func (ctx *PipelineRuntimeCtx) UpdateSettings(settings map[string]interface{}) e
 			}
 			err = svc.UpdateSettings(service_settings)
 			if err != nil {
-				ctx.logger.Errorf("Error updating settings for service %v. settings=%v, err=%v", name, service_settings, err)
+				ctx.logger.Errorf("Error updating settings for service %v. settings=%v, err=%v", name, metadata.MaskSensitiveSettings(service_settings), err)
 				return err
 			}
 		}
@@ -0,0 +1,165 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_manager
+
+import (
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/metadata"
+)
+
+// the global bandwidth budget is divided among the running pipelines on this node by weighted max-min fair sharing:
+// each pipeline gets a share of the budget in proportion to its weight, which is decided by the priority of its
+// replication, e.g., a high priority replication gets four times the share of a low priority one.
+// pipelines whose own bandwidth limits are lower than their shares get their limits, and what they leave unused
+// is divided among the other pipelines.
+// every running pipeline is guaranteed its share regardless of how much data other pipelines have to send,
+// so that a replication with a large backlog, e.g., a backfill, cannot starve the others
+
+// returns the bandwidth throttler shared by the outgoing nozzles of the replication, with its limit set
+// to the specified limit. the throttler is created when it does not exist yet, and is kept across pipeline restarts
+func BandwidthThrottler(topic string, limit int) *base.BandwidthThrottler {
+	return pipeline_mgr.bandwidthThrottler(topic, limit)
+}
+
+// sets the global bandwidth budget and re-allocates it among the running pipelines. 0 means no budget
+func SetBandwidthBudget(budget int) {
+	pipeline_mgr.setBandwidthBudget(budget)
+}
+
+// re-allocates the global bandwidth budget among the running pipelines.
+// needs to be called when the bandwidth limits of replications have been changed
+func AllocateBandwidth() {
+	pipeline_mgr.allocateBandwidth()
+}
+
+func (pipelineMgr *pipelineManager) bandwidthThrottler(topic string, limit int) *base.BandwidthThrottler {
+	pipelineMgr.bandwidth_lock.Lock()
+	defer pipelineMgr.bandwidth_lock.Unlock()
+
+	if pipelineMgr.bandwidth_throttlers == nil {
+		pipelineMgr.bandwidth_throttlers = make(map[string]*base.BandwidthThrottler)
+	}
+	throttler, ok := pipelineMgr.bandwidth_throttlers[topic]
+	if !ok {
+		throttler = base.NewBandwidthThrottler(limit)
+		pipelineMgr.bandwidth_throttlers[topic] = throttler
+	} else {
+		throttler.SetLimit(limit)
+	}
+	return throttler
+}
+
+func (pipelineMgr *pipelineManager) removeBandwidthThrottler(topic string) {
+	pipelineMgr.bandwidth_lock.Lock()
+	delete(pipelineMgr.bandwidth_throttlers, topic)
+	pipelineMgr.bandwidth_lock.Unlock()
+
+	pipelineMgr.allocateBandwidth()
+}
+
+func (pipelineMgr *pipelineManager) setBandwidthBudget(budget int) {
+	pipelineMgr.bandwidth_lock.Lock()
+	changed := pipelineMgr.bandwidth_budget != budget
+	pipelineMgr.bandwidth_budget = budget
+	pipelineMgr.bandwidth_lock.Unlock()
+
+	if changed {
+		pipelineMgr.logger.Infof("Bandwidth budget has been changed to %v\n", budget)
+		pipelineMgr.allocateBandwidth()
+	}
+}
+
+func (pipelineMgr *pipelineManager) allocateBandwidth() {
+	pipelineMgr.bandwidth_lock.Lock()
+	defer pipelineMgr.bandwidth_lock.Unlock()
+
+	if pipelineMgr.bandwidth_budget <= 0 {
+		for _, throttler := range pipelineMgr.bandwidth_throttlers {
+			throttler.SetShare(0)
+		}
+		return
+	}
+
+	// the budget is divided among the pipelines that have been constructed and not yet stopped
+	weights := make(map[string]int)
+	limits := make(map[string]int)
+	for topic, _ := range pipelineMgr.bandwidth_throttlers {
+		rep_status, _ := ReplicationStatus(topic)
+		if rep_status == nil || rep_status.Pipeline() == nil {
+			continue
+		}
+		settings := rep_status.Settings()
+		if settings == nil {
+			continue
+		}
+		weights[topic] = bandwidthWeight(settings)
+		limits[topic] = settings.BandwidthLimit
+	}
+
+	shares := computeBandwidthShares(pipelineMgr.bandwidth_budget, weights, limits)
+	for topic, throttler := range pipelineMgr.bandwidth_throttlers {
+		// pipelines that are not running do not send data. their shares are set when they are started
+		throttler.SetShare(shares[topic])
+	}
+	pipelineMgr.logger.Infof("Allocated bandwidth budget %v. shares=%v\n", pipelineMgr.bandwidth_budget, shares)
+}
+
+// the weight of a replication in the allocation of the global bandwidth budget, which is decided by its priority
+func bandwidthWeight(settings *metadata.ReplicationSettings) int {
+	return metadata.PriorityWeight(settings.Priority)
+}
+
+// divides budget among the topics in weights by weighted max-min fair sharing.
+// a topic never gets more than its limit in limits, if the limit is positive
+func computeBandwidthShares(budget int, weights map[string]int, limits map[string]int) map[string]int {
+	shares := make(map[string]int)
+	pending := make(map[string]int)
+	for topic, weight := range weights {
+		pending[topic] = weight
+	}
+
+	remaining := budget
+	for len(pending) > 0 {
+		totalWeight := 0
+		for _, weight := range pending {
+			totalWeight += weight
+		}
+
+		// topics whose limits are lower than their fair shares get their limits. what they leave unused
+		// is divided among the other topics in the next round
+		limited := false
+		for topic, weight := range pending {
+			fairShare := remaining * weight / totalWeight
+			if limits[topic] > 0 && limits[topic] <= fairShare {
+				shares[topic] = limits[topic]
+				delete(pending, topic)
+				limited = true
+			}
+		}
+		if limited {
+			remaining = budget
+			for _, share := range shares {
+				remaining -= share
+			}
+			continue
+		}
+
+		for topic, weight := range pending {
+			// a share of 0 would mean no limit. keep it positive when budget is too small to go around
+			share := remaining * weight / totalWeight
+			if share < 1 {
+				share = 1
+			}
+			shares[topic] = share
+		}
+		break
+	}
+	return shares
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_manager
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestComputeBandwidthShares(t *testing.T) {
+	tests := []struct {
+		name     string
+		budget   int
+		weights  map[string]int
+		limits   map[string]int
+		expected map[string]int
+	}{
+		{"equal weights",
+			900, map[string]int{"a": 1, "b": 1, "c": 1}, nil,
+			map[string]int{"a": 300, "b": 300, "c": 300}},
+		{"shares in proportion to weights",
+			700, map[string]int{"high": 4, "medium": 2, "low": 1}, nil,
+			map[string]int{"high": 400, "medium": 200, "low": 100}},
+		{"unused share of limited topic goes to others by weight",
+			700, map[string]int{"high": 4, "medium": 2, "low": 1}, map[string]int{"high": 100},
+			map[string]int{"high": 100, "medium": 400, "low": 200}},
+		{"limits above fair shares do not apply",
+			700, map[string]int{"high": 4, "medium": 2, "low": 1}, map[string]int{"low": 500},
+			map[string]int{"high": 400, "medium": 200, "low": 100}},
+		{"shares stay positive when budget is too small",
+			2, map[string]int{"high": 4, "low": 1}, nil,
+			map[string]int{"high": 1, "low": 1}},
+		{"no topics",
+			100, map[string]int{}, nil,
+			map[string]int{}},
+	}
+
+	for _, test := range tests {
+		shares := computeBandwidthShares(test.budget, test.weights, test.limits)
+		if !reflect.DeepEqual(shares, test.expected) {
+			t.Errorf("%v: expected shares %v, got %v", test.name, test.expected, shares)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_manager
+
+import (
+	"github.com/couchbase/goxdcr/base"
+)
+
+// returns the dead-letter queue shared by the outgoing nozzles of the replication. the queue is created
+// when it does not exist yet, and is kept across pipeline restarts until the replication is deleted
+func DeadLetterQueue(topic string) *base.DeadLetterQueue {
+	return pipeline_mgr.deadLetterQueue(topic, true)
+}
+
+// returns the dead-letter queue of the replication, or nil when the replication has no queue yet
+func ExistingDeadLetterQueue(topic string) *base.DeadLetterQueue {
+	return pipeline_mgr.deadLetterQueue(topic, false)
+}
+
+func (pipelineMgr *pipelineManager) deadLetterQueue(topic string, create bool) *base.DeadLetterQueue {
+	pipelineMgr.dead_letter_queue_lock.Lock()
+	defer pipelineMgr.dead_letter_queue_lock.Unlock()
+
+	if pipelineMgr.dead_letter_queues == nil {
+		pipelineMgr.dead_letter_queues = make(map[string]*base.DeadLetterQueue)
+	}
+	queue, ok := pipelineMgr.dead_letter_queues[topic]
+	if !ok && create {
+		queue = base.NewDeadLetterQueue(base.DeadLetterQueueMaxCount, base.DeadLetterQueueMaxSize)
+		pipelineMgr.dead_letter_queues[topic] = queue
+	}
+	return queue
+}
+
+func (pipelineMgr *pipelineManager) removeDeadLetterQueue(topic string) {
+	pipelineMgr.dead_letter_queue_lock.Lock()
+	defer pipelineMgr.dead_letter_queue_lock.Unlock()
+
+	if queue, ok := pipelineMgr.dead_letter_queues[topic]; ok {
+		if count := queue.Count(); count > 0 {
+			pipelineMgr.logger.Warnf("Discarding %v docs in dead-letter queue of replication %v since the replication has been deleted\n", count, topic)
+		}
+		delete(pipelineMgr.dead_letter_queues, topic)
+	}
+}
@@ -38,6 +38,20 @@ type pipelineManager struct {
 	once               sync.Once
 	logger             *log.CommonLogger
 	child_waitGrp      *sync.WaitGroup
+
+	// global bandwidth budget shared by the running pipelines in bytes per second. 0 means no budget
+	bandwidth_budget int
+	// bandwidth throttlers of replications, keyed by topic
+	bandwidth_throttlers map[string]*base.BandwidthThrottler
+	bandwidth_lock       sync.Mutex
+
+	// dead-letter queues of replications, keyed by topic
+	dead_letter_queues     map[string]*base.DeadLetterQueue
+	dead_letter_queue_lock sync.Mutex
+
+	// actions to be performed by pipeline updaters while pipelines are stopped, keyed by topic
+	stopped_pipeline_actions     map[string][]StoppedPipelineAction
+	stopped_pipeline_action_lock sync.Mutex
 }
 
 var pipeline_mgr pipelineManager
@@ -111,6 +125,33 @@ func Update(topic string, cur_err error) error {
 	return pipeline_mgr.update(topic, cur_err)
 }
 
+// starts the pipeline of the replication through its updater, and waits until the updater has made its first attempt,
+// so that pipelines started one after another are started in that order.
+// the updater keeps retrying when its first attempt fails, in which case no error is returned.
+// returns early when fin_ch is closed
+func StartThroughUpdater(topic string, fin_ch chan bool) error {
+	err := pipeline_mgr.update(topic, nil)
+	if err != nil {
+		return err
+	}
+
+	rep_status, _ := ReplicationStatus(topic)
+	if rep_status == nil {
+		return nil
+	}
+	updater, ok := rep_status.Updater().(*pipelineUpdater)
+	if !ok || updater == nil {
+		// the updater has finished already, or no updater is launched, e.g., on non-kv nodes
+		return nil
+	}
+
+	select {
+	case <-updater.attempted_ch:
+	case <-fin_ch:
+	}
+	return nil
+}
+
 func RemoveReplicationStatus(topic string) error {
 	rs, err := ReplicationStatus(topic)
 	if err != nil {
@@ -129,6 +170,9 @@ func RemoveReplicationStatus(topic string) error {
 		pipeline_mgr.logger.Infof("Stopping pipeline %v failed with err = %v\n", topic, err)
 	}
 
+	pipeline_mgr.removeBandwidthThrottler(topic)
+	pipeline_mgr.removeDeadLetterQueue(topic)
+	pipeline_mgr.removeStoppedPipelineActions(topic)
 	pipeline_mgr.repl_spec_svc.SetDerivedObj(topic, nil)
 
 	return nil
@@ -294,6 +338,8 @@ func (pipelineMgr *pipelineManager) startPipeline(topic string) (common.Pipeline
 
 		rep_status.RecordProgress("Pipeline is constructed")
 		rep_status.SetPipeline(p)
+		// the new pipeline gets its share of the global bandwidth budget before it starts sending data
+		pipelineMgr.allocateBandwidth()
 
 		pipelineMgr.logger.Infof("Pipeline %v is constructed. Starting it.", p.InstanceId())
 		p.SetProgressRecorder(rep_status.RecordProgress)
@@ -382,6 +428,8 @@ func (pipelineMgr *pipelineManager) stopPipeline(rep_status *pipeline.Replicatio
 				pipelineMgr.logger.Infof("Pipeline %v has been stopped\n", rep_status.RepId())
 			}
 			pipelineMgr.removePipelineFromReplicationStatus(p)
+			// the share of the stopped pipeline is re-allocated to the running ones
+			pipelineMgr.allocateBandwidth()
 			pipelineMgr.logger.Infof("Replication Status=%v\n", rep_status)
 		} else {
 			pipelineMgr.logger.Infof("Pipeline %v is not in the right state to be stopped. state=%v\n", rep_status.RepId(), state)
@@ -539,6 +587,8 @@ type pipelineUpdater struct {
 	update_now_ch chan bool
 	// channel indicating whether updater is really done
 	done_ch chan bool
+	// channel closed once updater has made its first attempt to update the pipeline
+	attempted_ch chan bool
 	//the current error
 	current_error error
 
@@ -564,6 +614,7 @@ func newPipelineUpdater(pipeline_name string, retry_interval int, waitGrp *sync.
 		num_of_retries: 0,
 		fin_ch:         make(chan bool, 1),
 		done_ch:        make(chan bool, 1),
+		attempted_ch:   make(chan bool),
 		waitGrp:        waitGrp,
 		rep_status:     rep_status,
 		logger:         logger,
@@ -580,10 +631,13 @@ func (r *pipelineUpdater) start() {
 
 	if r.current_error == nil {
 		//the update is not initiated from a failure case, so don't wait, update now
-		if r.update() {
+		updated := r.update()
+		close(r.attempted_ch)
+		if updated {
 			return
 		}
 	} else {
+		close(r.attempted_ch)
 		r.reportStatus()
 	}
 
@@ -637,6 +691,12 @@ func (r *pipelineUpdater) update() bool {
 		goto RE
 	}
 
+	// actions that require the pipeline to be stopped are performed only after it has been stopped successfully
+	err = pipeline_mgr.runStoppedPipelineActions(r.pipeline_name)
+	if err != nil {
+		goto RE
+	}
+
 	err = r.checkReplicationActiveness()
 	if err != nil {
 		goto RE
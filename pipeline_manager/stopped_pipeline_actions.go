@@ -0,0 +1,57 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_manager
+
+// an action that needs to be performed while the pipeline is stopped, e.g., resetting checkpoints
+type StoppedPipelineAction func() error
+
+// UpdateWithAction is like Update, except that the pipeline updater performs the action after it has
+// stopped the pipeline and before it restarts the pipeline. when the pipeline cannot be stopped,
+// or when the action fails, the action is kept and is retried along with the update
+func UpdateWithAction(topic string, action StoppedPipelineAction) error {
+	pipeline_mgr.addStoppedPipelineAction(topic, action)
+	return Update(topic, nil)
+}
+
+func (pipelineMgr *pipelineManager) addStoppedPipelineAction(topic string, action StoppedPipelineAction) {
+	pipelineMgr.stopped_pipeline_action_lock.Lock()
+	defer pipelineMgr.stopped_pipeline_action_lock.Unlock()
+
+	if pipelineMgr.stopped_pipeline_actions == nil {
+		pipelineMgr.stopped_pipeline_actions = make(map[string][]StoppedPipelineAction)
+	}
+	pipelineMgr.stopped_pipeline_actions[topic] = append(pipelineMgr.stopped_pipeline_actions[topic], action)
+}
+
+// performs, in order, the pending actions of the replication. it is called by the pipeline updater only,
+// after the pipeline has been stopped. actions that have not completed are kept for the next retry
+func (pipelineMgr *pipelineManager) runStoppedPipelineActions(topic string) error {
+	pipelineMgr.stopped_pipeline_action_lock.Lock()
+	defer pipelineMgr.stopped_pipeline_action_lock.Unlock()
+
+	actions := pipelineMgr.stopped_pipeline_actions[topic]
+	for len(actions) > 0 {
+		err := actions[0]()
+		if err != nil {
+			pipelineMgr.stopped_pipeline_actions[topic] = actions
+			return err
+		}
+		actions = actions[1:]
+	}
+	delete(pipelineMgr.stopped_pipeline_actions, topic)
+	return nil
+}
+
+func (pipelineMgr *pipelineManager) removeStoppedPipelineActions(topic string) {
+	pipelineMgr.stopped_pipeline_action_lock.Lock()
+	defer pipelineMgr.stopped_pipeline_action_lock.Unlock()
+
+	delete(pipelineMgr.stopped_pipeline_actions, topic)
+}
@@ -110,6 +110,9 @@ type CheckpointManager struct {
 
 	// whether replication is of capi type
 	capi bool
+	// whether replication does not write to target bucket, e.g., file and webhook replications.
+	// such replications have no target vbuckets to validate checkpoints against
+	targetless bool
 
 	user_agent string
 
@@ -235,6 +238,10 @@ func (ckmgr *CheckpointManager) populateRemoteBucketInfo(pipeline common.Pipelin
 	if err != nil {
 		return err
 	}
+	if !spec.Settings.HasTargetBucket() {
+		// target bucket is not written to by file and webhook replications
+		return nil
+	}
 	remote_bucket, err := service_def.NewRemoteBucketInfo(ckmgr.target_cluster_ref.Name, spec.TargetBucketName, ckmgr.target_cluster_ref, ckmgr.remote_cluster_svc, ckmgr.cluster_info_svc, ckmgr.logger)
 	if err != nil {
 		return err
@@ -258,7 +265,7 @@ func (ckmgr *CheckpointManager) Start(settings map[string]interface{}) error {
 	ckmgr.startRandomizedCheckpointingTicker()
 
 	//initialize connections
-	if !ckmgr.capi {
+	if !ckmgr.capi && !ckmgr.targetless {
 		err := ckmgr.initConnections()
 		if err != nil {
 			return err
@@ -292,6 +299,7 @@ func (ckmgr *CheckpointManager) initialize() {
 	ckmgr.composeUserAgent()
 
 	ckmgr.capi = (ckmgr.pipeline.Specification().Settings.RepType == metadata.ReplicationTypeCapi)
+	ckmgr.targetless = !ckmgr.pipeline.Specification().Settings.HasTargetBucket()
 }
 
 // compose user agent string for HELO command
@@ -443,7 +451,7 @@ func (ckmgr *CheckpointManager) Stop() error {
 	close(ckmgr.finish_ch)
 
 	//close the connections
-	if !ckmgr.capi {
+	if !ckmgr.capi && !ckmgr.targetless {
 		ckmgr.closeConnections()
 	}
 
@@ -610,8 +618,10 @@ func (ckmgr *CheckpointManager) SetVBTimestamps(topic string) error {
 
 	ckmgr.logger.Infof("Done with setting starting seqno for pipeline %v\n", ckmgr.pipeline.Topic())
 
-	ckmgr.wait_grp.Add(1)
-	go ckmgr.massCheckVBOpaquesJob()
+	if !ckmgr.targetless {
+		ckmgr.wait_grp.Add(1)
+		go ckmgr.massCheckVBOpaquesJob()
+	}
 
 	return nil
 }
@@ -665,6 +675,15 @@ func (ckmgr *CheckpointManager) getVBTimestampForVB(vbno uint16, ckptDoc *metada
 	ckpt_list := ckmgr.ckptRecords(ckptDoc, vbno)
 	for index, ckpt_record := range ckpt_list {
 		if ckpt_record != nil && ckpt_record.Seqno <= max_seqno {
+			if ckmgr.targetless {
+				// there is no target to agree on checkpoints with. data up to the checkpoint has been flushed to export files
+				// or accepted by webhook
+				if ckptDoc != nil {
+					agreeedIndex = index
+				}
+				goto POPULATE
+			}
+
 			remote_vb_status := &service_def.RemoteVBReplicationStatus{VBOpaque: ckpt_record.Target_vb_opaque,
 				VBSeqno: ckpt_record.Target_Seqno,
 				VBNo:    vbno}
@@ -715,7 +734,7 @@ func (ckmgr *CheckpointManager) ckptRecords(ckptDoc *metadata.CheckpointsDoc, vb
 }
 
 func (ckmgr *CheckpointManager) UpdateSettings(settings map[string]interface{}) error {
-	ckmgr.logger.Debugf("Updating settings on checkpoint manager for pipeline %v. settings=%v\n", ckmgr.pipeline.Topic(), settings)
+	ckmgr.logger.Debugf("Updating settings on checkpoint manager for pipeline %v. settings=%v\n", ckmgr.pipeline.Topic(), metadata.MaskSensitiveSettings(settings))
 	checkpoint_interval, err := utils.GetIntSettingFromSettings(settings, CHECKPOINT_INTERVAL)
 	if err != nil {
 		return err
@@ -918,7 +937,9 @@ func (ckmgr *CheckpointManager) PerformCkpt(fin_ch <-chan bool) {
 		// get through seqnos for all vbuckets in the pipeline
 		through_seqno_map = ckmgr.through_seqno_tracker_svc.GetThroughSeqnos()
 		// get high seqno and vbuuid for all vbuckets in the pipeline
-		high_seqno_and_vbuuid_map = ckmgr.getHighSeqnoAndVBUuidFromTarget()
+		if !ckmgr.targetless {
+			high_seqno_and_vbuuid_map = ckmgr.getHighSeqnoAndVBUuidFromTarget()
+		}
 	}
 
 	//divide the workload to several getter and run the getter parallelly
@@ -958,7 +979,9 @@ func (ckmgr *CheckpointManager) performCkpt(fin_ch <-chan bool, wait_grp *sync.W
 		// get through seqnos for all vbuckets in the pipeline
 		through_seqno_map = ckmgr.through_seqno_tracker_svc.GetThroughSeqnos()
 		// get high seqno and vbuuid for all vbuckets in the pipeline
-		high_seqno_and_vbuuid_map = ckmgr.getHighSeqnoAndVBUuidFromTarget()
+		if !ckmgr.targetless {
+			high_seqno_and_vbuuid_map = ckmgr.getHighSeqnoAndVBUuidFromTarget()
+		}
 	}
 	ckmgr.performCkpt_internal(ckmgr.getMyVBs(), fin_ch, wait_grp, ckmgr.ckpt_interval, through_seqno_map, high_seqno_and_vbuuid_map)
 }
@@ -1050,7 +1073,7 @@ func (ckmgr *CheckpointManager) do_checkpoint(vbno uint16, through_seqno_map map
 			return nil
 		}
 
-		if ckpt_record.Target_vb_opaque == nil {
+		if ckpt_record.Target_vb_opaque == nil && !ckmgr.targetless {
 			ckmgr.logger.Infof("%v remote bucket is an older node, no checkpointing should be done.", ckmgr.pipeline.Topic())
 			return nil
 		}
@@ -1058,7 +1081,9 @@ func (ckmgr *CheckpointManager) do_checkpoint(vbno uint16, through_seqno_map map
 		// get remote_seqno and vbuuid from target
 		var remote_seqno uint64
 		var targetVBOpaque metadata.TargetVBOpaque
-		if !ckmgr.capi {
+		if ckmgr.targetless {
+			// there is no target seqno or vbuuid to record
+		} else if !ckmgr.capi {
 			// non-capi mode, high_seqno and vbuuid on target have been retrieved through vbucket-seqno stats
 			high_seqno_and_vbuuid, ok := high_seqno_and_vbuuid_map[vbno]
 			if !ok {
@@ -1280,7 +1305,7 @@ func GetStartSeqnos(pipeline common.Pipeline, logger *log.CommonLogger) (map[uin
 		if ok {
 			return startSeqnos_obj_with_lock.Object.(map[uint16]*base.VBTimestamp), startSeqnos_obj_with_lock.Lock
 		} else {
-			logger.Errorf("%v Didn't find 'VBTimesstamps' in settings. settings=%v\n", pipeline.Topic(), settings)
+			logger.Errorf("%v Didn't find 'VBTimesstamps' in settings. settings=%v\n", pipeline.Topic(), metadata.MaskSensitiveSettings(settings))
 		}
 	} else {
 		logger.Info("pipleine is nil")
@@ -0,0 +1,223 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_svc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/couchbase/go-couchbase"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"github.com/couchbase/goxdcr/parts"
+	pipeline_pkg "github.com/couchbase/goxdcr/pipeline"
+	"github.com/couchbase/goxdcr/pipeline_manager"
+	"github.com/couchbase/goxdcr/pipeline_utils"
+	"github.com/couchbase/goxdcr/service_def"
+	"github.com/couchbase/goxdcr/utils"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrorConflictLogFileNotSetUp = errors.New("Conflict records cannot be written to file since xdcr has not been started with a log file directory.")
+
+// an entry in the conflict log
+type ConflictLogEntry struct {
+	ReplicationId string `json:"replicationId"`
+	*parts.ConflictRecord
+}
+
+// ConflictLogger records the documents that lost conflict resolution at source side, as reported by
+// DataFailedCRSource events from outgoing nozzles, to the destination specified by replication settings.
+// the most recent records are also kept in memory so that they can be queried through rest api
+type ConflictLogger struct {
+	id                string
+	topic             string
+	destination       string
+	bucketName        string
+	xdcr_topology_svc service_def.XDCRCompTopologySvc
+
+	// records waiting to be written to destination
+	records_ch chan *ConflictLogEntry
+	// ring buffer of the most recent records
+	recent       []*ConflictLogEntry
+	recent_next  int
+	recent_count int
+	recent_lock  sync.RWMutex
+	// the number of records that could not be written to destination
+	counter_dropped uint64
+
+	bucket    *couchbase.Bucket
+	finish_ch chan bool
+	wait_grp  sync.WaitGroup
+	logger    *log.CommonLogger
+}
+
+func NewConflictLogger(topic string, settings *metadata.ReplicationSettings, xdcr_topology_svc service_def.XDCRCompTopologySvc,
+	logger_ctx *log.LoggerContext) *ConflictLogger {
+	return &ConflictLogger{id: base.CONFLICT_LOGGER_SVC + "_" + topic,
+		topic:             topic,
+		destination:       settings.ConflictLogDestination,
+		bucketName:        settings.ConflictLogBucket,
+		xdcr_topology_svc: xdcr_topology_svc,
+		records_ch:        make(chan *ConflictLogEntry, base.ConflictLogQueueSize),
+		recent:            make([]*ConflictLogEntry, base.ConflictLogRecentRecordsSize),
+		finish_ch:         make(chan bool),
+		logger:            log.NewLogger("ConflictLogger", logger_ctx),
+	}
+}
+
+func (conflictLogger *ConflictLogger) Id() string {
+	return conflictLogger.id
+}
+
+func (conflictLogger *ConflictLogger) Attach(pipeline common.Pipeline) error {
+	conflictLogger.logger.Infof("Attach conflict logger with pipeline %v\n", pipeline.InstanceId())
+
+	asyncListenerMap := pipeline_pkg.GetAllAsyncComponentEventListeners(pipeline)
+	pipeline_utils.RegisterAsyncComponentEventHandler(asyncListenerMap, base.DataFailedCREventListener, conflictLogger)
+	return nil
+}
+
+func (conflictLogger *ConflictLogger) Start(settings map[string]interface{}) error {
+	if conflictLogger.destination == metadata.ConflictLogDestinationFile && log.ConflictLogWriter() == nil {
+		return ErrorConflictLogFileNotSetUp
+	}
+	if conflictLogger.destination == metadata.ConflictLogDestinationBucket {
+		localConnStr, err := conflictLogger.xdcr_topology_svc.MyConnectionStr()
+		if err != nil {
+			return err
+		}
+		conflictLogger.bucket, err = utils.LocalBucket(localConnStr, conflictLogger.bucketName)
+		if err != nil {
+			return fmt.Errorf("Error getting conflict log bucket %v. err=%v", conflictLogger.bucketName, err)
+		}
+	}
+
+	conflictLogger.wait_grp.Add(1)
+	go conflictLogger.write()
+
+	conflictLogger.logger.Infof("%v has started. destination=%v, bucket=%v\n", conflictLogger.id, conflictLogger.destination, conflictLogger.bucketName)
+	return nil
+}
+
+func (conflictLogger *ConflictLogger) Stop() error {
+	close(conflictLogger.finish_ch)
+	conflictLogger.wait_grp.Wait()
+
+	if conflictLogger.bucket != nil {
+		conflictLogger.bucket.Close()
+	}
+	conflictLogger.logger.Infof("%v has stopped. %v records were dropped\n", conflictLogger.id, atomic.LoadUint64(&conflictLogger.counter_dropped))
+	return nil
+}
+
+func (conflictLogger *ConflictLogger) UpdateSettings(settings map[string]interface{}) error {
+	// changes to conflict log settings require pipeline reconstruction
+	return nil
+}
+
+func (conflictLogger *ConflictLogger) ProcessEvent(event *common.Event) error {
+	if event.EventType != common.DataFailedCRSource {
+		return nil
+	}
+	record := event.OtherInfos.(parts.DataFailedCRSourceEventAdditional).Conflict
+	if record == nil {
+		return nil
+	}
+
+	entry := &ConflictLogEntry{ReplicationId: conflictLogger.topic, ConflictRecord: record}
+	conflictLogger.addRecentEntry(entry)
+
+	// never block the event listener, and hence replication, on slow writes to destination
+	select {
+	case conflictLogger.records_ch <- entry:
+	default:
+		atomic.AddUint64(&conflictLogger.counter_dropped, 1)
+	}
+	return nil
+}
+
+func (conflictLogger *ConflictLogger) addRecentEntry(entry *ConflictLogEntry) {
+	conflictLogger.recent_lock.Lock()
+	defer conflictLogger.recent_lock.Unlock()
+
+	conflictLogger.recent[conflictLogger.recent_next] = entry
+	conflictLogger.recent_next = (conflictLogger.recent_next + 1) % len(conflictLogger.recent)
+	if conflictLogger.recent_count < len(conflictLogger.recent) {
+		conflictLogger.recent_count++
+	}
+}
+
+// returns up to limit most recent conflict records, the newest first. limit <= 0 means all records kept
+func (conflictLogger *ConflictLogger) RecentConflicts(limit int) []*ConflictLogEntry {
+	conflictLogger.recent_lock.RLock()
+	defer conflictLogger.recent_lock.RUnlock()
+
+	count := conflictLogger.recent_count
+	if limit > 0 && limit < count {
+		count = limit
+	}
+	entries := make([]*ConflictLogEntry, 0, count)
+	for i := 1; i <= count; i++ {
+		index := (conflictLogger.recent_next - i + len(conflictLogger.recent)) % len(conflictLogger.recent)
+		entries = append(entries, conflictLogger.recent[index])
+	}
+	return entries
+}
+
+func (conflictLogger *ConflictLogger) write() {
+	defer conflictLogger.wait_grp.Done()
+
+	for {
+		select {
+		case <-conflictLogger.finish_ch:
+			return
+		case entry := <-conflictLogger.records_ch:
+			err := conflictLogger.writeEntry(entry)
+			if err != nil {
+				atomic.AddUint64(&conflictLogger.counter_dropped, 1)
+				conflictLogger.logger.Warnf("%v failed to write conflict record for doc %v in vb %v. err=%v\n", conflictLogger.id, entry.Key, entry.VBucket, err)
+			}
+		}
+	}
+}
+
+func (conflictLogger *ConflictLogger) writeEntry(entry *ConflictLogEntry) error {
+	if conflictLogger.destination == metadata.ConflictLogDestinationBucket {
+		// source seqno makes the key unique within the vbucket
+		key := fmt.Sprintf("%v/%v/%v/%v", base.ConflictLogDocKeyPrefix, conflictLogger.topic, entry.VBucket, entry.Seqno)
+		return conflictLogger.bucket.Set(key, 0, entry)
+	}
+
+	// one record per line
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = log.ConflictLogWriter().Write(append(bytes, '\n'))
+	return err
+}
+
+// returns up to limit most recent conflict records of the replication with the specified id.
+// returns an empty list when the replication is not running or does not have conflict logging enabled
+func GetRecentConflictsForPipeline(topic string, limit int) []*ConflictLogEntry {
+	repl_status, _ := pipeline_manager.ReplicationStatus(topic)
+	if repl_status == nil || repl_status.Pipeline() == nil || repl_status.Pipeline().RuntimeContext() == nil {
+		return []*ConflictLogEntry{}
+	}
+	service := repl_status.Pipeline().RuntimeContext().Service(base.CONFLICT_LOGGER_SVC)
+	if service == nil {
+		return []*ConflictLogEntry{}
+	}
+	return service.(*ConflictLogger).RecentConflicts(limit)
+}
@@ -0,0 +1,27 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_svc
+
+import (
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"testing"
+)
+
+// log files are not set up in tests, hence conflict records have nowhere to go
+func TestConflictLoggerRequiresLogFileForFileDestination(t *testing.T) {
+	settings := metadata.DefaultSettings()
+	settings.ConflictLogDestination = metadata.ConflictLogDestinationFile
+
+	conflictLogger := NewConflictLogger("test", settings, nil, log.DefaultLoggerContext)
+	if err := conflictLogger.Start(nil); err != ErrorConflictLogFileNotSetUp {
+		t.Errorf("expected ErrorConflictLogFileNotSetUp, got %v", err)
+	}
+}
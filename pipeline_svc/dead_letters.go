@@ -0,0 +1,128 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_svc
+
+import (
+	"encoding/binary"
+	"errors"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/common"
+	"github.com/couchbase/goxdcr/parts"
+	"github.com/couchbase/goxdcr/pipeline_manager"
+	"github.com/golang/snappy"
+	"time"
+)
+
+var ErrorPipelineNotRunningForRedrive = errors.New("Dead-lettered docs can be re-driven only when the replication is running.")
+
+// sends the re-drivable docs with the specified ids in the dead-letter queue of the replication to target again,
+// through the outgoing nozzles that currently own their vbuckets. empty ids means all re-drivable docs.
+// re-driven docs are removed from the queue, and are added back if target rejects them again.
+// returns the number of docs re-driven
+func RedriveDeadLetters(topic string, ids []uint64) (int, error) {
+	queue := pipeline_manager.ExistingDeadLetterQueue(topic)
+	if queue == nil {
+		return 0, nil
+	}
+
+	repl_status, _ := pipeline_manager.ReplicationStatus(topic)
+	if repl_status == nil || repl_status.Pipeline() == nil || repl_status.Pipeline().State() != common.Pipeline_Running {
+		return 0, ErrorPipelineNotRunningForRedrive
+	}
+	pipeline := repl_status.Pipeline()
+
+	letters := queue.RemoveRedrivable(ids)
+	not_redriven := make([]*base.DeadLetter, 0)
+	for _, letter := range letters {
+		target := redriveTarget(pipeline, letter.VBucket)
+		if target == nil {
+			not_redriven = append(not_redriven, letter)
+			continue
+		}
+		wrappedReq, err := newRedriveRequest(letter)
+		if err != nil || target.Receive(wrappedReq) != nil {
+			not_redriven = append(not_redriven, letter)
+		}
+	}
+	if len(not_redriven) > 0 {
+		queue.Restore(not_redriven)
+	}
+
+	return len(letters) - len(not_redriven), nil
+}
+
+// returns the outgoing nozzle that the docs in the vbucket are routed to, or nil when there is none
+func redriveTarget(pipeline common.Pipeline, vbno uint16) common.Part {
+	for _, source := range pipeline.Sources() {
+		router, ok := source.Connector().(*parts.Router)
+		if !ok {
+			continue
+		}
+		partId, ok := router.RoutingMap()[vbno]
+		if !ok {
+			continue
+		}
+		if target, ok := pipeline.Targets()[partId]; ok {
+			return target
+		}
+		// processor parts, when present, sit between routers and outgoing nozzles.
+		// re-driven docs have been processed already and go to the outgoing nozzles directly
+		if part, ok := router.DownStreams()[partId]; ok && part.Connector() != nil {
+			for downStreamId := range part.Connector().DownStreams() {
+				if target, ok := pipeline.Targets()[downStreamId]; ok {
+					return target
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// constructs the request to re-drive a dead-lettered doc. re-driven docs have 0 seqno, which tells the components
+// that track seqnos for checkpointing that they have been accounted for already, and which tells outgoing nozzles
+// to leave conflict resolution to target, since newer versions of the docs may have reached target in the meantime
+func newRedriveRequest(letter *base.DeadLetter) (*base.WrappedMCRequest, error) {
+	req := letter.Request()
+	// bodies were stored as sent, i.e., compressed when snappy was negotiated on the connection they were sent on.
+	// the connection they are re-driven on may not have snappy negotiated. outgoing nozzles compress bodies again when it has
+	if req.DataType&base.SnappyDataType != 0 {
+		body, err := snappy.Decode(nil, req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = body
+		req.DataType &^= base.SnappyDataType
+	}
+	// requests were stored with the opcodes and options used on the wire. restore the opcodes from dcp,
+	// which outgoing nozzles expect. options set by routers, e.g., FORCE_ACCEPT_WITH_META_OPS for lww buckets,
+	// are kept. the flag that asks target to skip conflict resolution is cleared
+	if req.Opcode == base.SET_WITH_META {
+		req.Opcode = mc.UPR_MUTATION
+	} else if req.Opcode == base.DELETE_WITH_META {
+		req.Opcode = mc.UPR_DELETION
+	}
+	if len(req.Extras) == 28 {
+		options := binary.BigEndian.Uint32(req.Extras[24:28]) &^ base.SKIP_CONFLICT_RESOLUTION_FLAG
+		if options == 0 {
+			req.Extras = req.Extras[:24]
+		} else {
+			binary.BigEndian.PutUint32(req.Extras[24:28], options)
+		}
+	}
+
+	wrappedReq := &base.WrappedMCRequest{Seqno: 0,
+		SrcVBucket: letter.VBucket,
+		Req:        req,
+		Start_time: time.Now(),
+	}
+	wrappedReq.ConstructUniqueKey()
+	return wrappedReq, nil
+}
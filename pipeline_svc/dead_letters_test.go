@@ -0,0 +1,112 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_svc
+
+import (
+	"encoding/binary"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/golang/snappy"
+	"testing"
+)
+
+const testSrcVBucket = 7
+
+var testBody = []byte(`{"a":1}`)
+
+func newTestDeadLetter(t *testing.T, options uint32) *base.DeadLetter {
+	req := &mc.MCRequest{Opcode: base.SET_WITH_META,
+		VBucket: 5,
+		Key:     []byte("k"),
+		Body:    testBody,
+		Extras:  make([]byte, 28),
+	}
+	binary.BigEndian.PutUint32(req.Extras[24:28], options)
+	return addTestDeadLetter(t, req)
+}
+
+func addTestDeadLetter(t *testing.T, req *mc.MCRequest) *base.DeadLetter {
+	queue := base.NewDeadLetterQueue(10, 1024*1024)
+	letter, _ := queue.Add(req, testSrcVBucket, 10, mc.E2BIG)
+	if !letter.Redrivable {
+		t.Fatalf("expected letter to be re-drivable")
+	}
+	return letter
+}
+
+func newTestRedriveRequest(t *testing.T, letter *base.DeadLetter) *base.WrappedMCRequest {
+	wrappedReq, err := newRedriveRequest(letter)
+	if err != nil {
+		t.Fatalf("Error constructing redrive request. err=%v", err)
+	}
+	return wrappedReq
+}
+
+func TestRedriveRequestKeepsForceAcceptOption(t *testing.T) {
+	letter := newTestDeadLetter(t, base.FORCE_ACCEPT_WITH_META_OPS|base.SKIP_CONFLICT_RESOLUTION_FLAG)
+
+	wrappedReq := newTestRedriveRequest(t, letter)
+	if wrappedReq.Seqno != 0 || wrappedReq.Req.Opcode != mc.UPR_MUTATION {
+		t.Errorf("expected mutation with 0 seqno, got opcode %v and seqno %v", wrappedReq.Req.Opcode, wrappedReq.Seqno)
+	}
+	if len(wrappedReq.Req.Extras) != 28 {
+		t.Fatalf("expected options to be kept, got extras of length %v", len(wrappedReq.Req.Extras))
+	}
+	if options := binary.BigEndian.Uint32(wrappedReq.Req.Extras[24:28]); options != base.FORCE_ACCEPT_WITH_META_OPS {
+		t.Errorf("expected only FORCE_ACCEPT_WITH_META_OPS to be kept, got options %x", options)
+	}
+}
+
+func TestRedriveRequestDropsEmptyOptions(t *testing.T) {
+	letter := newTestDeadLetter(t, base.SKIP_CONFLICT_RESOLUTION_FLAG)
+
+	wrappedReq := newTestRedriveRequest(t, letter)
+	if len(wrappedReq.Req.Extras) != 24 {
+		t.Errorf("expected options to be dropped, got extras of length %v", len(wrappedReq.Req.Extras))
+	}
+}
+
+// letters need to be routed by source vbucket, which the target vbucket of the request may differ from
+func TestRedriveRequestKeepsSourceVBucket(t *testing.T) {
+	letter := newTestDeadLetter(t, 0)
+	if letter.VBucket != testSrcVBucket {
+		t.Errorf("expected letter to record source vbucket %v, got %v", testSrcVBucket, letter.VBucket)
+	}
+
+	wrappedReq := newTestRedriveRequest(t, letter)
+	if wrappedReq.SrcVBucket != testSrcVBucket {
+		t.Errorf("expected source vbucket %v, got %v", testSrcVBucket, wrappedReq.SrcVBucket)
+	}
+}
+
+func TestRedriveRequestDecompressesBody(t *testing.T) {
+	req := &mc.MCRequest{Opcode: base.SET_WITH_META,
+		VBucket:  5,
+		DataType: 0x01 | base.SnappyDataType,
+		Key:      []byte("k"),
+		Body:     snappy.Encode(nil, testBody),
+		Extras:   make([]byte, 24),
+	}
+	letter := addTestDeadLetter(t, req)
+
+	wrappedReq := newTestRedriveRequest(t, letter)
+	if string(wrappedReq.Req.Body) != string(testBody) {
+		t.Errorf("expected uncompressed body %s, got %v", testBody, wrappedReq.Req.Body)
+	}
+	if wrappedReq.Req.DataType != 0x01 {
+		t.Errorf("expected snappy data type to be cleared, got data type %v", wrappedReq.Req.DataType)
+	}
+
+	req.Body = []byte("not snappy")
+	letter = addTestDeadLetter(t, req)
+	if _, err := newRedriveRequest(letter); err == nil {
+		t.Errorf("expected error on body that is not snappy-compressed")
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/couchbase/goxdcr/base"
 	"github.com/couchbase/goxdcr/common"
 	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
 	"github.com/couchbase/goxdcr/parts"
 	"github.com/couchbase/goxdcr/pipeline"
 	"github.com/couchbase/goxdcr/pipeline_utils"
@@ -125,7 +126,7 @@ func (pipelineSupervisor *PipelineSupervisor) Start(settings map[string]interfac
 	}
 
 	for _, dcp_nozzle := range pipelineSupervisor.pipeline.Sources() {
-		dcp_nozzle.(*parts.DcpNozzle).SetMaxMissCount(max_dcp_miss_count)
+		dcp_nozzle.(parts.SourceNozzle).SetMaxMissCount(max_dcp_miss_count)
 	}
 
 	// do the generic supervisor start stuff
@@ -250,7 +251,7 @@ func (pipelineSupervisor *PipelineSupervisor) init(settings map[string]interface
 }
 
 func (pipelineSupervisor *PipelineSupervisor) UpdateSettings(settings map[string]interface{}) error {
-	pipelineSupervisor.Logger().Debugf("Updating settings on pipelineSupervisor %v. settings=%v\n", pipelineSupervisor.Id(), settings)
+	pipelineSupervisor.Logger().Debugf("Updating settings on pipelineSupervisor %v. settings=%v\n", pipelineSupervisor.Id(), metadata.MaskSensitiveSettings(settings))
 	logLevelObj := utils.GetSettingFromSettings(settings, PIPELINE_LOG_LEVEL)
 
 	if logLevelObj == nil {
@@ -303,7 +304,7 @@ func (pipelineSupervisor *PipelineSupervisor) checkPipelineHealth() error {
 	}
 
 	for _, dcp_nozzle := range pipelineSupervisor.pipeline.Sources() {
-		err = dcp_nozzle.(*parts.DcpNozzle).CheckStuckness(dcp_stats)
+		err = dcp_nozzle.(parts.SourceNozzle).CheckStuckness(dcp_stats)
 		if err != nil {
 			//declare pipeline broken
 			pipelineSupervisor.setError(dcp_nozzle.Id(), err)
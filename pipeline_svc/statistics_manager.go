@@ -47,10 +47,19 @@ const (
 	SIZE_REP_QUEUE_METRIC  = "size_rep_queue"
 	DOCS_REP_QUEUE_METRIC  = "docs_rep_queue"
 
+	// the time, in milliseconds, that writes to target have been delayed by bandwidth limit
+	THROTTLED_TIME_METRIC = "throttled_time"
+
+	// the size of document bodies before and after compression, for bodies sent when compression has been enabled
+	DATA_BEFORE_COMPRESSION_METRIC = "data_before_compression"
+	DATA_AFTER_COMPRESSION_METRIC  = "data_after_compression"
+
 	DOCS_FILTERED_METRIC     = "docs_filtered"
 	EXPIRY_FILTERED_METRIC   = "expiry_filtered"
 	DELETION_FILTERED_METRIC = "deletion_filtered"
 	SET_FILTERED_METRIC      = "set_filtered"
+	// the number of docs that were dropped since their bodies could not be redacted
+	DOCS_UNREDACTABLE_METRIC = "docs_unredactable"
 
 	// the number of docs that failed conflict resolution on the source cluster side due to optimistic replication
 	DOCS_FAILED_CR_SOURCE_METRIC     = "docs_failed_cr_source"
@@ -58,6 +67,12 @@ const (
 	DELETION_FAILED_CR_SOURCE_METRIC = "deletion_failed_cr_source"
 	SET_FAILED_CR_SOURCE_METRIC      = "set_failed_cr_source"
 
+	// the number of docs that were not sent since newer versions of the same docs were in the same batches
+	DOCS_DEDUPLICATED_METRIC = "docs_deduplicated"
+
+	// the number of docs that were moved to dead-letter queue since target rejected them with permanent errors
+	DOCS_DEAD_LETTERED_METRIC = "docs_dead_lettered"
+
 	CHANGES_LEFT_METRIC = "changes_left"
 	DOCS_LATENCY_METRIC = "wtavg_docs_latency"
 	META_LATENCY_METRIC = "wtavg_meta_latency"
@@ -126,7 +141,9 @@ var OverviewMetricKeys = []string{DOCS_WRITTEN_METRIC, EXPIRY_DOCS_WRITTEN_METRI
 	EXPIRY_FILTERED_METRIC, DELETION_FILTERED_METRIC, SET_FILTERED_METRIC, NUM_CHECKPOINTS_METRIC, NUM_FAILEDCKPTS_METRIC,
 	TIME_COMMITING_METRIC, DOCS_OPT_REPD_METRIC, DOCS_RECEIVED_DCP_METRIC, EXPIRY_RECEIVED_DCP_METRIC,
 	DELETION_RECEIVED_DCP_METRIC, SET_RECEIVED_DCP_METRIC, SIZE_REP_QUEUE_METRIC, DOCS_REP_QUEUE_METRIC, DOCS_LATENCY_METRIC,
-	RESP_WAIT_METRIC, META_LATENCY_METRIC, DCP_DISPATCH_TIME_METRIC, DCP_DATACH_LEN,
+	RESP_WAIT_METRIC, META_LATENCY_METRIC, DCP_DISPATCH_TIME_METRIC, DCP_DATACH_LEN, DATA_BEFORE_COMPRESSION_METRIC,
+	DATA_AFTER_COMPRESSION_METRIC, THROTTLED_TIME_METRIC, DOCS_DEDUPLICATED_METRIC,
+	DOCS_DEAD_LETTERED_METRIC, DOCS_UNREDACTABLE_METRIC,
 }
 
 // the fixed user agent string for connections to collect stats for paused replications
@@ -327,15 +344,20 @@ func (stats_mgr *StatisticsManager) logStats() error {
 		//log parts summary
 		outNozzle_parts := stats_mgr.pipeline.Targets()
 		for _, part := range outNozzle_parts {
-			if stats_mgr.pipeline.Specification().Settings.RepType == metadata.ReplicationTypeXmem {
-				stats_mgr.logger.Info(part.(*parts.XmemNozzle).StatusSummary())
-			} else {
-				stats_mgr.logger.Info(part.(*parts.CapiNozzle).StatusSummary())
+			switch nozzle := part.(type) {
+			case *parts.XmemNozzle:
+				stats_mgr.logger.Info(nozzle.StatusSummary())
+			case *parts.CapiNozzle:
+				stats_mgr.logger.Info(nozzle.StatusSummary())
+			case *parts.FileNozzle:
+				stats_mgr.logger.Info(nozzle.StatusSummary())
+			case *parts.WebhookNozzle:
+				stats_mgr.logger.Info(nozzle.StatusSummary())
 			}
 		}
 		dcp_parts := stats_mgr.pipeline.Sources()
 		for _, part := range dcp_parts {
-			stats_mgr.logger.Info(part.(*parts.DcpNozzle).StatusSummary())
+			stats_mgr.logger.Info(part.(parts.SourceNozzle).StatusSummary())
 		}
 
 		// log listener summary
@@ -676,10 +698,10 @@ func (stats_mgr *StatisticsManager) Start(settings map[string]interface{}) error
 	if _, ok := settings[PUBLISH_INTERVAL]; ok {
 		stats_mgr.update_interval = time.Duration(settings[PUBLISH_INTERVAL].(int)) * time.Millisecond
 	} else {
-		stats_mgr.logger.Infof("%v There is no update_interval in settings map. settings=%v\n", stats_mgr.pipeline.InstanceId(), settings)
+		stats_mgr.logger.Infof("%v There is no update_interval in settings map. settings=%v\n", stats_mgr.pipeline.InstanceId(), metadata.MaskSensitiveSettings(settings))
 	}
 
-	stats_mgr.logger.Debugf("%v StatisticsManager Starts: update_interval=%v, settings=%v\n", stats_mgr.pipeline.InstanceId(), stats_mgr.update_interval, settings)
+	stats_mgr.logger.Debugf("%v StatisticsManager Starts: update_interval=%v, settings=%v\n", stats_mgr.pipeline.InstanceId(), stats_mgr.update_interval, metadata.MaskSensitiveSettings(settings))
 	stats_mgr.update_ticker_ch <- time.NewTicker(stats_mgr.update_interval)
 
 	stats_mgr.wait_grp.Add(1)
@@ -728,7 +750,7 @@ func (stats_mgr *StatisticsManager) initConnections() error {
 }
 
 func (stats_mgr *StatisticsManager) UpdateSettings(settings map[string]interface{}) error {
-	stats_mgr.logger.Debugf("%v Updating settings on stats manager. settings=%v\n", stats_mgr.pipeline.InstanceId(), settings)
+	stats_mgr.logger.Debugf("%v Updating settings on stats manager. settings=%v\n", stats_mgr.pipeline.InstanceId(), metadata.MaskSensitiveSettings(settings))
 
 	stats_interval, err := utils.GetIntSettingFromSettings(settings, PUBLISH_INTERVAL)
 	if err != nil {
@@ -803,6 +825,16 @@ func (outNozzle_collector *outNozzleCollector) Mount(pipeline common.Pipeline, s
 		registry.Register(RESP_WAIT_METRIC, resp_wait)
 		meta_latency := metrics.NewHistogram(metrics.NewUniformSample(stats_mgr.sample_size))
 		registry.Register(META_LATENCY_METRIC, meta_latency)
+		throttled_time := metrics.NewCounter()
+		registry.Register(THROTTLED_TIME_METRIC, throttled_time)
+		data_before_compression := metrics.NewCounter()
+		registry.Register(DATA_BEFORE_COMPRESSION_METRIC, data_before_compression)
+		data_after_compression := metrics.NewCounter()
+		registry.Register(DATA_AFTER_COMPRESSION_METRIC, data_after_compression)
+		docs_deduplicated := metrics.NewCounter()
+		registry.Register(DOCS_DEDUPLICATED_METRIC, docs_deduplicated)
+		docs_dead_lettered := metrics.NewCounter()
+		registry.Register(DOCS_DEAD_LETTERED_METRIC, docs_dead_lettered)
 
 		metric_map := make(map[string]interface{})
 		metric_map[SIZE_REP_QUEUE_METRIC] = size_rep_queue
@@ -820,6 +852,11 @@ func (outNozzle_collector *outNozzleCollector) Mount(pipeline common.Pipeline, s
 		metric_map[DOCS_LATENCY_METRIC] = docs_latency
 		metric_map[RESP_WAIT_METRIC] = resp_wait
 		metric_map[META_LATENCY_METRIC] = meta_latency
+		metric_map[THROTTLED_TIME_METRIC] = throttled_time
+		metric_map[DATA_BEFORE_COMPRESSION_METRIC] = data_before_compression
+		metric_map[DATA_AFTER_COMPRESSION_METRIC] = data_after_compression
+		metric_map[DOCS_DEDUPLICATED_METRIC] = docs_deduplicated
+		metric_map[DOCS_DEAD_LETTERED_METRIC] = docs_dead_lettered
 		outNozzle_collector.component_map[part.Id()] = metric_map
 
 		// register outNozzle_collector as the sync event listener/handler for StatsUpdate event
@@ -831,6 +868,8 @@ func (outNozzle_collector *outNozzleCollector) Mount(pipeline common.Pipeline, s
 	pipeline_utils.RegisterAsyncComponentEventHandler(async_listener_map, base.DataSentEventListener, outNozzle_collector)
 	pipeline_utils.RegisterAsyncComponentEventHandler(async_listener_map, base.DataFailedCREventListener, outNozzle_collector)
 	pipeline_utils.RegisterAsyncComponentEventHandler(async_listener_map, base.GetMetaReceivedEventListener, outNozzle_collector)
+	pipeline_utils.RegisterAsyncComponentEventHandler(async_listener_map, base.DataDeduplicatedEventListener, outNozzle_collector)
+	pipeline_utils.RegisterAsyncComponentEventHandler(async_listener_map, base.DataDeadLetteredEventListener, outNozzle_collector)
 
 	return nil
 }
@@ -851,6 +890,12 @@ func (outNozzle_collector *outNozzleCollector) ProcessEvent(event *common.Event)
 		queue_size_bytes := event.OtherInfos.([]int)[1]
 		setCounter(metric_map[DOCS_REP_QUEUE_METRIC].(metrics.Counter), queue_size)
 		setCounter(metric_map[SIZE_REP_QUEUE_METRIC].(metrics.Counter), queue_size_bytes)
+		setCounter(metric_map[THROTTLED_TIME_METRIC].(metrics.Counter), event.OtherInfos.([]int)[2])
+		// only xmem nozzles report compression stats
+		if len(event.OtherInfos.([]int)) > 4 {
+			setCounter(metric_map[DATA_BEFORE_COMPRESSION_METRIC].(metrics.Counter), event.OtherInfos.([]int)[3])
+			setCounter(metric_map[DATA_AFTER_COMPRESSION_METRIC].(metrics.Counter), event.OtherInfos.([]int)[4])
+		}
 	} else if event.EventType == common.DataSent {
 		outNozzle_collector.stats_mgr.logger.Debugf("%v Received a DataSent event from %v", outNozzle_collector.Id(), reflect.TypeOf(event.Component))
 		event_otherInfo := event.OtherInfos.(parts.DataSentEventAdditional)
@@ -902,6 +947,12 @@ func (outNozzle_collector *outNozzleCollector) ProcessEvent(event *common.Event)
 		event_otherInfos := event.OtherInfos.(parts.GetMetaReceivedEventAdditional)
 		commit_time := event_otherInfos.Commit_time
 		metric_map[META_LATENCY_METRIC].(metrics.Histogram).Sample().Update(commit_time.Nanoseconds() / 1000000)
+	} else if event.EventType == common.DataDeduplicated {
+		outNozzle_collector.stats_mgr.logger.Debugf("%v Received a DataDeduplicated event from %v", outNozzle_collector.Id(), reflect.TypeOf(event.Component))
+		metric_map[DOCS_DEDUPLICATED_METRIC].(metrics.Counter).Inc(1)
+	} else if event.EventType == common.DataDeadLettered {
+		outNozzle_collector.stats_mgr.logger.Debugf("%v Received a DataDeadLettered event from %v", outNozzle_collector.Id(), reflect.TypeOf(event.Component))
+		metric_map[DOCS_DEAD_LETTERED_METRIC].(metrics.Counter).Inc(1)
 	}
 
 	return nil
@@ -1011,22 +1062,13 @@ func (r_collector *routerCollector) Mount(pipeline common.Pipeline, stats_mgr *S
 	for _, dcp_part := range dcp_parts {
 		//get connector
 		conn := dcp_part.Connector()
-		registry_router := stats_mgr.getOrCreateRegistry(conn.Id())
-		docs_filtered := metrics.NewCounter()
-		registry_router.Register(DOCS_FILTERED_METRIC, docs_filtered)
-		expiry_filtered := metrics.NewCounter()
-		registry_router.Register(EXPIRY_FILTERED_METRIC, expiry_filtered)
-		deletion_filtered := metrics.NewCounter()
-		registry_router.Register(DELETION_FILTERED_METRIC, deletion_filtered)
-		set_filtered := metrics.NewCounter()
-		registry_router.Register(SET_FILTERED_METRIC, set_filtered)
-
-		metric_map := make(map[string]interface{})
-		metric_map[DOCS_FILTERED_METRIC] = docs_filtered
-		metric_map[EXPIRY_FILTERED_METRIC] = expiry_filtered
-		metric_map[DELETION_FILTERED_METRIC] = deletion_filtered
-		metric_map[SET_FILTERED_METRIC] = set_filtered
-		r_collector.component_map[conn.Id()] = metric_map
+		r_collector.registerFilteredMetrics(conn.Id())
+	}
+	// processor parts, if any, raise DataFiltered events for the data dropped by processors
+	for _, part := range pipeline_pkg.GetAllParts(pipeline) {
+		if _, ok := part.(*parts.ProcessorPart); ok {
+			r_collector.registerFilteredMetrics(part.Id())
+		}
 	}
 
 	async_listener_map := pipeline_pkg.GetAllAsyncComponentEventListeners(pipeline)
@@ -1034,6 +1076,28 @@ func (r_collector *routerCollector) Mount(pipeline common.Pipeline, stats_mgr *S
 	return nil
 }
 
+func (r_collector *routerCollector) registerFilteredMetrics(componentId string) {
+	registry_router := r_collector.stats_mgr.getOrCreateRegistry(componentId)
+	docs_filtered := metrics.NewCounter()
+	registry_router.Register(DOCS_FILTERED_METRIC, docs_filtered)
+	expiry_filtered := metrics.NewCounter()
+	registry_router.Register(EXPIRY_FILTERED_METRIC, expiry_filtered)
+	deletion_filtered := metrics.NewCounter()
+	registry_router.Register(DELETION_FILTERED_METRIC, deletion_filtered)
+	set_filtered := metrics.NewCounter()
+	registry_router.Register(SET_FILTERED_METRIC, set_filtered)
+	docs_unredactable := metrics.NewCounter()
+	registry_router.Register(DOCS_UNREDACTABLE_METRIC, docs_unredactable)
+
+	metric_map := make(map[string]interface{})
+	metric_map[DOCS_FILTERED_METRIC] = docs_filtered
+	metric_map[EXPIRY_FILTERED_METRIC] = expiry_filtered
+	metric_map[DELETION_FILTERED_METRIC] = deletion_filtered
+	metric_map[SET_FILTERED_METRIC] = set_filtered
+	metric_map[DOCS_UNREDACTABLE_METRIC] = docs_unredactable
+	r_collector.component_map[componentId] = metric_map
+}
+
 func (r_collector *routerCollector) Id() string {
 	return r_collector.id
 }
@@ -1056,6 +1120,9 @@ func (r_collector *routerCollector) ProcessEvent(event *common.Event) error {
 		} else {
 			panic(fmt.Sprintf("Invalid opcode, %v, in DataFiltered event from %v.", uprEvent.Opcode, event.Component.Id()))
 		}
+		if additionalInfo, ok := event.OtherInfos.(parts.DataFilteredEventAdditional); ok && additionalInfo.Unredactable {
+			metric_map[DOCS_UNREDACTABLE_METRIC].(metrics.Counter).Inc(1)
+		}
 	}
 
 	return nil
@@ -59,6 +59,9 @@ type TopologyChangeDetectorSvc struct {
 
 	// whether replication is of capi type
 	capi bool
+	// whether replication does not write to target bucket, e.g., file and webhook replications,
+	// which does not depend on target topology
+	targetless bool
 }
 
 func NewTopologyChangeDetectorSvc(cluster_info_svc service_def.ClusterInfoSvc,
@@ -83,6 +86,7 @@ func NewTopologyChangeDetectorSvc(cluster_info_svc service_def.ClusterInfoSvc,
 func (top_detect_svc *TopologyChangeDetectorSvc) Attach(pipeline common.Pipeline) error {
 	top_detect_svc.pipeline = pipeline
 	top_detect_svc.capi = pipeline.Specification().Settings.RepType == metadata.ReplicationTypeCapi
+	top_detect_svc.targetless = !pipeline.Specification().Settings.HasTargetBucket()
 	return nil
 }
 
@@ -102,14 +106,16 @@ func (top_detect_svc *TopologyChangeDetectorSvc) Start(map[string]interface{}) e
 	simple_utils.SortUint16List(top_detect_svc.vblist_original)
 
 	//initialize target vb server map to set up a baseline for target topology change detection
-	_, target_server_vb_map, err := top_detect_svc.getTargetBucketInfo()
-	if err != nil {
-		return err
-	}
 	top_detect_svc.target_vb_server_map_original = make(map[uint16]string)
-	for server, vbList := range target_server_vb_map {
-		for _, vb := range vbList {
-			top_detect_svc.target_vb_server_map_original[vb] = server
+	if !top_detect_svc.targetless {
+		_, target_server_vb_map, err := top_detect_svc.getTargetBucketInfo()
+		if err != nil {
+			return err
+		}
+		for server, vbList := range target_server_vb_map {
+			for _, vb := range vbList {
+				top_detect_svc.target_vb_server_map_original[vb] = server
+			}
 		}
 	}
 
@@ -169,6 +175,11 @@ func (top_detect_svc *TopologyChangeDetectorSvc) validate(checkTargetVersionForS
 		top_detect_svc.logger.Warnf("ToplogyChangeDetectorSvc for pipeline %v received error when validating or handling source topology change. err=%v", top_detect_svc.pipeline.Topic(), err)
 	}
 
+	if top_detect_svc.targetless {
+		// file and webhook replications are not affected by target topology changes
+		return
+	}
+
 	diff_vb_list, target_vb_server_map, err := top_detect_svc.validateTargetTopology(checkTargetVersionForSSL)
 	if err == target_cluster_version_changed_for_ssl_err {
 		// restart pipeline if target begins to support ssl
@@ -0,0 +1,121 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// separator of processor types in the processors replication setting
+const ProcessorTypesSeparator = ","
+
+var ErrorEmptyProcessorType = errors.New("Processor type cannot be empty.")
+
+// Processor is the processing logic that processor parts run on each request routed to them.
+// Processor parts can be inserted into replication pipelines between routers and outgoing nozzles
+// to filter, transform or enrich documents. Processors need to be safe for concurrent use
+type Processor interface {
+	// Process returns the request to be sent to target, which is either the request passed in, possibly modified,
+	// or a new request. A nil request indicates that the request is to be dropped. In both of the latter cases
+	// the request passed in is recycled and must not be retained by the processor. A new request takes over
+	// the seqno and source vbucket of the request passed in, which processors do not need to copy
+	Process(req *base.WrappedMCRequest) (*base.WrappedMCRequest, error)
+	// UpdateSettings is called with replication settings when they are changed on a running replication
+	UpdateSettings(settings map[string]interface{}) error
+}
+
+// ProcessorConstructor constructs a processor with the settings of the replication
+type ProcessorConstructor func(settings map[string]interface{}, logger_context *log.LoggerContext) (Processor, error)
+
+var registry = make(map[string]ProcessorConstructor)
+var registry_lock sync.RWMutex
+
+// RegisterProcessorType makes a processor type available to replications.
+// It is meant to be called by processor implementations at initialization time
+func RegisterProcessorType(processorType string, constructor ProcessorConstructor) error {
+	if len(processorType) == 0 {
+		return ErrorEmptyProcessorType
+	}
+	if strings.Contains(processorType, ProcessorTypesSeparator) {
+		return fmt.Errorf("Processor type %v cannot contain %v", processorType, ProcessorTypesSeparator)
+	}
+	if constructor == nil {
+		return fmt.Errorf("Constructor of processor type %v cannot be nil", processorType)
+	}
+
+	registry_lock.Lock()
+	defer registry_lock.Unlock()
+	if _, ok := registry[processorType]; ok {
+		return fmt.Errorf("Processor type %v has already been registered", processorType)
+	}
+	registry[processorType] = constructor
+	return nil
+}
+
+func IsProcessorTypeRegistered(processorType string) bool {
+	registry_lock.RLock()
+	defer registry_lock.RUnlock()
+	_, ok := registry[processorType]
+	return ok
+}
+
+// returns all registered processor types in sorted order
+func RegisteredProcessorTypes() []string {
+	registry_lock.RLock()
+	defer registry_lock.RUnlock()
+	processorTypes := make([]string, 0, len(registry))
+	for processorType, _ := range registry {
+		processorTypes = append(processorTypes, processorType)
+	}
+	sort.Strings(processorTypes)
+	return processorTypes
+}
+
+func NewProcessor(processorType string, settings map[string]interface{}, logger_context *log.LoggerContext) (Processor, error) {
+	registry_lock.RLock()
+	constructor, ok := registry[processorType]
+	registry_lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Processor type %v has not been registered", processorType)
+	}
+	return constructor(settings, logger_context)
+}
+
+// parses the value of the processors replication setting, which is a comma separated list of registered
+// processor types, e.g., "mask,enrich". Processors are run in the order listed
+func ParseProcessorTypes(processorTypesStr string) ([]string, error) {
+	processorTypes := make([]string, 0)
+	if len(strings.TrimSpace(processorTypesStr)) == 0 {
+		return processorTypes, nil
+	}
+
+	for _, processorType := range strings.Split(processorTypesStr, ProcessorTypesSeparator) {
+		processorType = strings.TrimSpace(processorType)
+		if len(processorType) == 0 {
+			return nil, ErrorEmptyProcessorType
+		}
+		if !IsProcessorTypeRegistered(processorType) {
+			return nil, fmt.Errorf("Processor type %v has not been registered. registered processor types are %v", processorType, RegisteredProcessorTypes())
+		}
+		for _, existingType := range processorTypes {
+			if existingType == processorType {
+				return nil, fmt.Errorf("Processor type %v is listed more than once", processorType)
+			}
+		}
+		processorTypes = append(processorTypes, processorType)
+	}
+	return processorTypes, nil
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package processor
+
+import (
+	"encoding/binary"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"reflect"
+	"testing"
+)
+
+const testProcessorType = "testPassThrough"
+
+type testPassThroughProcessor struct {
+}
+
+func (proc *testPassThroughProcessor) Process(req *base.WrappedMCRequest) (*base.WrappedMCRequest, error) {
+	return req, nil
+}
+
+func (proc *testPassThroughProcessor) UpdateSettings(settings map[string]interface{}) error {
+	return nil
+}
+
+func newTestPassThroughProcessor(settings map[string]interface{}, logger_context *log.LoggerContext) (Processor, error) {
+	return &testPassThroughProcessor{}, nil
+}
+
+func registerTestProcessorType(t *testing.T) {
+	if IsProcessorTypeRegistered(testProcessorType) {
+		return
+	}
+	if err := RegisterProcessorType(testProcessorType, newTestPassThroughProcessor); err != nil {
+		t.Fatalf("Error registering processor type. err=%v", err)
+	}
+}
+
+func TestRegisterProcessorType(t *testing.T) {
+	registerTestProcessorType(t)
+
+	if err := RegisterProcessorType(testProcessorType, newTestPassThroughProcessor); err == nil {
+		t.Errorf("Processor type should not be registered twice")
+	}
+	if err := RegisterProcessorType("", newTestPassThroughProcessor); err != ErrorEmptyProcessorType {
+		t.Errorf("Expected ErrorEmptyProcessorType, got %v", err)
+	}
+	if err := RegisterProcessorType("a"+ProcessorTypesSeparator+"b", newTestPassThroughProcessor); err == nil {
+		t.Errorf("Processor type with separator should have been rejected")
+	}
+	if err := RegisterProcessorType("noConstructor", nil); err == nil {
+		t.Errorf("Processor type without constructor should have been rejected")
+	}
+
+	processorTypes := RegisteredProcessorTypes()
+	if !reflect.DeepEqual(processorTypes, []string{ProcessorTypeRemoveExpiry, testProcessorType}) {
+		t.Errorf("Unexpected registered processor types %v", processorTypes)
+	}
+
+	if _, err := NewProcessor(testProcessorType, nil, log.DefaultLoggerContext); err != nil {
+		t.Errorf("Error constructing processor. err=%v", err)
+	}
+	if _, err := NewProcessor("unknown", nil, log.DefaultLoggerContext); err == nil {
+		t.Errorf("Processor of unregistered type should not have been constructed")
+	}
+}
+
+func TestParseProcessorTypes(t *testing.T) {
+	registerTestProcessorType(t)
+
+	valid := map[string][]string{
+		"":                []string{},
+		"  ":              []string{},
+		"testPassThrough": []string{testProcessorType},
+		// processors are run in the order listed
+		" testPassThrough , removeExpiry": []string{testProcessorType, ProcessorTypeRemoveExpiry},
+		"removeExpiry,testPassThrough":    []string{ProcessorTypeRemoveExpiry, testProcessorType},
+	}
+	for processorTypesStr, expected := range valid {
+		processorTypes, err := ParseProcessorTypes(processorTypesStr)
+		if err != nil || !reflect.DeepEqual(processorTypes, expected) {
+			t.Errorf("%q: expected %v, got %v. err=%v", processorTypesStr, expected, processorTypes, err)
+		}
+	}
+
+	invalid := []string{
+		"unknown",
+		"testPassThrough,",
+		"testPassThrough,,removeExpiry",
+		"testPassThrough,removeExpiry,testPassThrough",
+	}
+	for _, processorTypesStr := range invalid {
+		if _, err := ParseProcessorTypes(processorTypesStr); err == nil {
+			t.Errorf("%q should have been rejected", processorTypesStr)
+		}
+	}
+}
+
+func TestRemoveExpiryProcessor(t *testing.T) {
+	proc, err := NewProcessor(ProcessorTypeRemoveExpiry, nil, log.DefaultLoggerContext)
+	if err != nil {
+		t.Fatalf("Error constructing processor. err=%v", err)
+	}
+
+	for _, opcode := range []mc.CommandCode{mc.UPR_MUTATION, mc.UPR_EXPIRATION, mc.UPR_DELETION} {
+		extras := make([]byte, 24)
+		binary.BigEndian.PutUint32(extras[0:4], 7)
+		binary.BigEndian.PutUint32(extras[4:8], 3600)
+		req := &base.WrappedMCRequest{Seqno: 10,
+			Req: &mc.MCRequest{Opcode: opcode, Key: []byte("k"), Extras: extras},
+		}
+
+		processed, err := proc.Process(req)
+		if err != nil || processed != req {
+			t.Fatalf("Expected request to be modified in place. err=%v", err)
+		}
+		expectedExpiry := uint32(3600)
+		if opcode == mc.UPR_MUTATION {
+			expectedExpiry = 0
+		}
+		if expiry := binary.BigEndian.Uint32(processed.Req.Extras[4:8]); expiry != expectedExpiry {
+			t.Errorf("Opcode %v: expected expiry %v, got %v", opcode, expectedExpiry, expiry)
+		}
+		if flags := binary.BigEndian.Uint32(processed.Req.Extras[0:4]); flags != 7 {
+			t.Errorf("Opcode %v: expected flags to be kept, got %v", opcode, flags)
+		}
+	}
+}
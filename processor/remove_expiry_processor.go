@@ -0,0 +1,49 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package processor
+
+import (
+	"encoding/binary"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+)
+
+// processor type of RemoveExpiryProcessor
+const ProcessorTypeRemoveExpiry = "removeExpiry"
+
+func init() {
+	err := RegisterProcessorType(ProcessorTypeRemoveExpiry, NewRemoveExpiryProcessor)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// RemoveExpiryProcessor clears the expiry of mutations, so that documents that expire on source
+// are kept on target. Expirations and deletions are still replicated.
+// It modifies requests in place and has no settings
+type RemoveExpiryProcessor struct {
+}
+
+func NewRemoveExpiryProcessor(settings map[string]interface{}, logger_context *log.LoggerContext) (Processor, error) {
+	return &RemoveExpiryProcessor{}, nil
+}
+
+func (proc *RemoveExpiryProcessor) Process(req *base.WrappedMCRequest) (*base.WrappedMCRequest, error) {
+	// <<Flg:32, Exp:32, SeqNo:64, CASPart:64, Options:32>>
+	if req.Req.Opcode == mc.UPR_MUTATION && len(req.Req.Extras) >= 8 {
+		binary.BigEndian.PutUint32(req.Req.Extras[4:8], 0)
+	}
+	return req, nil
+}
+
+func (proc *RemoveExpiryProcessor) UpdateSettings(settings map[string]interface{}) error {
+	return nil
+}
@@ -15,9 +15,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/couchbase/cbauth"
 	ap "github.com/couchbase/goxdcr/adminport"
 	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/filter"
 	"github.com/couchbase/goxdcr/gen_server"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/metadata"
@@ -33,8 +33,8 @@ import (
 
 import _ "net/http/pprof"
 
-var StaticPaths = []string{base.RemoteClustersPath, CreateReplicationPath, InternalSettingsPath, SettingsReplicationsPath, AllReplicationsPath, AllReplicationInfosPath, RegexpValidationPrefix, MemStatsPath, BlockProfileStartPath, BlockProfileStopPath, XDCRInternalSettingsPath}
-var DynamicPathPrefixes = []string{base.RemoteClustersPath, DeleteReplicationPrefix, SettingsReplicationsPath, StatisticsPrefix, AllReplicationsPath, BucketSettingsPrefix}
+var StaticPaths = []string{base.RemoteClustersPath, CreateReplicationPath, InternalSettingsPath, SettingsReplicationsPath, AllReplicationsPath, AllReplicationInfosPath, RegexpValidationPrefix, KeyTransformPreviewPath, MemStatsPath, BlockProfileStartPath, BlockProfileStopPath, XDCRInternalSettingsPath}
+var DynamicPathPrefixes = []string{base.RemoteClustersPath, DeleteReplicationPrefix, SettingsReplicationsPath, StatisticsPrefix, AllReplicationsPath, BucketSettingsPrefix, ConflictsPrefix, DeadLettersPrefix, RedriveDeadLettersPrefix}
 
 var logger_ap *log.CommonLogger = log.NewLogger("AdminPort", log.DefaultLoggerContext)
 
@@ -88,7 +88,13 @@ func (adminport *Adminport) Start() {
 	// start http server
 	reqch := make(chan ap.Request)
 	hostAddr := utils.GetHostAddr(adminport.sourceKVHost, adminport.xdcrRestPort)
-	server := ap.NewHTTPServer("xdcr", hostAddr, base.AdminportUrlPrefix, reqch, new(ap.Handler))
+	var server ap.Server
+	if tlsConfig := getAdminportTLSConfig(); tlsConfig != nil {
+		// authenticator works off client certificates, which requires adminport to serve over tls
+		server = ap.NewHTTPSServer("xdcr", hostAddr, base.AdminportUrlPrefix, reqch, new(ap.Handler), tlsConfig)
+	} else {
+		server = ap.NewHTTPServer("xdcr", hostAddr, base.AdminportUrlPrefix, reqch, new(ap.Handler))
+	}
 	finch := adminport.finch
 
 	err = server.Start()
@@ -191,6 +197,8 @@ func (adminport *Adminport) handleRequest(
 		response, err = adminport.doGetStatisticsRequest(request)
 	case RegexpValidationPrefix + base.UrlDelimiter + base.MethodPost:
 		response, err = adminport.doRegexpValidationRequest(request)
+	case KeyTransformPreviewPath + base.UrlDelimiter + base.MethodPost:
+		response, err = adminport.doKeyTransformPreviewRequest(request)
 	case MemStatsPath + base.UrlDelimiter + base.MethodGet:
 		response, err = adminport.doMemStatsRequest(request)
 	case BlockProfileStartPath + base.UrlDelimiter + base.MethodPost:
@@ -205,6 +213,14 @@ func (adminport *Adminport) handleRequest(
 		response, err = adminport.doViewXDCRInternalSettingsRequest(request)
 	case XDCRInternalSettingsPath + base.UrlDelimiter + base.MethodPost:
 		response, err = adminport.doChangeXDCRInternalSettingsRequest(request)
+	case ConflictsPrefix + DynamicSuffix + base.UrlDelimiter + base.MethodGet:
+		response, err = adminport.doGetConflictsRequest(request)
+	case DeadLettersPrefix + DynamicSuffix + base.UrlDelimiter + base.MethodGet:
+		response, err = adminport.doGetDeadLettersRequest(request)
+	case DeadLettersPrefix + DynamicSuffix + base.UrlDelimiter + base.MethodDelete:
+		response, err = adminport.doDiscardDeadLettersRequest(request)
+	case RedriveDeadLettersPrefix + DynamicSuffix + base.UrlDelimiter + base.MethodPost:
+		response, err = adminport.doRedriveDeadLettersRequest(request)
 	default:
 		err = ap.ErrorInvalidRequest
 	}
@@ -409,7 +425,7 @@ func (adminport *Adminport) doCreateReplicationRequest(request *http.Request) (*
 	}
 
 	logger_ap.Infof("Request parameters: justValidate=%v, fromBucket=%v, toCluster=%v, toBucket=%v, settings=%v\n",
-		justValidate, fromBucket, toCluster, toBucket, settings)
+		justValidate, fromBucket, toCluster, toBucket, metadata.MaskSensitiveSettings(settings))
 
 	replicationId, errorsMap, err := CreateReplication(justValidate, fromBucket, toCluster, toBucket, settings, getRealUserIdFromRequest(request))
 
@@ -487,7 +503,7 @@ func (adminport *Adminport) doChangeInternalSettingsRequest(request *http.Reques
 		return EncodeInternalSettingsErrorsMapIntoResponse(errorsMap)
 	}
 
-	logger_ap.Infof("Request params: inputSettings=%v\n", settingsMap)
+	logger_ap.Infof("Request params: inputSettings=%v\n", metadata.MaskSensitiveSettings(settingsMap))
 
 	errorsMap, err = UpdateDefaultSettings(settingsMap, getRealUserIdFromRequest(request))
 	if err != nil {
@@ -536,7 +552,7 @@ func (adminport *Adminport) doChangeDefaultReplicationSettingsRequest(request *h
 		return EncodeErrorsMapIntoResponse(errorsMap, false)
 	}
 
-	logger_ap.Infof("Request params: justValidate=%v, inputSettings=%v\n", justValidate, settingsMap)
+	logger_ap.Infof("Request params: justValidate=%v, inputSettings=%v\n", justValidate, metadata.MaskSensitiveSettings(settingsMap))
 
 	if !justValidate {
 		errorsMap, err := UpdateDefaultSettings(settingsMap, getRealUserIdFromRequest(request))
@@ -606,7 +622,7 @@ func (adminport *Adminport) doChangeReplicationSettingsRequest(request *http.Req
 		return EncodeErrorsMapIntoResponse(errorsMap, false)
 	}
 
-	logger_ap.Infof("Request params: justValidate=%v, inputSettings=%v\n", justValidate, settingsMap)
+	logger_ap.Infof("Request params: justValidate=%v, inputSettings=%v\n", justValidate, metadata.MaskSensitiveSettings(settingsMap))
 
 	// "pauseRequested" setting is special - it requires execute permission
 	_, pauseRequestedSpecified := settingsMap[metadata.Active]
@@ -674,6 +690,122 @@ func (adminport *Adminport) doGetStatisticsRequest(request *http.Request) (*ap.R
 	}
 }
 
+func (adminport *Adminport) doGetConflictsRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Debugf("doGetConflictsRequest\n")
+
+	replicationId, err := DecodeDynamicParamInURL(request, ConflictsPrefix, "Replication Id")
+	if err != nil {
+		return EncodeReplicationValidationErrorIntoResponse(err)
+	}
+
+	response, err := authWebCredsForReplication(request, replicationId, []string{base.PermissionBucketXDCRReadSuffix})
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	limit, err := DecodeConflictsLimit(request)
+	if err != nil {
+		return EncodeReplicationValidationErrorIntoResponse(err)
+	}
+
+	// make sure that the replication exists
+	_, err = ReplicationSpecService().ReplicationSpec(replicationId)
+	if err != nil {
+		return EncodeReplicationSpecErrorIntoResponse(err)
+	}
+
+	// bodies of source documents are returned only to those who can read the documents in source bucket.
+	// bodies of target documents are never returned, since permissions on target bucket cannot be checked here
+	canReadSourceDocs, err := hasPermissionForReplication(request, replicationId, base.PermissionBucketDataReadSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	return EncodeObjectIntoResponse(GetRecentConflicts(replicationId, limit, canReadSourceDocs))
+}
+
+func (adminport *Adminport) doGetDeadLettersRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Debugf("doGetDeadLettersRequest\n")
+
+	replicationId, err := DecodeDynamicParamInURL(request, DeadLettersPrefix, "Replication Id")
+	if err != nil {
+		return EncodeReplicationValidationErrorIntoResponse(err)
+	}
+
+	response, err := authWebCredsForReplication(request, replicationId, []string{base.PermissionBucketXDCRReadSuffix})
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	// make sure that the replication exists
+	_, err = ReplicationSpecService().ReplicationSpec(replicationId)
+	if err != nil {
+		return EncodeReplicationSpecErrorIntoResponse(err)
+	}
+
+	return EncodeObjectIntoResponse(GetDeadLetters(replicationId))
+}
+
+func (adminport *Adminport) doDiscardDeadLettersRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Infof("doDiscardDeadLettersRequest\n")
+
+	replicationId, err := DecodeDynamicParamInURL(request, DeadLettersPrefix, "Replication Id")
+	if err != nil {
+		return EncodeReplicationValidationErrorIntoResponse(err)
+	}
+
+	response, err := authWebCredsForReplication(request, replicationId, []string{base.PermissionBucketXDCRWriteSuffix})
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	ids, err := DecodeDeadLetterIds(request)
+	if err != nil {
+		return EncodeReplicationValidationErrorIntoResponse(err)
+	}
+
+	_, err = ReplicationSpecService().ReplicationSpec(replicationId)
+	if err != nil {
+		return EncodeReplicationSpecErrorIntoResponse(err)
+	}
+
+	logger_ap.Infof("Request params: replicationId=%v, ids=%v\n", replicationId, ids)
+
+	return EncodeObjectIntoResponse(map[string]int{"discarded": DiscardDeadLetters(replicationId, ids)})
+}
+
+func (adminport *Adminport) doRedriveDeadLettersRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Infof("doRedriveDeadLettersRequest\n")
+
+	replicationId, err := DecodeDynamicParamInURL(request, RedriveDeadLettersPrefix, "Replication Id")
+	if err != nil {
+		return EncodeReplicationValidationErrorIntoResponse(err)
+	}
+
+	response, err := authWebCredsForReplication(request, replicationId, []string{base.PermissionBucketXDCRExecuteSuffix})
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	ids, err := DecodeDeadLetterIds(request)
+	if err != nil {
+		return EncodeReplicationValidationErrorIntoResponse(err)
+	}
+
+	_, err = ReplicationSpecService().ReplicationSpec(replicationId)
+	if err != nil {
+		return EncodeReplicationSpecErrorIntoResponse(err)
+	}
+
+	logger_ap.Infof("Request params: replicationId=%v, ids=%v\n", replicationId, ids)
+
+	count, err := RedriveDeadLetters(replicationId, ids)
+	if err != nil {
+		return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+	}
+	return EncodeObjectIntoResponse(map[string]int{"redriven": count})
+}
+
 func (adminport *Adminport) doMemStatsRequest(request *http.Request) (*ap.Response, error) {
 	logger_ap.Debugf("doMemStatsRequest\n")
 
@@ -728,11 +860,11 @@ func (adminport *Adminport) GetMessageKeyFromRequest(r *http.Request) (string, e
 	}
 }
 
-func authenticateRequest(request *http.Request) (cbauth.Creds, error) {
+func authenticateRequest(request *http.Request) (AdminportCreds, error) {
 	var err error
-	creds, err := cbauth.AuthWebCreds(request)
+	creds, err := getAdminportAuthenticator().Authenticate(request)
 	if err != nil {
-		logger_ap.Errorf("Error authenticating request. request=%v\n err= %v\n", request, err)
+		logger_ap.Errorf("Error authenticating request. method=%v, url=%v\n err= %v\n", request.Method, request.URL, err)
 		return nil, err
 	}
 
@@ -740,7 +872,7 @@ func authenticateRequest(request *http.Request) (cbauth.Creds, error) {
 	return creds, nil
 }
 
-func authorizeRequest(creds cbauth.Creds, permission string) (bool, error) {
+func authorizeRequest(creds AdminportCreds, permission string) (bool, error) {
 	allowed, err := creds.IsAllowed(permission)
 	if err != nil {
 		logger_ap.Errorf("Error occured when checking for permission %v for creds %v. err=%v\n", permission, creds.Name(), err)
@@ -754,7 +886,7 @@ func authWebCreds(request *http.Request, permission string) (*ap.Response, error
 	creds, err := authenticateRequest(request)
 
 	if err != nil {
-		if err == cbauth.ErrNoAuth {
+		if err == ErrorNoAuth {
 			return EncodeErrorMessageIntoResponse(err, http.StatusUnauthorized)
 		} else {
 			return nil, err
@@ -777,7 +909,7 @@ func authWebCredsForReplication(request *http.Request, replicationId string, per
 	creds, err := authenticateRequest(request)
 
 	if err != nil {
-		if err == cbauth.ErrNoAuth {
+		if err == ErrorNoAuth {
 			return EncodeErrorMessageIntoResponse(err, http.StatusUnauthorized)
 		} else {
 			return nil, err
@@ -818,6 +950,21 @@ func authWebCredsForReplication(request *http.Request, replicationId string, per
 	return nil, nil
 }
 
+// returns whether credentials in request have the specified permission on the source bucket of the replication
+func hasPermissionForReplication(request *http.Request, replicationId string, permissionSuffix string) (bool, error) {
+	creds, err := authenticateRequest(request)
+	if err != nil {
+		return false, err
+	}
+
+	sourceBucket, err := metadata.GetSourceBucketNameFromReplicationId(replicationId)
+	if err != nil {
+		return false, err
+	}
+
+	return authorizeRequest(creds, constructBucketPermission(sourceBucket, permissionSuffix))
+}
+
 func constructBucketPermission(bucketName, suffix string) string {
 	return base.PermissionBucketPrefix + bucketName + suffix
 }
@@ -835,7 +982,7 @@ func writeRemoteClusterAuditEvent(eventId uint32, remoteClusterRef *metadata.Rem
 }
 
 func getRealUserIdFromRequest(request *http.Request) *base.RealUserId {
-	creds, err := cbauth.AuthWebCreds(request)
+	creds, err := getAdminportAuthenticator().Authenticate(request)
 	if err != nil {
 		logger_rm.Errorf("Error getting real user id from http request. err=%v\n", err)
 		// put unknown user in the audit log.
@@ -857,13 +1004,29 @@ func (adminport *Adminport) doRegexpValidationRequest(request *http.Request) (*a
 		return response, err
 	}
 
-	expression, keys, err := DecodeRegexpValidationRequest(request)
+	expression, keys, docFilterExpression, docs, err := DecodeRegexpValidationRequest(request)
 	if err != nil {
 		return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
 	}
 
-	logger_ap.Infof("Request params: expression=%v, keys=%v\n",
-		expression, keys)
+	logger_ap.Infof("Request params: expression=%v, keys=%v, docFilterExpression=%v\n",
+		expression, keys, docFilterExpression)
+
+	if len(docFilterExpression) > 0 {
+		matchesMap, err := utils.GetMatchedDocs(expression, docFilterExpression, docs)
+		if err != nil {
+			return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+		}
+		return NewDocFilterValidationResponse(matchesMap)
+	}
+
+	if filter.IsStructuredKeyFilter(expression) {
+		resultsMap, err := utils.GetKeyFilterResults(expression, keys)
+		if err != nil {
+			return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+		}
+		return NewKeyFilterValidationResponse(resultsMap)
+	}
 
 	matchesMap, err := utils.GetMatchedKeys(expression, keys)
 	if err != nil {
@@ -874,6 +1037,29 @@ func (adminport *Adminport) doRegexpValidationRequest(request *http.Request) (*a
 
 }
 
+func (adminport *Adminport) doKeyTransformPreviewRequest(request *http.Request) (*ap.Response, error) {
+	logger_ap.Infof("doKeyTransformPreviewRequest\n")
+
+	response, err := authWebCreds(request, base.PermissionXDCRInternalRead)
+	if response != nil || err != nil {
+		return response, err
+	}
+
+	keyTransformRules, keys, err := DecodeKeyTransformPreviewRequest(request)
+	if err != nil {
+		return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+	}
+
+	logger_ap.Infof("Request params: keyTransformRules=%v, keys=%v\n", keyTransformRules, keys)
+
+	transformedKeysMap, err := utils.GetTransformedKeys(keyTransformRules, keys)
+	if err != nil {
+		return EncodeErrorMessageIntoResponse(err, http.StatusBadRequest)
+	}
+
+	return NewKeyTransformPreviewResponse(transformedKeysMap)
+}
+
 func (adminport *Adminport) doStartBlockProfile(request *http.Request) (*ap.Response, error) {
 	response, err := authWebCreds(request, base.PermissionXDCRInternalWrite)
 	if response != nil || err != nil {
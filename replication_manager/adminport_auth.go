@@ -0,0 +1,352 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// authentication of adminport requests
+
+package replication_manager
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/couchbase/cbauth"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var ErrorNoAuth = errors.New("Authentication failure")
+var ErrorAdminportAuthNotInStandaloneMode = errors.New("Adminport authentication types other than cbauth are available in standalone mode only.")
+var ErrorCbauthInStandaloneMode = errors.New("Adminport authentication type cbauth is not available in standalone mode.")
+
+// types of adminport authenticators that can be selected at startup
+const (
+	CbauthAuthType = "cbauth"
+	TokenAuthType  = "token"
+	CertAuthType   = "cert"
+)
+
+// credentials of an authenticated adminport request
+type AdminportCreds interface {
+	// name of the user
+	Name() string
+	// where the user is defined, which goes into audit logs along with user name
+	Source() string
+	// whether the user has the specified permission, e.g., cluster.xdcr.settings!write
+	IsAllowed(permission string) (bool, error)
+}
+
+type AdminportAuthenticator interface {
+	// returns ErrorNoAuth when request does not carry valid credentials
+	Authenticate(request *http.Request) (AdminportCreds, error)
+}
+
+// implemented by authenticators that work off client certificates,
+// which requires adminport to serve over tls with the returned config
+type AdminportTLSAuthenticator interface {
+	AdminportAuthenticator
+	TLSConfig() *tls.Config
+}
+
+var adminport_authenticator AdminportAuthenticator = &CbauthAuthenticator{}
+var adminport_authenticator_lock sync.RWMutex
+
+// replaces the default cbauth authenticator. needs to be called before replication manager is started
+func SetAdminportAuthenticator(authenticator AdminportAuthenticator) {
+	adminport_authenticator_lock.Lock()
+	defer adminport_authenticator_lock.Unlock()
+	adminport_authenticator = authenticator
+}
+
+func getAdminportAuthenticator() AdminportAuthenticator {
+	adminport_authenticator_lock.RLock()
+	defer adminport_authenticator_lock.RUnlock()
+	return adminport_authenticator
+}
+
+// returns nil when adminport is to serve over plain http
+func getAdminportTLSConfig() *tls.Config {
+	if tls_authenticator, ok := getAdminportAuthenticator().(AdminportTLSAuthenticator); ok {
+		return tls_authenticator.TLSConfig()
+	}
+	return nil
+}
+
+// config file for token and cert authenticators
+type AdminportAuthConfig struct {
+	// users of token authenticator
+	Tokens []*TokenUserConfig `json:"tokens"`
+
+	// server certificate and key of adminport, and CAs that client certificates need to be signed by
+	CertFile     string `json:"certFile"`
+	KeyFile      string `json:"keyFile"`
+	ClientCAFile string `json:"clientCAFile"`
+	// field of client certificates that names of cert users are matched against. defaults to CertUserFieldCommonName
+	CertUserField string `json:"certUserField"`
+	// users of cert authenticator
+	CertUsers []*CertUserConfig `json:"certUsers"`
+}
+
+// constructs authenticator of the specified type. config file is required for all types except cbauth.
+// cbauth is the only type available with ns_server, and the only type not available in standalone mode
+func NewAdminportAuthenticator(authType string, configFile string, standalone bool) (AdminportAuthenticator, error) {
+	if authType != CbauthAuthType && authType != TokenAuthType && authType != CertAuthType {
+		return nil, fmt.Errorf("Adminport authentication type %v is not supported", authType)
+	}
+	if authType == CbauthAuthType {
+		if standalone {
+			return nil, ErrorCbauthInStandaloneMode
+		}
+		return &CbauthAuthenticator{}, nil
+	}
+	if !standalone {
+		return nil, ErrorAdminportAuthNotInStandaloneMode
+	}
+	if configFile == "" {
+		return nil, fmt.Errorf("Config file is required for adminport authentication type %v", authType)
+	}
+
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &AdminportAuthConfig{}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing adminport authentication config file %v. err=%v", configFile, err)
+	}
+
+	if authType == TokenAuthType {
+		return NewStaticTokenAuthenticator(config.Tokens)
+	}
+	return NewClientCertAuthenticator(config.CertFile, config.KeyFile, config.ClientCAFile, config.CertUserField, config.CertUsers)
+}
+
+/************************************
+/* cbauth authenticator
+*************************************/
+
+// authenticates requests through ns_server, which is the default
+type CbauthAuthenticator struct {
+}
+
+func (authenticator *CbauthAuthenticator) Authenticate(request *http.Request) (AdminportCreds, error) {
+	creds, err := cbauth.AuthWebCreds(request)
+	if err == cbauth.ErrNoAuth {
+		return nil, ErrorNoAuth
+	} else if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+/************************************
+/* static credentials authenticator
+*************************************/
+
+// authenticates requests against a single administrator, who has all permissions.
+// this is used when xdcr runs in standalone mode, where there is no ns_server
+type StaticCredentialsAuthenticator struct {
+	username string
+	password string
+}
+
+func NewStaticCredentialsAuthenticator(username, password string) *StaticCredentialsAuthenticator {
+	return &StaticCredentialsAuthenticator{
+		username: username,
+		password: password,
+	}
+}
+
+func (authenticator *StaticCredentialsAuthenticator) Authenticate(request *http.Request) (AdminportCreds, error) {
+	username, password, ok := request.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(username), []byte(authenticator.username)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(authenticator.password)) != 1 {
+		return nil, ErrorNoAuth
+	}
+	return &roleCreds{
+		name:   username,
+		source: "admin",
+		roles:  []*AdminportRole{AdminportRoles[AdminRole]},
+	}, nil
+}
+
+/************************************
+/* static token authenticator
+*************************************/
+
+const BearerAuthPrefix = "Bearer "
+
+type TokenUserConfig struct {
+	Token string   `json:"token"`
+	User  string   `json:"user"`
+	Roles []string `json:"roles"`
+}
+
+// authenticates requests by bearer tokens in Authorization header, each of which belongs to a user with fixed roles
+type StaticTokenAuthenticator struct {
+	// keyed by sha256 hash of token, so that lookups do not reveal tokens through timing
+	users map[[sha256.Size]byte]*roleCreds
+}
+
+func NewStaticTokenAuthenticator(tokenUsers []*TokenUserConfig) (*StaticTokenAuthenticator, error) {
+	if len(tokenUsers) == 0 {
+		return nil, fmt.Errorf("No tokens are specified for token authenticator")
+	}
+
+	users := make(map[[sha256.Size]byte]*roleCreds)
+	for _, tokenUser := range tokenUsers {
+		if tokenUser.Token == "" || tokenUser.User == "" {
+			return nil, fmt.Errorf("Token and user are required for all tokens")
+		}
+		roles, err := GetAdminportRoles(tokenUser.Roles)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid roles for user %v. err=%v", tokenUser.User, err)
+		}
+		tokenHash := sha256.Sum256([]byte(tokenUser.Token))
+		if _, ok := users[tokenHash]; ok {
+			return nil, fmt.Errorf("Token of user %v is used by another user", tokenUser.User)
+		}
+		users[tokenHash] = &roleCreds{
+			name:   tokenUser.User,
+			source: "local",
+			roles:  roles,
+		}
+	}
+	return &StaticTokenAuthenticator{users: users}, nil
+}
+
+func (authenticator *StaticTokenAuthenticator) Authenticate(request *http.Request) (AdminportCreds, error) {
+	authHeader := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, BearerAuthPrefix) {
+		return nil, ErrorNoAuth
+	}
+	creds, ok := authenticator.users[sha256.Sum256([]byte(authHeader[len(BearerAuthPrefix):]))]
+	if !ok {
+		return nil, ErrorNoAuth
+	}
+	return creds, nil
+}
+
+/************************************
+/* client certificate authenticator
+*************************************/
+
+// fields of client certificates that names of cert users can be matched against
+const (
+	CertUserFieldCommonName = "subject.cn"
+	CertUserFieldDNSName    = "san.dnsname"
+	CertUserFieldEmail      = "san.email"
+)
+
+type CertUserConfig struct {
+	// matched against the configured field of client certificate
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// authenticates requests by client certificates, which adminport verifies during tls handshake.
+// certificates are mapped to users with fixed roles by the names in them
+type ClientCertAuthenticator struct {
+	// the one field of client certificates that user names are matched against
+	userField string
+	users     map[string]*roleCreds
+	tlsConfig *tls.Config
+}
+
+func NewClientCertAuthenticator(certFile, keyFile, clientCAFile, userField string, certUsers []*CertUserConfig) (*ClientCertAuthenticator, error) {
+	if certFile == "" || keyFile == "" || clientCAFile == "" {
+		return nil, fmt.Errorf("CertFile, keyFile and clientCAFile are required for cert authenticator")
+	}
+	switch userField {
+	case "":
+		userField = CertUserFieldCommonName
+	case CertUserFieldCommonName, CertUserFieldDNSName, CertUserFieldEmail:
+	default:
+		return nil, fmt.Errorf("Cert user field %v is not supported", userField)
+	}
+	if len(certUsers) == 0 {
+		return nil, fmt.Errorf("No users are specified for cert authenticator")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading adminport certificate. err=%v", err)
+	}
+	caPEM, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("No valid certificates are found in %v", clientCAFile)
+	}
+
+	users := make(map[string]*roleCreds)
+	for _, certUser := range certUsers {
+		if certUser.Name == "" {
+			return nil, fmt.Errorf("Name is required for all cert users")
+		}
+		if _, ok := users[certUser.Name]; ok {
+			return nil, fmt.Errorf("Cert user %v is specified more than once", certUser.Name)
+		}
+		roles, err := GetAdminportRoles(certUser.Roles)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid roles for cert user %v. err=%v", certUser.Name, err)
+		}
+		users[certUser.Name] = &roleCreds{
+			name:   certUser.Name,
+			source: "external",
+			roles:  roles,
+		}
+	}
+
+	return &ClientCertAuthenticator{
+		userField: userField,
+		users:     users,
+		tlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}, nil
+}
+
+func (authenticator *ClientCertAuthenticator) Authenticate(request *http.Request) (AdminportCreds, error) {
+	if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 || len(request.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrorNoAuth
+	}
+
+	clientCert := request.TLS.VerifiedChains[0][0]
+	var names []string
+	switch authenticator.userField {
+	case CertUserFieldCommonName:
+		names = []string{clientCert.Subject.CommonName}
+	case CertUserFieldDNSName:
+		names = clientCert.DNSNames
+	case CertUserFieldEmail:
+		names = clientCert.EmailAddresses
+	}
+	for _, name := range names {
+		if creds, ok := authenticator.users[name]; ok {
+			return creds, nil
+		}
+	}
+	return nil, ErrorNoAuth
+}
+
+func (authenticator *ClientCertAuthenticator) TLSConfig() *tls.Config {
+	return authenticator.tlsConfig
+}
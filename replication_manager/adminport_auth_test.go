@@ -0,0 +1,295 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package replication_manager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/couchbase/goxdcr/base"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAdminportRoles(t *testing.T) {
+	bucketWrite := constructBucketPermission("travel", base.PermissionBucketXDCRWriteSuffix)
+	bucketRead := constructBucketPermission("travel", base.PermissionBucketXDCRReadSuffix)
+
+	expected := []struct {
+		role       string
+		permission string
+		allowed    bool
+	}{
+		{AdminRole, base.PermissionXDCRInternalWrite, true},
+		{AdminRole, bucketWrite, true},
+		{ReplicationAdminRole, base.PermissionXDCRSettingsWrite, true},
+		{ReplicationAdminRole, bucketWrite, true},
+		{ReplicationAdminRole, base.PermissionXDCRInternalRead, false},
+		{ReadOnlyAdminRole, base.PermissionRemoteClusterRead, true},
+		{ReadOnlyAdminRole, bucketRead, true},
+		{ReadOnlyAdminRole, bucketWrite, false},
+		{ReadOnlyAdminRole, base.PermissionXDCRSettingsWrite, false},
+		{ReadOnlyAdminRole, constructBucketPermission("", base.PermissionBucketXDCRReadSuffix), false},
+	}
+	for _, e := range expected {
+		if allowed := AdminportRoles[e.role].IsAllowed(e.permission); allowed != e.allowed {
+			t.Errorf("Role %v with permission %v: expected allowed=%v, got %v", e.role, e.permission, e.allowed, allowed)
+		}
+	}
+
+	if _, err := GetAdminportRoles([]string{ReplicationAdminRole, "bucket_admin"}); err == nil {
+		t.Errorf("Undefined role should have been rejected")
+	}
+}
+
+func TestStaticTokenAuthenticator(t *testing.T) {
+	authenticator, err := NewStaticTokenAuthenticator([]*TokenUserConfig{
+		&TokenUserConfig{Token: "token1", User: "alice", Roles: []string{ReplicationAdminRole}},
+		&TokenUserConfig{Token: "token2", User: "bob", Roles: []string{ReadOnlyAdminRole}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("GET", "/pools/default/remoteClusters", nil)
+	if _, err = authenticator.Authenticate(request); err != ErrorNoAuth {
+		t.Errorf("Request without token should not be authenticated. err=%v", err)
+	}
+	request.Header.Set("Authorization", BearerAuthPrefix+"token3")
+	if _, err = authenticator.Authenticate(request); err != ErrorNoAuth {
+		t.Errorf("Request with unknown token should not be authenticated. err=%v", err)
+	}
+
+	request.Header.Set("Authorization", BearerAuthPrefix+"token2")
+	creds, err := authenticator.Authenticate(request)
+	if err != nil || creds.Name() != "bob" {
+		t.Fatalf("Wrong creds %v. err=%v", creds, err)
+	}
+	if allowed, _ := creds.IsAllowed(base.PermissionRemoteClusterWrite); allowed {
+		t.Errorf("Read only user should not be allowed to write remote clusters")
+	}
+
+	_, err = NewStaticTokenAuthenticator([]*TokenUserConfig{
+		&TokenUserConfig{Token: "token1", User: "alice", Roles: []string{AdminRole}},
+		&TokenUserConfig{Token: "token1", User: "bob", Roles: []string{AdminRole}},
+	})
+	if err == nil {
+		t.Errorf("Duplicate tokens should have been rejected")
+	}
+}
+
+func TestClientCertAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "adminport_auth_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caCert, caKey := createTestCert(t, "test ca", nil, nil)
+	serverCert, serverKey := createTestCert(t, "localhost", caCert, caKey)
+	clientCert, clientKey := createTestCert(t, "replicator", caCert, caKey)
+	otherClientCert, otherClientKey := createTestCert(t, "intruder", caCert, caKey)
+
+	certFile := writeTestPEM(t, dir, "server.pem", "CERTIFICATE", serverCert.Raw)
+	keyFile := writeTestPEM(t, dir, "server.key", "EC PRIVATE KEY", marshalTestKey(t, serverKey))
+	caFile := writeTestPEM(t, dir, "ca.pem", "CERTIFICATE", caCert.Raw)
+
+	authenticator, err := NewClientCertAuthenticator(certFile, keyFile, caFile, "", []*CertUserConfig{
+		&CertUserConfig{Name: "replicator", Roles: []string{ReplicationAdminRole}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		creds, err := authenticator.Authenticate(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if allowed, _ := creds.IsAllowed(base.PermissionXDCRSettingsWrite); !allowed {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(creds.Name()))
+	}))
+	server.TLS = authenticator.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(caCert)
+	newClient := func(cert *x509.Certificate, key *ecdsa.PrivateKey) *http.Client {
+		tlsConfig := &tls.Config{RootCAs: rootCAs, ServerName: "localhost"}
+		if cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	}
+
+	resp, err := newClient(clientCert, clientKey).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "replicator" {
+		t.Errorf("Wrong response for known client. status=%v, body=%s", resp.StatusCode, body)
+	}
+
+	resp, err = newClient(otherClientCert, otherClientKey).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Wrong response for unknown client. status=%v", resp.StatusCode)
+	}
+
+	// tls handshake fails without client certificate
+	if resp, err = newClient(nil, nil).Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("Request without client certificate should have failed")
+	}
+}
+
+func TestClientCertAuthenticatorUserField(t *testing.T) {
+	dir, err := ioutil.TempDir("", "adminport_auth_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caCert, caKey := createTestCert(t, "test ca", nil, nil)
+	serverCert, serverKey := createTestCert(t, "localhost", caCert, caKey)
+	certFile := writeTestPEM(t, dir, "server.pem", "CERTIFICATE", serverCert.Raw)
+	keyFile := writeTestPEM(t, dir, "server.key", "EC PRIVATE KEY", marshalTestKey(t, serverKey))
+	caFile := writeTestPEM(t, dir, "ca.pem", "CERTIFICATE", caCert.Raw)
+
+	// the user name appears in a different field of each certificate
+	certs := map[string]*x509.Certificate{
+		CertUserFieldCommonName: &x509.Certificate{Subject: pkix.Name{CommonName: "replicator"}},
+		CertUserFieldDNSName:    &x509.Certificate{Subject: pkix.Name{CommonName: "other"}, DNSNames: []string{"replicator"}},
+		CertUserFieldEmail:      &x509.Certificate{Subject: pkix.Name{CommonName: "other"}, EmailAddresses: []string{"replicator"}},
+	}
+	for userField := range certs {
+		authenticator, err := NewClientCertAuthenticator(certFile, keyFile, caFile, userField, []*CertUserConfig{
+			&CertUserConfig{Name: "replicator", Roles: []string{ReplicationAdminRole}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// only the certificate with the user name in the configured field is accepted
+		for certField, cert := range certs {
+			request := &http.Request{TLS: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}}
+			_, err := authenticator.Authenticate(request)
+			if certField == userField && err != nil {
+				t.Errorf("Certificate with user name in %v should have been accepted. err=%v", certField, err)
+			} else if certField != userField && err != ErrorNoAuth {
+				t.Errorf("Certificate with user name in %v should have been rejected when matching on %v. err=%v", certField, userField, err)
+			}
+		}
+	}
+
+	if _, err = NewClientCertAuthenticator(certFile, keyFile, caFile, "subject.o", []*CertUserConfig{
+		&CertUserConfig{Name: "replicator", Roles: []string{ReplicationAdminRole}},
+	}); err == nil {
+		t.Errorf("Unsupported cert user field should have been rejected")
+	}
+}
+
+func TestAdminportAuthenticatorTypeAndMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "adminport_auth_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "auth.json")
+	err = ioutil.WriteFile(configFile, []byte(`{"tokens": [{"token": "secret", "user": "replicator", "roles": ["admin"]}]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewAdminportAuthenticator(TokenAuthType, configFile, false); err != ErrorAdminportAuthNotInStandaloneMode {
+		t.Errorf("Token authenticator should have been rejected with ns_server. err=%v", err)
+	}
+	if _, err = NewAdminportAuthenticator(TokenAuthType, configFile, true); err != nil {
+		t.Errorf("Token authenticator should have been accepted in standalone mode. err=%v", err)
+	}
+	if _, err = NewAdminportAuthenticator(CbauthAuthType, "", true); err != ErrorCbauthInStandaloneMode {
+		t.Errorf("Cbauth authenticator should have been rejected in standalone mode. err=%v", err)
+	}
+	if _, err = NewAdminportAuthenticator(CbauthAuthType, "", false); err != nil {
+		t.Errorf("Cbauth authenticator should have been accepted with ns_server. err=%v", err)
+	}
+}
+
+// creates a certificate signed by parent, or a self signed CA certificate when parent is nil
+func createTestCert(t *testing.T, commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialNumber, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{commonName},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func marshalTestKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func writeTestPEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	file_path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(file_path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file_path
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// roles used by adminport authenticators other than cbauth.
+// a role maps onto the permissions checked by adminport, e.g., cluster.xdcr.settings!write
+
+package replication_manager
+
+import (
+	"fmt"
+	"github.com/couchbase/goxdcr/base"
+	"strings"
+)
+
+const (
+	// all permissions, including those of internal settings
+	AdminRole = "admin"
+	// management of remote cluster references, replications and replication settings
+	ReplicationAdminRole = "replication_admin"
+	// read access to remote cluster references, replications and replication settings
+	ReadOnlyAdminRole = "ro_admin"
+)
+
+// used in place of bucket name in bucket permissions of roles, to match all buckets
+const AnyBucket = "*"
+
+type AdminportRole struct {
+	Name        string
+	Permissions []string
+}
+
+var AdminportRoles = map[string]*AdminportRole{
+	AdminRole: &AdminportRole{
+		Name: AdminRole,
+		Permissions: []string{
+			base.PermissionRemoteClusterRead,
+			base.PermissionRemoteClusterWrite,
+			base.PermissionXDCRSettingsRead,
+			base.PermissionXDCRSettingsWrite,
+			anyBucketPermission(base.PermissionBucketXDCRReadSuffix),
+			anyBucketPermission(base.PermissionBucketXDCRWriteSuffix),
+			anyBucketPermission(base.PermissionBucketXDCRExecuteSuffix),
+			base.PermissionXDCRInternalRead,
+			base.PermissionXDCRInternalWrite,
+		},
+	},
+	ReplicationAdminRole: &AdminportRole{
+		Name: ReplicationAdminRole,
+		Permissions: []string{
+			base.PermissionRemoteClusterRead,
+			base.PermissionRemoteClusterWrite,
+			base.PermissionXDCRSettingsRead,
+			base.PermissionXDCRSettingsWrite,
+			anyBucketPermission(base.PermissionBucketXDCRReadSuffix),
+			anyBucketPermission(base.PermissionBucketXDCRWriteSuffix),
+			anyBucketPermission(base.PermissionBucketXDCRExecuteSuffix),
+		},
+	},
+	ReadOnlyAdminRole: &AdminportRole{
+		Name: ReadOnlyAdminRole,
+		Permissions: []string{
+			base.PermissionRemoteClusterRead,
+			base.PermissionXDCRSettingsRead,
+			anyBucketPermission(base.PermissionBucketXDCRReadSuffix),
+		},
+	},
+}
+
+func anyBucketPermission(suffix string) string {
+	return constructBucketPermission(AnyBucket, suffix)
+}
+
+// looks up roles by name. returns error if any of the roles is not defined
+func GetAdminportRoles(roleNames []string) ([]*AdminportRole, error) {
+	if len(roleNames) == 0 {
+		return nil, fmt.Errorf("No roles are specified")
+	}
+	roles := make([]*AdminportRole, 0, len(roleNames))
+	for _, roleName := range roleNames {
+		role, ok := AdminportRoles[roleName]
+		if !ok {
+			return nil, fmt.Errorf("Role %v is not defined", roleName)
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+func (role *AdminportRole) IsAllowed(permission string) bool {
+	for _, rolePermission := range role.Permissions {
+		if permissionMatches(rolePermission, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether permission of a role, which may be for all buckets, matches the permission being checked
+func permissionMatches(rolePermission, permission string) bool {
+	if rolePermission == permission {
+		return true
+	}
+
+	anyBucketPrefix := base.PermissionBucketPrefix + AnyBucket
+	if !strings.HasPrefix(rolePermission, anyBucketPrefix) {
+		return false
+	}
+	suffix := rolePermission[len(anyBucketPrefix):]
+	// bucket name in permission needs to be non-empty
+	return len(permission) > len(base.PermissionBucketPrefix)+len(suffix) &&
+		strings.HasPrefix(permission, base.PermissionBucketPrefix) &&
+		strings.HasSuffix(permission, suffix)
+}
+
+// credentials of a user with a fixed set of roles
+type roleCreds struct {
+	name   string
+	source string
+	roles  []*AdminportRole
+}
+
+func (creds *roleCreds) Name() string {
+	return creds.name
+}
+
+func (creds *roleCreds) Source() string {
+	return creds.source
+}
+
+func (creds *roleCreds) IsAllowed(permission string) (bool, error) {
+	for _, role := range creds.roles {
+		if role.IsAllowed(permission) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -13,7 +13,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"github.com/couchbase/cbauth/metakv"
 	mc "github.com/couchbase/gomemcached"
 	"github.com/couchbase/goxdcr/base"
 	"github.com/couchbase/goxdcr/log"
@@ -40,12 +39,15 @@ type MetakvChangeListener struct {
 	number_of_retry            int
 	children_waitgrp           *sync.WaitGroup
 	metadata_service_call_back base.MetadataServiceCallback
-	logger                     *log.CommonLogger
+	// metadata service whose changes are observed, which is backed by metakv in a couchbase cluster
+	metadata_service service_def.MetadataSvc
+	logger           *log.CommonLogger
 }
 
 func NewMetakvChangeListener(id, dirpath string, cancel_chan chan struct{},
 	children_waitgrp *sync.WaitGroup,
 	metadata_service_call_back base.MetadataServiceCallback,
+	metadata_service service_def.MetadataSvc,
 	logger_ctx *log.LoggerContext,
 	logger_name string) *MetakvChangeListener {
 	return &MetakvChangeListener{
@@ -54,6 +56,7 @@ func NewMetakvChangeListener(id, dirpath string, cancel_chan chan struct{},
 		cancel_chan:                cancel_chan,
 		children_waitgrp:           children_waitgrp,
 		metadata_service_call_back: metadata_service_call_back,
+		metadata_service:           metadata_service,
 		logger: log.NewLogger(logger_name, logger_ctx),
 	}
 }
@@ -73,7 +76,7 @@ func (mcl *MetakvChangeListener) Start() error {
 
 func (mcl *MetakvChangeListener) observeChildren() {
 	defer mcl.children_waitgrp.Done()
-	err := metakv.RunObserveChildren(mcl.dirpath, mcl.metakvCallback, mcl.cancel_chan)
+	err := mcl.metadata_service.ObserveChildren(mcl.dirpath, mcl.metakvCallback, mcl.cancel_chan)
 	// call failure call back only when there are real errors
 	// err may be nil when observeChildren is canceled, in which case there is no need to call failure call back
 	mcl.failureCallback(err)
@@ -102,7 +105,7 @@ func (mcl *MetakvChangeListener) metakvCallback_async(path string, value []byte,
 
 // callback function for listener failure event
 func (mcl *MetakvChangeListener) failureCallback(err error) {
-	mcl.logger.Infof("metakv.RunObserveChildren failed, err=%v\n", err)
+	mcl.logger.Infof("ObserveChildren failed, err=%v\n", err)
 	if err == nil && !isReplicationManagerRunning() {
 		//callback is cancelled and replication_mgr is exiting.
 		//no-op
@@ -124,6 +127,7 @@ type ReplicationSpecChangeListener struct {
 }
 
 func NewReplicationSpecChangeListener(repl_spec_svc service_def.ReplicationSpecSvc,
+	metadata_service service_def.MetadataSvc,
 	cancel_chan chan struct{},
 	children_waitgrp *sync.WaitGroup,
 	logger_ctx *log.LoggerContext) *ReplicationSpecChangeListener {
@@ -133,6 +137,7 @@ func NewReplicationSpecChangeListener(repl_spec_svc service_def.ReplicationSpecS
 			cancel_chan,
 			children_waitgrp,
 			repl_spec_svc.ReplicationSpecServiceCallback,
+			metadata_service,
 			logger_ctx,
 			"ReplicationSpecChangeListener"),
 	}
@@ -175,6 +180,12 @@ func (rscl *ReplicationSpecChangeListener) replicationSpecChangeHandlerCallback(
 	}
 
 	if specActive_old && specActive {
+		// changes that need checkpoints to be reset are checked first, since the checkpoints need to be reset
+		// even when other settings that require pipeline reconstruction have been changed along with them
+		if resetNeeded, reason := needToResetCheckpoints(oldSettings, newSpec.Settings); resetNeeded {
+			return rscl.restartPipelineWithCheckpointsReset(newSpec, reason)
+		}
+
 		// if some critical settings have been changed, stop, reconstruct, and restart pipeline
 		if needToReconstructPipeline(oldSettings, newSpec.Settings) {
 			rscl.logger.Infof("Restarting pipeline %v since the changes to replication spec are critical\n", topic)
@@ -200,13 +211,24 @@ func (rscl *ReplicationSpecChangeListener) replicationSpecChangeHandlerCallback(
 
 	} else if !specActive_old && specActive {
 		// start replication
+		if oldSettings != nil {
+			if resetNeeded, reason := needToResetCheckpoints(oldSettings, newSpec.Settings); resetNeeded {
+				return rscl.restartPipelineWithCheckpointsReset(newSpec, reason)
+			}
+		}
 		rscl.logger.Infof("Starting pipeline %v since the replication spec has been changed to active\n", topic)
 		go rscl.launchPipelineUpdate(topic)
 		return nil
 
 	} else {
 		// this is the case where pipeline is not running and spec is not active.
-		// nothing needs to be done
+		// checkpoints need to be reset if filter expressions have been changed with backfill, or if replay source
+		// has been changed, so that the replication starts over when it is resumed
+		if oldSettings != nil {
+			if resetNeeded, reason := needToResetCheckpoints(oldSettings, newSpec.Settings); resetNeeded {
+				return rscl.resetCheckpoints(newSpec, reason)
+			}
+		}
 		return nil
 	}
 }
@@ -241,6 +263,34 @@ func needToReconstructPipeline(oldSettings *metadata.ReplicationSettings, newSet
 	repTypeChanged := !(oldSettings.RepType == newSettings.RepType)
 	sourceNozzlePerNodeChanged := !(oldSettings.SourceNozzlePerNode == newSettings.SourceNozzlePerNode)
 	targetNozzlePerNodeChanged := !(oldSettings.TargetNozzlePerNode == newSettings.TargetNozzlePerNode)
+	processorsChanged := !(oldSettings.Processors == newSettings.Processors)
+	// compression is negotiated with target when connections are set up
+	compressionTypeChanged := !(oldSettings.CompressionType == newSettings.CompressionType)
+	// the sizes of data channels of outgoing nozzles depend on priority
+	priorityChanged := !(oldSettings.Priority == newSettings.Priority)
+	// conflict resolvers are set on outgoing nozzles when they are constructed
+	conflictResolverChanged := !(oldSettings.ConflictResolver == newSettings.ConflictResolver) ||
+		!(oldSettings.ConflictResolverField == newSettings.ConflictResolverField)
+	// conflict logger is registered with pipeline, and outgoing nozzles are told whether to record conflicts, at construction
+	conflictLogChanged := !(oldSettings.ConflictLogDestination == newSettings.ConflictLogDestination) ||
+		!(oldSettings.ConflictLogBucket == newSettings.ConflictLogBucket) ||
+		!(oldSettings.ConflictLogBodies == newSettings.ConflictLogBodies)
+	// export files are opened by file nozzles when they are constructed
+	exportChanged := !(oldSettings.ExportDir == newSettings.ExportDir) ||
+		!(oldSettings.ExportFormat == newSettings.ExportFormat) ||
+		!(oldSettings.ExportFileSizeMB == newSettings.ExportFileSizeMB) ||
+		!(oldSettings.ExportMaxFiles == newSettings.ExportMaxFiles)
+	// source nozzles are constructed as replay nozzles or dcp nozzles depending on replay settings
+	replayChanged := !(oldSettings.ReplayDir == newSettings.ReplayDir) ||
+		!(oldSettings.ReplayFormat == newSettings.ReplayFormat) ||
+		!(oldSettings.ReplayStartSeqno == newSettings.ReplayStartSeqno) ||
+		!(oldSettings.ReplayEndSeqno == newSettings.ReplayEndSeqno)
+	// webhook url and auth header are set on webhook nozzles when they are constructed
+	webhookChanged := !(oldSettings.WebhookURL == newSettings.WebhookURL) ||
+		!(oldSettings.WebhookAuthHeader == newSettings.WebhookAuthHeader)
+	// outgoing nozzles are constructed for all target vbs, and routers are connected to all of them, when keys are rewritten.
+	// changes to the rules themselves are applied to running routers
+	keyTransformToggled := (len(oldSettings.KeyTransformRules) == 0) != (len(newSettings.KeyTransformRules) == 0)
 
 	// the following may qualify for live update in the future.
 	// batchCount is tricky since the sizes of xmem data channels depend on it.
@@ -248,17 +298,75 @@ func needToReconstructPipeline(oldSettings *metadata.ReplicationSettings, newSet
 	batchCountChanged := (oldSettings.BatchCount != newSettings.BatchCount)
 	batchSizeChanged := (oldSettings.BatchSize != newSettings.BatchSize)
 
-	return repTypeChanged || sourceNozzlePerNodeChanged || targetNozzlePerNodeChanged ||
-		batchCountChanged || batchSizeChanged
+	return repTypeChanged || sourceNozzlePerNodeChanged || targetNozzlePerNodeChanged || processorsChanged ||
+		compressionTypeChanged || priorityChanged || conflictResolverChanged || conflictLogChanged || exportChanged || replayChanged || webhookChanged || keyTransformToggled || batchCountChanged || batchSizeChanged
+}
+
+// whether filter expressions have been changed
+func isFilterChanged(oldSettings *metadata.ReplicationSettings, newSettings *metadata.ReplicationSettings) bool {
+	return oldSettings.FilterExpression != newSettings.FilterExpression ||
+		oldSettings.DocFilterExpression != newSettings.DocFilterExpression
+}
+
+// whether filter expressions have been changed and the change needs to be backfilled
+func needToBackfillFilterChange(oldSettings *metadata.ReplicationSettings, newSettings *metadata.ReplicationSettings) bool {
+	return isFilterChanged(oldSettings, newSettings) && newSettings.FilterChangeMode == metadata.FilterChangeModeBackfill
+}
+
+// whether the replay settings that the starting seqnos of source nozzles depend on have been changed.
+// checkpoints taken before the change are seqnos of a different source, i.e., dcp or another archive,
+// or may be past a lowered replay start seqno, and replay nozzles would resume from them otherwise
+func isReplaySourceChanged(oldSettings *metadata.ReplicationSettings, newSettings *metadata.ReplicationSettings) bool {
+	return oldSettings.ReplayDir != newSettings.ReplayDir ||
+		oldSettings.ReplayFormat != newSettings.ReplayFormat ||
+		oldSettings.ReplayStartSeqno != newSettings.ReplayStartSeqno
+}
+
+// whether the export directory or format of a file replication has been changed.
+// the new directory, or files in the new format, need to hold all mutations, not only those after the checkpoints
+// that were taken while exporting to the old directory or in the old format
+func isExportDestinationChanged(oldSettings *metadata.ReplicationSettings, newSettings *metadata.ReplicationSettings) bool {
+	return newSettings.RepType == metadata.ReplicationTypeFile &&
+		(oldSettings.ExportDir != newSettings.ExportDir || oldSettings.ExportFormat != newSettings.ExportFormat)
+}
+
+// whether checkpoints need to be reset because of the settings change, and the reason for it
+func needToResetCheckpoints(oldSettings *metadata.ReplicationSettings, newSettings *metadata.ReplicationSettings) (bool, string) {
+	if needToBackfillFilterChange(oldSettings, newSettings) {
+		return true, "filter expressions have been changed with backfill"
+	}
+	if isReplaySourceChanged(oldSettings, newSettings) {
+		return true, "replay source has been changed"
+	}
+	if isExportDestinationChanged(oldSettings, newSettings) {
+		return true, "export directory or format has been changed"
+	}
+	return false, ""
+}
+
+// whether the handling of deletions and expirations has been changed
+func isDeletionHandlingChanged(oldSettings *metadata.ReplicationSettings, newSettings *metadata.ReplicationSettings) bool {
+	return oldSettings.DropDeletions != newSettings.DropDeletions ||
+		oldSettings.DropExpirations != newSettings.DropExpirations
 }
 
 func (rscl *ReplicationSpecChangeListener) liveUpdatePipeline(topic string, oldSettings *metadata.ReplicationSettings, newSettings *metadata.ReplicationSettings) error {
 	rscl.logger.Infof("Performing live update on pipeline %v \n", topic)
 
-	// perform live update on pipeline if qualifying settings have been changed
+	// perform live update on pipeline if qualifying settings have been changed.
+	// filter changes that are applied going forward, and changes to key transform rules, redaction rules,
+	// sampling percentage and the handling of deletions and expirations, are picked up by routers without restarting pipeline.
+	// changes to bandwidth limit and in-batch deduplication are picked up by outgoing nozzles
 	if oldSettings.LogLevel != newSettings.LogLevel || oldSettings.CheckpointInterval != newSettings.CheckpointInterval ||
 		oldSettings.StatsInterval != newSettings.StatsInterval ||
-		oldSettings.OptimisticReplicationThreshold != newSettings.OptimisticReplicationThreshold {
+		oldSettings.OptimisticReplicationThreshold != newSettings.OptimisticReplicationThreshold ||
+		isFilterChanged(oldSettings, newSettings) || isDeletionHandlingChanged(oldSettings, newSettings) ||
+		oldSettings.KeyTransformRules != newSettings.KeyTransformRules ||
+		oldSettings.RedactionRules != newSettings.RedactionRules ||
+		oldSettings.RedactionHashKey != newSettings.RedactionHashKey ||
+		oldSettings.SamplingPercentage != newSettings.SamplingPercentage ||
+		oldSettings.BandwidthLimit != newSettings.BandwidthLimit ||
+		oldSettings.DedupInBatch != newSettings.DedupInBatch {
 
 		rs, err := pipeline_manager.ReplicationStatus(topic)
 		if err != nil {
@@ -270,12 +378,52 @@ func (rscl *ReplicationSpecChangeListener) liveUpdatePipeline(topic string, oldS
 			return fmt.Errorf("Cannot find pipeline with topic %v", topic)
 		}
 
-		return pipeline.UpdateSettings(newSettings.ToMap())
+		err = pipeline.UpdateSettings(newSettings.ToMap())
+		if err == nil && oldSettings.BandwidthLimit != newSettings.BandwidthLimit {
+			// bandwidth limits cap the shares of the global bandwidth budget
+			pipeline_manager.AllocateBandwidth()
+		}
+		return err
 	}
 
 	return nil
 }
 
+// stops pipeline, resets the checkpoints of the vbuckets owned by the current node, and restarts pipeline,
+// so that documents that newly match the changed filter expressions are re-sent to target, or that the
+// changed replay source is replayed from its start.
+// all of these are done by the pipeline updater, which resets checkpoints only after the pipeline has been
+// stopped successfully, so that the pipeline does not write checkpoints after they are reset
+func (rscl *ReplicationSpecChangeListener) restartPipelineWithCheckpointsReset(spec *metadata.ReplicationSpecification, reason string) error {
+	rscl.logger.Infof("Restarting pipeline %v with checkpoints reset since %v\n", spec.Id, reason)
+
+	return pipeline_manager.UpdateWithAction(spec.Id, func() error {
+		return rscl.resetCheckpoints(spec, reason)
+	})
+}
+
+// removes the checkpoints of the vbuckets owned by the current node.
+// every node handles the settings change for its own vbuckets
+func (rscl *ReplicationSpecChangeListener) resetCheckpoints(spec *metadata.ReplicationSpecification, reason string) error {
+	kv_vb_map, err := pipeline_utils.GetSourceVBMap(ClusterInfoService(), XDCRCompTopologyService(), spec.SourceBucketName, rscl.logger)
+	if err != nil {
+		return err
+	}
+
+	for _, vbnos := range kv_vb_map {
+		for _, vbno := range vbnos {
+			err = CheckpointService().DelCheckpointsDoc(spec.Id, vbno)
+			if err != nil && err != service_def.MetadataNotFoundErr {
+				rscl.logger.Errorf("Error resetting checkpoints for replication %v and vbno %v. err=%v\n", spec.Id, vbno, err)
+				return err
+			}
+		}
+	}
+
+	rscl.logger.Infof("Reset checkpoints for replication %v since %v\n", spec.Id, reason)
+	return nil
+}
+
 // listener for remote clusters
 type RemoteClusterChangeListener struct {
 	*MetakvChangeListener
@@ -285,6 +433,7 @@ type RemoteClusterChangeListener struct {
 
 func NewRemoteClusterChangeListener(remote_cluster_svc service_def.RemoteClusterSvc,
 	repl_spec_svc service_def.ReplicationSpecSvc,
+	metadata_service service_def.MetadataSvc,
 	cancel_chan chan struct{},
 	children_waitgrp *sync.WaitGroup,
 	logger_ctx *log.LoggerContext) *RemoteClusterChangeListener {
@@ -294,6 +443,7 @@ func NewRemoteClusterChangeListener(remote_cluster_svc service_def.RemoteCluster
 			cancel_chan,
 			children_waitgrp,
 			remote_cluster_svc.RemoteClusterServiceCallback,
+			metadata_service,
 			logger_ctx,
 			"RemoteClusterChangeListener"),
 		repl_spec_svc,
@@ -414,6 +564,7 @@ type GlobalSettingChangeListener struct {
 }
 
 func NewGlobalSettingChangeListener(process_setting_svc service_def.GlobalSettingsSvc,
+	metadata_service service_def.MetadataSvc,
 	cancel_chan chan struct{},
 	children_waitgrp *sync.WaitGroup,
 	logger_ctx *log.LoggerContext) *GlobalSettingChangeListener {
@@ -423,6 +574,7 @@ func NewGlobalSettingChangeListener(process_setting_svc service_def.GlobalSettin
 			cancel_chan,
 			children_waitgrp,
 			process_setting_svc.GlobalSettingsServiceCallback,
+			metadata_service,
 			logger_ctx,
 			"GlobalSettingChangeListener"),
 	}
@@ -468,6 +620,8 @@ func (pscl *GlobalSettingChangeListener) globalSettingChangeHandlerCallback(sett
 	oldGoGCValue := debug.SetGCPercent(newSetting.GoGC)
 	pscl.logger.Infof("Successfully changed  GOGC setting from(old) %v to(New) %v\n", oldGoGCValue, newSetting.GoGC)
 
+	pipeline_manager.SetBandwidthBudget(newSetting.BandwidthBudget)
+
 	return nil
 }
 
@@ -477,6 +631,7 @@ type InternalSettingsChangeListener struct {
 }
 
 func NewInternalSettingsChangeListener(internal_setting_svc service_def.InternalSettingsSvc,
+	metadata_service service_def.MetadataSvc,
 	cancel_chan chan struct{},
 	children_waitgrp *sync.WaitGroup,
 	logger_ctx *log.LoggerContext) *InternalSettingsChangeListener {
@@ -486,6 +641,7 @@ func NewInternalSettingsChangeListener(internal_setting_svc service_def.Internal
 			cancel_chan,
 			children_waitgrp,
 			internal_setting_svc.InternalSettingsServiceCallback,
+			metadata_service,
 			logger_ctx,
 			"InternalSettingChangeListener"),
 	}
@@ -544,6 +700,7 @@ type BucketSettingsChange struct {
 func NewBucketSettingsChangeListener(bucket_settings_svc service_def.BucketSettingsSvc,
 	xdcr_topology_svc service_def.XDCRCompTopologySvc,
 	cluster_info_svc service_def.ClusterInfoSvc,
+	metadata_service service_def.MetadataSvc,
 	cancel_chan chan struct{},
 	children_waitgrp *sync.WaitGroup,
 	logger_ctx *log.LoggerContext) *BucketSettingsChangeListener {
@@ -553,6 +710,7 @@ func NewBucketSettingsChangeListener(bucket_settings_svc service_def.BucketSetti
 			cancel_chan,
 			children_waitgrp,
 			bucket_settings_svc.BucketSettingsServiceCallback,
+			metadata_service,
 			logger_ctx,
 			"BucketSettingsChangeListener"),
 		xdcr_topology_svc: xdcr_topology_svc,
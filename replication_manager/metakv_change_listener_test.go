@@ -0,0 +1,62 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package replication_manager
+
+import (
+	"github.com/couchbase/goxdcr/metadata"
+	"testing"
+)
+
+func TestNeedToResetCheckpoints(t *testing.T) {
+	tests := []struct {
+		name     string
+		update   func(settings *metadata.ReplicationSettings)
+		expected bool
+	}{
+		{"no change", func(settings *metadata.ReplicationSettings) {}, false},
+		{"replay started", func(settings *metadata.ReplicationSettings) { settings.ReplayDir = "archive" }, true},
+		{"replay format changed", func(settings *metadata.ReplicationSettings) { settings.ReplayFormat = metadata.ExportFormatBinary }, true},
+		{"replay start seqno changed", func(settings *metadata.ReplicationSettings) { settings.ReplayStartSeqno = 100 }, true},
+		{"replay end seqno changed", func(settings *metadata.ReplicationSettings) { settings.ReplayEndSeqno = 100 }, false},
+		{"export dir changed", func(settings *metadata.ReplicationSettings) {
+			settings.RepType = metadata.ReplicationTypeFile
+			settings.ExportDir = "archive2"
+		}, true},
+		{"export format changed", func(settings *metadata.ReplicationSettings) {
+			settings.RepType = metadata.ReplicationTypeFile
+			settings.ExportFormat = metadata.ExportFormatBinary
+		}, true},
+		{"export file size changed", func(settings *metadata.ReplicationSettings) {
+			settings.RepType = metadata.ReplicationTypeFile
+			settings.ExportFileSizeMB = 1
+		}, false},
+		{"filter changed going forward", func(settings *metadata.ReplicationSettings) { settings.FilterExpression = "a" }, false},
+		{"filter changed with backfill", func(settings *metadata.ReplicationSettings) {
+			settings.FilterExpression = "a"
+			settings.FilterChangeMode = metadata.FilterChangeModeBackfill
+		}, true},
+	}
+
+	for _, test := range tests {
+		oldSettings := metadata.DefaultSettings()
+		newSettings := metadata.DefaultSettings()
+		test.update(newSettings)
+		if resetNeeded, reason := needToResetCheckpoints(oldSettings, newSettings); resetNeeded != test.expected {
+			t.Errorf("%v: expected checkpoints reset to be %v, got %v with reason %q", test.name, test.expected, resetNeeded, reason)
+		}
+	}
+
+	// replay stopped, i.e., the replication goes back to streaming from dcp
+	oldSettings := metadata.DefaultSettings()
+	oldSettings.ReplayDir = "archive"
+	if resetNeeded, _ := needToResetCheckpoints(oldSettings, metadata.DefaultSettings()); !resetNeeded {
+		t.Errorf("expected checkpoints to be reset when replay is stopped")
+	}
+}
@@ -15,13 +15,13 @@ import (
 	"fmt"
 	ap "github.com/couchbase/goxdcr/adminport"
 	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/filter"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/metadata"
 	"github.com/couchbase/goxdcr/simple_utils"
 	"github.com/couchbase/goxdcr/utils"
 	"io/ioutil"
 	"net/http"
-	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -40,6 +40,7 @@ const (
 	CreateReplicationPath    = "controller/createReplication"
 	StatisticsPrefix         = "stats/buckets"
 	RegexpValidationPrefix   = "controller/regexpValidation"
+	KeyTransformPreviewPath  = "controller/keyTransformPreview"
 	InternalSettingsPath     = "internalSettings"
 	AllReplicationsPath      = "pools/default/replications"
 	AllReplicationInfosPath  = "pools/default/replicationInfos"
@@ -50,6 +51,9 @@ const (
 	BlockProfileStopPath     = "profile/block/stop"
 	BucketSettingsPrefix     = "controller/bucketSettings"
 	XDCRInternalSettingsPath = "xdcr/internalSettings"
+	ConflictsPrefix          = "xdcr/conflicts"
+	DeadLettersPrefix        = "xdcr/deadLetters"
+	RedriveDeadLettersPrefix = "controller/redriveDeadLetters"
 
 	// Some url paths are not static and have variable contents, e.g., settings/replications/$replication_id
 	// The message keys for such paths are constructed by appending the dynamic suffix below to the static portion of the path.
@@ -62,6 +66,8 @@ const (
 	Type                           = "type"
 	ReplicationType                = "replicationType"
 	FilterExpression               = "filterExpression"
+	DocFilterExpression            = "docFilterExpression"
+	FilterChangeMode               = "filterChangeMode"
 	PauseRequested                 = "pauseRequested"
 	CheckpointInterval             = "checkpointInterval"
 	BatchCount                     = "workerBatchSize"
@@ -74,9 +80,36 @@ const (
 	TimeoutPercentageCap           = "timeoutPercentageCap"
 	LogLevel                       = "logLevel"
 	StatsInterval                  = "statsInterval"
+	DropDeletions                  = "dropDeletions"
+	DropExpirations                = "dropExpirations"
+	KeyTransformRules              = "keyTransformRules"
+	RedactionRules                 = "redactionRules"
+	RedactionHashKey               = "redactionHashKey"
+	Processors                     = "processors"
+	SamplingPercentage             = "samplingPercentage"
+	CompressionType                = "compressionType"
+	BandwidthLimit                 = "bandwidthLimit"
+	Priority                       = "priority"
+	DedupInBatch                   = "dedupInBatch"
+	ConflictResolver               = "conflictResolver"
+	ConflictResolverField          = "conflictResolverField"
+	ConflictLogDestination         = "conflictLogDestination"
+	ConflictLogBucket              = "conflictLogBucket"
+	ConflictLogBodies              = "conflictLogBodies"
+	ExportDir                      = "exportDir"
+	ExportFormat                   = "exportFormat"
+	ExportFileSizeMB               = "exportFileSizeMb"
+	ExportMaxFiles                 = "exportMaxFiles"
+	ReplayDir                      = "replayDir"
+	ReplayFormat                   = "replayFormat"
+	ReplayStartSeqno               = "replayStartSeqno"
+	ReplayEndSeqno                 = "replayEndSeqno"
+	WebhookURL                     = "webhookUrl"
+	WebhookAuthHeader              = "webhookAuthHeader"
 	ReplicationTypeValue           = "continuous"
 	GoMaxProcs                     = "goMaxProcs"
 	GoGC                           = "goGC"
+	BandwidthBudget                = "bandwidthBudget"
 )
 
 // constants for parsing create replication response
@@ -90,6 +123,13 @@ const (
 	Keys       = "keys"
 	StartIndex = "startIndex"
 	EndIndex   = "endIndex"
+	// json map of doc key -> doc body, against which docFilterExpression is evaluated
+	Docs = "docs"
+	// fields in the response for structured key filter expressions
+	Passed    = "passed"
+	RuleType  = "ruleType"
+	RuleIndex = "ruleIndex"
+	Pattern   = "pattern"
 )
 
 // constants used for parsing bucket setting changes
@@ -98,6 +138,18 @@ const (
 	LWWEnabled = "lwwEnabled"
 )
 
+// constants for conflicts request
+const (
+	// maximum number of conflict records to return
+	ConflictsLimit = "limit"
+)
+
+// constants for dead letters requests
+const (
+	// comma separated ids of the dead-lettered docs to re-drive or discard. all docs when not specified
+	DeadLetterIds = "ids"
+)
+
 // constants for stats names
 const (
 	DocsWritten          = "docs_written"
@@ -131,6 +183,8 @@ var MissingOldSettingsInRequest = errors.New("Invalid http request. No old repli
 var RestKeyToSettingsKeyMap = map[string]string{
 	Type:                           metadata.ReplicationType,
 	FilterExpression:               metadata.FilterExpression,
+	DocFilterExpression:            metadata.DocFilterExpression,
+	FilterChangeMode:               metadata.FilterChangeMode,
 	PauseRequested:                 metadata.Active,
 	CheckpointInterval:             metadata.CheckpointInterval,
 	BatchCount:                     metadata.BatchCount,
@@ -141,16 +195,45 @@ var RestKeyToSettingsKeyMap = map[string]string{
 	TargetNozzlePerNode:            metadata.TargetNozzlePerNode,
 	/*MaxExpectedReplicationLag:      metadata.MaxExpectedReplicationLag,
 	TimeoutPercentageCap:           metadata.TimeoutPercentageCap,*/
-	LogLevel:      metadata.PipelineLogLevel,
-	StatsInterval: metadata.PipelineStatsInterval,
-	GoMaxProcs:    metadata.GoMaxProcs,
-	GoGC:          metadata.GoGC,
+	LogLevel:               metadata.PipelineLogLevel,
+	StatsInterval:          metadata.PipelineStatsInterval,
+	GoMaxProcs:             metadata.GoMaxProcs,
+	GoGC:                   metadata.GoGC,
+	BandwidthBudget:        metadata.BandwidthBudget,
+	DropDeletions:          metadata.DropDeletions,
+	DropExpirations:        metadata.DropExpirations,
+	KeyTransformRules:      metadata.KeyTransformRules,
+	RedactionRules:         metadata.RedactionRules,
+	RedactionHashKey:       metadata.RedactionHashKey,
+	Processors:             metadata.Processors,
+	SamplingPercentage:     metadata.SamplingPercentage,
+	CompressionType:        metadata.CompressionType,
+	BandwidthLimit:         metadata.BandwidthLimit,
+	Priority:               metadata.Priority,
+	DedupInBatch:           metadata.DedupInBatch,
+	ConflictResolver:       metadata.ConflictResolver,
+	ConflictResolverField:  metadata.ConflictResolverField,
+	ConflictLogDestination: metadata.ConflictLogDestination,
+	ConflictLogBucket:      metadata.ConflictLogBucket,
+	ConflictLogBodies:      metadata.ConflictLogBodies,
+	ExportDir:              metadata.ExportDir,
+	ExportFormat:           metadata.ExportFormat,
+	ExportFileSizeMB:       metadata.ExportFileSizeMB,
+	ExportMaxFiles:         metadata.ExportMaxFiles,
+	ReplayDir:              metadata.ReplayDir,
+	ReplayFormat:           metadata.ReplayFormat,
+	ReplayStartSeqno:       metadata.ReplayStartSeqno,
+	ReplayEndSeqno:         metadata.ReplayEndSeqno,
+	WebhookURL:             metadata.WebhookURL,
+	WebhookAuthHeader:      metadata.WebhookAuthHeader,
 }
 
 // internal replication settings key -> replication settings key in rest api
 var SettingsKeyToRestKeyMap = map[string]string{
 	metadata.ReplicationType:                Type,
 	metadata.FilterExpression:               FilterExpression,
+	metadata.DocFilterExpression:            DocFilterExpression,
+	metadata.FilterChangeMode:               FilterChangeMode,
 	metadata.Active:                         PauseRequested,
 	metadata.CheckpointInterval:             CheckpointInterval,
 	metadata.BatchCount:                     BatchCount,
@@ -161,10 +244,37 @@ var SettingsKeyToRestKeyMap = map[string]string{
 	metadata.TargetNozzlePerNode:            TargetNozzlePerNode,
 	/*metadata.MaxExpectedReplicationLag:      MaxExpectedReplicationLag,
 	metadata.TimeoutPercentageCap:           TimeoutPercentageCap,*/
-	metadata.PipelineLogLevel:      LogLevel,
-	metadata.PipelineStatsInterval: StatsInterval,
-	metadata.GoMaxProcs:            GoMaxProcs,
-	metadata.GoGC:                  GoGC,
+	metadata.PipelineLogLevel:       LogLevel,
+	metadata.PipelineStatsInterval:  StatsInterval,
+	metadata.GoMaxProcs:             GoMaxProcs,
+	metadata.GoGC:                   GoGC,
+	metadata.BandwidthBudget:        BandwidthBudget,
+	metadata.DropDeletions:          DropDeletions,
+	metadata.DropExpirations:        DropExpirations,
+	metadata.KeyTransformRules:      KeyTransformRules,
+	metadata.RedactionRules:         RedactionRules,
+	metadata.RedactionHashKey:       RedactionHashKey,
+	metadata.Processors:             Processors,
+	metadata.SamplingPercentage:     SamplingPercentage,
+	metadata.CompressionType:        CompressionType,
+	metadata.BandwidthLimit:         BandwidthLimit,
+	metadata.Priority:               Priority,
+	metadata.DedupInBatch:           DedupInBatch,
+	metadata.ConflictResolver:       ConflictResolver,
+	metadata.ConflictResolverField:  ConflictResolverField,
+	metadata.ConflictLogDestination: ConflictLogDestination,
+	metadata.ConflictLogBucket:      ConflictLogBucket,
+	metadata.ConflictLogBodies:      ConflictLogBodies,
+	metadata.ExportDir:              ExportDir,
+	metadata.ExportFormat:           ExportFormat,
+	metadata.ExportFileSizeMB:       ExportFileSizeMB,
+	metadata.ExportMaxFiles:         ExportMaxFiles,
+	metadata.ReplayDir:              ReplayDir,
+	metadata.ReplayFormat:           ReplayFormat,
+	metadata.ReplayStartSeqno:       ReplayStartSeqno,
+	metadata.ReplayEndSeqno:         ReplayEndSeqno,
+	metadata.WebhookURL:             WebhookURL,
+	metadata.WebhookAuthHeader:      WebhookAuthHeader,
 }
 
 var logger_msgutil *log.CommonLogger = log.NewLogger("MsgUtils", log.DefaultLoggerContext)
@@ -208,13 +318,18 @@ func getReplicationDocMap(replSpec *metadata.ReplicationSpecification) map[strin
 		replDocMap[base.ReplicationDocPauseRequestedOutput] = !replSpec.Settings.Active
 		if replSpec.Settings.RepType == metadata.ReplicationTypeXmem {
 			replDocMap[base.ReplicationDocType] = base.ReplicationDocTypeXmem
+		} else if replSpec.Settings.RepType == metadata.ReplicationTypeFile {
+			replDocMap[base.ReplicationDocType] = base.ReplicationDocTypeFile
+		} else if replSpec.Settings.RepType == metadata.ReplicationTypeWebhook {
+			replDocMap[base.ReplicationDocType] = base.ReplicationDocTypeWebhook
 		} else {
 			replDocMap[base.ReplicationDocType] = base.ReplicationDocTypeCapi
 		}
 
 		// copy other replication settings into replication doc
 		for key, value := range replSpec.Settings.ToMap() {
-			if key != metadata.ReplicationType && key != metadata.Active {
+			// settings that carry secrets, e.g., webhook auth header, are not exposed
+			if key != metadata.ReplicationType && key != metadata.Active && !metadata.SensitiveSettings[key] {
 				replDocMap[key] = value
 			}
 		}
@@ -408,6 +523,10 @@ func DecodeCreateReplicationRequest(request *http.Request) (justValidate bool, f
 		if ok && len(filterExpression.(string)) > 0 {
 			errorsMap[FilterExpression] = errors.New("Filter expression can be specified in Enterprise edition only")
 		}
+		docFilterExpression, ok := settings[metadata.DocFilterExpression]
+		if ok && len(docFilterExpression.(string)) > 0 {
+			errorsMap[DocFilterExpression] = errors.New("Document filter expression can be specified in Enterprise edition only")
+		}
 	}
 
 	return
@@ -431,6 +550,29 @@ func DecodeChangeReplicationSettings(request *http.Request, isDefaultSettings bo
 		errorsMap[key] = value
 	}
 
+	if isDefaultSettings || len(errorsMap) > 0 {
+		return
+	}
+
+	_, filterExpressionChanged := settings[metadata.FilterExpression]
+	_, docFilterExpressionChanged := settings[metadata.DocFilterExpression]
+	if filterExpressionChanged || docFilterExpressionChanged {
+		isEnterprise, err := XDCRCompTopologyService().IsMyClusterEnterprise()
+		if err != nil {
+			errorsMap[base.PlaceHolderFieldKey] = err
+			return
+		}
+		if !isEnterprise {
+			errorsMap[FilterExpression] = errors.New("Filter expression can be specified in Enterprise edition only")
+			return
+		}
+
+		// a filter change is applied going forward unless backfill has been explicitly requested
+		if _, ok := settings[metadata.FilterChangeMode]; !ok {
+			settings[metadata.FilterChangeMode] = metadata.FilterChangeModeForward
+		}
+	}
+
 	return
 }
 
@@ -485,7 +627,7 @@ func DecodeSettingsFromRequest(request *http.Request, isDefaultSettings bool, is
 		return nil, errorsMap
 	}
 
-	logger_msgutil.Debugf("settings decoded from request: %v\n", settings)
+	logger_msgutil.Debugf("settings decoded from request: %v\n", metadata.MaskSensitiveSettings(settings))
 	return settings, nil
 }
 
@@ -516,7 +658,7 @@ func DecodeSettingsFromInternalSettingsRequest(request *http.Request) (map[strin
 		return nil, errorsMap
 	}
 
-	logger_msgutil.Debugf("settings decoded from request: %v\n", settings)
+	logger_msgutil.Debugf("settings decoded from request: %v\n", metadata.MaskSensitiveSettings(settings))
 	return settings, nil
 }
 
@@ -542,22 +684,65 @@ func DecodeSettingsFromXDCRInternalSettingsRequest(request *http.Request) (map[s
 		return nil, errorsMap
 	}
 
-	logger_msgutil.Debugf("settings decoded from request: %v\n", settings)
+	logger_msgutil.Debugf("settings decoded from request: %v\n", metadata.MaskSensitiveSettings(settings))
 	return settings, nil
 }
 
-func DecodeRegexpValidationRequest(request *http.Request) (string, []string, error) {
+// decodes a regexp validation request, which validates either a key filter expression against a list of keys,
+// or a document filter expression against a map of sample documents, or both
+func DecodeRegexpValidationRequest(request *http.Request) (string, []string, string, map[string]interface{}, error) {
 	var expression string
 	var keys []string
+	var docFilterExpression string
+	var docs map[string]interface{}
 
 	if err := request.ParseForm(); err != nil {
-		return "", nil, err
+		return "", nil, "", nil, err
 	}
 
 	for key, valArr := range request.Form {
 		switch key {
 		case Expression:
 			expression = getStringFromValArr(valArr)
+		case Keys:
+			keysStr := getStringFromValArr(valArr)
+			err := json.Unmarshal([]byte(keysStr), &keys)
+			if err != nil {
+				return "", nil, "", nil, utils.NewEnhancedError(fmt.Sprintf("Error parsing keys=%v.", keysStr), err)
+			}
+		case DocFilterExpression:
+			docFilterExpression = getStringFromValArr(valArr)
+		case Docs:
+			docsStr := getStringFromValArr(valArr)
+			err := json.Unmarshal([]byte(docsStr), &docs)
+			if err != nil {
+				return "", nil, "", nil, utils.NewEnhancedError(fmt.Sprintf("Error parsing docs=%v.", docsStr), err)
+			}
+		default:
+			// ignore other parameters
+		}
+	}
+
+	if len(expression) == 0 && len(docFilterExpression) == 0 {
+		return "", nil, "", nil, simple_utils.MissingParameterError("expression")
+	}
+
+	return expression, keys, docFilterExpression, docs, nil
+}
+
+// decodes a key transform preview request, which applies key transform rules to a list of sample keys
+func DecodeKeyTransformPreviewRequest(request *http.Request) (string, []string, error) {
+	var keyTransformRules string
+	var keys []string
+
+	if err := request.ParseForm(); err != nil {
+		return "", nil, err
+	}
+
+	for key, valArr := range request.Form {
+		switch key {
+		case KeyTransformRules:
+			keyTransformRules = getStringFromValArr(valArr)
 		case Keys:
 			keysStr := getStringFromValArr(valArr)
 			err := json.Unmarshal([]byte(keysStr), &keys)
@@ -569,11 +754,11 @@ func DecodeRegexpValidationRequest(request *http.Request) (string, []string, err
 		}
 	}
 
-	if len(expression) == 0 {
-		return "", nil, simple_utils.MissingParameterError("expression")
+	if len(keyTransformRules) == 0 {
+		return "", nil, simple_utils.MissingParameterError(KeyTransformRules)
 	}
 
-	return expression, keys, nil
+	return keyTransformRules, keys, nil
 }
 
 func NewCreateReplicationResponse(replicationId string) (*ap.Response, error) {
@@ -643,6 +828,78 @@ func NewRegexpValidationResponse(matchesMap map[string][][]int) (*ap.Response, e
 	return EncodeObjectIntoResponse(returnMap)
 }
 
+// for each key, returns whether the key passes the structured key filter expression and the rule that decided it
+func NewKeyFilterValidationResponse(resultsMap map[string]*filter.KeyFilterResult) (*ap.Response, error) {
+	returnMap := make(map[string]interface{})
+
+	for key, result := range resultsMap {
+		convertedResult := make(map[string]interface{})
+		convertedResult[Passed] = result.Passed
+		if result.Rule != nil {
+			convertedResult[RuleType] = result.Rule.Type
+			convertedResult[RuleIndex] = result.Rule.Index
+			convertedResult[Pattern] = result.Rule.Pattern
+		}
+		returnMap[key] = convertedResult
+	}
+
+	return EncodeObjectIntoResponse(returnMap)
+}
+
+// matchesMap: doc key -> whether the doc passes the key filter expression, if specified, and the doc filter expression
+func NewDocFilterValidationResponse(matchesMap map[string]bool) (*ap.Response, error) {
+	returnMap := make(map[string]interface{})
+	for key, matched := range matchesMap {
+		returnMap[key] = matched
+	}
+	return EncodeObjectIntoResponse(returnMap)
+}
+
+// transformedKeysMap: original key -> key after key transform rules have been applied
+func NewKeyTransformPreviewResponse(transformedKeysMap map[string]string) (*ap.Response, error) {
+	returnMap := make(map[string]interface{})
+	for key, transformedKey := range transformedKeysMap {
+		returnMap[key] = transformedKey
+	}
+	return EncodeObjectIntoResponse(returnMap)
+}
+
+// decodes the maximum number of conflict records to return from the "limit" query parameter. 0 means no limit
+func DecodeConflictsLimit(request *http.Request) (int, error) {
+	if err := request.ParseForm(); err != nil {
+		return 0, ErrorParsingForm
+	}
+	value := request.Form.Get(ConflictsLimit)
+	if len(value) == 0 {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return 0, simple_utils.GenericInvalidValueError(ConflictsLimit)
+	}
+	return limit, nil
+}
+
+// decodes the ids of dead-lettered docs from the "ids" parameter. returns an empty list when no ids are specified
+func DecodeDeadLetterIds(request *http.Request) ([]uint64, error) {
+	if err := request.ParseForm(); err != nil {
+		return nil, ErrorParsingForm
+	}
+	ids := make([]uint64, 0)
+	value := request.Form.Get(DeadLetterIds)
+	if len(value) == 0 {
+		return ids, nil
+	}
+	for _, idStr := range strings.Split(value, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(idStr), 10, 64)
+		if err != nil {
+			return nil, simple_utils.GenericInvalidValueError(DeadLetterIds)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
 // decode dynamic paramater from the path of http request
 func DecodeDynamicParamInURL(request *http.Request, pathPrefix string, paramName string) (string, error) {
 	// length of prefix preceding replicationId in request url path
@@ -659,7 +916,7 @@ func DecodeDynamicParamInURL(request *http.Request, pathPrefix string, paramName
 }
 
 func verifyFilterExpression(filterExpression string) error {
-	_, err := regexp.Compile(filterExpression)
+	_, err := filter.NewKeyFilter(filterExpression)
 	return err
 }
 
@@ -701,6 +958,9 @@ func convertSettingsToRestSettingsMap(settings *metadata.ReplicationSettings, is
 			// pauseRequested = !active
 			valueBool := value.(bool)
 			restSettingsMap[restKey] = !valueBool
+		} else if metadata.SensitiveSettings[key] {
+			// settings that carry secrets, e.g., webhook auth header, are not returned
+			continue
 		} else {
 			restSettingsMap[restKey] = value
 		}
@@ -34,6 +34,7 @@ import (
 	"os"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -45,6 +46,9 @@ var StatsUpdateIntervalForPausedReplications = 60 * time.Second
 var StatusCheckInterval = 15 * time.Second
 var MemStatsLogInterval = 2 * time.Minute
 
+// whether to follow ns_server shutdown protocol. there is no ns_server in standalone mode
+var PollStdinForShutdown = true
+
 var GoXDCROptions struct {
 	SourceKVAdminPort    uint64 //source kv admin port
 	XdcrRestPort         uint64 // port number of XDCR rest server
@@ -89,6 +93,8 @@ type replicationManager struct {
 	bucket_settings_svc service_def.BucketSettingsSvc
 	//internal settings service
 	internal_settings_svc service_def.InternalSettingsSvc
+	//metadata service, whose changes are monitored by metadata change listeners
+	metadata_svc service_def.MetadataSvc
 
 	once sync.Once
 
@@ -124,17 +130,20 @@ func StartReplicationManager(sourceKVHost string, xdcrRestPort uint16,
 	uilog_svc service_def.UILogSvc,
 	global_setting_svc service_def.GlobalSettingsSvc,
 	bucket_settings_svc service_def.BucketSettingsSvc,
-	internal_settings_svc service_def.InternalSettingsSvc) {
+	internal_settings_svc service_def.InternalSettingsSvc,
+	metadata_svc service_def.MetadataSvc) {
 
 	replication_mgr.once.Do(func() {
 		// ns_server shutdown protocol: poll stdin and exit upon reciept of EOF
-		go pollStdin()
+		if PollStdinForShutdown {
+			go pollStdin()
+		}
 
 		// initialize constants
 		initConstants(xdcr_topology_svc, internal_settings_svc)
 
 		// initializes replication manager
-		replication_mgr.init(repl_spec_svc, remote_cluster_svc, cluster_info_svc, xdcr_topology_svc, replication_settings_svc, checkpoints_svc, capi_svc, audit_svc, uilog_svc, global_setting_svc, bucket_settings_svc, internal_settings_svc)
+		replication_mgr.init(repl_spec_svc, remote_cluster_svc, cluster_info_svc, xdcr_topology_svc, replication_settings_svc, checkpoints_svc, capi_svc, audit_svc, uilog_svc, global_setting_svc, bucket_settings_svc, internal_settings_svc, metadata_svc)
 
 		// start pipeline master supervisor
 		// TODO should we make heart beat settings configurable?
@@ -146,14 +155,14 @@ func StartReplicationManager(sourceKVHost string, xdcrRestPort uint16,
 		replication_mgr.GenericSupervisor.Start(nil)
 
 		// set ReplicationStatus for paused replications
-		replication_mgr.initPausedReplications()
+		activeReplications := replication_mgr.initPausedReplications()
 		logger_rm.Info("initPausedReplications succeeded")
 
 		replication_mgr.running = true
 		replication_mgr.running_lock = sync.RWMutex{}
 
 		replication_mgr.status_logger_finch = make(chan bool, 1)
-		go replication_mgr.checkReplicationStatus(replication_mgr.status_logger_finch)
+		go replication_mgr.checkReplicationStatus(activeReplications, replication_mgr.status_logger_finch)
 
 		// periodically log mem stats to facilitate debugging of memory issues
 		replication_mgr.mem_stats_logger_finch = make(chan bool, 1)
@@ -199,6 +208,7 @@ func initConstants(xdcr_topology_svc service_def.XDCRCompTopologySvc, internal_s
 		time.Duration(internal_settings.TimeoutCheckpointBeforeStop)*time.Second,
 		internal_settings.CapiDataChanSizeMultiplier,
 		time.Duration(internal_settings.RefreshRemoteClusterRefInterval)*time.Second,
+		internal_settings.KnownClustersCycleCheckMode,
 		version)
 }
 
@@ -207,6 +217,7 @@ func (rm *replicationManager) initMetadataChangeMonitor() {
 
 	replicationSpecChangeListener := NewReplicationSpecChangeListener(
 		rm.repl_spec_svc,
+		rm.metadata_svc,
 		rm.metadata_change_callback_cancel_ch,
 		rm.children_waitgrp,
 		log.DefaultLoggerContext)
@@ -216,6 +227,7 @@ func (rm *replicationManager) initMetadataChangeMonitor() {
 	remoteClusterChangeListener := NewRemoteClusterChangeListener(
 		rm.remote_cluster_svc,
 		rm.repl_spec_svc,
+		rm.metadata_svc,
 		rm.metadata_change_callback_cancel_ch,
 		rm.children_waitgrp,
 		log.DefaultLoggerContext)
@@ -225,6 +237,7 @@ func (rm *replicationManager) initMetadataChangeMonitor() {
 
 	globalSettingChangeListener := NewGlobalSettingChangeListener(
 		rm.global_setting_svc,
+		rm.metadata_svc,
 		rm.metadata_change_callback_cancel_ch,
 		rm.children_waitgrp,
 		log.DefaultLoggerContext)
@@ -235,6 +248,7 @@ func (rm *replicationManager) initMetadataChangeMonitor() {
 
 	internalSettingsChangeListener := NewInternalSettingsChangeListener(
 		rm.internal_settings_svc,
+		rm.metadata_svc,
 		rm.metadata_change_callback_cancel_ch,
 		rm.children_waitgrp,
 		log.DefaultLoggerContext)
@@ -245,7 +259,8 @@ func (rm *replicationManager) initMetadataChangeMonitor() {
 	mcm.Start()
 }
 
-func (rm *replicationManager) initPausedReplications() {
+// returns the ids of active replications in the order in which they are to be started
+func (rm *replicationManager) initPausedReplications() []string {
 	for i := 0; i < service_def.MaxNumOfRetries; i++ {
 		// set ReplicationStatus for paused replications so that they will show up in task list
 		specs, err := rm.repl_spec_svc.AllReplicationSpecs()
@@ -254,26 +269,92 @@ func (rm *replicationManager) initPausedReplications() {
 			continue
 
 		} else {
+			activeSpecs := make(replicationSpecsByPriority, 0)
 			for _, spec := range specs {
 				if !spec.Settings.Active {
 					rep_status, _ := pipeline_manager.ReplicationStatus(spec.Id)
 					if rep_status == nil {
 						pipeline_manager.InitReplicationStatusForReplication(spec.Id)
 					}
+				} else {
+					activeSpecs = append(activeSpecs, spec)
 				}
 			}
-			return
+
+			// higher priority replications are started first so that they recover first after a restart
+			sort.Sort(activeSpecs)
+			activeReplications := make([]string, 0, len(activeSpecs))
+			for _, spec := range activeSpecs {
+				activeReplications = append(activeReplications, spec.Id)
+			}
+			return activeReplications
 		}
 	}
 
 	logger_rm.Errorf("Failed to initPausedReplications after %v retries.", service_def.MaxNumOfRetries)
 	exitProcess(false)
+	return nil
+}
+
+// starts the pipelines of active replications one at a time, in the order specified
+func (rm *replicationManager) startReplications(topics []string, fin_chan chan bool) {
+	isKV, err := rm.xdcr_topology_svc.IsKVNode()
+	if err == nil && !isKV {
+		logger_rm.Infof("This node is not a KV node, would not start replications\n")
+		return
+	}
+
+	for _, topic := range topics {
+		select {
+		case <-fin_chan:
+			return
+		default:
+		}
+
+		rep_status, _ := pipeline_manager.ReplicationStatus(topic)
+		if rep_status != nil && rep_status.Updater() != nil {
+			// the replication has been changed since and its pipeline is being taken care of by its updater
+			logger_rm.Infof("Skip starting pipeline %v since there is an updater launched for it\n", topic)
+			continue
+		}
+
+		// start pipeline through its updater, which retries when the pipeline fails to start,
+		// and which other changes to the replication in the meantime are serialized with
+		err = pipeline_manager.StartThroughUpdater(topic, fin_chan)
+		if err != nil {
+			logger_rm.Errorf("Failed to start pipeline %v. err=%v\n", topic, err)
+		}
+	}
+}
+
+// sorts replication specs by priority, higher priority ones first. specs with the same priority are sorted by id
+type replicationSpecsByPriority []*metadata.ReplicationSpecification
+
+func (specs replicationSpecsByPriority) Len() int {
+	return len(specs)
+}
+
+func (specs replicationSpecsByPriority) Swap(i, j int) {
+	specs[i], specs[j] = specs[j], specs[i]
+}
+
+func (specs replicationSpecsByPriority) Less(i, j int) bool {
+	weight_i := metadata.PriorityWeight(specs[i].Settings.Priority)
+	weight_j := metadata.PriorityWeight(specs[j].Settings.Priority)
+	if weight_i != weight_j {
+		return weight_i > weight_j
+	}
+	return specs[i].Id < specs[j].Id
 }
 
-func (rm *replicationManager) checkReplicationStatus(fin_chan chan bool) {
+func (rm *replicationManager) checkReplicationStatus(activeReplications []string, fin_chan chan bool) {
 	logger_rm.Infof("checkReplicationStatus started.")
 	defer logger_rm.Infof("checkReplicationStatus exited")
 
+	// start active replications in the order of their priorities before checking on pipelines,
+	// so that pipelines of lower priority replications are not started ahead of higher priority ones
+	rm.startReplications(activeReplications, fin_chan)
+
 	status_check_ticker := time.NewTicker(StatusCheckInterval)
 	defer status_check_ticker.Stop()
 	stats_update_ticker := time.NewTicker(StatsUpdateIntervalForPausedReplications)
@@ -305,7 +386,8 @@ func (rm *replicationManager) init(
 	uilog_svc service_def.UILogSvc,
 	global_setting_svc service_def.GlobalSettingsSvc,
 	bucket_settings_svc service_def.BucketSettingsSvc,
-	internal_settings_svc service_def.InternalSettingsSvc) {
+	internal_settings_svc service_def.InternalSettingsSvc,
+	metadata_svc service_def.MetadataSvc) {
 
 	rm.GenericSupervisor = *supervisor.NewGenericSupervisor(base.ReplicationManagerSupervisorId, log.DefaultLoggerContext, rm, nil)
 	rm.pipelineMasterSupervisor = supervisor.NewGenericSupervisor(base.PipelineMasterSupervisorId, log.DefaultLoggerContext, rm, &rm.GenericSupervisor)
@@ -322,6 +404,7 @@ func (rm *replicationManager) init(
 	rm.global_setting_svc = global_setting_svc
 	rm.bucket_settings_svc = bucket_settings_svc
 	rm.internal_settings_svc = internal_settings_svc
+	rm.metadata_svc = metadata_svc
 	fac := factory.NewXDCRFactory(repl_spec_svc, remote_cluster_svc, cluster_info_svc, xdcr_topology_svc, checkpoint_svc, capi_svc, uilog_svc, bucket_settings_svc, log.DefaultLoggerContext, log.DefaultLoggerContext, rm, rm.pipelineMasterSupervisor)
 
 	pipeline_manager.PipelineManager(fac, repl_spec_svc, xdcr_topology_svc, remote_cluster_svc, log.DefaultLoggerContext)
@@ -375,7 +458,7 @@ func InternalSettingsService() service_def.InternalSettingsSvc {
 //and start the replication pipeline
 func CreateReplication(justValidate bool, sourceBucket, targetCluster, targetBucket string, settings map[string]interface{}, realUserId *base.RealUserId) (string, map[string]error, error) {
 	logger_rm.Infof("Creating replication - justValidate=%v, sourceBucket=%s, targetCluster=%s, targetBucket=%s, settings=%v\n",
-		justValidate, sourceBucket, targetCluster, targetBucket, settings)
+		justValidate, sourceBucket, targetCluster, targetBucket, metadata.MaskSensitiveSettings(settings))
 
 	var spec *metadata.ReplicationSpecification
 	spec, errorsMap, err := replication_mgr.createAndPersistReplicationSpec(justValidate, sourceBucket, targetCluster, targetBucket, settings)
@@ -492,6 +575,11 @@ func UpdateDefaultReplicationSettings(settings map[string]interface{}, realUserI
 		return errorMap, nil
 	}
 
+	errorMap = defaultSettings.ValidateDependentSettings()
+	if len(errorMap) != 0 {
+		return errorMap, nil
+	}
+
 	if len(changedSettingsMap) != 0 {
 		err = ReplicationSettingsService().SetDefaultReplicationSettings(defaultSettings)
 		if err != nil {
@@ -510,26 +598,21 @@ func UpdateDefaultReplicationSettings(settings map[string]interface{}, realUserI
 
 //update the per-replication settings
 func UpdateReplicationSettings(topic string, settings map[string]interface{}, realUserId *base.RealUserId) (map[string]error, error) {
-	logger_rm.Infof("Update replication settings for %v, settings=%v\n", topic, settings)
+	logger_rm.Infof("Update replication settings for %v, settings=%v\n", topic, metadata.MaskSensitiveSettings(settings))
 	// read replication spec with the specified replication id
 	replSpec, err := ReplicationSpecService().ReplicationSpec(topic)
 	if err != nil {
 		return nil, err
 	}
 
-	oldFilterExpression := replSpec.Settings.FilterExpression
-
 	// update replication spec with input settings
 	changedSettingsMap, errorMap := replSpec.Settings.UpdateSettingsFromMap(settings)
 
-	// enforce that filter expression cannot be changed
-	newFilterExpression, ok := settings[FilterExpression]
-	if ok {
-		if newFilterExpression != oldFilterExpression {
-			errorMap[FilterExpression] = errors.New("Filter expression cannot be changed after the replication is created")
-		}
+	if len(errorMap) != 0 {
+		return errorMap, nil
 	}
 
+	errorMap = replSpec.Settings.ValidateDependentSettings()
 	if len(errorMap) != 0 {
 		return errorMap, nil
 	}
@@ -587,10 +670,53 @@ func GetStatistics(bucket string) (*expvar.Map, error) {
 	return stats, nil
 }
 
+// returns up to limit most recent conflict records of the replication. 0 means no limit.
+// bodies of target versions are left out, and those of source versions are kept only when withSourceBodies is true
+func GetRecentConflicts(replicationId string, limit int, withSourceBodies bool) []*pipeline_svc.ConflictLogEntry {
+	entries := pipeline_svc.GetRecentConflictsForPipeline(replicationId, limit)
+	for index, entry := range entries {
+		// entries are shared with conflict logger, hence bodies are removed from copies of them
+		entries[index] = &pipeline_svc.ConflictLogEntry{ReplicationId: entry.ReplicationId,
+			ConflictRecord: entry.ConflictRecord.CopyWithBodies(withSourceBodies, false)}
+	}
+	return entries
+}
+
+// returns the docs in the dead-letter queue of the replication, the oldest first
+func GetDeadLetters(replicationId string) []*base.DeadLetter {
+	queue := pipeline_manager.ExistingDeadLetterQueue(replicationId)
+	if queue == nil {
+		return []*base.DeadLetter{}
+	}
+	return queue.List()
+}
+
+// removes the docs with the specified ids from the dead-letter queue of the replication without re-driving them.
+// empty ids means all docs. returns the number of docs discarded
+func DiscardDeadLetters(replicationId string, ids []uint64) int {
+	queue := pipeline_manager.ExistingDeadLetterQueue(replicationId)
+	if queue == nil {
+		return 0
+	}
+	discarded := queue.Remove(ids)
+	logger_rm.Infof("Discarded %v docs from dead-letter queue of replication %v\n", len(discarded), replicationId)
+	return len(discarded)
+}
+
+// sends the docs with the specified ids in the dead-letter queue of the replication to target again.
+// empty ids means all re-drivable docs. returns the number of docs re-driven
+func RedriveDeadLetters(replicationId string, ids []uint64) (int, error) {
+	count, err := pipeline_svc.RedriveDeadLetters(replicationId, ids)
+	if err == nil {
+		logger_rm.Infof("Re-drove %v docs from dead-letter queue of replication %v\n", count, replicationId)
+	}
+	return count, err
+}
+
 //create and persist the replication specification
 func (rm *replicationManager) createAndPersistReplicationSpec(justValidate bool, sourceBucket, targetCluster, targetBucket string, settings map[string]interface{}) (*metadata.ReplicationSpecification, map[string]error, error) {
 	logger_rm.Infof("Creating replication spec - justValidate=%v, sourceBucket=%s, targetCluster=%s, targetBucket=%s, settings=%v\n",
-		justValidate, sourceBucket, targetCluster, targetBucket, settings)
+		justValidate, sourceBucket, targetCluster, targetBucket, metadata.MaskSensitiveSettings(settings))
 
 	// validate that everything is alright with the replication configuration before actually creating it
 	sourceBucketUUID, targetBucketUUID, targetClusterRef, errorMap := replication_mgr.repl_spec_svc.ValidateNewReplicationSpec(sourceBucket, targetCluster, targetBucket, settings)
@@ -608,6 +734,10 @@ func (rm *replicationManager) createAndPersistReplicationSpec(justValidate bool,
 	if len(errorMap) != 0 {
 		return nil, errorMap, nil
 	}
+	errorMap = replSettings.ValidateDependentSettings()
+	if len(errorMap) != 0 {
+		return nil, errorMap, nil
+	}
 	spec.Settings = replSettings
 
 	if justValidate {
@@ -908,6 +1038,14 @@ func exitProcess_once(byForce bool) {
 	if !byForce {
 		cleanup()
 	}
+
+	// metadata services that write changes in the background, e.g., FileMetadataSvc, write out what is left
+	if closer, ok := replication_mgr.metadata_svc.(io.Closer); ok {
+		err := closer.Close()
+		if err != nil {
+			logger_rm.Errorf("Failed to close metadata service. err=%v\n", err)
+		}
+	}
 }
 
 func writeGenericReplicationEvent(eventId uint32, spec *metadata.ReplicationSpecification, realUserId *base.RealUserId) {
@@ -924,7 +1062,8 @@ func writeCreateReplicationEvent(spec *metadata.ReplicationSpecification, realUs
 	if err == nil {
 		createReplicationEvent := &base.CreateReplicationEvent{
 			GenericReplicationEvent: *genericReplicationEvent,
-			FilterExpression:        spec.Settings.FilterExpression}
+			FilterExpression:        spec.Settings.FilterExpression,
+			DocFilterExpression:     spec.Settings.DocFilterExpression}
 
 		err = AuditService().Write(base.CreateReplicationEventId, createReplicationEvent)
 	}
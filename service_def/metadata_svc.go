@@ -13,6 +13,7 @@ package service_def
 import (
 	"errors"
 	"fmt"
+	"github.com/couchbase/goxdcr/base"
 )
 
 var MaxNumOfRetries = 5
@@ -44,4 +45,9 @@ type MetadataSvc interface {
 	GetAllMetadataFromCatalog(catalogKey string) ([]*MetadataEntry, error)
 	GetAllKeysFromCatalog(catalogKey string) ([]string, error)
 	DelAllFromCatalog(catalogKey string) error
+
+	// invokes callback on all existing children of dirpath, and then on each subsequent change to them,
+	// until cancel is closed. value passed to callback is nil when a child has been deleted.
+	// returns nil when cancelled, or the error returned by callback
+	ObserveChildren(dirpath string, callback base.MetadataServiceCallback, cancel chan struct{}) error
 }
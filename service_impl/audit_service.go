@@ -14,7 +14,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/couchbase/cbauth"
 	mc "github.com/couchbase/gomemcached"
 	mcc "github.com/couchbase/gomemcached/client"
 	"github.com/couchbase/goxdcr/base"
@@ -142,7 +141,7 @@ func (service *AuditSvc) init() error {
 			return utils.NewEnhancedError(ErrorInitializingAuditService+" Error getting address of current cluster.", err)
 		}
 
-		service.username, service.password, err = cbauth.GetMemcachedServiceAuth(clusterAddr)
+		service.username, service.password, err = utils.GetLocalMemcachedServiceAuth(clusterAddr)
 		if err != nil {
 			err = utils.NewEnhancedError(fmt.Sprintf(ErrorInitializingAuditService+" Error getting memcached credentials for cluster %v\n.", clusterAddr), err)
 			return err
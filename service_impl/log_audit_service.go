@@ -0,0 +1,38 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package service_impl
+
+import (
+	"encoding/json"
+	"github.com/couchbase/goxdcr/log"
+)
+
+// audit service that writes audit events into xdcr log.
+// used in standalone mode, where there is no memcached audit daemon to send audit events to
+type LogAuditSvc struct {
+	logger *log.CommonLogger
+}
+
+func NewLogAuditSvc(loggerCtx *log.LoggerContext) *LogAuditSvc {
+	return &LogAuditSvc{
+		logger: log.NewLogger("AuditSvc", loggerCtx),
+	}
+}
+
+func (service *LogAuditSvc) Write(eventId uint32, event interface{}) error {
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		// ignore errors when writing audit logs, as AuditSvc does
+		service.logger.Errorf("Error marshalling audit event. eventId=%v, err=%v\n", eventId, err)
+		return nil
+	}
+	service.logger.Infof("Audit event. eventId=%v, event=%s\n", eventId, eventBytes)
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package service_impl
+
+import (
+	"errors"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/utils"
+)
+
+var ErrorNoKVNodes = errors.New("There are no kv nodes in static topology.")
+
+// XDCRCompTopologySvc with fixed topology, for xdcr running in standalone mode without ns_server.
+// the xdcr comp is responsible for all kv nodes of the local cluster
+type StaticXDCRTopologySvc struct {
+	// host and port of the rest endpoint of local cluster
+	hostName       string
+	adminport      uint16
+	kvNodes        []string
+	clusterUuid    string
+	clusterVersion string
+	isEnterprise   bool
+	username       string
+	password       string
+	logger         *log.CommonLogger
+}
+
+func NewStaticXDCRTopologySvc(hostName string, adminport uint16, kvNodes []string,
+	clusterUuid, clusterVersion string, isEnterprise bool,
+	username, password string, logger_ctx *log.LoggerContext) (*StaticXDCRTopologySvc, error) {
+	if len(kvNodes) == 0 {
+		return nil, ErrorNoKVNodes
+	}
+	top_svc := &StaticXDCRTopologySvc{
+		hostName:       hostName,
+		adminport:      adminport,
+		kvNodes:        kvNodes,
+		clusterUuid:    clusterUuid,
+		clusterVersion: clusterVersion,
+		isEnterprise:   isEnterprise,
+		username:       username,
+		password:       password,
+		logger:         log.NewLogger("StaticTopoSvc", logger_ctx),
+	}
+	top_svc.logger.Infof("Created static topology service. host=%v, kvNodes=%v, clusterUuid=%v\n", hostName, kvNodes, clusterUuid)
+	return top_svc, nil
+}
+
+func (top_svc *StaticXDCRTopologySvc) MyHost() (string, error) {
+	return top_svc.hostName, nil
+}
+
+func (top_svc *StaticXDCRTopologySvc) MyHostAddr() (string, error) {
+	return utils.GetHostAddr(top_svc.hostName, top_svc.adminport), nil
+}
+
+func (top_svc *StaticXDCRTopologySvc) MyMemcachedAddr() (string, error) {
+	return top_svc.kvNodes[0], nil
+}
+
+func (top_svc *StaticXDCRTopologySvc) MyAdminPort() (uint16, error) {
+	return top_svc.adminport, nil
+}
+
+// there is no ssl proxy in standalone mode
+func (top_svc *StaticXDCRTopologySvc) MyProxyPort() (uint16, error) {
+	return 0, nil
+}
+
+func (top_svc *StaticXDCRTopologySvc) MyKVNodes() ([]string, error) {
+	kvNodes := make([]string, len(top_svc.kvNodes))
+	copy(kvNodes, top_svc.kvNodes)
+	return kvNodes, nil
+}
+
+func (top_svc *StaticXDCRTopologySvc) MyClusterUuid() (string, error) {
+	return top_svc.clusterUuid, nil
+}
+
+func (top_svc *StaticXDCRTopologySvc) MyClusterVersion() (string, error) {
+	return top_svc.clusterVersion, nil
+}
+
+func (top_svc *StaticXDCRTopologySvc) IsMyClusterEnterprise() (bool, error) {
+	return top_svc.isEnterprise, nil
+}
+
+func (top_svc *StaticXDCRTopologySvc) XDCRCompToKVNodeMap() (map[string][]string, error) {
+	kvNodes, _ := top_svc.MyKVNodes()
+	return map[string][]string{top_svc.hostName: kvNodes}, nil
+}
+
+// implements base.ClusterConnectionInfoProvider
+func (top_svc *StaticXDCRTopologySvc) MyConnectionStr() (string, error) {
+	return utils.GetHostAddr(top_svc.hostName, top_svc.adminport), nil
+}
+
+func (top_svc *StaticXDCRTopologySvc) MyCredentials() (string, string, []byte, bool, error) {
+	return top_svc.username, top_svc.password, nil, false, nil
+}
+
+func (top_svc *StaticXDCRTopologySvc) IsKVNode() (bool, error) {
+	return true, nil
+}
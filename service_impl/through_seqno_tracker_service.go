@@ -33,14 +33,23 @@ type ThroughSeqnoTrackerSvc struct {
 	// stores for each vb a sorted list of the seqnos that have been sent to and confirmed by target
 	vb_sent_seqno_list_map map[uint16]*SortedSeqnoListWithLock
 
-	// Note: lists in the following two maps are treated in the same way in through_seqno computation
-	// they are maintained as two seperate lists because insertions into the lists are simpler
+	// Note: lists in the following maps are treated in the same way in through_seqno computation
+	// they are maintained as seperate lists because insertions into the lists are simpler
 	// and quicker this way - each insertion is simply an append to the end of the list
 
-	// stores for each vb a sorted list of seqnos that have been filtered out
+	// stores for each vb a list of seqnos that have been filtered out by routers or dropped by processors.
+	// the list is sorted before use, since processors drop docs after routers have filtered later docs of the same vb
 	vb_filtered_seqno_list_map map[uint16]*SortedSeqnoListWithLock
-	// stores for each vb a sorted list of seqnos that have failed conflict resolution on source
+	// stores for each vb a list of seqnos that have failed conflict resolution on source. the list is sorted before use,
+	// since docs of a vb are sent by more than one outgoing nozzle when their keys are rewritten
 	vb_failed_cr_seqno_list_map map[uint16]*SortedSeqnoListWithLock
+	// stores for each vb a list of seqnos of document versions that have been superseded within batches of outgoing nozzles.
+	// they are kept apart from filtered seqnos since they are raised by outgoing nozzles, asynchronously with filtered seqnos.
+	// the list is sorted before use for the same reason as failed_cr_seqno_list
+	vb_deduplicated_seqno_list_map map[uint16]*SortedSeqnoListWithLock
+	// stores for each vb a list of seqnos of documents that target has rejected permanently, which are kept in
+	// dead-letter queue. the list is sorted before use for the same reason as deduplicated_seqno_list
+	vb_dead_lettered_seqno_list_map map[uint16]*SortedSeqnoListWithLock
 
 	// gap_seqno_list_1[i] stores the start seqno of the ith gap range
 	// gap_seqno_list_2[i] stores the end seqno of  the ith gap range
@@ -69,8 +78,11 @@ func newSortedSeqnoListWithLock() *SortedSeqnoListWithLock {
 }
 
 // when needToSort is true, sort the internal seqno_list before returning it
-// sorting is needed only when seqno_list is not already sorted, which is the case only for sent_seqno_list
-// in other words, needToSort should be set to true only when operating on sent_seqno_list
+// sorting is needed only when seqno_list is not already sorted, which is the case for sent_seqno_list,
+// for filtered_seqno_list, which receives seqnos from both routers and processors,
+// and for failed_cr_seqno_list, deduplicated_seqno_list and dead_lettered_seqno_list, which receive seqnos of a vb
+// from all outgoing nozzles
+// when document keys are rewritten
 func (list_obj *SortedSeqnoListWithLock) getSortedSeqnoList(needToSort bool) []uint64 {
 	if needToSort {
 		list_obj.lock.Lock()
@@ -98,7 +110,8 @@ func (list_obj *SortedSeqnoListWithLock) appendSeqno(seqno uint64, logger *log.C
 func (list_obj *SortedSeqnoListWithLock) truncateSeqnos(through_seqno uint64) {
 	list_obj.lock.Lock()
 	defer list_obj.lock.Unlock()
-	seqno_list := list_obj.seqno_list
+	// seqnos may have been appended out of order since seqno_list was last sorted
+	seqno_list := simple_utils.SortUint64List(list_obj.seqno_list)
 	index, found := simple_utils.SearchUint64List(seqno_list, through_seqno)
 	if found {
 		list_obj.seqno_list = seqno_list[index+1:]
@@ -161,14 +174,16 @@ func truncateGapSeqnoList(through_seqno uint64, seqno_list []uint64) []uint64 {
 func NewThroughSeqnoTrackerSvc(logger_ctx *log.LoggerContext) *ThroughSeqnoTrackerSvc {
 	logger := log.NewLogger("ThrSeqTrackSvc", logger_ctx)
 	tsTracker := &ThroughSeqnoTrackerSvc{
-		logger:                      logger,
-		vb_map:                      make(map[uint16]bool),
-		through_seqno_map:           make(map[uint16]*base.SeqnoWithLock),
-		vb_last_seen_seqno_map:      make(map[uint16]*base.SeqnoWithLock),
-		vb_sent_seqno_list_map:      make(map[uint16]*SortedSeqnoListWithLock),
-		vb_filtered_seqno_list_map:  make(map[uint16]*SortedSeqnoListWithLock),
-		vb_failed_cr_seqno_list_map: make(map[uint16]*SortedSeqnoListWithLock),
-		vb_gap_seqno_list_map:       make(map[uint16]*DualSortedSeqnoListWithLock),
+		logger:                          logger,
+		vb_map:                          make(map[uint16]bool),
+		through_seqno_map:               make(map[uint16]*base.SeqnoWithLock),
+		vb_last_seen_seqno_map:          make(map[uint16]*base.SeqnoWithLock),
+		vb_sent_seqno_list_map:          make(map[uint16]*SortedSeqnoListWithLock),
+		vb_filtered_seqno_list_map:      make(map[uint16]*SortedSeqnoListWithLock),
+		vb_failed_cr_seqno_list_map:     make(map[uint16]*SortedSeqnoListWithLock),
+		vb_deduplicated_seqno_list_map:  make(map[uint16]*SortedSeqnoListWithLock),
+		vb_dead_lettered_seqno_list_map: make(map[uint16]*SortedSeqnoListWithLock),
+		vb_gap_seqno_list_map:           make(map[uint16]*DualSortedSeqnoListWithLock),
 	}
 	return tsTracker
 }
@@ -177,16 +192,22 @@ func (tsTracker *ThroughSeqnoTrackerSvc) initialize(pipeline common.Pipeline) {
 	tsTracker.rep_id = pipeline.Topic()
 	tsTracker.id = pipeline.Topic() + "_" + base.ThroughSeqnoTracker
 	for _, vbno := range pipeline_utils.GetSourceVBListPerPipeline(pipeline) {
-		tsTracker.vb_map[vbno] = true
+		tsTracker.initializeVb(vbno)
+	}
+}
 
-		tsTracker.through_seqno_map[vbno] = base.NewSeqnoWithLock()
-		tsTracker.vb_last_seen_seqno_map[vbno] = base.NewSeqnoWithLock()
+func (tsTracker *ThroughSeqnoTrackerSvc) initializeVb(vbno uint16) {
+	tsTracker.vb_map[vbno] = true
 
-		tsTracker.vb_sent_seqno_list_map[vbno] = newSortedSeqnoListWithLock()
-		tsTracker.vb_filtered_seqno_list_map[vbno] = newSortedSeqnoListWithLock()
-		tsTracker.vb_failed_cr_seqno_list_map[vbno] = newSortedSeqnoListWithLock()
-		tsTracker.vb_gap_seqno_list_map[vbno] = newDualSortedSeqnoListWithLock()
-	}
+	tsTracker.through_seqno_map[vbno] = base.NewSeqnoWithLock()
+	tsTracker.vb_last_seen_seqno_map[vbno] = base.NewSeqnoWithLock()
+
+	tsTracker.vb_sent_seqno_list_map[vbno] = newSortedSeqnoListWithLock()
+	tsTracker.vb_filtered_seqno_list_map[vbno] = newSortedSeqnoListWithLock()
+	tsTracker.vb_failed_cr_seqno_list_map[vbno] = newSortedSeqnoListWithLock()
+	tsTracker.vb_deduplicated_seqno_list_map[vbno] = newSortedSeqnoListWithLock()
+	tsTracker.vb_dead_lettered_seqno_list_map[vbno] = newSortedSeqnoListWithLock()
+	tsTracker.vb_gap_seqno_list_map[vbno] = newDualSortedSeqnoListWithLock()
 }
 
 func (tsTracker *ThroughSeqnoTrackerSvc) Attach(pipeline common.Pipeline) error {
@@ -200,6 +221,8 @@ func (tsTracker *ThroughSeqnoTrackerSvc) Attach(pipeline common.Pipeline) error
 	pipeline_utils.RegisterAsyncComponentEventHandler(asyncListenerMap, base.DataFailedCREventListener, tsTracker)
 	pipeline_utils.RegisterAsyncComponentEventHandler(asyncListenerMap, base.DataFilteredEventListener, tsTracker)
 	pipeline_utils.RegisterAsyncComponentEventHandler(asyncListenerMap, base.DataReceivedEventListener, tsTracker)
+	pipeline_utils.RegisterAsyncComponentEventHandler(asyncListenerMap, base.DataDeduplicatedEventListener, tsTracker)
+	pipeline_utils.RegisterAsyncComponentEventHandler(asyncListenerMap, base.DataDeadLetteredEventListener, tsTracker)
 	return nil
 }
 
@@ -221,6 +244,14 @@ func (tsTracker *ThroughSeqnoTrackerSvc) ProcessEvent(event *common.Event) error
 		seqno := event.OtherInfos.(parts.DataFailedCRSourceEventAdditional).Seqno
 		vbno := event.OtherInfos.(parts.DataFailedCRSourceEventAdditional).VBucket
 		tsTracker.addFailedCRSeqno(vbno, seqno)
+	} else if event.EventType == common.DataDeduplicated {
+		seqno := event.OtherInfos.(parts.DataDeduplicatedEventAdditional).Seqno
+		vbno := event.OtherInfos.(parts.DataDeduplicatedEventAdditional).VBucket
+		tsTracker.addDeduplicatedSeqno(vbno, seqno)
+	} else if event.EventType == common.DataDeadLettered {
+		seqno := event.OtherInfos.(parts.DataDeadLetteredEventAdditional).Seqno
+		vbno := event.OtherInfos.(parts.DataDeadLetteredEventAdditional).VBucket
+		tsTracker.addDeadLetteredSeqno(vbno, seqno)
 	} else if event.EventType == common.DataReceived {
 		upr_event := event.Data.(*mcc.UprEvent)
 		seqno := upr_event.Seqno
@@ -235,24 +266,60 @@ func (tsTracker *ThroughSeqnoTrackerSvc) ProcessEvent(event *common.Event) error
 }
 
 func (tsTracker *ThroughSeqnoTrackerSvc) addSentSeqno(vbno uint16, sent_seqno uint64) {
+	if sent_seqno == 0 {
+		// documents re-driven from dead-letter queue do not have seqnos and are not tracked
+		return
+	}
 	tsTracker.validateVbno(vbno, "addSentSeqno")
 	tsTracker.logger.Tracef("%v adding sent seqno %v for vb %v.\n", tsTracker.id, sent_seqno, vbno)
 	tsTracker.vb_sent_seqno_list_map[vbno].appendSeqno(sent_seqno, tsTracker.logger)
 }
 
 func (tsTracker *ThroughSeqnoTrackerSvc) addFilteredSeqno(vbno uint16, filtered_seqno uint64) {
+	if filtered_seqno == 0 {
+		// documents re-driven from dead-letter queue do not have seqnos and are not tracked
+		return
+	}
 	tsTracker.validateVbno(vbno, "addFilteredSeqno")
 	tsTracker.logger.Tracef("%v adding filtered seqno %v for vb %v.", tsTracker.id, filtered_seqno, vbno)
 	tsTracker.vb_filtered_seqno_list_map[vbno].appendSeqno(filtered_seqno, tsTracker.logger)
 }
 
 func (tsTracker *ThroughSeqnoTrackerSvc) addFailedCRSeqno(vbno uint16, failed_cr_seqno uint64) {
+	if failed_cr_seqno == 0 {
+		// documents re-driven from dead-letter queue do not have seqnos and are not tracked
+		return
+	}
 	tsTracker.validateVbno(vbno, "addFailedCRSeqno")
 
 	tsTracker.logger.Tracef("%v adding failed cr seqno %v for vb %v.", tsTracker.id, failed_cr_seqno, vbno)
 	tsTracker.vb_failed_cr_seqno_list_map[vbno].appendSeqno(failed_cr_seqno, tsTracker.logger)
 }
 
+// superseded versions of documents are treated the same way as filtered ones in through_seqno computation
+func (tsTracker *ThroughSeqnoTrackerSvc) addDeduplicatedSeqno(vbno uint16, deduplicated_seqno uint64) {
+	if deduplicated_seqno == 0 {
+		// documents re-driven from dead-letter queue do not have seqnos and are not tracked
+		return
+	}
+	tsTracker.validateVbno(vbno, "addDeduplicatedSeqno")
+
+	tsTracker.logger.Tracef("%v adding deduplicated seqno %v for vb %v.", tsTracker.id, deduplicated_seqno, vbno)
+	tsTracker.vb_deduplicated_seqno_list_map[vbno].appendSeqno(deduplicated_seqno, tsTracker.logger)
+}
+
+// dead-lettered documents are kept in dead-letter queue and do not hold back checkpointing
+func (tsTracker *ThroughSeqnoTrackerSvc) addDeadLetteredSeqno(vbno uint16, dead_lettered_seqno uint64) {
+	if dead_lettered_seqno == 0 {
+		// documents re-driven from dead-letter queue do not have seqnos and are not tracked
+		return
+	}
+	tsTracker.validateVbno(vbno, "addDeadLetteredSeqno")
+
+	tsTracker.logger.Tracef("%v adding dead-lettered seqno %v for vb %v.", tsTracker.id, dead_lettered_seqno, vbno)
+	tsTracker.vb_dead_lettered_seqno_list_map[vbno].appendSeqno(dead_lettered_seqno, tsTracker.logger)
+}
+
 func (tsTracker *ThroughSeqnoTrackerSvc) processGapSeqnos(vbno uint16, current_seqno uint64) {
 	tsTracker.validateVbno(vbno, "processGapSeqnos")
 
@@ -278,6 +345,8 @@ func (tsTracker *ThroughSeqnoTrackerSvc) truncateSeqnoLists(vbno uint16, through
 	tsTracker.vb_sent_seqno_list_map[vbno].truncateSeqnos(through_seqno)
 	tsTracker.vb_filtered_seqno_list_map[vbno].truncateSeqnos(through_seqno)
 	tsTracker.vb_failed_cr_seqno_list_map[vbno].truncateSeqnos(through_seqno)
+	tsTracker.vb_deduplicated_seqno_list_map[vbno].truncateSeqnos(through_seqno)
+	tsTracker.vb_dead_lettered_seqno_list_map[vbno].truncateSeqnos(through_seqno)
 	tsTracker.vb_gap_seqno_list_map[vbno].truncateSeqnos(through_seqno)
 }
 
@@ -294,22 +363,27 @@ func (tsTracker *ThroughSeqnoTrackerSvc) GetThroughSeqno(vbno uint16) uint64 {
 	last_through_seqno := through_seqno_obj.GetSeqnoWithoutLock()
 	sent_seqno_list := tsTracker.vb_sent_seqno_list_map[vbno].getSortedSeqnoList(true)
 	max_sent_seqno := maxSeqno(sent_seqno_list)
-	filtered_seqno_list := tsTracker.vb_filtered_seqno_list_map[vbno].getSortedSeqnoList(false)
+	filtered_seqno_list := tsTracker.vb_filtered_seqno_list_map[vbno].getSortedSeqnoList(true)
 	max_filtered_seqno := maxSeqno(filtered_seqno_list)
-	failed_cr_seqno_list := tsTracker.vb_failed_cr_seqno_list_map[vbno].getSortedSeqnoList(false)
+	failed_cr_seqno_list := tsTracker.vb_failed_cr_seqno_list_map[vbno].getSortedSeqnoList(true)
 	max_failed_cr_seqno := maxSeqno(failed_cr_seqno_list)
+	deduplicated_seqno_list := tsTracker.vb_deduplicated_seqno_list_map[vbno].getSortedSeqnoList(true)
+	max_deduplicated_seqno := maxSeqno(deduplicated_seqno_list)
+	dead_lettered_seqno_list := tsTracker.vb_dead_lettered_seqno_list_map[vbno].getSortedSeqnoList(true)
+	max_dead_lettered_seqno := maxSeqno(dead_lettered_seqno_list)
 	gap_seqno_list_1, gap_seqno_list_2 := tsTracker.vb_gap_seqno_list_map[vbno].getSortedSeqnoLists()
 	max_end_gap_seqno := maxSeqno(gap_seqno_list_2)
 
-	tsTracker.logger.Tracef("%v, vbno=%v, last_through_seqno=%v len(sent_seqno_list)=%v len(filtered_seqno_list)=%v len(failed_cr_seqno_list)=%v len(gap_seqno_list_1)=%v len(gap_seqno_list_2)=%v\n", tsTracker.id, vbno, last_through_seqno, len(sent_seqno_list), len(filtered_seqno_list), len(failed_cr_seqno_list), len(gap_seqno_list_1), len(gap_seqno_list_2))
-	tsTracker.logger.Tracef("%v, vbno=%v, last_through_seqno=%v\n sent_seqno_list=%v\n filtered_seqno_list=%v\n failed_cr_seqno_list=%v\n gap_seqno_list_1=%v\n gap_seqno_list_2=%v\n", tsTracker.id, vbno, last_through_seqno, sent_seqno_list, filtered_seqno_list, failed_cr_seqno_list, gap_seqno_list_1, gap_seqno_list_2)
+	tsTracker.logger.Tracef("%v, vbno=%v, last_through_seqno=%v len(sent_seqno_list)=%v len(filtered_seqno_list)=%v len(failed_cr_seqno_list)=%v len(deduplicated_seqno_list)=%v len(dead_lettered_seqno_list)=%v len(gap_seqno_list_1)=%v len(gap_seqno_list_2)=%v\n", tsTracker.id, vbno, last_through_seqno, len(sent_seqno_list), len(filtered_seqno_list), len(failed_cr_seqno_list), len(deduplicated_seqno_list), len(dead_lettered_seqno_list), len(gap_seqno_list_1), len(gap_seqno_list_2))
+	tsTracker.logger.Tracef("%v, vbno=%v, last_through_seqno=%v\n sent_seqno_list=%v\n filtered_seqno_list=%v\n failed_cr_seqno_list=%v\n deduplicated_seqno_list=%v\n dead_lettered_seqno_list=%v\n gap_seqno_list_1=%v\n gap_seqno_list_2=%v\n", tsTracker.id, vbno, last_through_seqno, sent_seqno_list, filtered_seqno_list, failed_cr_seqno_list, deduplicated_seqno_list, dead_lettered_seqno_list, gap_seqno_list_1, gap_seqno_list_2)
 
 	// Goal of algorithm:
 	// Find the right through_seqno for stats and checkpointing, with the constraint that through_seqno cannot be
 	// a gap seqno, since we do not want to use gap seqnos for checkpointing
 
 	// Starting from last_through_seqno, find the largest N such that last_through_seqno+1, last_through_seqno+2,
-	// .., last_through_seqno+N all exist in filtered_seqno_list, failed_cr_seqno_list, sent_seqno_list, or a gap range,
+	// .., last_through_seqno+N all exist in filtered_seqno_list, failed_cr_seqno_list, deduplicated_seqno_list,
+	// dead_lettered_seqno_list, sent_seqno_list, or a gap range,
 	// and that last_through_seqno+N itself is not in a gap range
 	// return last_through_seqno+N as the current through_seqno. Note that N could be 0.
 
@@ -319,12 +393,16 @@ func (tsTracker *ThroughSeqnoTrackerSvc) GetThroughSeqno(vbno uint16) uint64 {
 	var last_sent_index int = -1
 	var last_filtered_index int = -1
 	var last_failed_cr_index int = -1
+	var last_deduplicated_index int = -1
+	var last_dead_lettered_index int = -1
 	var found_seqno_type int = -1
 
 	const (
-		SeqnoTypeSent     int = 1
-		SeqnoTypeFiltered int = 2
-		SeqnoTypeFailedCR int = 3
+		SeqnoTypeSent         int = 1
+		SeqnoTypeFiltered     int = 2
+		SeqnoTypeFailedCR     int = 3
+		SeqnoTypeDeduplicated int = 4
+		SeqnoTypeDeadLettered int = 5
 	)
 
 	for {
@@ -356,6 +434,24 @@ func (tsTracker *ThroughSeqnoTrackerSvc) GetThroughSeqno(vbno uint16) uint64 {
 			}
 		}
 
+		if iter_seqno <= max_deduplicated_seqno {
+			deduplicated_index, deduplicated_found := simple_utils.SearchUint64List(deduplicated_seqno_list, iter_seqno)
+			if deduplicated_found {
+				last_deduplicated_index = deduplicated_index
+				found_seqno_type = SeqnoTypeDeduplicated
+				continue
+			}
+		}
+
+		if iter_seqno <= max_dead_lettered_seqno {
+			dead_lettered_index, dead_lettered_found := simple_utils.SearchUint64List(dead_lettered_seqno_list, iter_seqno)
+			if dead_lettered_found {
+				last_dead_lettered_index = dead_lettered_index
+				found_seqno_type = SeqnoTypeDeadLettered
+				continue
+			}
+		}
+
 		if iter_seqno <= max_end_gap_seqno {
 			gap_found := isSeqnoGapSeqno(gap_seqno_list_1, gap_seqno_list_2, iter_seqno)
 			if gap_found {
@@ -367,13 +463,17 @@ func (tsTracker *ThroughSeqnoTrackerSvc) GetThroughSeqno(vbno uint16) uint64 {
 		break
 	}
 
-	if last_sent_index >= 0 || last_filtered_index >= 0 || last_failed_cr_index >= 0 {
+	if last_sent_index >= 0 || last_filtered_index >= 0 || last_failed_cr_index >= 0 || last_deduplicated_index >= 0 || last_dead_lettered_index >= 0 {
 		if found_seqno_type == SeqnoTypeSent {
 			through_seqno = sent_seqno_list[last_sent_index]
 		} else if found_seqno_type == SeqnoTypeFiltered {
 			through_seqno = filtered_seqno_list[last_filtered_index]
 		} else if found_seqno_type == SeqnoTypeFailedCR {
 			through_seqno = failed_cr_seqno_list[last_failed_cr_index]
+		} else if found_seqno_type == SeqnoTypeDeduplicated {
+			through_seqno = deduplicated_seqno_list[last_deduplicated_index]
+		} else if found_seqno_type == SeqnoTypeDeadLettered {
+			through_seqno = dead_lettered_seqno_list[last_dead_lettered_index]
 		} else {
 			panic(fmt.Sprintf("unexpected found_seqno_type, %v", found_seqno_type))
 		}
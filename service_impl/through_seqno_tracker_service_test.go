@@ -0,0 +1,84 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package service_impl
+
+import (
+	"github.com/couchbase/goxdcr/log"
+	"testing"
+)
+
+func newTestThroughSeqnoTracker(vbnos ...uint16) *ThroughSeqnoTrackerSvc {
+	tsTracker := NewThroughSeqnoTrackerSvc(log.DefaultLoggerContext)
+	tsTracker.id = "testTracker"
+	for _, vbno := range vbnos {
+		tsTracker.initializeVb(vbno)
+	}
+	return tsTracker
+}
+
+// filtered and deduplicated seqnos are raised by different parts and arrive out of order
+func TestThroughSeqnoWithFilteredAndDeduplicatedSeqnos(t *testing.T) {
+	tsTracker := newTestThroughSeqnoTracker(1)
+
+	tsTracker.addSentSeqno(1, 1)
+	tsTracker.addSentSeqno(1, 3)
+	// 7 is filtered by router before 5 is dropped by processor
+	tsTracker.addFilteredSeqno(1, 7)
+	tsTracker.addFilteredSeqno(1, 2)
+	tsTracker.addFilteredSeqno(1, 5)
+	tsTracker.addDeduplicatedSeqno(1, 6)
+	tsTracker.addDeduplicatedSeqno(1, 4)
+
+	if through_seqno := tsTracker.GetThroughSeqno(1); through_seqno != 7 {
+		t.Errorf("expected through seqno 7, got %v", through_seqno)
+	}
+
+	tsTracker.addDeduplicatedSeqno(1, 10)
+	tsTracker.addFilteredSeqno(1, 9)
+	tsTracker.addDeduplicatedSeqno(1, 8)
+	if through_seqno := tsTracker.GetThroughSeqno(1); through_seqno != 10 {
+		t.Errorf("expected through seqno 10, got %v", through_seqno)
+	}
+}
+
+func TestThroughSeqnoStopsAtMissingSeqno(t *testing.T) {
+	tsTracker := newTestThroughSeqnoTracker(1)
+
+	tsTracker.addDeduplicatedSeqno(1, 3)
+	tsTracker.addFilteredSeqno(1, 1)
+	tsTracker.addSentSeqno(1, 4)
+
+	// seqno 2 has not been accounted for yet
+	if through_seqno := tsTracker.GetThroughSeqno(1); through_seqno != 1 {
+		t.Errorf("expected through seqno 1, got %v", through_seqno)
+	}
+
+	tsTracker.addDeduplicatedSeqno(1, 2)
+	if through_seqno := tsTracker.GetThroughSeqno(1); through_seqno != 4 {
+		t.Errorf("expected through seqno 4, got %v", through_seqno)
+	}
+}
+
+// dead-lettered seqnos are raised by outgoing nozzles, asynchronously with filtered and deduplicated seqnos
+func TestThroughSeqnoWithDeadLetteredSeqnos(t *testing.T) {
+	tsTracker := newTestThroughSeqnoTracker(1)
+
+	tsTracker.addDeadLetteredSeqno(1, 5)
+	tsTracker.addFilteredSeqno(1, 4)
+	tsTracker.addDeadLetteredSeqno(1, 2)
+	tsTracker.addDeduplicatedSeqno(1, 3)
+	tsTracker.addSentSeqno(1, 1)
+	// re-driven docs have no seqnos and are ignored
+	tsTracker.addDeadLetteredSeqno(1, 0)
+
+	if through_seqno := tsTracker.GetThroughSeqno(1); through_seqno != 5 {
+		t.Errorf("expected through seqno 5, got %v", through_seqno)
+	}
+}
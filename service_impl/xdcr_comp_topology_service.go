@@ -12,7 +12,6 @@ package service_impl
 import (
 	"errors"
 	"fmt"
-	"github.com/couchbase/cbauth"
 	"github.com/couchbase/goxdcr/base"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/service_def"
@@ -217,7 +216,7 @@ func (top_svc *XDCRTopologySvc) MyCredentials() (string, string, []byte, bool, e
 		panic("connStr == ")
 	}
 
-	username, password, err := cbauth.GetHTTPServiceAuth(connStr)
+	username, password, err := utils.GetLocalHTTPServiceAuth(connStr)
 	return username, password, nil, false, err
 }
 
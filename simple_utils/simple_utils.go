@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"github.com/couchbase/goxdcr/base"
 	"github.com/couchbase/goxdcr/log"
+	"hash/crc32"
 	"math"
 	mrand "math/rand"
 	"reflect"
@@ -397,6 +398,12 @@ func BalanceLoad(num_of_worker int, num_of_load int) [][]int {
 	return load_distribution
 }
 
+// returns the vbucket that a document key belongs to in a bucket with the specified number of vbuckets.
+// this is the same hashing that memcached and smart clients use
+func GetVBucketForKey(key []byte, numOfVBuckets uint16) uint16 {
+	return uint16(((crc32.ChecksumIEEE(key) >> 16) & 0x7fff) % uint32(numOfVBuckets))
+}
+
 // check if a cluster (with specified clusterCompatibility) is compatible with version
 func IsClusterCompatible(clusterCompatibility int, version []int) bool {
 	return clusterCompatibility >= EncodeVersionToEffectiveVersion(version)
@@ -0,0 +1,181 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package standalone
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/utils"
+	"net/http"
+	"strconv"
+)
+
+const (
+	BucketTypeMembase = "membase"
+	KVService         = "kv"
+)
+
+// a node as ns_server reports it in cluster info
+type NodeInfo struct {
+	// host:port at which the rest endpoints of the node are served
+	HostAddr string
+	Services []string
+	// host:port of kv service. empty when the node is not a kv node
+	KVAddr       string
+	KVSSLPort    uint16
+	SSLMgmtPort  uint16
+	SSLProxyPort uint16
+	// couchApiBase is not reported when capi port is 0
+	CapiPort uint16
+}
+
+// a bucket as ns_server reports it in bucket info
+type BucketInfo struct {
+	Name                   string
+	UUID                   string
+	Password               string
+	ConflictResolutionType string
+	// kv address of the node that is master for each vbucket
+	VBOwners []string
+}
+
+// ClusterInfo builds the node and bucket info that ns_server serves, in the format that xdcr parses.
+// it is shared by the cluster rest server of standalone mode and the fake ns_server in tests
+type ClusterInfo struct {
+	ImplementationVersion string
+	ClusterCompatibility  int
+	// revision of cluster map
+	Rev int
+	// the first node is the node being queried
+	Nodes []*NodeInfo
+}
+
+func (cluster *ClusterInfo) NodeInfoList() []interface{} {
+	return cluster.nodeInfoList(cluster.Nodes)
+}
+
+func (cluster *ClusterInfo) nodeInfoList(nodes []*NodeInfo) []interface{} {
+	nodeInfos := make([]interface{}, 0, len(nodes))
+	for _, node := range nodes {
+		nodeInfos = append(nodeInfos, cluster.NodeInfo(node))
+	}
+	return nodeInfos
+}
+
+func (cluster *ClusterInfo) NodeInfo(node *NodeInfo) map[string]interface{} {
+	nodeInfo := map[string]interface{}{
+		base.HostNameKey:             node.HostAddr,
+		base.ThisNodeKey:             node == cluster.Nodes[0],
+		base.ClusterCompatibilityKey: cluster.ClusterCompatibility,
+		"version":                    cluster.ImplementationVersion,
+		"status":                     "healthy",
+		"clusterMembership":          "active",
+		base.ServicesKey:             node.Services,
+		base.PortsKey: map[string]interface{}{
+			base.DirectPortKey:   portOf(node.KVAddr),
+			base.SSLProxyPortKey: node.SSLProxyPort,
+			base.SSLPortKey:      node.SSLMgmtPort,
+		},
+	}
+	if node.CapiPort != 0 {
+		hostName := utils.GetHostName(node.HostAddr)
+		nodeInfo[base.CouchApiBase] = fmt.Sprintf("http://%v/", utils.GetHostAddr(hostName, node.CapiPort))
+		nodeInfo[base.CouchApiBaseHttps] = fmt.Sprintf("https://%v/", utils.GetHostAddr(hostName, node.CapiPort))
+	}
+	return nodeInfo
+}
+
+// nodesExt is consulted for kv ports only, so kv nodes are reported with the host name of their kv service
+func (cluster *ClusterInfo) NodeExtList() []interface{} {
+	nodeExts := make([]interface{}, 0, len(cluster.Nodes))
+	for _, node := range cluster.Nodes {
+		hostName := utils.GetHostName(node.HostAddr)
+		services := map[string]interface{}{
+			"mgmt":    portOf(node.HostAddr),
+			"mgmtSSL": node.SSLMgmtPort,
+		}
+		if node.KVAddr != "" {
+			hostName = utils.GetHostName(node.KVAddr)
+			services[base.KVPortKey] = portOf(node.KVAddr)
+			services[base.KVSSLPortKey] = node.KVSSLPort
+			if node.CapiPort != 0 {
+				services["capi"] = node.CapiPort
+			}
+		}
+		nodeExts = append(nodeExts, map[string]interface{}{
+			base.HostNameKey: hostName,
+			base.ServicesKey: services,
+			base.ThisNodeKey: node == cluster.Nodes[0],
+		})
+	}
+	return nodeExts
+}
+
+func (cluster *ClusterInfo) BucketInfo(bucket *BucketInfo) map[string]interface{} {
+	kvNodes := make([]*NodeInfo, 0, len(cluster.Nodes))
+	serverList := make([]string, 0, len(cluster.Nodes))
+	serverIndex := make(map[string]int)
+	for _, node := range cluster.Nodes {
+		if node.KVAddr == "" {
+			continue
+		}
+		serverIndex[node.KVAddr] = len(serverList)
+		kvNodes = append(kvNodes, node)
+		serverList = append(serverList, node.KVAddr)
+	}
+	vbMap := make([][]int, len(bucket.VBOwners))
+	for vbno, owner := range bucket.VBOwners {
+		vbMap[vbno] = []int{serverIndex[owner]}
+	}
+
+	return map[string]interface{}{
+		"name":                         bucket.Name,
+		base.UUIDKey:                   bucket.UUID,
+		base.URIKey:                    fmt.Sprintf("%v%v?bucket_uuid=%v", base.DefaultPoolBucketsPath, bucket.Name, bucket.UUID),
+		base.BucketTypeKey:             BucketTypeMembase,
+		base.ConflictResolutionTypeKey: bucket.ConflictResolutionType,
+		base.SASLPasswordKey:           bucket.Password,
+		"rev":                          cluster.Rev,
+		base.NodesKey:                  cluster.nodeInfoList(kvNodes),
+		base.NodeExtKey:                cluster.NodeExtList(),
+		base.BucketCapabilitiesKey:     []string{"xattr", "dcp", "cbhello", "touch", "cccp", "xdcrCheckpointing", "nodesExt"},
+		base.VBucketServerMapKey: map[string]interface{}{
+			"hashAlgorithm":    "CRC",
+			"numReplicas":      0,
+			base.ServerListKey: serverList,
+			base.VBucketMapKey: vbMap,
+		},
+	}
+}
+
+// writes value as json response. content length is always set, since xdcr does not read responses without it
+func WriteJson(w http.ResponseWriter, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(base.ContentType, base.JsonContentType)
+	w.Header().Set(base.ContentLength, strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// port of hostAddr, or 0 when hostAddr is empty or has no valid port
+func portOf(hostAddr string) uint16 {
+	if hostAddr == "" {
+		return 0
+	}
+	port, err := utils.GetPortNumber(hostAddr)
+	if err != nil {
+		return 0
+	}
+	return port
+}
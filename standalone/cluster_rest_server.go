@@ -0,0 +1,247 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package standalone
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/simple_utils"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// cluster map never changes
+const clusterMapRev = 1
+
+// ClusterRestServer serves, for a cluster in standalone config, the read only subset of ns_server rest api
+// that xdcr uses to discover cluster uuid, version, nodes, buckets and vbucket maps.
+// this way the code paths that query ns_server work unchanged for clusters of plain kv nodes
+type ClusterRestServer struct {
+	cluster              *ClusterConfig
+	clusterCompatibility int
+	cluster_info         *ClusterInfo
+	listener             net.Listener
+	server               *http.Server
+	logger               *log.CommonLogger
+}
+
+func NewClusterRestServer(cluster *ClusterConfig, logger_ctx *log.LoggerContext) (*ClusterRestServer, error) {
+	version, err := cluster.compatibilityVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	rest_server := &ClusterRestServer{
+		cluster:              cluster,
+		clusterCompatibility: simple_utils.EncodeVersionToEffectiveVersion(version),
+		logger:               log.NewLogger("ClusterRestServer", logger_ctx),
+	}
+	rest_server.cluster_info = rest_server.clusterInfo()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(base.PoolsPath, rest_server.authenticated(rest_server.handlePools))
+	mux.HandleFunc(base.DefaultPoolPath, rest_server.authenticated(rest_server.handleDefaultPool))
+	mux.HandleFunc(base.NodesPath, rest_server.authenticated(rest_server.handleNodes))
+	mux.HandleFunc(strings.TrimSuffix(base.DefaultPoolBucketsPath, base.UrlDelimiter), rest_server.authenticated(rest_server.handleBuckets))
+	mux.HandleFunc(base.DefaultPoolBucketsPath, rest_server.authenticated(rest_server.handleBucket))
+	mux.HandleFunc(base.BPath, rest_server.authenticated(rest_server.handleBucket))
+	mux.HandleFunc(base.NodeServicesPath, rest_server.authenticated(rest_server.handleNodeServices))
+	mux.HandleFunc(base.NodesSelfPath, rest_server.authenticated(rest_server.handleNodesSelf))
+	mux.HandleFunc(base.DefaultPoolTasksPath, rest_server.authenticated(rest_server.handleTasks))
+	mux.HandleFunc(base.UrlDelimiter+base.UILogPath, rest_server.authenticated(rest_server.handleUILog))
+	// there is no ssl support for plain kv nodes. xdcrSSLPorts is left unhandled and gets 404
+
+	rest_server.server = &http.Server{Handler: mux}
+	return rest_server, nil
+}
+
+// starts listening on rest address of cluster
+func (rest_server *ClusterRestServer) Start() error {
+	listener, err := net.Listen("tcp", rest_server.cluster.RestAddr)
+	if err != nil {
+		return err
+	}
+	rest_server.listener = listener
+
+	go func() {
+		err := rest_server.server.Serve(listener)
+		rest_server.logger.Infof("Rest server for cluster %v exited. err=%v\n", rest_server.cluster.UUID, err)
+	}()
+
+	rest_server.logger.Infof("Serving rest endpoints of cluster %v at %v\n", rest_server.cluster.UUID, rest_server.cluster.RestAddr)
+	return nil
+}
+
+func (rest_server *ClusterRestServer) Stop() error {
+	if rest_server.listener == nil {
+		return nil
+	}
+	return rest_server.listener.Close()
+}
+
+/************************************
+/* rest handlers
+*************************************/
+
+func (rest_server *ClusterRestServer) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(username), []byte(rest_server.cluster.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(rest_server.cluster.Password)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (rest_server *ClusterRestServer) handlePools(w http.ResponseWriter, r *http.Request) {
+	WriteJson(w, map[string]interface{}{
+		base.ImplementationVersionKey: rest_server.implementationVersion(),
+		base.IsEnterprise:             rest_server.cluster.IsEnterprise,
+		base.UUIDKey:                  rest_server.cluster.UUID,
+		base.Pools: []interface{}{map[string]interface{}{
+			"name":      base.DefaultPoolName,
+			base.URIKey: fmt.Sprintf("%v?uuid=%v", base.DefaultPoolPath, rest_server.cluster.UUID),
+		}},
+	})
+}
+
+func (rest_server *ClusterRestServer) handleDefaultPool(w http.ResponseWriter, r *http.Request) {
+	WriteJson(w, map[string]interface{}{
+		"name":        base.DefaultPoolName,
+		"rev":         clusterMapRev,
+		base.NodesKey: rest_server.cluster_info.NodeInfoList(),
+		base.BucketsKey: map[string]interface{}{
+			base.URIKey: fmt.Sprintf("%v?v=%v&uuid=%v", strings.TrimSuffix(base.DefaultPoolBucketsPath, base.UrlDelimiter), clusterMapRev, rest_server.cluster.UUID),
+		},
+		"rebalanceStatus": "none",
+	})
+}
+
+func (rest_server *ClusterRestServer) handleNodes(w http.ResponseWriter, r *http.Request) {
+	WriteJson(w, map[string]interface{}{base.NodesKey: rest_server.cluster_info.NodeInfoList()})
+}
+
+func (rest_server *ClusterRestServer) handleBuckets(w http.ResponseWriter, r *http.Request) {
+	bucketInfos := make([]interface{}, 0, len(rest_server.cluster.Buckets))
+	for _, bucket := range rest_server.cluster.Buckets {
+		bucketInfos = append(bucketInfos, rest_server.bucketInfo(bucket))
+	}
+	WriteJson(w, bucketInfos)
+}
+
+// serves both /pools/default/buckets/$bucket and /pools/default/b/$bucket
+func (rest_server *ClusterRestServer) handleBucket(w http.ResponseWriter, r *http.Request) {
+	bucketName := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, base.DefaultPoolBucketsPath), base.BPath)
+	for _, bucket := range rest_server.cluster.Buckets {
+		if bucket.Name == bucketName {
+			WriteJson(w, rest_server.bucketInfo(bucket))
+			return
+		}
+	}
+	http.Error(w, "Requested resource not found.", http.StatusNotFound)
+}
+
+func (rest_server *ClusterRestServer) handleNodeServices(w http.ResponseWriter, r *http.Request) {
+	WriteJson(w, map[string]interface{}{
+		"rev":           clusterMapRev,
+		base.NodeExtKey: rest_server.cluster_info.NodeExtList(),
+	})
+}
+
+func (rest_server *ClusterRestServer) handleNodesSelf(w http.ResponseWriter, r *http.Request) {
+	WriteJson(w, rest_server.cluster_info.NodeInfo(rest_server.cluster_info.Nodes[0]))
+}
+
+// there are never rebalances
+func (rest_server *ClusterRestServer) handleTasks(w http.ResponseWriter, r *http.Request) {
+	WriteJson(w, []interface{}{map[string]interface{}{
+		"type":   "rebalance",
+		"status": "notRunning",
+	}})
+}
+
+// ui logs go into xdcr log, since there is no ui
+func (rest_server *ClusterRestServer) handleUILog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != base.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	rest_server.logger.Infof("UI log: %v\n", r.Form.Get(base.UILogMessageKey))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (rest_server *ClusterRestServer) implementationVersion() string {
+	edition := "community"
+	if rest_server.cluster.IsEnterprise {
+		edition = "enterprise"
+	}
+	// format of [version]-[buildNumber]-[edition], which is what ns_server reports
+	return fmt.Sprintf("%v-0000-%v", rest_server.cluster.Version, edition)
+}
+
+// each kv node is reported as a node whose rest endpoint is the rest endpoint of the cluster,
+// since that is the only address where this process serves rest endpoints of the cluster.
+// the first kv node is the node being queried
+func (rest_server *ClusterRestServer) clusterInfo() *ClusterInfo {
+	nodes := make([]*NodeInfo, 0, len(rest_server.cluster.KVNodes))
+	for _, kvNode := range rest_server.cluster.KVNodes {
+		nodes = append(nodes, &NodeInfo{HostAddr: rest_server.cluster.RestAddr,
+			Services: []string{KVService},
+			KVAddr:   kvNode,
+		})
+	}
+	return &ClusterInfo{ImplementationVersion: rest_server.implementationVersion(),
+		ClusterCompatibility: rest_server.clusterCompatibility,
+		Rev:                  clusterMapRev,
+		Nodes:                nodes,
+	}
+}
+
+func (rest_server *ClusterRestServer) bucketInfo(bucket *BucketConfig) map[string]interface{} {
+	vbOwners := make([]string, bucket.NumVBuckets)
+	for kvNode, vbnos := range rest_server.vbucketMap(bucket) {
+		for _, vbno := range vbnos {
+			vbOwners[vbno] = kvNode
+		}
+	}
+	return rest_server.cluster_info.BucketInfo(&BucketInfo{Name: bucket.Name,
+		UUID:                   bucket.UUID,
+		Password:               bucket.Password,
+		ConflictResolutionType: bucket.ConflictResolutionType,
+		VBOwners:               vbOwners,
+	})
+}
+
+// kv node to vbuckets map of bucket, either as configured or with vbuckets distributed evenly across kv nodes
+func (rest_server *ClusterRestServer) vbucketMap(bucket *BucketConfig) map[string][]uint16 {
+	if bucket.VBucketMap != nil {
+		return bucket.VBucketMap
+	}
+
+	kvNodes := rest_server.cluster.KVNodes
+	numOfNodes := len(kvNodes)
+	if numOfNodes > int(bucket.NumVBuckets) {
+		numOfNodes = int(bucket.NumVBuckets)
+	}
+	vbucketMap := make(map[string][]uint16)
+	load_distribution := simple_utils.BalanceLoad(numOfNodes, int(bucket.NumVBuckets))
+	for index := 0; index < numOfNodes; index++ {
+		for vbno := load_distribution[index][0]; vbno < load_distribution[index][1]; vbno++ {
+			vbucketMap[kvNodes[index]] = append(vbucketMap[kvNodes[index]], uint16(vbno))
+		}
+	}
+	return vbucketMap
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package standalone
+
+import (
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testLogger = log.NewLogger("ClusterRestServerTest", log.DefaultLoggerContext)
+
+func TestClusterRestServersFromConfig(t *testing.T) {
+	file_path := writeTestConfig(t, testConfig)
+	defer os.RemoveAll(filepath.Dir(file_path))
+
+	config, err := LoadConfig(file_path)
+	if err != nil {
+		t.Fatalf("Error loading config. err=%v", err)
+	}
+	for _, cluster := range config.AllClusters() {
+		rest_server, err := NewClusterRestServer(cluster, nil)
+		if err == nil {
+			err = rest_server.Start()
+		}
+		if err != nil {
+			t.Fatalf("Error starting rest server for cluster %v. err=%v", cluster.RestAddr, err)
+		}
+		defer rest_server.Stop()
+	}
+
+	for _, cluster := range config.AllClusters() {
+		clusterUUID, nodeList, err := utils.GetClusterUUIDAndNodeListWithMinInfo(cluster.RestAddr, cluster.Username, cluster.Password, nil, false, testLogger)
+		if err != nil {
+			t.Fatalf("Error getting node list of cluster %v. err=%v", cluster.RestAddr, err)
+		}
+		if clusterUUID != cluster.UUID || len(nodeList) != len(cluster.KVNodes) {
+			t.Errorf("Expected uuid %v and %v nodes, got %v and %v", cluster.UUID, len(cluster.KVNodes), clusterUUID, nodeList)
+		}
+
+		// every node needs to be advertised at an address where the rest endpoints of the cluster are served
+		for _, node := range nodeList {
+			hostAddr, err := utils.GetHostAddrFromNodeInfo(cluster.RestAddr, node.(map[string]interface{}), testLogger)
+			if err != nil || hostAddr != cluster.RestAddr {
+				t.Errorf("Expected node to be advertised at %v, got %v. err=%v", cluster.RestAddr, hostAddr, err)
+				continue
+			}
+			if nodeClusterUUID, _, err := utils.GetClusterUUIDAndNodeListWithMinInfo(hostAddr, cluster.Username, cluster.Password, nil, false, testLogger); err != nil || nodeClusterUUID != cluster.UUID {
+				t.Errorf("Error querying node %v. uuid=%v, err=%v", hostAddr, nodeClusterUUID, err)
+			}
+		}
+
+		for _, bucket := range cluster.Buckets {
+			_, bucketUUID, crType, _, serverVBMap, err := utils.BucketValidationInfo(cluster.RestAddr, bucket.Name, cluster.Username, cluster.Password, nil, false, testLogger)
+			if err != nil {
+				t.Fatalf("Error getting info of bucket %v. err=%v", bucket.Name, err)
+			}
+			if bucketUUID != bucket.UUID || crType != bucket.ConflictResolutionType {
+				t.Errorf("Wrong info of bucket %v. uuid=%v, conflictResolutionType=%v", bucket.Name, bucketUUID, crType)
+			}
+			numVBuckets := 0
+			for _, vbnos := range serverVBMap {
+				numVBuckets += len(vbnos)
+			}
+			if numVBuckets != int(bucket.NumVBuckets) || len(serverVBMap) != len(cluster.KVNodes) {
+				t.Errorf("Expected %v vbuckets across kv nodes %v, got %v", bucket.NumVBuckets, cluster.KVNodes, serverVBMap)
+			}
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// standalone mode, where xdcr runs without ns_server and replicates between plain kv nodes.
+// the clusters involved, i.e., their uuids, kv nodes, buckets and vbucket maps, are fixed by a config file
+package standalone
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/utils"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var DefaultClusterVersion = "5.0.0"
+var DefaultNumVBuckets uint16 = 1024
+
+type Config struct {
+	// host and port of xdcr rest server. host defaults to base.LocalHostName
+	XdcrRestHost string `json:"xdcrRestHost"`
+	XdcrRestPort uint16 `json:"xdcrRestPort"`
+	// file where metadata, e.g., remote cluster references, replication specs and checkpoints, is kept
+	MetadataFile string `json:"metadataFile"`
+	// credentials of the administrator of xdcr rest server
+	AdminUsername string `json:"adminUsername"`
+	AdminPassword string `json:"adminPassword"`
+	// the cluster whose buckets are replicated from
+	LocalCluster *ClusterConfig `json:"localCluster"`
+	// clusters that can be replicated to. remote cluster references to them need to be created with their rest addresses
+	RemoteClusters []*ClusterConfig `json:"remoteClusters"`
+}
+
+// a cluster of plain kv nodes, for which this process serves the cluster info rest endpoints that ns_server would
+type ClusterConfig struct {
+	// host:port at which this process serves the rest endpoints of the cluster.
+	// host needs to be localhost or an ip address of this host, for remote clusters too
+	RestAddr     string `json:"restAddr"`
+	UUID         string `json:"uuid"`
+	Version      string `json:"version"`
+	IsEnterprise bool   `json:"isEnterprise"`
+	// credentials for both the rest endpoints and kv nodes
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// host:port of kv nodes
+	KVNodes []string        `json:"kvNodes"`
+	Buckets []*BucketConfig `json:"buckets"`
+}
+
+type BucketConfig struct {
+	Name     string `json:"name"`
+	UUID     string `json:"uuid"`
+	Password string `json:"password"`
+	// seqno or lww
+	ConflictResolutionType string `json:"conflictResolutionType"`
+	NumVBuckets            uint16 `json:"numVBuckets"`
+	// kv node to vbuckets map. when not specified, vbuckets are distributed evenly across kv nodes
+	VBucketMap map[string][]uint16 `json:"vbucketMap"`
+}
+
+func LoadConfig(file_path string) (*Config, error) {
+	data, err := ioutil.ReadFile(file_path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing standalone config file %v. err=%v", file_path, err)
+	}
+
+	err = config.initialize()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid standalone config file %v. err=%v", file_path, err)
+	}
+	return config, nil
+}
+
+// validates config and fills in defaults
+func (config *Config) initialize() error {
+	if config.XdcrRestHost == "" {
+		config.XdcrRestHost = base.LocalHostName
+	}
+	if config.XdcrRestPort == 0 {
+		config.XdcrRestPort = base.AdminportNumber
+	}
+	if config.MetadataFile == "" {
+		return fmt.Errorf("metadataFile is required")
+	}
+	if config.AdminUsername == "" || config.AdminPassword == "" {
+		return fmt.Errorf("adminUsername and adminPassword are required")
+	}
+	if config.LocalCluster == nil {
+		return fmt.Errorf("localCluster is required")
+	}
+
+	restAddrs := make(map[string]bool)
+	clusterUUIDs := make(map[string]bool)
+	for _, cluster := range config.AllClusters() {
+		err := cluster.initialize()
+		if err != nil {
+			return err
+		}
+		if restAddrs[cluster.RestAddr] {
+			return fmt.Errorf("restAddr %v is used by more than one cluster", cluster.RestAddr)
+		}
+		restAddrs[cluster.RestAddr] = true
+		if clusterUUIDs[cluster.UUID] {
+			return fmt.Errorf("uuid %v is used by more than one cluster", cluster.UUID)
+		}
+		clusterUUIDs[cluster.UUID] = true
+	}
+	return nil
+}
+
+// local cluster followed by remote clusters
+func (config *Config) AllClusters() []*ClusterConfig {
+	return append([]*ClusterConfig{config.LocalCluster}, config.RemoteClusters...)
+}
+
+func (cluster *ClusterConfig) initialize() error {
+	if cluster.RestAddr == "" {
+		return fmt.Errorf("restAddr is required for all clusters")
+	}
+	if err := validateHostAddr(cluster.RestAddr); err != nil {
+		return fmt.Errorf("restAddr %v of cluster is invalid. err=%v", cluster.RestAddr, err)
+	}
+	if err := validateLocalHostAddr(cluster.RestAddr); err != nil {
+		return fmt.Errorf("restAddr %v of cluster is invalid. err=%v", cluster.RestAddr, err)
+	}
+	if cluster.UUID == "" {
+		return fmt.Errorf("uuid is required for cluster %v", cluster.RestAddr)
+	}
+	if cluster.Version == "" {
+		cluster.Version = DefaultClusterVersion
+	}
+	if _, err := cluster.compatibilityVersion(); err != nil {
+		return err
+	}
+	if len(cluster.KVNodes) == 0 {
+		return fmt.Errorf("kvNodes is required for cluster %v", cluster.RestAddr)
+	}
+
+	kvNodes := make(map[string]bool)
+	for _, kvNode := range cluster.KVNodes {
+		if err := validateHostAddr(kvNode); err != nil {
+			return fmt.Errorf("kv node %v of cluster %v is invalid. err=%v", kvNode, cluster.RestAddr, err)
+		}
+		if kvNodes[kvNode] {
+			return fmt.Errorf("kv node %v is listed more than once in cluster %v", kvNode, cluster.RestAddr)
+		}
+		kvNodes[kvNode] = true
+	}
+
+	bucketNames := make(map[string]bool)
+	for _, bucket := range cluster.Buckets {
+		if bucketNames[bucket.Name] {
+			return fmt.Errorf("bucket %v is listed more than once in cluster %v", bucket.Name, cluster.RestAddr)
+		}
+		bucketNames[bucket.Name] = true
+		err := bucket.initialize(kvNodes)
+		if err != nil {
+			return fmt.Errorf("bucket %v of cluster %v is invalid. err=%v", bucket.Name, cluster.RestAddr, err)
+		}
+	}
+	return nil
+}
+
+// major and minor versions, e.g., [5, 0] for 5.0.0
+func (cluster *ClusterConfig) compatibilityVersion() ([]int, error) {
+	versionParts := strings.Split(cluster.Version, ".")
+	if len(versionParts) < 2 {
+		return nil, fmt.Errorf("version %v of cluster %v is of wrong format", cluster.Version, cluster.RestAddr)
+	}
+	version := make([]int, 2)
+	for i := 0; i < 2; i++ {
+		versionPart, err := strconv.Atoi(versionParts[i])
+		if err != nil {
+			return nil, fmt.Errorf("version %v of cluster %v is of wrong format", cluster.Version, cluster.RestAddr)
+		}
+		version[i] = versionPart
+	}
+	return version, nil
+}
+
+func (bucket *BucketConfig) initialize(kvNodes map[string]bool) error {
+	if bucket.Name == "" || bucket.UUID == "" {
+		return fmt.Errorf("name and uuid are required")
+	}
+	switch bucket.ConflictResolutionType {
+	case "":
+		bucket.ConflictResolutionType = base.ConflictResolutionType_Seqno
+	case base.ConflictResolutionType_Seqno, base.ConflictResolutionType_Lww:
+	default:
+		return fmt.Errorf("conflictResolutionType %v is not supported", bucket.ConflictResolutionType)
+	}
+	if bucket.NumVBuckets == 0 {
+		bucket.NumVBuckets = DefaultNumVBuckets
+	}
+	if bucket.VBucketMap == nil {
+		return nil
+	}
+
+	// each vbucket needs to be on exactly one of the kv nodes
+	owners := make([]string, bucket.NumVBuckets)
+	for kvNode, vbnos := range bucket.VBucketMap {
+		if !kvNodes[kvNode] {
+			return fmt.Errorf("%v in vbucketMap is not a kv node of cluster", kvNode)
+		}
+		for _, vbno := range vbnos {
+			if vbno >= bucket.NumVBuckets {
+				return fmt.Errorf("vbucket %v is out of range", vbno)
+			}
+			if owners[vbno] != "" {
+				return fmt.Errorf("vbucket %v is on both %v and %v", vbno, owners[vbno], kvNode)
+			}
+			owners[vbno] = kvNode
+		}
+	}
+	for vbno, owner := range owners {
+		if owner == "" {
+			return fmt.Errorf("vbucket %v is not on any kv node", vbno)
+		}
+	}
+	return nil
+}
+
+// hostAddr needs to be in the form of hostName:port
+func validateHostAddr(hostAddr string) error {
+	if !strings.Contains(hostAddr, base.UrlPortNumberDelimiter) {
+		return fmt.Errorf("port number is missing")
+	}
+	_, err := utils.GetPortNumber(hostAddr)
+	return err
+}
+
+// hostAddr needs to be bindable on this host
+func validateLocalHostAddr(hostAddr string) error {
+	hostName := utils.GetHostName(hostAddr)
+	if hostName == "localhost" {
+		return nil
+	}
+	ip := net.ParseIP(hostName)
+	if ip == nil {
+		return fmt.Errorf("host %v is neither localhost nor an ip address", hostName)
+	}
+	if ip.IsLoopback() {
+		return nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v is not an ip address of this host", hostName)
+}
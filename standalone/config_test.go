@@ -0,0 +1,112 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package standalone
+
+import (
+	"github.com/couchbase/goxdcr/base"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testConfig = `{
+  "metadataFile": "/var/lib/goxdcr/metadata.json",
+  "adminUsername": "admin",
+  "adminPassword": "password",
+  "localCluster": {
+    "restAddr": "127.0.0.1:19000",
+    "uuid": "local-uuid",
+    "username": "kvuser",
+    "password": "kvpassword",
+    "kvNodes": ["10.0.0.1:11210", "10.0.0.2:11210"],
+    "buckets": [{"name": "default", "uuid": "default-uuid"}]
+  },
+  "remoteClusters": [{
+    "restAddr": "127.0.0.1:19001",
+    "uuid": "remote-uuid",
+    "version": "4.6.0",
+    "username": "remoteuser",
+    "password": "remotepassword",
+    "kvNodes": ["10.0.1.1:11210"],
+    "buckets": [{"name": "target", "uuid": "target-uuid", "conflictResolutionType": "lww",
+      "numVBuckets": 4, "vbucketMap": {"10.0.1.1:11210": [0, 1, 2, 3]}}]
+  }]
+}`
+
+func writeTestConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "standalone_config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file_path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(file_path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file_path
+}
+
+func TestLoadConfig(t *testing.T) {
+	file_path := writeTestConfig(t, testConfig)
+	defer os.RemoveAll(filepath.Dir(file_path))
+
+	config, err := LoadConfig(file_path)
+	if err != nil {
+		t.Fatalf("Error loading config. err=%v", err)
+	}
+	if config.XdcrRestHost != base.LocalHostName || config.XdcrRestPort != base.AdminportNumber {
+		t.Errorf("Wrong default xdcr rest address %v:%v", config.XdcrRestHost, config.XdcrRestPort)
+	}
+	clusters := config.AllClusters()
+	if len(clusters) != 2 || clusters[0].UUID != "local-uuid" || clusters[1].UUID != "remote-uuid" {
+		t.Fatalf("Wrong clusters %v", clusters)
+	}
+	if clusters[0].Version != DefaultClusterVersion {
+		t.Errorf("Wrong default version %v", clusters[0].Version)
+	}
+	local_bucket := clusters[0].Buckets[0]
+	if local_bucket.NumVBuckets != DefaultNumVBuckets || local_bucket.ConflictResolutionType != base.ConflictResolutionType_Seqno {
+		t.Errorf("Wrong bucket defaults %v", local_bucket)
+	}
+	version, err := clusters[1].compatibilityVersion()
+	if err != nil || version[0] != 4 || version[1] != 6 {
+		t.Errorf("Wrong compatibility version %v. err=%v", version, err)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	invalid_configs := map[string]string{
+		"missing metadata file": `{"adminUsername": "a", "adminPassword": "p",
+			"localCluster": {"restAddr": "127.0.0.1:19000", "uuid": "u", "kvNodes": ["10.0.0.1:11210"]}}`,
+		"missing kv port": `{"metadataFile": "m", "adminUsername": "a", "adminPassword": "p",
+			"localCluster": {"restAddr": "127.0.0.1:19000", "uuid": "u", "kvNodes": ["10.0.0.1"]}}`,
+		"duplicate uuid": `{"metadataFile": "m", "adminUsername": "a", "adminPassword": "p",
+			"localCluster": {"restAddr": "127.0.0.1:19000", "uuid": "u", "kvNodes": ["10.0.0.1:11210"]},
+			"remoteClusters": [{"restAddr": "127.0.0.1:19001", "uuid": "u", "kvNodes": ["10.0.1.1:11210"]}]}`,
+		"remote rest address not on this host": `{"metadataFile": "m", "adminUsername": "a", "adminPassword": "p",
+			"localCluster": {"restAddr": "127.0.0.1:19000", "uuid": "u", "kvNodes": ["10.0.0.1:11210"]},
+			"remoteClusters": [{"restAddr": "192.0.2.1:19000", "uuid": "r", "kvNodes": ["192.0.2.1:11210"]}]}`,
+		"incomplete vbucket map": `{"metadataFile": "m", "adminUsername": "a", "adminPassword": "p",
+			"localCluster": {"restAddr": "127.0.0.1:19000", "uuid": "u", "kvNodes": ["10.0.0.1:11210"],
+			"buckets": [{"name": "b", "uuid": "bu", "numVBuckets": 2, "vbucketMap": {"10.0.0.1:11210": [0]}}]}}`,
+		"unknown conflict resolution type": `{"metadataFile": "m", "adminUsername": "a", "adminPassword": "p",
+			"localCluster": {"restAddr": "127.0.0.1:19000", "uuid": "u", "kvNodes": ["10.0.0.1:11210"],
+			"buckets": [{"name": "b", "uuid": "bu", "conflictResolutionType": "custom"}]}}`,
+	}
+	for name, content := range invalid_configs {
+		file_path := writeTestConfig(t, content)
+		_, err := LoadConfig(file_path)
+		os.RemoveAll(filepath.Dir(file_path))
+		if err == nil {
+			t.Errorf("Config with %v should have been rejected", name)
+		}
+	}
+}
@@ -126,7 +126,7 @@ func invokeFactory() error {
 	replication_manager.StartReplicationManager(options.sourceKVHost, base.AdminportNumber,
 		repl_spec_svc,
 		remote_cluster_svc,
-		cluster_info_svc, top_svc, metadata_svc.NewReplicationSettingsSvc(msvc, nil), checkpoints_svc, capi_svc, audit_svc, uilog_svc, processSetting_svc, bucketSettings_svc, internalSettings_svc)
+		cluster_info_svc, top_svc, metadata_svc.NewReplicationSettingsSvc(msvc, nil), checkpoints_svc, capi_svc, audit_svc, uilog_svc, processSetting_svc, bucketSettings_svc, internalSettings_svc, msvc)
 
 	fac := factory.NewXDCRFactory(repl_spec_svc, remote_cluster_svc, cluster_info_svc, top_svc, checkpoints_svc, capi_svc, uilog_svc, bucketSettings_svc, log.DefaultLoggerContext, log.DefaultLoggerContext, nil, nil)
 
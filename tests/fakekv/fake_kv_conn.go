@@ -0,0 +1,520 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package fakekv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// dcp snapshot marker type for snapshots from memory
+	snapshot_type_memory uint32 = 0x01
+	// dcp stream end flag for streams that have reached their end seqno
+	stream_end_ok uint32 = 0x00
+
+	sasl_mechanism_plain = "PLAIN"
+)
+
+// a dcp stream of a vbucket on a connection
+type fakeStream struct {
+	vbno     uint16
+	opaque   uint32
+	endSeqno uint64
+	finch    chan bool
+}
+
+// a client connection to the fake kv server. requests are processed sequentially, in the order they are received.
+// dcp streams push messages from their own go routines, hence all writes go through writeLock
+type fakeKVConn struct {
+	server  *FakeKVServer
+	netConn net.Conn
+
+	bucketSelected bool
+	dcpOpened      bool
+
+	streams       map[uint16]*fakeStream
+	streamsLock   sync.Mutex
+	streamWaitGrp sync.WaitGroup
+
+	writeLock sync.Mutex
+	finch     chan bool
+	closeOnce sync.Once
+}
+
+func newFakeKVConn(server *FakeKVServer, netConn net.Conn) *fakeKVConn {
+	return &fakeKVConn{server: server,
+		netConn: netConn,
+		streams: make(map[uint16]*fakeStream),
+		finch:   make(chan bool),
+	}
+}
+
+func (conn *fakeKVConn) serve(waitGrp *sync.WaitGroup) {
+	defer waitGrp.Done()
+	defer conn.server.removeConn(conn)
+	defer conn.streamWaitGrp.Wait()
+	defer conn.close()
+
+	reader := bufio.NewReader(conn.netConn)
+	hdrBytes := make([]byte, mc.HDR_LEN)
+	for {
+		req := &mc.MCRequest{}
+		_, err := req.Receive(reader, hdrBytes)
+		if err != nil {
+			if err != io.EOF {
+				select {
+				case <-conn.finch:
+				default:
+					conn.server.logger.Debugf("Fake kv server %v closing connection from %v. err=%v\n", conn.server.Addr(), conn.netConn.RemoteAddr(), err)
+				}
+			}
+			return
+		}
+
+		err = conn.handleRequest(req)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (conn *fakeKVConn) close() {
+	conn.closeOnce.Do(func() {
+		close(conn.finch)
+		conn.netConn.Close()
+	})
+}
+
+func (conn *fakeKVConn) handleRequest(req *mc.MCRequest) error {
+	if status, injected := conn.server.recordOp(req.Opcode); injected {
+		return conn.respond(req, status, nil, nil, nil, 0)
+	}
+
+	switch req.Opcode {
+	case mc.SASL_LIST_MECHS:
+		return conn.respond(req, mc.SUCCESS, nil, nil, []byte(sasl_mechanism_plain), 0)
+	case mc.SASL_AUTH:
+		return conn.handleSaslAuth(req)
+	case mc.SELECT_BUCKET:
+		return conn.handleSelectBucket(req)
+	case mc.HELLO:
+		return conn.handleHELO(req)
+	case mc.NOOP:
+		return conn.respond(req, mc.SUCCESS, nil, nil, nil, 0)
+	case mc.STAT:
+		return conn.handleStats(req)
+	case mc.UPR_BUFFERACK:
+		// buffer acks do not get responses, and flow control is not enforced
+		return nil
+	}
+
+	if !conn.bucketSelected {
+		return conn.respond(req, mc.NO_BUCKET, nil, nil, nil, 0)
+	}
+
+	switch req.Opcode {
+	case mc.GET:
+		return conn.handleGet(req)
+	case base.GET_WITH_META:
+		return conn.handleGetMeta(req)
+	case base.SET_WITH_META, base.DELETE_WITH_META:
+		return conn.handleSetMeta(req)
+	case mc.UPR_OPEN:
+		conn.dcpOpened = true
+		return conn.respond(req, mc.SUCCESS, nil, nil, nil, 0)
+	case mc.UPR_CONTROL:
+		return conn.respond(req, mc.SUCCESS, nil, nil, nil, 0)
+	case mc.UPR_STREAMREQ:
+		return conn.handleStreamRequest(req)
+	case mc.UPR_CLOSESTREAM:
+		return conn.handleCloseStream(req)
+	case mc.UPR_FAILOVERLOG:
+		return conn.handleFailoverLog(req)
+	default:
+		return conn.respond(req, mc.UNKNOWN_COMMAND, nil, nil, nil, 0)
+	}
+}
+
+// body of sasl plain auth is "\x00" + username + "\x00" + password. the username is the bucket name
+func (conn *fakeKVConn) handleSaslAuth(req *mc.MCRequest) error {
+	parts := bytes.Split(req.Body, []byte{0})
+	if string(req.Key) != sasl_mechanism_plain || len(parts) != 3 ||
+		string(parts[1]) != conn.server.bucketName || string(parts[2]) != conn.server.password {
+		return conn.respond(req, mc.AUTH_ERROR, nil, nil, nil, 0)
+	}
+	conn.bucketSelected = true
+	return conn.respond(req, mc.SUCCESS, nil, nil, nil, 0)
+}
+
+func (conn *fakeKVConn) handleSelectBucket(req *mc.MCRequest) error {
+	if string(req.Key) != conn.server.bucketName {
+		return conn.respond(req, mc.KEY_ENOENT, nil, nil, nil, 0)
+	}
+	conn.bucketSelected = true
+	return conn.respond(req, mc.SUCCESS, nil, nil, nil, 0)
+}
+
+// enables the requested features that the server supports. the response body lists them, two bytes each
+func (conn *fakeKVConn) handleHELO(req *mc.MCRequest) error {
+	conn.server.lock.RLock()
+	supported := conn.server.heloFeatures
+	conn.server.lock.RUnlock()
+
+	body := make([]byte, 0, len(req.Body))
+	for i := 0; i+2 <= len(req.Body); i += 2 {
+		feature := binary.BigEndian.Uint16(req.Body[i : i+2])
+		for _, supportedFeature := range supported {
+			if feature == supportedFeature {
+				body = append(body, req.Body[i:i+2]...)
+				break
+			}
+		}
+	}
+	return conn.respond(req, mc.SUCCESS, nil, nil, body, 0)
+}
+
+// stats are returned as a series of responses, one per stat, terminated by a response with empty key.
+// "vbucket-seqno" and "vbucket-seqno $vbno" are supported. other stat groups get no stats
+func (conn *fakeKVConn) handleStats(req *mc.MCRequest) error {
+	stats := make(map[string]string)
+
+	fields := strings.Fields(string(req.Key))
+	if len(fields) > 0 && fields[0] == base.VBUCKET_SEQNO_STAT_NAME {
+		conn.server.lock.RLock()
+		for vbno, vb := range conn.server.vbuckets {
+			if len(fields) > 1 && fields[1] != strconv.Itoa(int(vbno)) {
+				continue
+			}
+			high_seqno := strconv.FormatUint(vb.high_seqno, 10)
+			stats[fmt.Sprintf(base.VBUCKET_HIGH_SEQNO_STAT_KEY_FORMAT, vbno)] = high_seqno
+			stats[fmt.Sprintf("vb_%v:abs_high_seqno", vbno)] = high_seqno
+			stats[fmt.Sprintf("vb_%v:last_persisted_seqno", vbno)] = high_seqno
+			stats[fmt.Sprintf("vb_%v:last_persisted_snap_start", vbno)] = high_seqno
+			stats[fmt.Sprintf("vb_%v:last_persisted_snap_end", vbno)] = high_seqno
+			stats[fmt.Sprintf("vb_%v:purge_seqno", vbno)] = "0"
+			stats[fmt.Sprintf(base.VBUCKET_UUID_STAT_KEY_FORMAT, vbno)] = strconv.FormatUint(vb.failoverLog[0].Vbuuid, 10)
+		}
+		conn.server.lock.RUnlock()
+	}
+
+	keys := make([]string, 0, len(stats))
+	for key, _ := range stats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		err := conn.respond(req, mc.SUCCESS, nil, []byte(key), []byte(stats[key]), 0)
+		if err != nil {
+			return err
+		}
+	}
+	return conn.respond(req, mc.SUCCESS, nil, nil, nil, 0)
+}
+
+func (conn *fakeKVConn) handleGet(req *mc.MCRequest) error {
+	item, status := conn.server.getItem(req.VBucket, string(req.Key))
+	if status != mc.SUCCESS {
+		return conn.respond(req, status, nil, nil, nil, 0)
+	}
+	if item.Deleted {
+		return conn.respond(req, mc.KEY_ENOENT, nil, nil, nil, 0)
+	}
+	extras := make([]byte, 4)
+	binary.BigEndian.PutUint32(extras[0:4], item.Flags)
+	return conn.respond(req, mc.SUCCESS, extras, nil, item.Value, item.Cas)
+}
+
+// GET_WITH_META response extras are <<Deleted:32, Flags:32, Expiry:32, RevSeqno:64>>. deleted documents are returned
+func (conn *fakeKVConn) handleGetMeta(req *mc.MCRequest) error {
+	item, status := conn.server.getItem(req.VBucket, string(req.Key))
+	if status != mc.SUCCESS {
+		return conn.respond(req, status, nil, nil, nil, 0)
+	}
+	extras := make([]byte, 20)
+	if item.Deleted {
+		binary.BigEndian.PutUint32(extras[0:4], 1)
+	}
+	binary.BigEndian.PutUint32(extras[4:8], item.Flags)
+	binary.BigEndian.PutUint32(extras[8:12], item.Expiry)
+	binary.BigEndian.PutUint64(extras[12:20], item.RevSeqno)
+	return conn.respond(req, mc.SUCCESS, extras, nil, nil, item.Cas)
+}
+
+// SET_WITH_META and DELETE_WITH_META extras are <<Flags:32, Expiry:32, RevSeqno:64, Cas:64, Options:32>>,
+// where options are optional. the request is rejected with KEY_EEXISTS when it loses conflict resolution
+func (conn *fakeKVConn) handleSetMeta(req *mc.MCRequest) error {
+	if len(req.Extras) < 24 {
+		return conn.respond(req, mc.EINVAL, nil, nil, nil, 0)
+	}
+	var options uint32
+	if len(req.Extras) >= 28 {
+		options = binary.BigEndian.Uint32(req.Extras[24:28])
+	}
+
+	incoming := &FakeItem{Key: string(req.Key),
+		Flags:    binary.BigEndian.Uint32(req.Extras[0:4]),
+		Expiry:   binary.BigEndian.Uint32(req.Extras[4:8]),
+		RevSeqno: binary.BigEndian.Uint64(req.Extras[8:16]),
+		Cas:      binary.BigEndian.Uint64(req.Extras[16:24]),
+		DataType: req.DataType,
+		Deleted:  req.Opcode == base.DELETE_WITH_META,
+	}
+	if !incoming.Deleted {
+		// the request body may be reused by the client after the request is processed
+		incoming.Value = append([]byte(nil), req.Body...)
+	}
+
+	// only SKIP_CONFLICT_RESOLUTION_FLAG bypasses conflict resolution. FORCE_ACCEPT_WITH_META_OPS, which routers set
+	// for lww buckets, only tells memcached that the client is aware of lww, and the request still goes through it
+	skipConflictResolution := options&base.SKIP_CONFLICT_RESOLUTION_FLAG != 0
+	status := conn.server.setWithMeta(req.VBucket, incoming, skipConflictResolution)
+	if status != mc.SUCCESS {
+		return conn.respond(req, status, nil, nil, nil, 0)
+	}
+	return conn.respond(req, mc.SUCCESS, nil, nil, nil, incoming.Cas)
+}
+
+// UPR_STREAMREQ extras are <<Flags:32, Reserved:32, StartSeqno:64, EndSeqno:64, Vbuuid:64, SnapStart:64, SnapEnd:64>>.
+// a successful response carries the failover log of the vbucket, and a ROLLBACK response carries the rollback seqno
+func (conn *fakeKVConn) handleStreamRequest(req *mc.MCRequest) error {
+	if !conn.dcpOpened || len(req.Extras) < 48 {
+		return conn.respond(req, mc.EINVAL, nil, nil, nil, 0)
+	}
+	vbno := req.VBucket
+	startSeqno := binary.BigEndian.Uint64(req.Extras[8:16])
+	endSeqno := binary.BigEndian.Uint64(req.Extras[16:24])
+	vbuuid := binary.BigEndian.Uint64(req.Extras[24:32])
+
+	conn.server.lock.RLock()
+	vb, ok := conn.server.vbuckets[vbno]
+	if !ok {
+		conn.server.lock.RUnlock()
+		return conn.respond(req, mc.NOT_MY_VBUCKET, nil, nil, nil, 0)
+	}
+	rollbackSeqno, rollback := vb.rollbackSeqno(vbuuid, startSeqno)
+	failoverLog := encodeFailoverLog(vb.failoverLog)
+	conn.server.lock.RUnlock()
+
+	if rollback {
+		body := make([]byte, 8)
+		binary.BigEndian.PutUint64(body, rollbackSeqno)
+		return conn.respond(req, mc.ROLLBACK, nil, nil, body, 0)
+	}
+
+	stream := &fakeStream{vbno: vbno,
+		opaque:   req.Opaque,
+		endSeqno: endSeqno,
+		finch:    make(chan bool),
+	}
+	conn.streamsLock.Lock()
+	if _, ok := conn.streams[vbno]; ok {
+		conn.streamsLock.Unlock()
+		return conn.respond(req, mc.KEY_EEXISTS, nil, nil, nil, 0)
+	}
+	conn.streams[vbno] = stream
+	conn.streamsLock.Unlock()
+
+	// the response needs to be sent before the stream starts sending snapshot markers
+	err := conn.respond(req, mc.SUCCESS, nil, nil, failoverLog, 0)
+	if err != nil {
+		return err
+	}
+
+	conn.streamWaitGrp.Add(1)
+	go conn.runStream(stream, startSeqno)
+	return nil
+}
+
+func (conn *fakeKVConn) handleCloseStream(req *mc.MCRequest) error {
+	conn.streamsLock.Lock()
+	stream, ok := conn.streams[req.VBucket]
+	if ok {
+		delete(conn.streams, req.VBucket)
+		close(stream.finch)
+	}
+	conn.streamsLock.Unlock()
+
+	if !ok {
+		return conn.respond(req, mc.KEY_ENOENT, nil, nil, nil, 0)
+	}
+	return conn.respond(req, mc.SUCCESS, nil, nil, nil, 0)
+}
+
+func (conn *fakeKVConn) handleFailoverLog(req *mc.MCRequest) error {
+	conn.server.lock.RLock()
+	vb, ok := conn.server.vbuckets[req.VBucket]
+	var failoverLog []byte
+	if ok {
+		failoverLog = encodeFailoverLog(vb.failoverLog)
+	}
+	conn.server.lock.RUnlock()
+
+	if !ok {
+		return conn.respond(req, mc.NOT_MY_VBUCKET, nil, nil, nil, 0)
+	}
+	return conn.respond(req, mc.SUCCESS, nil, nil, failoverLog, 0)
+}
+
+// sends the documents changed after startSeqno, and then the documents changed afterwards, until
+// endSeqno has been reached, the stream has been closed, or the connection has been closed.
+// documents are sent in snapshots, each of which covers the changes accumulated since the previous one
+func (conn *fakeKVConn) runStream(stream *fakeStream, startSeqno uint64) {
+	defer conn.streamWaitGrp.Done()
+
+	sent_seqno := startSeqno
+	for {
+		conn.server.lock.RLock()
+		vb, ok := conn.server.vbuckets[stream.vbno]
+		if !ok {
+			conn.server.lock.RUnlock()
+			return
+		}
+		items, notify_ch := vb.itemsAfter(sent_seqno)
+		conn.server.lock.RUnlock()
+
+		for len(items) > 0 && items[len(items)-1].Seqno > stream.endSeqno {
+			items = items[:len(items)-1]
+		}
+
+		if len(items) > 0 {
+			err := conn.sendSnapshot(stream, items)
+			if err != nil {
+				return
+			}
+			sent_seqno = items[len(items)-1].Seqno
+		}
+
+		if sent_seqno >= stream.endSeqno {
+			conn.endStream(stream)
+			return
+		}
+
+		select {
+		case <-notify_ch:
+		case <-stream.finch:
+			return
+		case <-conn.finch:
+			return
+		}
+	}
+}
+
+func (conn *fakeKVConn) sendSnapshot(stream *fakeStream, items []*FakeItem) error {
+	extras := make([]byte, 20)
+	binary.BigEndian.PutUint64(extras[0:8], items[0].Seqno)
+	binary.BigEndian.PutUint64(extras[8:16], items[len(items)-1].Seqno)
+	binary.BigEndian.PutUint32(extras[16:20], snapshot_type_memory)
+	err := conn.send(&mc.MCRequest{Opcode: mc.UPR_SNAPSHOT,
+		VBucket: stream.vbno,
+		Opaque:  stream.opaque,
+		Extras:  extras})
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		err = conn.send(composeDcpRequest(stream, item))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stream end is sent only when the stream has not been closed by the client
+func (conn *fakeKVConn) endStream(stream *fakeStream) {
+	conn.streamsLock.Lock()
+	current, ok := conn.streams[stream.vbno]
+	if !ok || current != stream {
+		conn.streamsLock.Unlock()
+		return
+	}
+	delete(conn.streams, stream.vbno)
+	conn.streamsLock.Unlock()
+
+	extras := make([]byte, 4)
+	binary.BigEndian.PutUint32(extras[0:4], stream_end_ok)
+	conn.send(&mc.MCRequest{Opcode: mc.UPR_STREAMEND,
+		VBucket: stream.vbno,
+		Opaque:  stream.opaque,
+		Extras:  extras})
+}
+
+// mutation extras are <<BySeqno:64, RevSeqno:64, Flags:32, Expiry:32, LockTime:32, MetaLen:16, Nru:8>>,
+// and deletion extras are <<BySeqno:64, RevSeqno:64, MetaLen:16>>
+func composeDcpRequest(stream *fakeStream, item *FakeItem) *mc.MCRequest {
+	req := &mc.MCRequest{VBucket: stream.vbno,
+		Opaque:   stream.opaque,
+		Cas:      item.Cas,
+		Key:      []byte(item.Key),
+		DataType: item.DataType,
+	}
+	if item.Deleted {
+		req.Opcode = mc.UPR_DELETION
+		req.Extras = make([]byte, 18)
+	} else {
+		req.Opcode = mc.UPR_MUTATION
+		req.Extras = make([]byte, 31)
+		binary.BigEndian.PutUint32(req.Extras[16:20], item.Flags)
+		binary.BigEndian.PutUint32(req.Extras[20:24], item.Expiry)
+		req.Body = item.Value
+	}
+	binary.BigEndian.PutUint64(req.Extras[0:8], item.Seqno)
+	binary.BigEndian.PutUint64(req.Extras[8:16], item.RevSeqno)
+	return req
+}
+
+func (conn *fakeKVConn) respond(req *mc.MCRequest, status mc.Status, extras, key, body []byte, cas uint64) error {
+	res := &mc.MCResponse{Opcode: req.Opcode,
+		Status: status,
+		Opaque: req.Opaque,
+		Cas:    cas,
+		Extras: extras,
+		Key:    key,
+		Body:   body,
+	}
+	return conn.write(res.Bytes())
+}
+
+func (conn *fakeKVConn) send(req *mc.MCRequest) error {
+	return conn.write(req.Bytes())
+}
+
+func (conn *fakeKVConn) write(data []byte) error {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	_, err := conn.netConn.Write(data)
+	if err != nil {
+		conn.close()
+	}
+	return err
+}
+
+// failover log entries are <<Vbuuid:64, Seqno:64>>, latest entry first
+func encodeFailoverLog(failoverLog []FailoverEntry) []byte {
+	body := make([]byte, 16*len(failoverLog))
+	for index, entry := range failoverLog {
+		binary.BigEndian.PutUint64(body[16*index:16*index+8], entry.Vbuuid)
+		binary.BigEndian.PutUint64(body[16*index+8:16*index+16], entry.Seqno)
+	}
+	return body
+}
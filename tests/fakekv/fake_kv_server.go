@@ -0,0 +1,479 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// fakekv is an in-process fake of a kv node, which speaks enough of the memcached binary protocol
+// for DcpNozzle, XmemNozzle, CheckpointManager and full pipelines to be tested without a live cluster.
+// it supports sasl plain auth, select bucket, HELO, GET, GET_WITH_META, SET_WITH_META, DELETE_WITH_META,
+// "stats vbucket-seqno", failover logs, and dcp open, control, stream request, snapshot markers,
+// mutations, deletions, stream end and close stream
+package fakekv
+
+import (
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/simple_utils"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// a version of a document in a vbucket. items are never modified once created, hence they can be shared
+type FakeItem struct {
+	Key      string
+	Value    []byte
+	Flags    uint32
+	Expiry   uint32
+	DataType uint8
+	Seqno    uint64
+	RevSeqno uint64
+	Cas      uint64
+	Deleted  bool
+}
+
+// [vbuuid, seqno] pair in a failover log
+type FailoverEntry struct {
+	Vbuuid uint64
+	Seqno  uint64
+}
+
+type fakeVBucket struct {
+	vbno uint16
+	// latest entry first, as in memcached
+	failoverLog []FailoverEntry
+	high_seqno  uint64
+	// the latest version of each document
+	docs map[string]*FakeItem
+	// closed and replaced whenever a new item is added, to wake up the dcp streams of the vbucket
+	notify_ch chan bool
+}
+
+// FakeKVServer listens on a local port and serves a single bucket with the specified vbuckets.
+// requests for other vbuckets get NOT_MY_VBUCKET
+type FakeKVServer struct {
+	bucketName string
+	password   string
+	crMode     base.ConflictResolutionMode
+	// features that are enabled when requested in HELO
+	heloFeatures []uint16
+
+	listener net.Listener
+	vbuckets map[uint16]*fakeVBucket
+	last_cas uint64
+
+	// status to return, in place of processing the request, for the next few requests of an opcode
+	injected_status map[mc.CommandCode]*injectedStatus
+	op_counts       map[mc.CommandCode]uint64
+
+	conns   map[*fakeKVConn]bool
+	closed  bool
+	finch   chan bool
+	waitGrp sync.WaitGroup
+	lock    sync.RWMutex
+	logger  *log.CommonLogger
+}
+
+type injectedStatus struct {
+	status mc.Status
+	count  int
+}
+
+// starts a fake kv server on a random local port. connections authenticate with bucketName and password
+func NewFakeKVServer(bucketName, password string, vbnos []uint16) (*FakeKVServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	server := &FakeKVServer{bucketName: bucketName,
+		password:        password,
+		crMode:          base.CRMode_RevId,
+		heloFeatures:    []uint16{base.HELOFeatureTCPNoDelay, base.HELOFeatureSnappy},
+		listener:        listener,
+		vbuckets:        make(map[uint16]*fakeVBucket),
+		injected_status: make(map[mc.CommandCode]*injectedStatus),
+		op_counts:       make(map[mc.CommandCode]uint64),
+		conns:           make(map[*fakeKVConn]bool),
+		finch:           make(chan bool),
+		logger:          log.NewLogger("FakeKVServer", log.DefaultLoggerContext),
+	}
+	for _, vbno := range vbnos {
+		server.vbuckets[vbno] = &fakeVBucket{vbno: vbno,
+			failoverLog: []FailoverEntry{{Vbuuid: newVbuuid(), Seqno: 0}},
+			docs:        make(map[string]*FakeItem),
+			notify_ch:   make(chan bool),
+		}
+	}
+
+	server.waitGrp.Add(1)
+	go server.accept()
+
+	server.logger.Infof("Fake kv server for bucket %v started on %v with %v vbuckets\n", bucketName, server.Addr(), len(vbnos))
+	return server, nil
+}
+
+// the host:port that the server listens on
+func (server *FakeKVServer) Addr() string {
+	return server.listener.Addr().String()
+}
+
+func (server *FakeKVServer) BucketName() string {
+	return server.bucketName
+}
+
+// the vbuckets on the server, sorted
+func (server *FakeKVServer) VBList() []uint16 {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	vbnos := make([]uint16, 0, len(server.vbuckets))
+	for vbno, _ := range server.vbuckets {
+		vbnos = append(vbnos, vbno)
+	}
+	return simple_utils.SortUint16List(vbnos)
+}
+
+// sets the conflict resolution mode used for SET_WITH_META and DELETE_WITH_META. the default is revid
+func (server *FakeKVServer) SetConflictResolutionMode(crMode base.ConflictResolutionMode) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.crMode = crMode
+}
+
+// sets the features that the server enables when they are requested in HELO
+func (server *FakeKVServer) SetHELOFeatures(features []uint16) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.heloFeatures = features
+}
+
+// makes the server respond to the next count requests of opcode with status, e.g., TMPFAIL,
+// without processing the requests
+func (server *FakeKVServer) InjectStatus(opcode mc.CommandCode, status mc.Status, count int) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.injected_status[opcode] = &injectedStatus{status: status, count: count}
+}
+
+// the number of requests of opcode that the server has received
+func (server *FakeKVServer) OpCount(opcode mc.CommandCode) uint64 {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	return server.op_counts[opcode]
+}
+
+// sets a document in a vbucket, as a client of the source bucket would. the new version of the document is
+// streamed to the open dcp streams of the vbucket
+func (server *FakeKVServer) Set(vbno uint16, key string, value []byte, flags, expiry uint32) (*FakeItem, error) {
+	return server.mutate(vbno, key, value, flags, expiry, false)
+}
+
+// deletes a document in a vbucket, as a client of the source bucket would
+func (server *FakeKVServer) Delete(vbno uint16, key string) (*FakeItem, error) {
+	return server.mutate(vbno, key, nil, 0, 0, true)
+}
+
+func (server *FakeKVServer) mutate(vbno uint16, key string, value []byte, flags, expiry uint32, deleted bool) (*FakeItem, error) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	vb, ok := server.vbuckets[vbno]
+	if !ok {
+		return nil, fmt.Errorf("vb %v is not on fake kv server %v", vbno, server.Addr())
+	}
+
+	var revSeqno uint64 = 1
+	if existing, ok := vb.docs[key]; ok {
+		revSeqno = existing.RevSeqno + 1
+	} else if deleted {
+		return nil, fmt.Errorf("key %v does not exist in vb %v", key, vbno)
+	}
+
+	item := &FakeItem{Key: key,
+		Value:    value,
+		Flags:    flags,
+		Expiry:   expiry,
+		RevSeqno: revSeqno,
+		Cas:      server.newCas(),
+		Deleted:  deleted,
+	}
+	vb.add(item)
+	return item, nil
+}
+
+// the current version of a document, which may be a deletion. returns false if the document has never existed
+func (server *FakeKVServer) Document(vbno uint16, key string) (*FakeItem, bool) {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	vb, ok := server.vbuckets[vbno]
+	if !ok {
+		return nil, false
+	}
+	item, ok := vb.docs[key]
+	return item, ok
+}
+
+// the number of documents, excluding deletions, in a vbucket
+func (server *FakeKVServer) DocCount(vbno uint16) int {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	vb, ok := server.vbuckets[vbno]
+	if !ok {
+		return 0
+	}
+	count := 0
+	for _, item := range vb.docs {
+		if !item.Deleted {
+			count++
+		}
+	}
+	return count
+}
+
+func (server *FakeKVServer) HighSeqno(vbno uint16) uint64 {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	if vb, ok := server.vbuckets[vbno]; ok {
+		return vb.high_seqno
+	}
+	return 0
+}
+
+// the failover log of a vbucket, latest entry first
+func (server *FakeKVServer) FailoverLog(vbno uint16) []FailoverEntry {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	vb, ok := server.vbuckets[vbno]
+	if !ok {
+		return nil
+	}
+	failoverLog := make([]FailoverEntry, len(vb.failoverLog))
+	copy(failoverLog, vb.failoverLog)
+	return failoverLog
+}
+
+// simulates a failover of a vbucket, after which the vbucket has a new vbuuid.
+// when rollbackSeqno is smaller than the high seqno, the documents after rollbackSeqno are lost,
+// and dcp clients with later start seqnos are asked to roll back
+func (server *FakeKVServer) Failover(vbno uint16, rollbackSeqno uint64) error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	vb, ok := server.vbuckets[vbno]
+	if !ok {
+		return fmt.Errorf("vb %v is not on fake kv server %v", vbno, server.Addr())
+	}
+	if rollbackSeqno < vb.high_seqno {
+		for key, item := range vb.docs {
+			if item.Seqno > rollbackSeqno {
+				delete(vb.docs, key)
+			}
+		}
+		vb.high_seqno = rollbackSeqno
+	}
+	vb.failoverLog = append([]FailoverEntry{{Vbuuid: newVbuuid(), Seqno: vb.high_seqno}}, vb.failoverLog...)
+	return nil
+}
+
+// closes the listener and all connections
+func (server *FakeKVServer) Close() error {
+	server.lock.Lock()
+	if server.closed {
+		server.lock.Unlock()
+		return nil
+	}
+	server.closed = true
+	close(server.finch)
+	conns := make([]*fakeKVConn, 0, len(server.conns))
+	for conn, _ := range server.conns {
+		conns = append(conns, conn)
+	}
+	server.lock.Unlock()
+
+	err := server.listener.Close()
+	for _, conn := range conns {
+		conn.close()
+	}
+	server.waitGrp.Wait()
+	server.logger.Infof("Fake kv server on %v has been closed\n", server.Addr())
+	return err
+}
+
+func (server *FakeKVServer) accept() {
+	defer server.waitGrp.Done()
+	for {
+		netConn, err := server.listener.Accept()
+		if err != nil {
+			select {
+			case <-server.finch:
+			default:
+				server.logger.Errorf("Fake kv server on %v failed to accept connection. err=%v\n", server.Addr(), err)
+			}
+			return
+		}
+
+		conn := newFakeKVConn(server, netConn)
+		server.lock.Lock()
+		if server.closed {
+			server.lock.Unlock()
+			netConn.Close()
+			return
+		}
+		server.conns[conn] = true
+		server.lock.Unlock()
+
+		server.waitGrp.Add(1)
+		go conn.serve(&server.waitGrp)
+	}
+}
+
+func (server *FakeKVServer) removeConn(conn *fakeKVConn) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	delete(server.conns, conn)
+}
+
+// records the request, and returns the injected status for it, if any
+func (server *FakeKVServer) recordOp(opcode mc.CommandCode) (mc.Status, bool) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.op_counts[opcode]++
+	injected, ok := server.injected_status[opcode]
+	if !ok {
+		return mc.SUCCESS, false
+	}
+	injected.count--
+	if injected.count <= 0 {
+		delete(server.injected_status, opcode)
+	}
+	return injected.status, true
+}
+
+// cas values are nanosecond timestamps, which are kept strictly increasing. caller needs to hold server.lock
+func (server *FakeKVServer) newCas() uint64 {
+	cas := uint64(time.Now().UnixNano())
+	if cas <= server.last_cas {
+		cas = server.last_cas + 1
+	}
+	server.last_cas = cas
+	return cas
+}
+
+// the current version of a document, for client requests
+func (server *FakeKVServer) getItem(vbno uint16, key string) (*FakeItem, mc.Status) {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	vb, ok := server.vbuckets[vbno]
+	if !ok {
+		return nil, mc.NOT_MY_VBUCKET
+	}
+	item, ok := vb.docs[key]
+	if !ok {
+		return nil, mc.KEY_ENOENT
+	}
+	return item, mc.SUCCESS
+}
+
+// applies a SET_WITH_META or DELETE_WITH_META, which keeps the metadata of the incoming document.
+// returns KEY_EEXISTS when the incoming document loses conflict resolution against the existing one
+func (server *FakeKVServer) setWithMeta(vbno uint16, incoming *FakeItem, skipConflictResolution bool) mc.Status {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	vb, ok := server.vbuckets[vbno]
+	if !ok {
+		return mc.NOT_MY_VBUCKET
+	}
+	if existing, ok := vb.docs[incoming.Key]; ok && !skipConflictResolution && !wins(incoming, existing, server.crMode) {
+		return mc.KEY_EEXISTS
+	}
+	if incoming.Cas > server.last_cas {
+		server.last_cas = incoming.Cas
+	}
+	vb.add(incoming)
+	return mc.SUCCESS
+}
+
+// whether incoming wins conflict resolution against existing. revid mode compares rev seqno, cas, expiry
+// and flags in that order, and lww mode compares cas first. ties go to the existing document
+func wins(incoming, existing *FakeItem, crMode base.ConflictResolutionMode) bool {
+	first := []uint64{incoming.RevSeqno, incoming.Cas, uint64(incoming.Expiry), uint64(incoming.Flags)}
+	second := []uint64{existing.RevSeqno, existing.Cas, uint64(existing.Expiry), uint64(existing.Flags)}
+	if crMode == base.CRMode_LWW {
+		first[0], first[1] = first[1], first[0]
+		second[0], second[1] = second[1], second[0]
+	}
+	for index := range first {
+		if first[index] != second[index] {
+			return first[index] > second[index]
+		}
+	}
+	return false
+}
+
+// adds a new version of a document, assigning it the next seqno. caller needs to hold server.lock
+func (vb *fakeVBucket) add(item *FakeItem) {
+	vb.high_seqno++
+	item.Seqno = vb.high_seqno
+	vb.docs[item.Key] = item
+
+	close(vb.notify_ch)
+	vb.notify_ch = make(chan bool)
+}
+
+// the documents changed after seqno, in seqno order, and the channel that is closed on the next change.
+// only the latest version of a document is returned, as dcp does. caller needs to hold server.lock
+func (vb *fakeVBucket) itemsAfter(seqno uint64) ([]*FakeItem, chan bool) {
+	items := make([]*FakeItem, 0)
+	for _, item := range vb.docs {
+		if item.Seqno > seqno {
+			items = append(items, item)
+		}
+	}
+	sort.Sort(fakeItemsBySeqno(items))
+	return items, vb.notify_ch
+}
+
+// the seqno that a dcp client with the specified vbuuid and start seqno needs to roll back to.
+// returns false if no rollback is needed. caller needs to hold server.lock
+func (vb *fakeVBucket) rollbackSeqno(vbuuid, startSeqno uint64) (uint64, bool) {
+	if startSeqno == 0 {
+		return 0, false
+	}
+	for index, entry := range vb.failoverLog {
+		if entry.Vbuuid != vbuuid {
+			continue
+		}
+		// the history of vbuuid ends where the next failover log entry starts
+		upper := vb.high_seqno
+		if index > 0 {
+			upper = vb.failoverLog[index-1].Seqno
+		}
+		if startSeqno > upper {
+			return upper, true
+		}
+		return 0, false
+	}
+	return 0, true
+}
+
+type fakeItemsBySeqno []*FakeItem
+
+func (items fakeItemsBySeqno) Len() int           { return len(items) }
+func (items fakeItemsBySeqno) Swap(i, j int)      { items[i], items[j] = items[j], items[i] }
+func (items fakeItemsBySeqno) Less(i, j int) bool { return items[i].Seqno < items[j].Seqno }
+
+func newVbuuid() uint64 {
+	vbuuid := uint64(rand.Int63())
+	if vbuuid == 0 {
+		vbuuid = 1
+	}
+	return vbuuid
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package fakekv
+
+import (
+	"encoding/binary"
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
+	"github.com/couchbase/goxdcr/base"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	testBucketName = "default"
+	testPassword   = "password"
+	eventTimeout   = 5 * time.Second
+)
+
+func startServer(t *testing.T) *FakeKVServer {
+	server, err := NewFakeKVServer(testBucketName, testPassword, []uint16{0, 1, 2, 3})
+	if err != nil {
+		t.Fatalf("failed to start fake kv server. err=%v", err)
+	}
+	return server
+}
+
+func connect(t *testing.T, server *FakeKVServer) *mcc.Client {
+	client, err := base.NewConn(server.Addr(), testBucketName, testPassword, true /*plainAuth*/)
+	if err != nil {
+		t.Fatalf("failed to connect to fake kv server. err=%v", err)
+	}
+	return client
+}
+
+// the status of a response. the memcached client returns non-success responses as errors
+func statusOf(res *mc.MCResponse, err error) (mc.Status, error) {
+	if resErr, ok := err.(*mc.MCResponse); ok {
+		return resErr.Status, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return res.Status, nil
+}
+
+func setWithMeta(client *mcc.Client, vbno uint16, key string, revSeqno, cas uint64) (mc.Status, error) {
+	extras := make([]byte, 24)
+	binary.BigEndian.PutUint64(extras[8:16], revSeqno)
+	binary.BigEndian.PutUint64(extras[16:24], cas)
+	return statusOf(client.Send(&mc.MCRequest{Opcode: base.SET_WITH_META,
+		VBucket: vbno,
+		Key:     []byte(key),
+		Extras:  extras,
+		Body:    []byte(`{"rev":` + strconv.FormatUint(revSeqno, 10) + `}`),
+	}))
+}
+
+// waits for the next event with the specified opcode on the feed, skipping other events
+func nextEvent(t *testing.T, feed *mcc.UprFeed, opcode mc.CommandCode) *mcc.UprEvent {
+	timer := time.NewTimer(eventTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case event, ok := <-feed.C:
+			if !ok {
+				t.Fatalf("upr feed closed while waiting for %v", opcode)
+			}
+			if event.Opcode == opcode {
+				return event
+			}
+		case <-timer.C:
+			t.Fatalf("timed out waiting for %v", opcode)
+		}
+	}
+}
+
+func openFeed(t *testing.T, server *FakeKVServer) *mcc.UprFeed {
+	feed, err := connect(t, server).NewUprFeed()
+	if err != nil {
+		t.Fatalf("failed to create upr feed. err=%v", err)
+	}
+	err = feed.UprOpen("fakekv_test", 0, 1024*1024)
+	if err != nil {
+		t.Fatalf("failed to open upr feed. err=%v", err)
+	}
+	feed.StartFeedWithConfig(base.UprFeedDataChanLength)
+	return feed
+}
+
+func TestStatsVBucketSeqno(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := server.Set(1, fmt.Sprintf("key%v", i), []byte("{}"), 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := connect(t, server)
+	defer client.Close()
+	stats, err := client.StatsMap(base.VBUCKET_SEQNO_STAT_NAME)
+	if err != nil {
+		t.Fatalf("failed to get stats. err=%v", err)
+	}
+
+	if stats[fmt.Sprintf(base.VBUCKET_HIGH_SEQNO_STAT_KEY_FORMAT, 1)] != "3" {
+		t.Errorf("expected high seqno 3 for vb 1, got stats %v", stats)
+	}
+	if stats[fmt.Sprintf(base.VBUCKET_HIGH_SEQNO_STAT_KEY_FORMAT, 0)] != "0" {
+		t.Errorf("expected high seqno 0 for vb 0, got stats %v", stats)
+	}
+	vbuuid := strconv.FormatUint(server.FailoverLog(1)[0].Vbuuid, 10)
+	if stats[fmt.Sprintf(base.VBUCKET_UUID_STAT_KEY_FORMAT, 1)] != vbuuid {
+		t.Errorf("expected vbuuid %v for vb 1, got stats %v", vbuuid, stats)
+	}
+}
+
+func TestSetWithMetaConflictResolution(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	client := connect(t, server)
+	defer client.Close()
+
+	status, err := setWithMeta(client, 2, "doc", 5, 100)
+	if err != nil || status != mc.SUCCESS {
+		t.Fatalf("expected SetWithMeta to succeed. status=%v, err=%v", status, err)
+	}
+
+	// lower rev seqno loses conflict resolution under revid
+	status, err = setWithMeta(client, 2, "doc", 3, 200)
+	if err != nil || status != mc.KEY_EEXISTS {
+		t.Fatalf("expected KEY_EEXISTS for losing SetWithMeta. status=%v, err=%v", status, err)
+	}
+
+	res, err := client.Send(&mc.MCRequest{Opcode: base.GET_WITH_META, VBucket: 2, Key: []byte("doc")})
+	if err != nil {
+		t.Fatalf("GetMeta failed. err=%v", err)
+	}
+	if revSeqno := binary.BigEndian.Uint64(res.Extras[12:20]); revSeqno != 5 || res.Cas != 100 {
+		t.Errorf("expected rev seqno 5 and cas 100, got rev seqno %v and cas %v", revSeqno, res.Cas)
+	}
+
+	// the same request wins under lww, since its cas is higher
+	server.SetConflictResolutionMode(base.CRMode_LWW)
+	status, err = setWithMeta(client, 2, "doc", 3, 200)
+	if err != nil || status != mc.SUCCESS {
+		t.Fatalf("expected SetWithMeta to succeed under lww. status=%v, err=%v", status, err)
+	}
+
+	status, err = setWithMeta(client, 5, "doc", 1, 1)
+	if err != nil || status != mc.NOT_MY_VBUCKET {
+		t.Fatalf("expected NOT_MY_VBUCKET. status=%v, err=%v", status, err)
+	}
+
+	status, err = statusOf(client.Send(&mc.MCRequest{Opcode: base.DELETE_WITH_META, VBucket: 2, Key: []byte("doc"),
+		Extras: make([]byte, 24)}))
+	if err != nil || status != mc.KEY_EEXISTS {
+		t.Fatalf("expected KEY_EEXISTS for losing DelWithMeta. status=%v, err=%v", status, err)
+	}
+	if server.DocCount(2) != 1 {
+		t.Errorf("expected 1 document in vb 2, got %v", server.DocCount(2))
+	}
+}
+
+func TestDcpStream(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := server.Set(0, fmt.Sprintf("key%v", i), []byte("{}"), 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	feed := openFeed(t, server)
+	defer feed.Close()
+
+	err := feed.UprRequestStream(0, 0, 0, server.FailoverLog(0)[0].Vbuuid, 0, math.MaxUint64, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to request stream. err=%v", err)
+	}
+	if event := nextEvent(t, feed, mc.UPR_STREAMREQ); event.Status != mc.SUCCESS {
+		t.Fatalf("expected stream request to succeed, got status %v", event.Status)
+	}
+
+	for i := 1; i <= 3; i++ {
+		event := nextEvent(t, feed, mc.UPR_MUTATION)
+		if event.Seqno != uint64(i) || string(event.Key) != fmt.Sprintf("key%v", i-1) {
+			t.Fatalf("expected key%v with seqno %v, got %s with seqno %v", i-1, i, event.Key, event.Seqno)
+		}
+	}
+
+	// changes after the stream has started are streamed as well
+	if _, err := server.Delete(0, "key1"); err != nil {
+		t.Fatal(err)
+	}
+	event := nextEvent(t, feed, mc.UPR_DELETION)
+	if event.Seqno != 4 || string(event.Key) != "key1" {
+		t.Fatalf("expected deletion of key1 with seqno 4, got %s with seqno %v", event.Key, event.Seqno)
+	}
+}
+
+func TestDcpStreamRollback(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := server.Set(3, fmt.Sprintf("key%v", i), []byte("{}"), 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vbuuid := server.FailoverLog(3)[0].Vbuuid
+	if err := server.Failover(3, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.FailoverLog(3)) != 2 {
+		t.Fatalf("expected 2 failover log entries, got %v", server.FailoverLog(3))
+	}
+
+	feed := openFeed(t, server)
+	defer feed.Close()
+
+	err := feed.UprRequestStream(3, 0, 0, vbuuid, 3, math.MaxUint64, 3, 3)
+	if err != nil {
+		t.Fatalf("failed to request stream. err=%v", err)
+	}
+	event := nextEvent(t, feed, mc.UPR_STREAMREQ)
+	if event.Status != mc.ROLLBACK {
+		t.Fatalf("expected rollback, got status %v", event.Status)
+	}
+	if rollbackSeqno := binary.BigEndian.Uint64(event.Value[:8]); rollbackSeqno != 1 {
+		t.Errorf("expected rollback to seqno 1, got %v", rollbackSeqno)
+	}
+}
+
+func TestSetWithMetaOptions(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+	server.SetConflictResolutionMode(base.CRMode_LWW)
+
+	client := connect(t, server)
+	defer client.Close()
+
+	status, err := setWithMeta(client, 1, "doc", 1, 100)
+	if err != nil || status != mc.SUCCESS {
+		t.Fatalf("expected SetWithMeta to succeed. status=%v, err=%v", status, err)
+	}
+
+	withOptions := func(options uint32) (mc.Status, error) {
+		extras := make([]byte, 28)
+		binary.BigEndian.PutUint64(extras[8:16], 2)
+		binary.BigEndian.PutUint64(extras[16:24], 50)
+		binary.BigEndian.PutUint32(extras[24:28], options)
+		return statusOf(client.Send(&mc.MCRequest{Opcode: base.SET_WITH_META,
+			VBucket: 1,
+			Key:     []byte("doc"),
+			Extras:  extras,
+			Body:    []byte(`{}`),
+		}))
+	}
+
+	// FORCE_ACCEPT_WITH_META_OPS does not bypass conflict resolution, and the lower cas loses under lww
+	status, err = withOptions(base.FORCE_ACCEPT_WITH_META_OPS)
+	if err != nil || status != mc.KEY_EEXISTS {
+		t.Fatalf("expected KEY_EEXISTS with FORCE_ACCEPT_WITH_META_OPS. status=%v, err=%v", status, err)
+	}
+
+	status, err = withOptions(base.FORCE_ACCEPT_WITH_META_OPS | base.SKIP_CONFLICT_RESOLUTION_FLAG)
+	if err != nil || status != mc.SUCCESS {
+		t.Fatalf("expected SetWithMeta to succeed with SKIP_CONFLICT_RESOLUTION_FLAG. status=%v, err=%v", status, err)
+	}
+	if item, _ := server.Document(1, "doc"); item.Cas != 50 {
+		t.Errorf("expected document with cas 50, got %v", item.Cas)
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package fakekv
+
+// tests of DcpNozzle and XmemNozzle against fake kv servers. they live here, rather than in parts,
+// since DcpNozzle needs a topology service from service_impl, which imports parts
+
+import (
+	"encoding/binary"
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/common"
+	component "github.com/couchbase/goxdcr/component"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/parts"
+	"github.com/couchbase/goxdcr/service_impl"
+	"sync"
+	"testing"
+	"time"
+)
+
+// records the events raised by a part
+type testEventListener struct {
+	events []*common.Event
+	lock   sync.Mutex
+}
+
+func (listener *testEventListener) OnEvent(event *common.Event) {
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+	listener.events = append(listener.events, event)
+}
+
+func (listener *testEventListener) eventsOfType(eventType common.ComponentEventType) []*common.Event {
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+	events := make([]*common.Event, 0)
+	for _, event := range listener.events {
+		if event.EventType == eventType {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// waits until the listener has received count events of the type
+func (listener *testEventListener) waitForEvents(t *testing.T, eventType common.ComponentEventType, count int) []*common.Event {
+	deadline := time.Now().Add(eventTimeout)
+	for {
+		events := listener.eventsOfType(eventType)
+		if len(events) >= count {
+			return events
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v events of type %v, got %v", count, eventType, len(events))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// connector that records the data forwarded by a source nozzle
+type testConnector struct {
+	*component.AbstractComponent
+	forwarded chan interface{}
+}
+
+func newTestConnector() *testConnector {
+	return &testConnector{AbstractComponent: component.NewAbstractComponent("test_connector"),
+		forwarded: make(chan interface{}, 100),
+	}
+}
+
+func (con *testConnector) Forward(data interface{}) error {
+	con.forwarded <- data
+	return nil
+}
+
+func (con *testConnector) DownStreams() map[string]common.Part {
+	return nil
+}
+
+func (con *testConnector) AddDownStream(partId string, part common.Part) error {
+	return nil
+}
+
+func (con *testConnector) UpdateSettings(settings map[string]interface{}) error {
+	return nil
+}
+
+func (con *testConnector) nextEvent(t *testing.T) *mcc.UprEvent {
+	select {
+	case data := <-con.forwarded:
+		return data.(*mcc.UprEvent)
+	case <-time.After(eventTimeout):
+		t.Fatalf("timed out waiting for dcp nozzle to forward mutation")
+	}
+	return nil
+}
+
+func startDcpNozzle(t *testing.T, server *FakeKVServer, vbnos []uint16, updater func(uint16, uint64) (*base.VBTimestamp, error)) (*parts.DcpNozzle, *testConnector) {
+	topSvc, err := service_impl.NewStaticXDCRTopologySvc("127.0.0.1", 8091, []string{server.Addr()},
+		"uuid", "5.0", true, testBucketName, testPassword, log.DefaultLoggerContext)
+	if err != nil {
+		t.Fatalf("failed to construct topology service. err=%v", err)
+	}
+
+	dcp := parts.NewDcpNozzle("dcp_test", testBucketName, testPassword, vbnos, topSvc, log.DefaultLoggerContext)
+	connector := newTestConnector()
+	dcp.SetConnector(connector)
+	err = dcp.Start(map[string]interface{}{parts.DCP_VBTimestampUpdator: updater,
+		parts.DCP_Stats_Interval: 1000,
+	})
+	if err != nil {
+		t.Fatalf("failed to start dcp nozzle. err=%v", err)
+	}
+	return dcp, connector
+}
+
+func TestDcpNozzleStreamsMutations(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := server.Set(1, fmt.Sprintf("key%v", i), []byte("{}"), 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dcp, connector := startDcpNozzle(t, server, []uint16{1}, nil)
+	defer dcp.Stop()
+
+	// streams are started once checkpoint manager sets the start seqnos, here from seqno 1
+	err := dcp.UpdateSettings(map[string]interface{}{parts.DCP_VBTimestamp: map[uint16]*base.VBTimestamp{
+		1: {Vbno: 1, Vbuuid: server.FailoverLog(1)[0].Vbuuid, Seqno: 1, SnapshotStart: 1, SnapshotEnd: 1},
+	}})
+	if err != nil {
+		t.Fatalf("failed to set start seqnos. err=%v", err)
+	}
+
+	for seqno := uint64(2); seqno <= 3; seqno++ {
+		event := connector.nextEvent(t)
+		if event.Opcode != mc.UPR_MUTATION || event.Seqno != seqno || string(event.Key) != fmt.Sprintf("key%v", seqno-1) {
+			t.Fatalf("expected mutation of key%v with seqno %v, got %v of %s with seqno %v", seqno-1, seqno, event.Opcode, event.Key, event.Seqno)
+		}
+	}
+
+	// changes after the stream has started are forwarded as well
+	if _, err := server.Delete(1, "key0"); err != nil {
+		t.Fatal(err)
+	}
+	event := connector.nextEvent(t)
+	if event.Opcode != mc.UPR_DELETION || event.Seqno != 4 || string(event.Key) != "key0" {
+		t.Fatalf("expected deletion of key0 with seqno 4, got %v of %s with seqno %v", event.Opcode, event.Key, event.Seqno)
+	}
+}
+
+func TestDcpNozzleRollback(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := server.Set(2, fmt.Sprintf("key%v", i), []byte("{}"), 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	staleVbuuid := server.FailoverLog(2)[0].Vbuuid
+	if err := server.Failover(2, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// on rollback, dcp nozzle asks checkpoint manager for a new start seqno, and restarts the stream from there
+	rollbackSeqnos := make(chan uint64, 1)
+	updater := func(vbno uint16, rollbackSeqno uint64) (*base.VBTimestamp, error) {
+		rollbackSeqnos <- rollbackSeqno
+		return &base.VBTimestamp{Vbno: vbno, Vbuuid: server.FailoverLog(vbno)[0].Vbuuid}, nil
+	}
+	dcp, connector := startDcpNozzle(t, server, []uint16{2}, updater)
+	defer dcp.Stop()
+
+	err := dcp.UpdateSettings(map[string]interface{}{parts.DCP_VBTimestamp: map[uint16]*base.VBTimestamp{
+		2: {Vbno: 2, Vbuuid: staleVbuuid, Seqno: 3, SnapshotStart: 3, SnapshotEnd: 3},
+	}})
+	if err != nil {
+		t.Fatalf("failed to set start seqnos. err=%v", err)
+	}
+
+	select {
+	case rollbackSeqno := <-rollbackSeqnos:
+		if rollbackSeqno != 1 {
+			t.Errorf("expected rollback to seqno 1, got %v", rollbackSeqno)
+		}
+	case <-time.After(eventTimeout):
+		t.Fatalf("timed out waiting for rollback")
+	}
+
+	// only key0 survived the failover
+	event := connector.nextEvent(t)
+	if event.Seqno != 1 || string(event.Key) != "key0" {
+		t.Fatalf("expected key0 with seqno 1 after rollback, got %s with seqno %v", event.Key, event.Seqno)
+	}
+}
+
+func startXmemNozzle(t *testing.T, server *FakeKVServer, crMode base.ConflictResolutionMode, optiRepThreshold int) (*parts.XmemNozzle, *testEventListener) {
+	xmem := parts.NewXmemNozzle(fmt.Sprintf("xmem_test_%v", time.Now().UnixNano()), "test_topic", "xmem_test", 2,
+		server.Addr(), "source", testBucketName, testPassword, nil, crMode, log.DefaultLoggerContext)
+	listener := &testEventListener{}
+	xmem.RegisterComponentEventListener(common.DataSent, listener)
+	xmem.RegisterComponentEventListener(common.DataFailedCRSource, listener)
+	xmem.RegisterComponentEventListener(common.ErrorEncountered, listener)
+
+	err := xmem.Start(map[string]interface{}{parts.SETTING_BATCHCOUNT: 10,
+		parts.SETTING_BATCHSIZE:             1024,
+		parts.SETTING_OPTI_REP_THRESHOLD:    optiRepThreshold,
+		parts.SETTING_BATCH_EXPIRATION_TIME: 50 * time.Millisecond,
+		parts.SETTING_STATS_INTERVAL:        1000,
+	})
+	if err != nil {
+		t.Fatalf("failed to start xmem nozzle. err=%v", err)
+	}
+	return xmem, listener
+}
+
+// composes a request for a source mutation, as router does
+func newTestXmemRequest(seqno uint64, key string, revSeqno, cas uint64, crMode base.ConflictResolutionMode) *base.WrappedMCRequest {
+	extrasSize := 24
+	if crMode == base.CRMode_LWW {
+		extrasSize = 28
+	}
+	extras := make([]byte, extrasSize)
+	binary.BigEndian.PutUint64(extras[8:16], revSeqno)
+	binary.BigEndian.PutUint64(extras[16:24], cas)
+	if crMode == base.CRMode_LWW {
+		binary.BigEndian.PutUint32(extras[24:28], base.FORCE_ACCEPT_WITH_META_OPS)
+	}
+
+	req := &base.WrappedMCRequest{Seqno: seqno,
+		Req: &mc.MCRequest{Opcode: mc.UPR_MUTATION,
+			VBucket: 0,
+			Key:     []byte(key),
+			Cas:     cas,
+			Extras:  extras,
+			Body:    []byte(`{"seqno":` + fmt.Sprint(seqno) + `}`),
+		},
+		Start_time: time.Now(),
+	}
+	req.ConstructUniqueKey()
+	return req
+}
+
+func TestXmemNozzleReplicatesMutations(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	existing, err := server.Set(0, "existing", []byte(`{}`), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// documents are looked up on target before they are sent, and the ones that lose conflict resolution are not sent
+	xmem, listener := startXmemNozzle(t, server, base.CRMode_RevId, 0)
+	defer xmem.Stop()
+
+	xmem.Receive(newTestXmemRequest(1, "new", 1, 100, base.CRMode_RevId))
+	xmem.Receive(newTestXmemRequest(2, "existing", existing.RevSeqno, existing.Cas-1, base.CRMode_RevId))
+
+	sent := listener.waitForEvents(t, common.DataSent, 1)
+	failedCR := listener.waitForEvents(t, common.DataFailedCRSource, 1)
+	if seqno := sent[0].OtherInfos.(parts.DataSentEventAdditional).Seqno; seqno != 1 {
+		t.Errorf("expected seqno 1 to be sent, got %v", seqno)
+	}
+	if seqno := failedCR[0].OtherInfos.(parts.DataFailedCRSourceEventAdditional).Seqno; seqno != 2 {
+		t.Errorf("expected seqno 2 to fail conflict resolution, got %v", seqno)
+	}
+	if errors := listener.eventsOfType(common.ErrorEncountered); len(errors) != 0 {
+		t.Errorf("expected no errors, got %v", errors[0].OtherInfos)
+	}
+
+	doc, ok := server.Document(0, "new")
+	if !ok || doc.RevSeqno != 1 || doc.Cas != 100 || string(doc.Value) != `{"seqno":1}` {
+		t.Errorf("expected new document with source metadata on target, got %+v", doc)
+	}
+	if count := server.OpCount(base.SET_WITH_META); count != 1 {
+		t.Errorf("expected 1 SetWithMeta, got %v", count)
+	}
+}
+
+func TestXmemNozzleTargetConflictResolutionWithForceAccept(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+	server.SetConflictResolutionMode(base.CRMode_LWW)
+
+	existing, err := server.Set(0, "existing", []byte(`{}`), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// documents are sent optimistically, and rely on conflict resolution on target. requests from lww buckets
+	// carry FORCE_ACCEPT_WITH_META_OPS, which does not skip it
+	xmem, listener := startXmemNozzle(t, server, base.CRMode_LWW, 1024*1024)
+	defer xmem.Stop()
+
+	xmem.Receive(newTestXmemRequest(1, "new", 1, 100, base.CRMode_LWW))
+	xmem.Receive(newTestXmemRequest(2, "existing", existing.RevSeqno+10, existing.Cas-1, base.CRMode_LWW))
+
+	// documents rejected by target are still reported as sent
+	listener.waitForEvents(t, common.DataSent, 2)
+	if errors := listener.eventsOfType(common.ErrorEncountered); len(errors) != 0 {
+		t.Errorf("expected no errors, got %v", errors[0].OtherInfos)
+	}
+
+	if doc, ok := server.Document(0, "new"); !ok || doc.Cas != 100 {
+		t.Errorf("expected new document with source cas on target, got %+v", doc)
+	}
+	if doc, _ := server.Document(0, "existing"); doc.Cas != existing.Cas || doc.RevSeqno != existing.RevSeqno {
+		t.Errorf("expected existing document to win conflict resolution on target, got %+v", doc)
+	}
+	if count := server.OpCount(base.SET_WITH_META); count != 2 {
+		t.Errorf("expected 2 SetWithMeta, got %v", count)
+	}
+	if count := server.OpCount(base.GET_WITH_META); count != 0 {
+		t.Errorf("expected no GetWithMeta, got %v", count)
+	}
+}
@@ -0,0 +1,548 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// fakens is an httptest based stand-in for the ns_server rest endpoints that xdcr queries for cluster info,
+// i.e., /pools, /pools/default, /pools/nodes, bucket info, nodeServices, /nodes/self, xdcrSSLPorts and tasks.
+// cluster uuid, nodes, vbucket maps, ssl ports and compatibility versions are configurable,
+// and rebalances can be simulated by adding and removing nodes and moving vbuckets
+package fakens
+
+import (
+	"encoding/pem"
+	"fmt"
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/simple_utils"
+	"github.com/couchbase/goxdcr/standalone"
+	"github.com/couchbase/goxdcr/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultImplementationVersion = "5.0.0-0000-enterprise"
+	BucketTypeMembase            = standalone.BucketTypeMembase
+	KVService                    = standalone.KVService
+)
+
+var DefaultClusterCompatibility = []int{5, 0}
+
+// a node in the fake cluster. the node served by the fake ns_server is the first node
+type FakeNode struct {
+	// host:port of the rest endpoint of the node
+	Hostname     string
+	Services     []string
+	KVPort       uint16
+	KVSSLPort    uint16
+	SSLMgmtPort  uint16
+	SSLProxyPort uint16
+	CapiPort     uint16
+}
+
+type fakeBucket struct {
+	name                   string
+	uuid                   string
+	password               string
+	conflictResolutionType string
+	// rest host name of the node that is master for each vbucket
+	vbOwners []string
+}
+
+type FakeNsServerOptions struct {
+	// empty cluster uuid means that the cluster has not been initialized
+	ClusterUUID           string
+	ImplementationVersion string
+	ClusterCompatibility  []int
+	IsEnterprise          bool
+	// when username is not empty, requests other than xdcrSSLPorts need to carry matching basic auth
+	Username string
+	Password string
+	// whether the server listens on https
+	TLS bool
+	// ports of the node served by the fake ns_server
+	KVPort       uint16
+	KVSSLPort    uint16
+	SSLMgmtPort  uint16
+	SSLProxyPort uint16
+	CapiPort     uint16
+}
+
+type FakeNsServer struct {
+	server  *httptest.Server
+	options FakeNsServerOptions
+
+	nodes   []*FakeNode
+	buckets map[string]*fakeBucket
+	// revision of cluster map, which increases on every topology change
+	rev                  int
+	rebalance_running    bool
+	clusterCompatibility int
+
+	lock sync.RWMutex
+}
+
+func NewFakeNsServer(options FakeNsServerOptions) *FakeNsServer {
+	if options.ImplementationVersion == "" {
+		options.ImplementationVersion = DefaultImplementationVersion
+	}
+	if options.ClusterCompatibility == nil {
+		options.ClusterCompatibility = DefaultClusterCompatibility
+	}
+
+	ns := &FakeNsServer{options: options,
+		buckets:              make(map[string]*fakeBucket),
+		rev:                  1,
+		clusterCompatibility: simple_utils.EncodeVersionToEffectiveVersion(options.ClusterCompatibility),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(base.PoolsPath, ns.handlePools)
+	mux.HandleFunc(base.DefaultPoolPath, ns.handleDefaultPool)
+	mux.HandleFunc(base.NodesPath, ns.handleNodes)
+	mux.HandleFunc(strings.TrimSuffix(base.DefaultPoolBucketsPath, base.UrlDelimiter), ns.handleBuckets)
+	mux.HandleFunc(base.DefaultPoolBucketsPath, ns.handleBucket)
+	mux.HandleFunc(base.BPath, ns.handleBucket)
+	mux.HandleFunc(base.NodeServicesPath, ns.handleNodeServices)
+	mux.HandleFunc(base.NodesSelfPath, ns.handleNodesSelf)
+	mux.HandleFunc(base.SSLPortsPath, ns.handleSSLPorts)
+	mux.HandleFunc(base.DefaultPoolTasksPath, ns.handleTasks)
+
+	if options.TLS {
+		ns.server = httptest.NewTLSServer(mux)
+	} else {
+		ns.server = httptest.NewServer(mux)
+	}
+
+	ns.nodes = []*FakeNode{{Hostname: ns.server.Listener.Addr().String(),
+		Services:     []string{KVService},
+		KVPort:       options.KVPort,
+		KVSSLPort:    options.KVSSLPort,
+		SSLMgmtPort:  options.SSLMgmtPort,
+		SSLProxyPort: options.SSLProxyPort,
+		CapiPort:     options.CapiPort,
+	}}
+	return ns
+}
+
+// host:port of the fake ns_server
+func (ns *FakeNsServer) HostAddr() string {
+	return ns.server.Listener.Addr().String()
+}
+
+func (ns *FakeNsServer) URL() string {
+	return ns.server.URL
+}
+
+// the pem encoded certificate of the server, when it listens on https
+func (ns *FakeNsServer) Certificate() []byte {
+	if ns.server.TLS == nil || len(ns.server.TLS.Certificates) == 0 {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ns.server.TLS.Certificates[0].Certificate[0]})
+}
+
+func (ns *FakeNsServer) Close() {
+	ns.server.Close()
+}
+
+// changes cluster uuid, e.g., to simulate that the node has been moved to a different cluster
+func (ns *FakeNsServer) SetClusterUUID(clusterUUID string) {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	ns.options.ClusterUUID = clusterUUID
+}
+
+func (ns *FakeNsServer) SetClusterCompatibility(version []int) {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	ns.clusterCompatibility = simple_utils.EncodeVersionToEffectiveVersion(version)
+}
+
+func (ns *FakeNsServer) SetImplementationVersion(implementationVersion string, isEnterprise bool) {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	ns.options.ImplementationVersion = implementationVersion
+	ns.options.IsEnterprise = isEnterprise
+}
+
+// creates a bucket with numVBuckets vbuckets, which are distributed evenly across kv nodes
+func (ns *FakeNsServer) AddBucket(bucketName, bucketUUID, password string, numVBuckets int) error {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	if _, ok := ns.buckets[bucketName]; ok {
+		return fmt.Errorf("bucket %v already exists", bucketName)
+	}
+	bucket := &fakeBucket{name: bucketName,
+		uuid:                   bucketUUID,
+		password:               password,
+		conflictResolutionType: base.ConflictResolutionType_Seqno,
+		vbOwners:               make([]string, numVBuckets),
+	}
+	err := ns.distributeVBuckets(bucket)
+	if err != nil {
+		return err
+	}
+	ns.buckets[bucketName] = bucket
+	ns.rev++
+	return nil
+}
+
+// deletes a bucket. requests for its info get 404 afterwards
+func (ns *FakeNsServer) DeleteBucket(bucketName string) {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	delete(ns.buckets, bucketName)
+	ns.rev++
+}
+
+func (ns *FakeNsServer) SetBucketConflictResolutionType(bucketName, conflictResolutionType string) error {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	bucket, ok := ns.buckets[bucketName]
+	if !ok {
+		return fmt.Errorf("bucket %v does not exist", bucketName)
+	}
+	bucket.conflictResolutionType = conflictResolutionType
+	return nil
+}
+
+// adds a node to the cluster. the node owns no vbuckets until Rebalance is called
+func (ns *FakeNsServer) AddNode(node *FakeNode) error {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	if ns.findNode(node.Hostname) != nil {
+		return fmt.Errorf("node %v is already in cluster", node.Hostname)
+	}
+	nodeCopy := *node
+	ns.nodes = append(ns.nodes, &nodeCopy)
+	ns.rev++
+	return nil
+}
+
+// removes a node from the cluster, as a rebalance out would. the vbuckets on the node are moved to the remaining kv nodes
+func (ns *FakeNsServer) RemoveNode(hostname string) error {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	if hostname == ns.HostAddr() {
+		return fmt.Errorf("node %v served by fake ns_server cannot be removed", hostname)
+	}
+	for index, node := range ns.nodes {
+		if node.Hostname != hostname {
+			continue
+		}
+		ns.nodes = append(ns.nodes[:index], ns.nodes[index+1:]...)
+		for _, bucket := range ns.buckets {
+			if err := ns.distributeVBuckets(bucket); err != nil {
+				return err
+			}
+		}
+		ns.rev++
+		return nil
+	}
+	return fmt.Errorf("node %v is not in cluster", hostname)
+}
+
+// distributes the vbuckets of all buckets evenly across kv nodes, as a rebalance would
+func (ns *FakeNsServer) Rebalance() error {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	for _, bucket := range ns.buckets {
+		if err := ns.distributeVBuckets(bucket); err != nil {
+			return err
+		}
+	}
+	ns.rev++
+	return nil
+}
+
+// moves a vbucket to a node, e.g., to simulate a rebalance that is in progress
+func (ns *FakeNsServer) MoveVBucket(bucketName string, vbno uint16, hostname string) error {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	bucket, ok := ns.buckets[bucketName]
+	if !ok {
+		return fmt.Errorf("bucket %v does not exist", bucketName)
+	}
+	if int(vbno) >= len(bucket.vbOwners) {
+		return fmt.Errorf("vb %v is out of range for bucket %v", vbno, bucketName)
+	}
+	if node := ns.findNode(hostname); node == nil || !node.hasService(KVService) {
+		return fmt.Errorf("%v is not a kv node in cluster", hostname)
+	}
+	bucket.vbOwners[vbno] = hostname
+	ns.rev++
+	return nil
+}
+
+// sets whether a rebalance is reported as running in tasks and in default pool info
+func (ns *FakeNsServer) SetRebalanceRunning(running bool) {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	ns.rebalance_running = running
+}
+
+// the kv server, host:kvport, to vbuckets map of a bucket, as xdcr would derive from bucket info
+func (ns *FakeNsServer) ServerVBMap(bucketName string) map[string][]uint16 {
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+	bucket, ok := ns.buckets[bucketName]
+	if !ok {
+		return nil
+	}
+	serverVBMap := make(map[string][]uint16)
+	for vbno, owner := range bucket.vbOwners {
+		kvAddr := ns.findNode(owner).kvAddr()
+		serverVBMap[kvAddr] = append(serverVBMap[kvAddr], uint16(vbno))
+	}
+	return serverVBMap
+}
+
+// caller needs to hold ns.lock
+func (ns *FakeNsServer) distributeVBuckets(bucket *fakeBucket) error {
+	kvNodes := ns.kvNodes()
+	if len(kvNodes) == 0 {
+		return fmt.Errorf("there are no kv nodes in cluster")
+	}
+	numOfNodes := len(kvNodes)
+	if numOfNodes > len(bucket.vbOwners) {
+		numOfNodes = len(bucket.vbOwners)
+	}
+	if numOfNodes == 0 {
+		return nil
+	}
+	load_distribution := simple_utils.BalanceLoad(numOfNodes, len(bucket.vbOwners))
+	for index := 0; index < numOfNodes; index++ {
+		for vbno := load_distribution[index][0]; vbno < load_distribution[index][1]; vbno++ {
+			bucket.vbOwners[vbno] = kvNodes[index].Hostname
+		}
+	}
+	return nil
+}
+
+// caller needs to hold ns.lock
+func (ns *FakeNsServer) kvNodes() []*FakeNode {
+	kvNodes := make([]*FakeNode, 0, len(ns.nodes))
+	for _, node := range ns.nodes {
+		if node.hasService(KVService) {
+			kvNodes = append(kvNodes, node)
+		}
+	}
+	return kvNodes
+}
+
+// caller needs to hold ns.lock
+func (ns *FakeNsServer) findNode(hostname string) *FakeNode {
+	for _, node := range ns.nodes {
+		if node.Hostname == hostname {
+			return node
+		}
+	}
+	return nil
+}
+
+func (node *FakeNode) hasService(service string) bool {
+	for _, nodeService := range node.Services {
+		if nodeService == service {
+			return true
+		}
+	}
+	return false
+}
+
+func (node *FakeNode) kvAddr() string {
+	return utils.GetHostAddr(utils.GetHostName(node.Hostname), node.KVPort)
+}
+
+/************************************
+/* rest handlers
+*************************************/
+
+// checks basic auth. xdcrSSLPorts is queried without credentials, and is not checked
+func (ns *FakeNsServer) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	if ns.options.Username == "" {
+		return true
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok || username != ns.options.Username || password != ns.options.Password {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (ns *FakeNsServer) handlePools(w http.ResponseWriter, r *http.Request) {
+	if !ns.authenticate(w, r) {
+		return
+	}
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+
+	poolsInfo := map[string]interface{}{
+		base.ImplementationVersionKey: ns.options.ImplementationVersion,
+		base.IsEnterprise:             ns.options.IsEnterprise,
+	}
+	if ns.options.ClusterUUID == "" {
+		// uninitialized cluster has empty uuid and pools
+		poolsInfo[base.UUIDKey] = []interface{}{}
+		poolsInfo[base.Pools] = []interface{}{}
+	} else {
+		poolsInfo[base.UUIDKey] = ns.options.ClusterUUID
+		poolsInfo[base.Pools] = []interface{}{map[string]interface{}{
+			"name":      base.DefaultPoolName,
+			base.URIKey: fmt.Sprintf("%v?uuid=%v", base.DefaultPoolPath, ns.options.ClusterUUID),
+		}}
+	}
+	standalone.WriteJson(w, poolsInfo)
+}
+
+func (ns *FakeNsServer) handleDefaultPool(w http.ResponseWriter, r *http.Request) {
+	if !ns.authenticate(w, r) {
+		return
+	}
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+
+	rebalanceStatus := "none"
+	if ns.rebalance_running {
+		rebalanceStatus = "running"
+	}
+	standalone.WriteJson(w, map[string]interface{}{
+		"name":        base.DefaultPoolName,
+		"rev":         ns.rev,
+		base.NodesKey: ns.clusterInfo().NodeInfoList(),
+		base.BucketsKey: map[string]interface{}{
+			base.URIKey: fmt.Sprintf("%v?v=%v&uuid=%v", strings.TrimSuffix(base.DefaultPoolBucketsPath, base.UrlDelimiter), ns.rev, ns.options.ClusterUUID),
+		},
+		"rebalanceStatus": rebalanceStatus,
+	})
+}
+
+func (ns *FakeNsServer) handleNodes(w http.ResponseWriter, r *http.Request) {
+	if !ns.authenticate(w, r) {
+		return
+	}
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+	standalone.WriteJson(w, map[string]interface{}{base.NodesKey: ns.clusterInfo().NodeInfoList()})
+}
+
+func (ns *FakeNsServer) handleBuckets(w http.ResponseWriter, r *http.Request) {
+	if !ns.authenticate(w, r) {
+		return
+	}
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+	bucketInfos := make([]interface{}, 0, len(ns.buckets))
+	for _, bucket := range ns.buckets {
+		bucketInfos = append(bucketInfos, ns.bucketInfo(bucket))
+	}
+	standalone.WriteJson(w, bucketInfos)
+}
+
+// serves both /pools/default/buckets/$bucket and /pools/default/b/$bucket
+func (ns *FakeNsServer) handleBucket(w http.ResponseWriter, r *http.Request) {
+	if !ns.authenticate(w, r) {
+		return
+	}
+	bucketName := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, base.DefaultPoolBucketsPath), base.BPath)
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+	bucket, ok := ns.buckets[bucketName]
+	if !ok {
+		http.Error(w, "Requested resource not found.", http.StatusNotFound)
+		return
+	}
+	standalone.WriteJson(w, ns.bucketInfo(bucket))
+}
+
+func (ns *FakeNsServer) handleNodeServices(w http.ResponseWriter, r *http.Request) {
+	if !ns.authenticate(w, r) {
+		return
+	}
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+	standalone.WriteJson(w, map[string]interface{}{
+		"rev":           ns.rev,
+		base.NodeExtKey: ns.clusterInfo().NodeExtList(),
+	})
+}
+
+func (ns *FakeNsServer) handleNodesSelf(w http.ResponseWriter, r *http.Request) {
+	if !ns.authenticate(w, r) {
+		return
+	}
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+	clusterInfo := ns.clusterInfo()
+	standalone.WriteJson(w, clusterInfo.NodeInfo(clusterInfo.Nodes[0]))
+}
+
+func (ns *FakeNsServer) handleSSLPorts(w http.ResponseWriter, r *http.Request) {
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+	node := ns.nodes[0]
+	standalone.WriteJson(w, map[string]interface{}{
+		base.SSLPortKey: node.SSLMgmtPort,
+		"httpsCAPI":     node.CapiPort,
+	})
+}
+
+func (ns *FakeNsServer) handleTasks(w http.ResponseWriter, r *http.Request) {
+	if !ns.authenticate(w, r) {
+		return
+	}
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+	status := "notRunning"
+	if ns.rebalance_running {
+		status = "running"
+	}
+	standalone.WriteJson(w, []interface{}{map[string]interface{}{
+		"type":   "rebalance",
+		"status": status,
+	}})
+}
+
+// cluster info as of current topology. caller needs to hold ns.lock
+func (ns *FakeNsServer) clusterInfo() *standalone.ClusterInfo {
+	nodes := make([]*standalone.NodeInfo, 0, len(ns.nodes))
+	for _, node := range ns.nodes {
+		nodeInfo := &standalone.NodeInfo{HostAddr: node.Hostname,
+			Services:     node.Services,
+			SSLMgmtPort:  node.SSLMgmtPort,
+			SSLProxyPort: node.SSLProxyPort,
+			CapiPort:     node.CapiPort,
+		}
+		if node.hasService(KVService) {
+			nodeInfo.KVAddr = node.kvAddr()
+			nodeInfo.KVSSLPort = node.KVSSLPort
+		}
+		nodes = append(nodes, nodeInfo)
+	}
+	return &standalone.ClusterInfo{ImplementationVersion: ns.options.ImplementationVersion,
+		ClusterCompatibility: ns.clusterCompatibility,
+		Rev:                  ns.rev,
+		Nodes:                nodes,
+	}
+}
+
+// caller needs to hold ns.lock
+func (ns *FakeNsServer) bucketInfo(bucket *fakeBucket) map[string]interface{} {
+	vbOwners := make([]string, len(bucket.vbOwners))
+	for vbno, owner := range bucket.vbOwners {
+		vbOwners[vbno] = ns.findNode(owner).kvAddr()
+	}
+	return ns.clusterInfo().BucketInfo(&standalone.BucketInfo{Name: bucket.name,
+		UUID:                   bucket.uuid,
+		Password:               bucket.password,
+		ConflictResolutionType: bucket.conflictResolutionType,
+		VBOwners:               vbOwners,
+	})
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package fakens
+
+import (
+	"github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/utils"
+	"testing"
+)
+
+const (
+	testClusterUUID = "d5dea23aa7ee3771becb3fcdb46ff956"
+	testBucketName  = "default"
+	testBucketUUID  = "c6a9d0a0d7ae4b1f3a8b6a41b0b9c3e1"
+	testUsername    = "Administrator"
+	testPassword    = "welcome"
+	testNumVBuckets = 64
+)
+
+var testLogger = log.NewLogger("FakeNsServerTest", log.DefaultLoggerContext)
+
+func startServer(t *testing.T) *FakeNsServer {
+	ns := NewFakeNsServer(FakeNsServerOptions{ClusterUUID: testClusterUUID,
+		IsEnterprise: true,
+		Username:     testUsername,
+		Password:     testPassword,
+		KVPort:       12000,
+		KVSSLPort:    11998,
+		SSLMgmtPort:  19000,
+		SSLProxyPort: 11996,
+		CapiPort:     9500,
+	})
+	if err := ns.AddBucket(testBucketName, testBucketUUID, "", testNumVBuckets); err != nil {
+		ns.Close()
+		t.Fatal(err)
+	}
+	return ns
+}
+
+func getServerVBMap(t *testing.T, ns *FakeNsServer) map[string][]uint16 {
+	bucketInfo, err := utils.GetBucketInfo(ns.HostAddr(), testBucketName, testUsername, testPassword, nil, false, testLogger)
+	if err != nil {
+		t.Fatalf("failed to get bucket info. err=%v", err)
+	}
+	serverVBMap, err := utils.GetServerVBucketsMap(ns.HostAddr(), testBucketName, bucketInfo)
+	if err != nil {
+		t.Fatalf("failed to get server vb map. err=%v", err)
+	}
+	return serverVBMap
+}
+
+func TestClusterInfo(t *testing.T) {
+	ns := startServer(t)
+	defer ns.Close()
+
+	clusterUUID, nodeList, err := utils.GetClusterUUIDAndNodeListWithMinInfo(ns.HostAddr(), testUsername, testPassword, nil, false, testLogger)
+	if err != nil {
+		t.Fatalf("failed to get cluster uuid and node list. err=%v", err)
+	}
+	if clusterUUID != testClusterUUID || len(nodeList) != 1 {
+		t.Errorf("expected cluster uuid %v and 1 node, got %v and %v", testClusterUUID, clusterUUID, nodeList)
+	}
+
+	nodeList, err = utils.GetNodeListWithFullInfo(ns.HostAddr(), testUsername, testPassword, nil, false, testLogger)
+	if err != nil {
+		t.Fatalf("failed to get node list. err=%v", err)
+	}
+	clusterCompatibility, err := utils.GetClusterCompatibilityFromNodeList(nodeList)
+	if err != nil || clusterCompatibility != 0x50000 {
+		t.Errorf("expected cluster compatibility 0x50000, got %v. err=%v", clusterCompatibility, err)
+	}
+
+	_, _, err = utils.GetClusterUUIDAndNodeListWithMinInfo(ns.HostAddr(), testUsername, "wrong", nil, false, testLogger)
+	if err == nil {
+		t.Errorf("expected error with wrong password")
+	}
+}
+
+func TestBucketInfo(t *testing.T) {
+	ns := startServer(t)
+	defer ns.Close()
+
+	bucketType, bucketUUID, crType, _, serverVBMap, err := utils.BucketValidationInfo(ns.HostAddr(), testBucketName, testUsername, testPassword, nil, false, testLogger)
+	if err != nil {
+		t.Fatalf("failed to get bucket validation info. err=%v", err)
+	}
+	if bucketType != BucketTypeMembase || bucketUUID != testBucketUUID || crType != base.ConflictResolutionType_Seqno {
+		t.Errorf("unexpected bucket info. bucketType=%v, bucketUUID=%v, crType=%v", bucketType, bucketUUID, crType)
+	}
+	if vbList := serverVBMap["127.0.0.1:12000"]; len(vbList) != testNumVBuckets {
+		t.Errorf("expected all vbuckets on 127.0.0.1:12000, got %v", serverVBMap)
+	}
+
+	sslPortMap, err := utils.GetMemcachedSSLPortMap(ns.HostAddr(), testUsername, testPassword, nil, false, testBucketName, testLogger)
+	if err != nil || sslPortMap["127.0.0.1:12000"] != 11998 {
+		t.Errorf("expected kv ssl port 11998, got %v. err=%v", sslPortMap, err)
+	}
+
+	sslPort, err, _ := utils.GetSSLPort(ns.HostAddr(), testLogger)
+	if err != nil || sslPort != 19000 {
+		t.Errorf("expected ssl mgmt port 19000, got %v. err=%v", sslPort, err)
+	}
+
+	ns.DeleteBucket(testBucketName)
+	_, err = utils.GetBucketInfo(ns.HostAddr(), testBucketName, testUsername, testPassword, nil, false, testLogger)
+	if err != utils.NonExistentBucketError {
+		t.Errorf("expected NonExistentBucketError after bucket deletion, got %v", err)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	ns := startServer(t)
+	defer ns.Close()
+
+	err := ns.AddNode(&FakeNode{Hostname: "127.0.0.2:8091", Services: []string{KVService}, KVPort: 12002})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// vbuckets do not move until rebalance
+	if serverVBMap := getServerVBMap(t, ns); len(serverVBMap) != 1 {
+		t.Errorf("expected vbuckets on 1 node before rebalance, got %v", serverVBMap)
+	}
+
+	if err = ns.Rebalance(); err != nil {
+		t.Fatal(err)
+	}
+	serverVBMap := getServerVBMap(t, ns)
+	if len(serverVBMap["127.0.0.1:12000"]) != testNumVBuckets/2 || len(serverVBMap["127.0.0.2:12002"]) != testNumVBuckets/2 {
+		t.Errorf("expected vbuckets to be split evenly after rebalance, got %v", serverVBMap)
+	}
+
+	if err = ns.MoveVBucket(testBucketName, 0, "127.0.0.2:8091"); err != nil {
+		t.Fatal(err)
+	}
+	serverVBMap = getServerVBMap(t, ns)
+	if len(serverVBMap["127.0.0.2:12002"]) != testNumVBuckets/2+1 {
+		t.Errorf("expected vb 0 to be moved to 127.0.0.2:12002, got %v", serverVBMap)
+	}
+
+	if err = ns.RemoveNode("127.0.0.2:8091"); err != nil {
+		t.Fatal(err)
+	}
+	if serverVBMap = getServerVBMap(t, ns); len(serverVBMap["127.0.0.1:12000"]) != testNumVBuckets {
+		t.Errorf("expected all vbuckets on 127.0.0.1:12000 after rebalance out, got %v", serverVBMap)
+	}
+}
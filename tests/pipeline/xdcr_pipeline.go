@@ -163,7 +163,7 @@ func setup() error {
 		repl_spec_svc, remote_cluster_svc,
 		cluster_info_svc, top_svc, metadata_svc.NewReplicationSettingsSvc(metakv_svc, nil),
 		metadata_svc.NewCheckpointsService(metakv_svc, nil), service_impl.NewCAPIService(cluster_info_svc, nil),
-		audit_svc, uilog_svc, processSetting_svc, buckerSettings_svc, internalSettings_svc)
+		audit_svc, uilog_svc, processSetting_svc, buckerSettings_svc, internalSettings_svc, metakv_svc)
 
 	logger.Info("Finish setup")
 	return nil
@@ -182,7 +182,7 @@ func startRouter() {
 		partMap[partId] = NewTestPart(partId)
 	}
 
-	router, _ = parts.NewRouter("router1", "router1", options.filter_expression, partMap, buildVbMap(partMap), base.CRMode_RevId, couchlog.DefaultLoggerContext, nil)
+	router, _ = parts.NewRouter("router1", "router1", options.filter_expression, "", partMap, buildVbMap(partMap), 0, base.CRMode_RevId, couchlog.DefaultLoggerContext, nil)
 }
 
 func buildVbMap(downStreamParts map[string]pc.Part) map[uint16]string {
@@ -0,0 +1,240 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package transform
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// redaction actions
+const (
+	// replaces field value with the hex encoded hmac-sha256 of its json representation, keyed with the
+	// redaction hash key of the replication. equal values are hashed to equal strings, so redacted fields
+	// can still be joined on, while values cannot be recovered by hashing guessed values without the key
+	RedactionHash = "hash"
+	// replaces field value with null
+	RedactionNull = "null"
+	// replaces field value with a fixed value
+	RedactionReplace = "replace"
+)
+
+// path segment that matches all fields of an object or all elements of an array
+const RedactionWildcard = "*"
+
+var ErrorEmptyRedactionRules = errors.New("Redaction rules need to contain at least one rule.")
+var ErrorMissingRedactionHashKey = errors.New("Redaction hash key needs to be specified for hash action.")
+var ErrorUnredactableBody = errors.New("Document body is not a json object and cannot be redacted.")
+
+/************************************
+/* struct FieldRedactor
+*************************************/
+
+// FieldRedactor masks fields in json document bodies before they are sent to target.
+// Redaction rules are specified as a json array, e.g.,
+//
+//	[{"field": "email", "action": "hash"},
+//	 {"field": "payment.cards.*.number", "action": "replace", "value": "xxxx"},
+//	 {"field": "ssn", "action": "null"}]
+//
+// Fields are dotted paths. A numeric segment selects an array element and a * segment selects all
+// fields or elements. Rules on fields that do not exist in a document are ignored, and bodies that
+// contain none of the fields are left untouched. Bodies that are not json objects cannot be checked
+// for the fields and are refused, so that they are never sent to target unredacted.
+type FieldRedactor struct {
+	rulesStr string
+	rules    []*RedactionRule
+	// key of the hmac used by hash action
+	hashKey string
+}
+
+type RedactionRule struct {
+	Field  string `json:"field"`
+	Action string `json:"action"`
+	// replacement value for RedactionReplace action. can be any json value
+	Value interface{} `json:"value,omitempty"`
+	path  []string
+}
+
+func NewFieldRedactor(rulesStr string, hashKey string) (*FieldRedactor, error) {
+	rules, err := parseRedactionRules(rulesStr)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if rule.Action == RedactionHash && len(hashKey) == 0 {
+			return nil, ErrorMissingRedactionHashKey
+		}
+	}
+	return &FieldRedactor{rulesStr: rulesStr, rules: rules, hashKey: hashKey}, nil
+}
+
+// checks that redaction rules can be parsed. the hash key needed by the rules is checked by NewFieldRedactor
+func ValidateRedactionRules(rulesStr string) error {
+	_, err := parseRedactionRules(rulesStr)
+	return err
+}
+
+func parseRedactionRules(rulesStr string) ([]*RedactionRule, error) {
+	var rules []*RedactionRule
+	decoder := json.NewDecoder(strings.NewReader(rulesStr))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&rules)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid redaction rules. err=%v", err)
+	}
+	if len(rules) == 0 {
+		return nil, ErrorEmptyRedactionRules
+	}
+
+	for index, rule := range rules {
+		if rule == nil {
+			return nil, fmt.Errorf("Redaction rule %v is empty", index)
+		}
+		err = rule.validate()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redaction rule %v. err=%v", index, err)
+		}
+	}
+	return rules, nil
+}
+
+func (rule *RedactionRule) validate() error {
+	if len(rule.Field) == 0 {
+		return errors.New("field needs to be specified")
+	}
+	rule.path = strings.Split(rule.Field, ".")
+	for _, segment := range rule.path {
+		if len(segment) == 0 {
+			return fmt.Errorf("field %v contains empty path segment", rule.Field)
+		}
+	}
+
+	switch rule.Action {
+	case RedactionHash, RedactionNull:
+		if rule.Value != nil {
+			return fmt.Errorf("%v action does not take value", rule.Action)
+		}
+	case RedactionReplace:
+		if rule.Value == nil {
+			return fmt.Errorf("%v action needs a non-null value", rule.Action)
+		}
+	default:
+		return fmt.Errorf("unknown action %v. valid actions are %v, %v and %v", rule.Action,
+			RedactionHash, RedactionNull, RedactionReplace)
+	}
+	return nil
+}
+
+// returns the redacted value of the field
+func (rule *RedactionRule) redact(value interface{}, hashKey string) interface{} {
+	switch rule.Action {
+	case RedactionHash:
+		valueBytes, err := json.Marshal(value)
+		if err != nil {
+			// cannot happen for values produced by json decoding
+			return nil
+		}
+		mac := hmac.New(sha256.New, []byte(hashKey))
+		mac.Write(valueBytes)
+		return hex.EncodeToString(mac.Sum(nil))
+	case RedactionReplace:
+		return rule.Value
+	default:
+		return nil
+	}
+}
+
+// applies the rule to the fields at path within obj. returns whether any field has been redacted
+func (rule *RedactionRule) apply(obj interface{}, path []string, hashKey string) bool {
+	segment := path[0]
+	last := len(path) == 1
+	redacted := false
+
+	switch container := obj.(type) {
+	case map[string]interface{}:
+		for field, value := range container {
+			if segment != RedactionWildcard && segment != field {
+				continue
+			}
+			if last {
+				container[field] = rule.redact(value, hashKey)
+				redacted = true
+			} else if rule.apply(value, path[1:], hashKey) {
+				redacted = true
+			}
+		}
+	case []interface{}:
+		for index, value := range container {
+			if segment != RedactionWildcard && segment != strconv.Itoa(index) {
+				continue
+			}
+			if last {
+				container[index] = rule.redact(value, hashKey)
+				redacted = true
+			} else if rule.apply(value, path[1:], hashKey) {
+				redacted = true
+			}
+		}
+	}
+	return redacted
+}
+
+func (redactor *FieldRedactor) Rules() string {
+	return redactor.rulesStr
+}
+
+func (redactor *FieldRedactor) HashKey() string {
+	return redactor.hashKey
+}
+
+// Redact returns the body with all matching fields redacted, or ErrorUnredactableBody when the body
+// is not a json object. The body passed in is never modified, since it may be shared with the source event.
+// The returned body may be of a different size than the original one.
+func (redactor *FieldRedactor) Redact(body []byte) ([]byte, error) {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// keep numbers as they are in the original body
+	decoder.UseNumber()
+	if decoder.Decode(&doc) != nil || decoder.More() {
+		return nil, ErrorUnredactableBody
+	}
+	if _, ok := doc.(map[string]interface{}); !ok {
+		return nil, ErrorUnredactableBody
+	}
+
+	redacted := false
+	for _, rule := range redactor.rules {
+		if rule.apply(doc, rule.path, redactor.hashKey) {
+			redacted = true
+		}
+	}
+	if !redacted {
+		return body, nil
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(doc)
+	if err != nil {
+		// cannot happen for values produced by json decoding
+		return nil, err
+	}
+	// Encode appends a new line
+	return bytes.TrimRight(buffer.Bytes(), "\n"), nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package transform
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+const testHashRules = `[{"field": "email", "action": "hash"}]`
+
+func redactEmail(t *testing.T, redactor *FieldRedactor, body string) string {
+	redacted, err := redactor.Redact([]byte(body))
+	if err != nil {
+		t.Fatalf("failed to redact %v. err=%v", body, err)
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal(redacted, &doc)
+	if err != nil {
+		t.Fatalf("redacted body %v is not valid json. err=%v", string(redacted), err)
+	}
+	email, _ := doc["email"].(string)
+	return email
+}
+
+func TestFieldRedactorHashNeedsKey(t *testing.T) {
+	_, err := NewFieldRedactor(testHashRules, "")
+	if err != ErrorMissingRedactionHashKey {
+		t.Errorf("expected ErrorMissingRedactionHashKey, got %v", err)
+	}
+	// rules can still be validated on their own, e.g., when hash key is set separately
+	if err := ValidateRedactionRules(testHashRules); err != nil {
+		t.Errorf("expected rules to be valid, got %v", err)
+	}
+	// other actions do not need hash key
+	if _, err := NewFieldRedactor(`[{"field": "email", "action": "null"}]`, ""); err != nil {
+		t.Errorf("expected null action not to need hash key, got %v", err)
+	}
+}
+
+func TestFieldRedactorHashIsKeyed(t *testing.T) {
+	redactor1, err := NewFieldRedactor(testHashRules, "key1")
+	if err != nil {
+		t.Fatalf("failed to construct redactor. err=%v", err)
+	}
+	redactor2, err := NewFieldRedactor(testHashRules, "key2")
+	if err != nil {
+		t.Fatalf("failed to construct redactor. err=%v", err)
+	}
+
+	body := `{"email": "a@b.com", "age": 5}`
+	hash1 := redactEmail(t, redactor1, body)
+	if hash1 == "" || hash1 == "a@b.com" {
+		t.Fatalf("expected email to be hashed, got %v", hash1)
+	}
+	if again := redactEmail(t, redactor1, body); again != hash1 {
+		t.Errorf("expected equal values to be hashed to equal strings, got %v and %v", hash1, again)
+	}
+	if hash2 := redactEmail(t, redactor2, body); hash2 == hash1 {
+		t.Errorf("expected hashes with different keys to differ, got %v for both", hash1)
+	}
+	unkeyed := sha256.Sum256([]byte(`"a@b.com"`))
+	if hash1 == hex.EncodeToString(unkeyed[:]) {
+		t.Errorf("expected hash not to be the unkeyed sha256 of the value")
+	}
+}
+
+func TestFieldRedactorRefusesUnredactableBodies(t *testing.T) {
+	redactor, err := NewFieldRedactor(testHashRules, "key")
+	if err != nil {
+		t.Fatalf("failed to construct redactor. err=%v", err)
+	}
+
+	for _, body := range []string{"not json", `[{"email": "a@b.com"}]`, `"a@b.com"`, `{"email": "a@b.com"} {}`, ""} {
+		redacted, err := redactor.Redact([]byte(body))
+		if err != ErrorUnredactableBody || redacted != nil {
+			t.Errorf("expected %q to be refused, got body %q and err %v", body, string(redacted), err)
+		}
+	}
+}
+
+func TestFieldRedactorLeavesBodiesWithoutFields(t *testing.T) {
+	redactor, err := NewFieldRedactor(testHashRules, "key")
+	if err != nil {
+		t.Fatalf("failed to construct redactor. err=%v", err)
+	}
+
+	body := `{"name":  "a", "n": 12345678901234567890}`
+	redacted, err := redactor.Redact([]byte(body))
+	if err != nil || string(redacted) != body {
+		t.Errorf("expected body to be left untouched, got body %v and err %v", string(redacted), err)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// types of key transform rules
+const (
+	KeyTransformAddPrefix    = "addPrefix"
+	KeyTransformStripPrefix  = "stripPrefix"
+	KeyTransformRegexReplace = "regexReplace"
+)
+
+var ErrorEmptyKeyTransformRules = errors.New("Key transform rules need to contain at least one rule.")
+
+/************************************
+/* struct KeyTransformer
+*************************************/
+
+// KeyTransformer rewrites document keys before they are sent to target.
+// Key transform rules are specified as a json array, and are applied in the order specified, e.g.,
+//
+//	[{"type": "stripPrefix", "value": "tmp::"},
+//	 {"type": "addPrefix", "value": "siteA::"},
+//	 {"type": "regexReplace", "pattern": "::v[0-9]+$", "replacement": ""}]
+//
+// A rule that would result in an empty key is not applied, since documents cannot have empty keys.
+type KeyTransformer struct {
+	rulesStr string
+	rules    []*KeyTransformRule
+}
+
+type KeyTransformRule struct {
+	// KeyTransformAddPrefix, KeyTransformStripPrefix or KeyTransformRegexReplace
+	Type string `json:"type"`
+	// prefix to be added or stripped
+	Value string `json:"value,omitempty"`
+	// regular expression and its replacement, which may reference submatches, e.g., $1
+	Pattern     string `json:"pattern,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+	regexp      *regexp.Regexp
+}
+
+func NewKeyTransformer(rulesStr string) (*KeyTransformer, error) {
+	var rules []*KeyTransformRule
+	decoder := json.NewDecoder(strings.NewReader(rulesStr))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&rules)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key transform rules. err=%v", err)
+	}
+	if len(rules) == 0 {
+		return nil, ErrorEmptyKeyTransformRules
+	}
+
+	for index, rule := range rules {
+		if rule == nil {
+			return nil, fmt.Errorf("Key transform rule %v is empty", index)
+		}
+		err = rule.validate()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key transform rule %v. err=%v", index, err)
+		}
+	}
+
+	return &KeyTransformer{rulesStr: rulesStr, rules: rules}, nil
+}
+
+func (rule *KeyTransformRule) validate() error {
+	switch rule.Type {
+	case KeyTransformAddPrefix, KeyTransformStripPrefix:
+		if len(rule.Value) == 0 {
+			return fmt.Errorf("%v rule needs a non-empty value", rule.Type)
+		}
+		if len(rule.Pattern) > 0 || len(rule.Replacement) > 0 {
+			return fmt.Errorf("%v rule does not take pattern or replacement", rule.Type)
+		}
+	case KeyTransformRegexReplace:
+		if len(rule.Pattern) == 0 {
+			return fmt.Errorf("%v rule needs a non-empty pattern", rule.Type)
+		}
+		if len(rule.Value) > 0 {
+			return fmt.Errorf("%v rule does not take value", rule.Type)
+		}
+		regExp, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return err
+		}
+		rule.regexp = regExp
+	default:
+		return fmt.Errorf("unknown rule type %v. valid types are %v, %v and %v", rule.Type,
+			KeyTransformAddPrefix, KeyTransformStripPrefix, KeyTransformRegexReplace)
+	}
+	return nil
+}
+
+func (rule *KeyTransformRule) apply(key []byte) []byte {
+	switch rule.Type {
+	case KeyTransformAddPrefix:
+		newKey := make([]byte, 0, len(rule.Value)+len(key))
+		newKey = append(newKey, rule.Value...)
+		return append(newKey, key...)
+	case KeyTransformStripPrefix:
+		if bytes.HasPrefix(key, []byte(rule.Value)) {
+			return key[len(rule.Value):]
+		}
+	case KeyTransformRegexReplace:
+		return rule.regexp.ReplaceAll(key, []byte(rule.Replacement))
+	}
+	return key
+}
+
+func (keyTransformer *KeyTransformer) Rules() string {
+	return keyTransformer.rulesStr
+}
+
+// Transform returns the key after all rules have been applied.
+// The key passed in is never modified, since it may be shared with the source event
+func (keyTransformer *KeyTransformer) Transform(key []byte) []byte {
+	for _, rule := range keyTransformer.rules {
+		newKey := rule.apply(key)
+		if len(newKey) > 0 {
+			key = newKey
+		}
+	}
+	return key
+}
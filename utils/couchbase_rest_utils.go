@@ -7,7 +7,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/couchbase/cbauth"
 	"github.com/couchbase/go-couchbase"
 	base "github.com/couchbase/goxdcr/base"
 	"github.com/couchbase/goxdcr/log"
@@ -530,7 +529,7 @@ func RemovePrefix(prefix string, str string) string {
 
 //this expect the baseURL doesn't contain username and password
 //if username and password passed in is "", assume it is local rest call,
-//then call cbauth to add authenticate information
+//then add authentication information for local cluster, through cbauth unless static credentials are used
 func QueryRestApiWithAuth(
 	baseURL string,
 	path string,
@@ -738,7 +737,7 @@ func maybeAddAuth(req *http.Request, username string, password string) {
 
 //this expect the baseURL doesn't contain username and password
 //if username and password passed in is "", assume it is local rest call,
-//then call cbauth to add authenticate information
+//then add authentication information for local cluster, through cbauth unless static credentials are used
 func ConstructHttpRequest(
 	baseURL string,
 	path string,
@@ -807,7 +806,7 @@ func ConstructHttpRequest(
 	// username is nil when calling /nodes/self/xdcrSSLPorts on target
 	// other username can be nil only in local rest calls
 	if username == "" && path != base.SSLPortsPath {
-		err := cbauth.SetRequestAuth(req)
+		err := setLocalRequestAuth(req)
 		if err != nil {
 			l.Errorf("Failed to set authentication to request, req=%v\n", req)
 			return nil, "", err
@@ -0,0 +1,79 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// credentials for the local cluster, i.e., for rest calls to local ns_server and for memcached connections
+// to local kv nodes. they are retrieved through cbauth, unless static credentials have been set up
+// for xdcr running in standalone mode, where there is no ns_server and hence no cbauth
+package utils
+
+import (
+	"github.com/couchbase/cbauth"
+	"github.com/couchbase/go-couchbase"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+type staticCredentials struct {
+	username string
+	password string
+}
+
+var static_local_credentials *staticCredentials
+var static_local_credentials_lock sync.RWMutex
+
+// makes all local connections use the specified credentials instead of cbauth
+func UseStaticLocalCredentials(username, password string) {
+	static_local_credentials_lock.Lock()
+	defer static_local_credentials_lock.Unlock()
+	static_local_credentials = &staticCredentials{username, password}
+}
+
+func getStaticLocalCredentials() *staticCredentials {
+	static_local_credentials_lock.RLock()
+	defer static_local_credentials_lock.RUnlock()
+	return static_local_credentials
+}
+
+// credentials for memcached connections to local kv nodes
+func GetLocalMemcachedServiceAuth(hostAddr string) (string, string, error) {
+	if credentials := getStaticLocalCredentials(); credentials != nil {
+		return credentials.username, credentials.password, nil
+	}
+	return cbauth.GetMemcachedServiceAuth(hostAddr)
+}
+
+// credentials for rest calls to local ns_server
+func GetLocalHTTPServiceAuth(hostAddr string) (string, string, error) {
+	if credentials := getStaticLocalCredentials(); credentials != nil {
+		return credentials.username, credentials.password, nil
+	}
+	return cbauth.GetHTTPServiceAuth(hostAddr)
+}
+
+func setLocalRequestAuth(req *http.Request) error {
+	if credentials := getStaticLocalCredentials(); credentials != nil {
+		req.SetBasicAuth(credentials.username, credentials.password)
+		return nil
+	}
+	return cbauth.SetRequestAuth(req)
+}
+
+func connectToLocalCluster(localURL string) (couchbase.Client, error) {
+	if credentials := getStaticLocalCredentials(); credentials != nil {
+		u, err := url.Parse(localURL)
+		if err != nil {
+			return couchbase.Client{}, err
+		}
+		// go-couchbase picks up basic auth credentials from url
+		u.User = url.UserPassword(credentials.username, credentials.password)
+		return couchbase.Connect(u.String())
+	}
+	return couchbase.ConnectWithAuth(localURL, cbauth.NewAuthHandler(nil))
+}
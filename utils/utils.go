@@ -5,13 +5,14 @@ import (
 	"errors"
 	"expvar"
 	"fmt"
-	"github.com/couchbase/cbauth"
 	"github.com/couchbase/go-couchbase"
 	mc "github.com/couchbase/gomemcached"
 	mcc "github.com/couchbase/gomemcached/client"
 	base "github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/filter"
 	"github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/simple_utils"
+	"github.com/couchbase/goxdcr/transform"
 	"net"
 	"net/url"
 	"reflect"
@@ -86,7 +87,7 @@ func RecoverPanic(err *error) {
 
 func LocalPool(localConnectStr string) (couchbase.Pool, error) {
 	localURL := fmt.Sprintf("http://%s", localConnectStr)
-	client, err := couchbase.ConnectWithAuth(localURL, cbauth.NewAuthHandler(nil))
+	client, err := connectToLocalCluster(localURL)
 	if err != nil {
 		return couchbase.Pool{}, NewEnhancedError(fmt.Sprintf("Error connecting to couchbase. url=%v", UrlForLog(localURL)), err)
 	}
@@ -296,10 +297,82 @@ func GetMatchedKeys(expression string, keys []string) (map[string][][]int, error
 	return matchesMap, nil
 }
 
+// evaluates a structured key filter expression against the keys and returns, for each key,
+// whether it passes the filter and which include or exclude rule decided it
+func GetKeyFilterResults(expression string, keys []string) (map[string]*filter.KeyFilterResult, error) {
+	if !utf8.ValidString(expression) {
+		return nil, errors.New("expression is not valid utf8")
+	}
+	for _, key := range keys {
+		if !utf8.ValidString(key) {
+			return nil, errors.New("key is not valid utf8")
+		}
+	}
+
+	keyFilter, err := filter.NewKeyFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsMap := make(map[string]*filter.KeyFilterResult)
+	for _, key := range keys {
+		resultsMap[key] = keyFilter.Evaluate([]byte(key))
+	}
+
+	return resultsMap, nil
+}
+
+// returns, for each of the sample keys, the key after key transform rules have been applied
+func GetTransformedKeys(keyTransformRules string, keys []string) (map[string]string, error) {
+	for _, key := range keys {
+		if !utf8.ValidString(key) {
+			return nil, errors.New("key is not valid utf8")
+		}
+	}
+
+	keyTransformer, err := transform.NewKeyTransformer(keyTransformRules)
+	if err != nil {
+		return nil, err
+	}
+
+	transformedKeysMap := make(map[string]string)
+	for _, key := range keys {
+		transformedKeysMap[key] = string(keyTransformer.Transform([]byte(key)))
+	}
+
+	return transformedKeysMap, nil
+}
+
 func RegexpMatch(regExp *regexp.Regexp, key []byte) bool {
 	return regExp.Match(key)
 }
 
+// returns, for each of the sample docs, whether the doc passes both the key filter expression, if specified,
+// and the doc filter expression
+func GetMatchedDocs(expression string, docFilterExpression string, docs map[string]interface{}) (map[string]bool, error) {
+	var keyFilter *filter.KeyFilter
+	var err error
+	if len(expression) > 0 {
+		keyFilter, err = filter.NewKeyFilter(expression)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	docFilter, err := filter.NewDocFilter(docFilterExpression)
+	if err != nil {
+		return nil, err
+	}
+
+	matchesMap := make(map[string]bool)
+	for key, doc := range docs {
+		matched := keyFilter == nil || keyFilter.Match([]byte(key))
+		matchesMap[key] = matched && docFilter.MatchDoc(doc)
+	}
+
+	return matchesMap, nil
+}
+
 // given a matches map, convert the indices from byte index to rune index
 func convertByteIndexToRuneIndex(key string, matches [][]int) ([][]int, error) {
 	convertedMatches := make([][]int, 0)
@@ -374,7 +447,7 @@ func GetMemcachedConnection(serverAddr, bucketName string, userAgent string, pla
 	if serverAddr == "" {
 		panic("serverAddr is empty")
 	}
-	username, password, err := cbauth.GetMemcachedServiceAuth(serverAddr)
+	username, password, err := GetLocalMemcachedServiceAuth(serverAddr)
 	logger.Debugf("memcached auth: username=%v, password=%v, err=%v\n", username, password, err)
 	if err != nil {
 		return nil, err
@@ -408,14 +481,21 @@ func GetRemoteMemcachedConnection(serverAddr, username string, password string,
 
 // send helo with specified user agent string to memcached
 func SendHELO(client *mcc.Client, userAgent string, readTimeout, writeTimeout time.Duration, logger *log.CommonLogger) {
-	helo := ComposeHELORequest(userAgent)
+	SendHELOWithFeatures(client, userAgent, readTimeout, writeTimeout, nil, logger)
+}
+
+// send helo with specified user agent string and features to memcached. tcp nodelay is always requested.
+// returns the features that have been enabled by memcached. errors are logged and not returned,
+// in which case no features have been enabled
+func SendHELOWithFeatures(client *mcc.Client, userAgent string, readTimeout, writeTimeout time.Duration, features []uint16, logger *log.CommonLogger) []uint16 {
+	helo := ComposeHELORequestWithFeatures(userAgent, features)
 
 	conn := client.Hijack()
 	conn.(net.Conn).SetWriteDeadline(time.Now().Add(writeTimeout))
 	_, err := conn.Write(helo.Bytes())
 	if err != nil {
 		logger.Warnf("Error sending HELO command. userAgent=%v, err=%v.", userAgent, err)
-		return
+		return nil
 	}
 
 	conn.(net.Conn).SetReadDeadline(time.Now().Add(readTimeout))
@@ -426,14 +506,28 @@ func SendHELO(client *mcc.Client, userAgent string, readTimeout, writeTimeout ti
 		logger.Warnf("Received unexpected response from HELO command. userAgent=%v, response status=%v.", userAgent, response.Status)
 	} else {
 		logger.Infof("Successfully sent HELO command with userAgent=%v", userAgent)
+		// response body contains the enabled features, two bytes each
+		enabledFeatures := make([]uint16, 0, len(response.Body)/2)
+		for i := 0; i+2 <= len(response.Body); i += 2 {
+			enabledFeatures = append(enabledFeatures, binary.BigEndian.Uint16(response.Body[i:i+2]))
+		}
+		return enabledFeatures
 	}
+	return nil
 }
 
 // compose a HELO command with specified user agent string
 func ComposeHELORequest(userAgent string) *mc.MCRequest {
-	value := make([]byte, 2)
-	// tcp nodelay
-	binary.BigEndian.PutUint16(value[0:2], 0x03)
+	return ComposeHELORequestWithFeatures(userAgent, nil)
+}
+
+// compose a HELO command with specified user agent string and features, in addition to tcp nodelay
+func ComposeHELORequestWithFeatures(userAgent string, features []uint16) *mc.MCRequest {
+	value := make([]byte, 2*(len(features)+1))
+	binary.BigEndian.PutUint16(value[0:2], base.HELOFeatureTCPNoDelay)
+	for index, feature := range features {
+		binary.BigEndian.PutUint16(value[2*(index+1):2*(index+2)], feature)
+	}
 	return &mc.MCRequest{
 		Key:    []byte(userAgent),
 		Opcode: mc.HELLO,